@@ -0,0 +1,521 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is everything service reads on start, it is loaded by Load
+// from defaults, then file, then environment, then flags, later ones win
+type Config struct {
+	Listen string `json:"listen" yaml:"listen" toml:"listen"`
+	NodeID string `json:"node_id" yaml:"node_id" toml:"node_id"`
+	// ShutdownTimeout is how long in-flight requests and workers are waited for on stop
+	ShutdownTimeout Duration `json:"shutdown_timeout" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// RequestTimeout is how long request may wait for postgres and redis
+	RequestTimeout Duration `json:"request_timeout" yaml:"request_timeout" toml:"request_timeout"`
+	// LogLevel is lowest level written: debug, info, warn or error
+	LogLevel string `json:"log_level" yaml:"log_level" toml:"log_level"`
+
+	Postgres Postgres `json:"postgres" yaml:"postgres" toml:"postgres"`
+	Redis    Redis    `json:"redis" yaml:"redis" toml:"redis"`
+	Tracing  Tracing  `json:"tracing" yaml:"tracing" toml:"tracing"`
+	Mail     Mail     `json:"mail" yaml:"mail" toml:"mail"`
+	// SessionStore is where sessions live: redis, postgres or memory of single instance,
+	// redis is required anyway, oauth tokens, federation states and events are kept there
+	SessionStore string `json:"session_store" yaml:"session_store" toml:"session_store"`
+
+	// EventsStream is redis stream domain events are published to
+	EventsStream string `json:"events_stream" yaml:"events_stream" toml:"events_stream"`
+	// RetentionDays is how long deleted accounts are kept before anonymization
+	RetentionDays int `json:"retention_days" yaml:"retention_days" toml:"retention_days"`
+	// AuditKey keys hashes of emails written to audit log and links of its hash chain,
+	// emails are not logged without it
+	AuditKey string `json:"audit_key" yaml:"audit_key" toml:"audit_key"`
+
+	// OIDCEnabled serves discovery, jwks and userinfo and adds id tokens to openid grants
+	OIDCEnabled bool `json:"oidc_enabled" yaml:"oidc_enabled" toml:"oidc_enabled"`
+	// OIDCIssuer is issuer of id tokens and base of discovery urls, it is never taken from request
+	OIDCIssuer string `json:"oidc_issuer" yaml:"oidc_issuer" toml:"oidc_issuer"`
+	// OIDCKeysKey is base64 of 32 bytes key encrypting private signing keys in postgres
+	OIDCKeysKey string `json:"oidc_keys_key" yaml:"oidc_keys_key" toml:"oidc_keys_key"`
+	// FederationProviders is path to json list of external identity providers
+	FederationProviders string `json:"federation_providers" yaml:"federation_providers" toml:"federation_providers"`
+	// TenantHosts maps request host to its tenant
+	TenantHosts map[string]string `json:"tenant_hosts" yaml:"tenant_hosts" toml:"tenant_hosts"`
+}
+
+// option is a setting which can be overridden by environment variable and flag,
+// secrets have no flag, command line is visible to everyone on the host
+type option struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+var options = []option{
+	{"LISTEN", "listen", "address to serve http on", func(c *Config, v string) error {
+		c.Listen = v
+		return nil
+	}},
+	{"NODEID", "node-id", "id of this instance reported by /node", func(c *Config, v string) error {
+		c.NodeID = v
+		return nil
+	}},
+	{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long to drain requests and workers on stop", func(c *Config, v string) error {
+		return setDuration(&c.ShutdownTimeout, v)
+	}},
+	{"REQUEST_TIMEOUT", "request-timeout", "how long request may wait for storage", func(c *Config, v string) error {
+		return setDuration(&c.RequestTimeout, v)
+	}},
+	{"LOG_LEVEL", "log-level", "lowest level to log: debug, info, warn or error", func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}},
+	{"DBHOST", "db-host", "postgres host", func(c *Config, v string) error {
+		c.Postgres.Host = v
+		return nil
+	}},
+	{"DBPORT", "db-port", "postgres port", func(c *Config, v string) error {
+		return setInt(&c.Postgres.Port, v)
+	}},
+	{"DBNAME", "db-name", "postgres database", func(c *Config, v string) error {
+		c.Postgres.DBName = v
+		return nil
+	}},
+	{"DBUSER", "db-user", "postgres user", func(c *Config, v string) error {
+		c.Postgres.User = v
+		return nil
+	}},
+	{"DBPASS", "", "", func(c *Config, v string) error {
+		c.Postgres.Password = v
+		return nil
+	}},
+	{"DBSSLMODE", "db-sslmode", "postgres sslmode", func(c *Config, v string) error {
+		c.Postgres.SSLMode = v
+		return nil
+	}},
+	{"DBSSLROOTCERT", "db-sslrootcert", "postgres server ca certificate", func(c *Config, v string) error {
+		c.Postgres.SSLRootCert = v
+		return nil
+	}},
+	{"DBSSLCERT", "db-sslcert", "postgres client certificate", func(c *Config, v string) error {
+		c.Postgres.SSLCert = v
+		return nil
+	}},
+	{"DBSSLKEY", "db-sslkey", "postgres client key", func(c *Config, v string) error {
+		c.Postgres.SSLKey = v
+		return nil
+	}},
+	{"DB_MAX_OPEN_CONNS", "db-max-open-conns", "postgres open connections limit", func(c *Config, v string) error {
+		return setInt(&c.Postgres.MaxOpenConns, v)
+	}},
+	{"DB_MAX_IDLE_CONNS", "db-max-idle-conns", "postgres idle connections limit", func(c *Config, v string) error {
+		return setInt(&c.Postgres.MaxIdleConns, v)
+	}},
+	{"DB_CONN_MAX_LIFETIME", "db-conn-max-lifetime", "postgres connection lifetime", func(c *Config, v string) error {
+		return setDuration(&c.Postgres.ConnMaxLifetime, v)
+	}},
+	{"TRACE_EXPORTER", "trace-exporter", "trace exporter: none, stdout or otlp", func(c *Config, v string) error {
+		c.Tracing.Exporter = v
+		return nil
+	}},
+	{"TRACE_ENDPOINT", "trace-endpoint", "otlp collector host:port", func(c *Config, v string) error {
+		c.Tracing.Endpoint = v
+		return nil
+	}},
+	{"TRACE_INSECURE", "trace-insecure", "send traces to collector without tls", func(c *Config, v string) error {
+		return setBool(&c.Tracing.Insecure, v)
+	}},
+	{"TRACE_SAMPLE_RATIO", "trace-sample-ratio", "share of new traces to record, from 0 to 1", func(c *Config, v string) error {
+		return setFloat(&c.Tracing.SampleRatio, v)
+	}},
+	{"TRACE_SERVICE_NAME", "trace-service-name", "service name in traces", func(c *Config, v string) error {
+		c.Tracing.ServiceName = v
+		return nil
+	}},
+	{"SMTP_ADDR", "smtp-addr", "smtp relay host:port", func(c *Config, v string) error {
+		c.Mail.SMTPAddr = v
+		return nil
+	}},
+	{"SMTP_USER", "smtp-user", "smtp relay user", func(c *Config, v string) error {
+		c.Mail.Username = v
+		return nil
+	}},
+	{"SMTP_PASSWORD", "", "", func(c *Config, v string) error {
+		c.Mail.Password = v
+		return nil
+	}},
+	{"MAIL_FROM", "mail-from", "sender address of emails", func(c *Config, v string) error {
+		c.Mail.From = v
+		return nil
+	}},
+	{"INVITE_URL", "invite-url", "page accepting organization invitations", func(c *Config, v string) error {
+		c.Mail.InviteURL = v
+		return nil
+	}},
+	{"SESSION_STORE", "session-store", "session backend: redis, postgres or memory", func(c *Config, v string) error {
+		c.SessionStore = v
+		return nil
+	}},
+	{"REDIS_HOST", "redis-host", "redis host, port 6379 is used when it is not given", func(c *Config, v string) error {
+		c.Redis.Addr = redisAddr(v)
+		return nil
+	}},
+	{"REDIS_MODE", "redis-mode", "redis mode: standalone, sentinel or cluster", func(c *Config, v string) error {
+		c.Redis.Mode = v
+		return nil
+	}},
+	{"REDIS_ADDRS", "redis-addrs", "sentinel or cluster nodes separated by comma", func(c *Config, v string) error {
+		c.Redis.Addrs = splitList(v)
+		return nil
+	}},
+	{"REDIS_MASTER_NAME", "redis-master-name", "master name known to sentinels", func(c *Config, v string) error {
+		c.Redis.MasterName = v
+		return nil
+	}},
+	{"REDIS_PASSWORD", "", "", func(c *Config, v string) error {
+		c.Redis.Password = v
+		return nil
+	}},
+	{"REDIS_DB", "redis-db", "redis database number", func(c *Config, v string) error {
+		return setInt(&c.Redis.DB, v)
+	}},
+	{"REDIS_POOL_SIZE", "redis-pool-size", "redis connections limit", func(c *Config, v string) error {
+		return setInt(&c.Redis.PoolSize, v)
+	}},
+	{"REDIS_DIAL_TIMEOUT", "redis-dial-timeout", "redis connect timeout", func(c *Config, v string) error {
+		return setDuration(&c.Redis.DialTimeout, v)
+	}},
+	{"REDIS_READ_TIMEOUT", "redis-read-timeout", "redis read timeout", func(c *Config, v string) error {
+		return setDuration(&c.Redis.ReadTimeout, v)
+	}},
+	{"REDIS_WRITE_TIMEOUT", "redis-write-timeout", "redis write timeout", func(c *Config, v string) error {
+		return setDuration(&c.Redis.WriteTimeout, v)
+	}},
+	{"REDIS_TLS", "redis-tls", "connect to redis over tls", func(c *Config, v string) error {
+		return setBool(&c.Redis.TLS.Enabled, v)
+	}},
+	{"REDIS_TLS_CA", "redis-tls-ca", "redis server ca certificate", func(c *Config, v string) error {
+		c.Redis.TLS.CAFile = v
+		return nil
+	}},
+	{"EVENTS_STREAM", "events-stream", "redis stream for domain events", func(c *Config, v string) error {
+		c.EventsStream = v
+		return nil
+	}},
+	{"RETENTION_DAYS", "retention-days", "days to keep deleted accounts", func(c *Config, v string) error {
+		return setInt(&c.RetentionDays, v)
+	}},
+	{"AUDIT_KEY", "", "", func(c *Config, v string) error {
+		c.AuditKey = v
+		return nil
+	}},
+	{"OIDC_ENABLED", "oidc-enabled", "serve openid connect provider", func(c *Config, v string) error {
+		return setBool(&c.OIDCEnabled, v)
+	}},
+	{"OIDC_ISSUER", "oidc-issuer", "issuer of id tokens, public url of the service", func(c *Config, v string) error {
+		c.OIDCIssuer = v
+		return nil
+	}},
+	{"OIDC_KEYS_KEY", "", "", func(c *Config, v string) error {
+		c.OIDCKeysKey = v
+		return nil
+	}},
+	{"FEDERATION_PROVIDERS", "federation-providers", "path to external identity providers list", func(c *Config, v string) error {
+		c.FederationProviders = v
+		return nil
+	}},
+	{"TENANT_HOSTS", "tenant-hosts", "host=tenant pairs separated by comma", func(c *Config, v string) error {
+		hosts, err := parseTenantHosts(v)
+		if err != nil {
+			return err
+		}
+		c.TenantHosts = hosts
+		return nil
+	}},
+}
+
+// Default returns config which works with services on localhost
+func Default() *Config {
+	return &Config{
+		Listen:          ":8080",
+		ShutdownTimeout: Duration{15 * time.Second},
+		RequestTimeout:  Duration{10 * time.Second},
+		LogLevel:        "info",
+		Postgres: Postgres{
+			Host:            "localhost",
+			Port:            5432,
+			DBName:          "db",
+			User:            "postgres",
+			SSLMode:         "disable",
+			ConnectTimeout:  Duration{10 * time.Second},
+			MaxOpenConns:    20,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: Duration{30 * time.Minute},
+		},
+		Redis: Redis{
+			Mode:         RedisStandalone,
+			Addr:         "localhost:6379",
+			DialTimeout:  Duration{5 * time.Second},
+			ReadTimeout:  Duration{3 * time.Second},
+			WriteTimeout: Duration{3 * time.Second},
+		},
+		Tracing: Tracing{
+			Exporter:    TraceNone,
+			SampleRatio: 1,
+			ServiceName: "crawlyzer-auth",
+		},
+		SessionStore:  SessionsRedis,
+		EventsStream:  "crawlyzer:auth:events",
+		RetentionDays: 30,
+	}
+}
+
+// Load builds config from file given by -config flag or CONFIG_FILE, environment and flags,
+// arguments left after flags are returned for commands
+func Load(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("crawlyzer-auth", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "path to json, yaml or toml config file")
+	for _, o := range options {
+		if o.flag != "" {
+			fs.String(o.flag, "", o.usage)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	c := Default()
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, o := range options {
+		if v, ok := os.LookupEnv(o.env); ok && v != "" {
+			if err := o.set(c, v); err != nil {
+				return nil, nil, fmt.Errorf("config: %s: %v", o.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range options {
+			if err == nil && o.flag == f.Name {
+				if e := o.set(c, f.Value.String()); e != nil {
+					err = fmt.Errorf("config: -%s: %v", f.Name, e)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+// loadFile decodes file by its extension over current values
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+
+	// unknown keys are errors, misspelled option must not silently fall back to default
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	case ".toml":
+		var md toml.MetaData
+		if md, err = toml.Decode(string(data), c); err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown option %s", md.Undecoded()[0])
+		}
+	default:
+		return fmt.Errorf("config: unknown format of %s, use .json, .yaml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate reports all problems at once, so they can be fixed in one go
+func (c *Config) Validate() error {
+	var problems []string
+	required := map[string]string{
+		"listen":          c.Listen,
+		"postgres.host":   c.Postgres.Host,
+		"postgres.dbname": c.Postgres.DBName,
+		"postgres.user":   c.Postgres.User,
+		"events_stream":   c.EventsStream,
+	}
+	for name, v := range required {
+		if strings.TrimSpace(v) == "" {
+			problems = append(problems, name+" is required")
+		}
+	}
+
+	problems = append(problems, c.Postgres.validate()...)
+	problems = append(problems, c.Redis.validate()...)
+	problems = append(problems, c.Tracing.validate()...)
+	problems = append(problems, c.Mail.validate()...)
+
+	switch c.SessionStore {
+	case SessionsRedis, SessionsPostgres, SessionsMemory:
+	default:
+		problems = append(problems, "session_store must be one of redis, postgres, memory")
+	}
+
+	if c.RetentionDays <= 0 {
+		problems = append(problems, "retention_days must be positive")
+	}
+
+	if c.ShutdownTimeout.Duration <= 0 {
+		problems = append(problems, "shutdown_timeout must be positive")
+	}
+
+	if c.RequestTimeout.Duration <= 0 {
+		problems = append(problems, "request_timeout must be positive")
+	}
+
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, "log_level must be one of debug, info, warn, error")
+	}
+
+	if c.OIDCEnabled {
+		if c.OIDCIssuer == "" {
+			problems = append(problems, "oidc_issuer is required when oidc is enabled")
+		}
+		if _, err := c.OIDCKey(); err != nil {
+			problems = append(problems, "oidc_keys_key must be 32 bytes in base64 when oidc is enabled")
+		}
+	}
+
+	if c.OIDCIssuer != "" {
+		u, err := url.Parse(c.OIDCIssuer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "oidc_issuer must be http or https url")
+		}
+	}
+
+	for host, tenant := range c.TenantHosts {
+		if host == "" || tenant == "" {
+			problems = append(problems, "tenant_hosts can't have empty host or tenant")
+			break
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// OIDCKey decodes OIDCKeysKey
+func (c *Config) OIDCKey() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(c.OIDCKeysKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	return key, nil
+}
+
+// parseTenantHosts parses "host=tenant,host=tenant", hosts are case insensitive
+func parseTenantHosts(s string) (map[string]string, error) {
+	hosts := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("bad pair %q, must be host=tenant", pair)
+		}
+		hosts[strings.ToLower(kv[0])] = kv[1]
+	}
+	return hosts, nil
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func redisAddr(host string) string {
+	if strings.Contains(host, ":") {
+		return host
+	}
+	return host + ":6379"
+}
+
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", v)
+	}
+	*dst = n
+	return nil
+}
+
+func setBool(dst *bool, v string) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%q is not true or false", v)
+	}
+	*dst = b
+	return nil
+}
+
+func setFloat(dst *float64, v string) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", v)
+	}
+	*dst = f
+	return nil
+}
+
+func setDuration(dst *Duration, v string) error {
+	if err := dst.UnmarshalText([]byte(v)); err != nil {
+		return fmt.Errorf("%q is not a duration like 30s or 5m", v)
+	}
+	return nil
+}
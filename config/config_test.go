@@ -0,0 +1,262 @@
+package config
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// clearEnv unsets all variables config reads, so environment of the host doesn't leak into tests
+func clearEnv() func() {
+	saved := map[string]string{}
+	for _, name := range append([]string{"CONFIG_FILE"}, envNames()...) {
+		if v, ok := os.LookupEnv(name); ok {
+			saved[name] = v
+		}
+		os.Unsetenv(name)
+	}
+
+	return func() {
+		for _, name := range envNames() {
+			os.Unsetenv(name)
+		}
+		for name, v := range saved {
+			os.Setenv(name, v)
+		}
+	}
+}
+
+func envNames() []string {
+	var names []string
+	for _, o := range options {
+		names = append(names, o.env)
+	}
+	return names
+}
+
+func TestLoad(t *testing.T) {
+	Convey("Config loading", t, func() {
+		defer clearEnv()()
+
+		dir, err := ioutil.TempDir("", "config")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(dir)
+
+		write := func(name, data string) string {
+			path := filepath.Join(dir, name)
+			So(ioutil.WriteFile(path, []byte(data), 0600), ShouldEqual, nil)
+			return path
+		}
+
+		Convey("Without anything must be defaults", func() {
+			c, args, err := Load(nil)
+			So(err, ShouldEqual, nil)
+			So(c, ShouldResemble, Default())
+			So(len(args), ShouldEqual, 0)
+		})
+
+		variants := []map[string]interface{}{
+			{"case": "json", "file": "conf.json", "data": `{"listen": ":3000", "postgres": {"host": "pg"}, "tenant_hosts": {"a.com": "a"}}`},
+			{"case": "yaml", "file": "conf.yaml", "data": "listen: \":3000\"\npostgres:\n  host: pg\ntenant_hosts:\n  a.com: a\n"},
+			{"case": "toml", "file": "conf.toml", "data": "listen = \":3000\"\n[postgres]\nhost = \"pg\"\n[tenant_hosts]\n\"a.com\" = \"a\"\n"},
+		}
+
+		for _, v := range variants {
+			Convey("When file is "+v["case"].(string), func() {
+				path := write(v["file"].(string), v["data"].(string))
+
+				c, _, err := Load([]string{"-config", path})
+
+				Convey("Must be read over defaults", func() {
+					So(err, ShouldEqual, nil)
+					So(c.Listen, ShouldEqual, ":3000")
+					So(c.Postgres.Host, ShouldEqual, "pg")
+					So(c.Postgres.User, ShouldEqual, "postgres")
+					So(c.TenantHosts, ShouldResemble, map[string]string{"a.com": "a"})
+				})
+			})
+		}
+
+		Convey("When file has unknown option", func() {
+			path := write("conf.yaml", "listne: \":3000\"\n")
+
+			_, _, err := Load([]string{"-config", path})
+
+			Convey("Must be error", func() {
+				So(err, ShouldNotEqual, nil)
+			})
+		})
+
+		Convey("When file has unknown format", func() {
+			path := write("conf.ini", "listen=:3000\n")
+
+			_, _, err := Load([]string{"-config", path})
+
+			Convey("Must be error", func() {
+				So(err, ShouldNotEqual, nil)
+			})
+		})
+
+		Convey("When option is everywhere", func() {
+			path := write("conf.json", `{"listen": ":1000", "postgres": {"host": "file", "user": "file"}, "redis": {"addr": "file:6379"}}`)
+			os.Setenv("CONFIG_FILE", path)
+			os.Setenv("LISTEN", ":2000")
+			os.Setenv("DBHOST", "env")
+			os.Setenv("REDIS_HOST", "env")
+
+			c, args, err := Load([]string{"-listen", ":3000", "verify-audit", "-x"})
+
+			Convey("Flag must win over env and env over file", func() {
+				So(err, ShouldEqual, nil)
+				So(c.Listen, ShouldEqual, ":3000")
+				So(c.Postgres.Host, ShouldEqual, "env")
+				So(c.Postgres.User, ShouldEqual, "file")
+				So(c.Redis.Addr, ShouldEqual, "env:6379")
+				So(args, ShouldResemble, []string{"verify-audit", "-x"})
+			})
+		})
+
+		Convey("When values are invalid", func() {
+			path := write("conf.json", `{"listen": "", "retention_days": -1, "oidc_issuer": "issuer", "shutdown_timeout": "0s", "request_timeout": "-1s"}`)
+
+			_, _, err := Load([]string{"-config", path})
+
+			Convey("Must report all of them", func() {
+				So(err.Error(), ShouldEqual, "config: listen is required; oidc_issuer must be http or https url; "+
+					"request_timeout must be positive; retention_days must be positive; shutdown_timeout must be positive")
+			})
+		})
+
+		Convey("When oidc is enabled", func() {
+			os.Setenv("OIDC_ENABLED", "true")
+
+			_, _, err := Load(nil)
+
+			Convey("Issuer and keys key must be required", func() {
+				So(err.Error(), ShouldEqual, "config: oidc_issuer is required when oidc is enabled; "+
+					"oidc_keys_key must be 32 bytes in base64 when oidc is enabled")
+			})
+
+			Convey("When issuer and keys key are given", func() {
+				os.Setenv("OIDC_KEYS_KEY", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+
+				c, _, err := Load([]string{"-oidc-issuer", "https://auth.crawlyzer.test"})
+
+				Convey("Must be accepted", func() {
+					So(err, ShouldEqual, nil)
+					key, err := c.OIDCKey()
+					So(err, ShouldEqual, nil)
+					So(string(key), ShouldEqual, "0123456789abcdef0123456789abcdef")
+				})
+			})
+		})
+
+		Convey("When number is malformed", func() {
+			os.Setenv("RETENTION_DAYS", "month")
+
+			_, _, err := Load(nil)
+
+			Convey("Must name the variable", func() {
+				So(err.Error(), ShouldEqual, `config: RETENTION_DAYS: "month" is not a number`)
+			})
+		})
+
+		Convey("When session store is postgres", func() {
+			os.Setenv("SESSION_STORE", "postgres")
+
+			c, _, err := Load(nil)
+
+			Convey("Must be accepted", func() {
+				So(err, ShouldEqual, nil)
+				So(c.SessionStore, ShouldEqual, SessionsPostgres)
+			})
+		})
+
+		Convey("When session store is unknown", func() {
+			_, _, err := Load([]string{"-session-store", "memcached"})
+
+			Convey("Must be error", func() {
+				So(err.Error(), ShouldEqual, "config: session_store must be one of redis, postgres, memory")
+			})
+		})
+
+		Convey("When traces go to collector", func() {
+			os.Setenv("TRACE_EXPORTER", "otlp")
+			os.Setenv("TRACE_SAMPLE_RATIO", "0.25")
+
+			_, _, err := Load(nil)
+
+			Convey("Endpoint must be required", func() {
+				So(err.Error(), ShouldEqual, "config: tracing.endpoint is required for otlp exporter")
+			})
+
+			Convey("When endpoint is given", func() {
+				c, _, err := Load([]string{"-trace-endpoint", "otel:4318"})
+
+				Convey("Must be accepted", func() {
+					So(err, ShouldEqual, nil)
+					So(c.Tracing.Endpoint, ShouldEqual, "otel:4318")
+					So(c.Tracing.SampleRatio, ShouldEqual, 0.25)
+				})
+			})
+		})
+
+		Convey("When trace sample ratio is out of range", func() {
+			_, _, err := Load([]string{"-trace-sample-ratio", "2"})
+
+			Convey("Must be error", func() {
+				So(err.Error(), ShouldEqual, "config: tracing.sample_ratio must be between 0 and 1")
+			})
+		})
+
+		Convey("When smtp relay is set", func() {
+			os.Setenv("SMTP_ADDR", "smtp.local:587")
+
+			_, _, err := Load(nil)
+
+			Convey("Sender and invite page must be required", func() {
+				So(err.Error(), ShouldEqual, "config: mail.from is required when smtp is set; "+
+					"mail.invite_url must be http or https url when smtp is set")
+			})
+
+			Convey("When sender and invite page are given", func() {
+				c, _, err := Load([]string{"-mail-from", "auth@crawlyzer.io", "-invite-url", "https://app.crawlyzer.io/invite"})
+
+				Convey("Must be accepted", func() {
+					So(err, ShouldEqual, nil)
+					So(c.Mail.Enabled(), ShouldBeTrue)
+					So(c.Mail.InviteURL, ShouldEqual, "https://app.crawlyzer.io/invite")
+				})
+			})
+		})
+
+		Convey("When log level is unknown", func() {
+			os.Setenv("LOG_LEVEL", "verbose")
+
+			_, _, err := Load(nil)
+
+			Convey("Must be error", func() {
+				So(err.Error(), ShouldEqual, "config: log_level must be one of debug, info, warn, error")
+			})
+		})
+
+		Convey("When tenant hosts are malformed", func() {
+			_, _, err := Load([]string{"-tenant-hosts", "a.com=a,b.com"})
+
+			Convey("Must be error", func() {
+				So(err, ShouldNotEqual, nil)
+			})
+		})
+
+		Convey("When tenant hosts are given", func() {
+			c, _, err := Load([]string{"-tenant-hosts", "A.com=a, b.com=b"})
+
+			Convey("Hosts must be lower case", func() {
+				So(err, ShouldEqual, nil)
+				So(c.TenantHosts, ShouldResemble, map[string]string{"a.com": "a", "b.com": "b"})
+			})
+		})
+	})
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Mail is smtp relay for emails carrying secrets, like invitation tokens,
+// features sending them are unavailable while SMTPAddr is empty
+type Mail struct {
+	// SMTPAddr is host:port of relay, STARTTLS is used when relay offers it
+	SMTPAddr string `json:"smtp_addr" yaml:"smtp_addr" toml:"smtp_addr"`
+	Username string `json:"username" yaml:"username" toml:"username"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+	From     string `json:"from" yaml:"from" toml:"from"`
+	// InviteURL is page accepting invitations, token is added to it as token query parameter
+	InviteURL string `json:"invite_url" yaml:"invite_url" toml:"invite_url"`
+}
+
+// Enabled tells if emails can be sent
+func (m Mail) Enabled() bool {
+	return m.SMTPAddr != ""
+}
+
+func (m Mail) validate() []string {
+	if !m.Enabled() {
+		return nil
+	}
+
+	var problems []string
+	if _, _, err := net.SplitHostPort(m.SMTPAddr); err != nil {
+		problems = append(problems, "mail.smtp_addr must be host:port")
+	}
+	if strings.TrimSpace(m.From) == "" {
+		problems = append(problems, "mail.from is required when smtp is set")
+	}
+
+	u, err := url.Parse(m.InviteURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, "mail.invite_url must be http or https url when smtp is set")
+	}
+	return problems
+}
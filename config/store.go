@@ -0,0 +1,253 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// redis deployment modes
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
+// session backends, memory one keeps sessions in the process and fits only single instance
+const (
+	SessionsRedis    = "redis"
+	SessionsPostgres = "postgres"
+	SessionsMemory   = "memory"
+)
+
+type Postgres struct {
+	Host     string `json:"host" yaml:"host" toml:"host"`
+	Port     int    `json:"port" yaml:"port" toml:"port"`
+	DBName   string `json:"dbname" yaml:"dbname" toml:"dbname"`
+	User     string `json:"user" yaml:"user" toml:"user"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+
+	// SSLMode is libpq sslmode, certificates are paths to pem files
+	SSLMode     string `json:"sslmode" yaml:"sslmode" toml:"sslmode"`
+	SSLRootCert string `json:"sslrootcert" yaml:"sslrootcert" toml:"sslrootcert"`
+	SSLCert     string `json:"sslcert" yaml:"sslcert" toml:"sslcert"`
+	SSLKey      string `json:"sslkey" yaml:"sslkey" toml:"sslkey"`
+
+	ConnectTimeout Duration `json:"connect_timeout" yaml:"connect_timeout" toml:"connect_timeout"`
+
+	// zero open conns or lifetime means no limit, zero idle conns keeps no idle connections
+	MaxOpenConns    int      `json:"max_open_conns" yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns" yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime" yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+}
+
+type Redis struct {
+	// Mode is standalone with Addr, sentinel with sentinels in Addrs and MasterName
+	// or cluster with seed nodes in Addrs
+	Mode       string   `json:"mode" yaml:"mode" toml:"mode"`
+	Addr       string   `json:"addr" yaml:"addr" toml:"addr"`
+	Addrs      []string `json:"addrs" yaml:"addrs" toml:"addrs"`
+	MasterName string   `json:"master_name" yaml:"master_name" toml:"master_name"`
+
+	Password string `json:"password" yaml:"password" toml:"password"`
+	// DB must be 0 in cluster
+	DB int `json:"db" yaml:"db" toml:"db"`
+
+	// PoolSize is connections per cpu of go-redis when zero
+	PoolSize     int `json:"pool_size" yaml:"pool_size" toml:"pool_size"`
+	MinIdleConns int `json:"min_idle_conns" yaml:"min_idle_conns" toml:"min_idle_conns"`
+
+	DialTimeout  Duration `json:"dial_timeout" yaml:"dial_timeout" toml:"dial_timeout"`
+	ReadTimeout  Duration `json:"read_timeout" yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout" yaml:"write_timeout" toml:"write_timeout"`
+	PoolTimeout  Duration `json:"pool_timeout" yaml:"pool_timeout" toml:"pool_timeout"`
+	IdleTimeout  Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+
+	TLS TLS `json:"tls" yaml:"tls" toml:"tls"`
+}
+
+// TLS of client connection, certificates are paths to pem files,
+// client certificate is needed only when server verifies clients
+type TLS struct {
+	Enabled            bool   `json:"enabled" yaml:"enabled" toml:"enabled"`
+	CAFile             string `json:"ca_file" yaml:"ca_file" toml:"ca_file"`
+	CertFile           string `json:"cert_file" yaml:"cert_file" toml:"cert_file"`
+	KeyFile            string `json:"key_file" yaml:"key_file" toml:"key_file"`
+	ServerName         string `json:"server_name" yaml:"server_name" toml:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+}
+
+// Duration is time.Duration written as "30s" or "5m" in config files
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// DSN is libpq connection string, values are quoted so passwords may contain spaces and quotes
+func (p Postgres) DSN() string {
+	params := map[string]string{
+		"host":        p.Host,
+		"dbname":      p.DBName,
+		"user":        p.User,
+		"password":    p.Password,
+		"sslmode":     p.SSLMode,
+		"sslrootcert": p.SSLRootCert,
+		"sslcert":     p.SSLCert,
+		"sslkey":      p.SSLKey,
+	}
+	if p.Port != 0 {
+		params["port"] = strconv.Itoa(p.Port)
+	}
+	if p.ConnectTimeout.Duration > 0 {
+		// libpq takes whole seconds, less than one would mean no timeout
+		secs := int(p.ConnectTimeout.Seconds())
+		if secs < 1 {
+			secs = 1
+		}
+		params["connect_timeout"] = strconv.Itoa(secs)
+	}
+
+	var keys []string
+	for k, v := range params {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, k+"="+quoteDSN(params[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func quoteDSN(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `'`, `\'`, -1)
+	return "'" + v + "'"
+}
+
+// Config builds tls config, nil when TLS is disabled
+func (t TLS) Config() (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+
+	conf := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if t.CAFile != "" {
+		data, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls ca: %v", err)
+		}
+
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("tls ca: no certificates in " + t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls client certificate: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func (p Postgres) validate() []string {
+	var problems []string
+	if p.Port < 0 || p.Port > 65535 {
+		problems = append(problems, "postgres.port must be between 1 and 65535")
+	}
+
+	known := false
+	for _, m := range sslModes {
+		known = known || p.SSLMode == m
+	}
+	if !known {
+		problems = append(problems, "postgres.sslmode must be one of "+strings.Join(sslModes, ", "))
+	}
+
+	if (p.SSLCert == "") != (p.SSLKey == "") {
+		problems = append(problems, "postgres.sslcert and postgres.sslkey must be set together")
+	}
+
+	if p.MaxOpenConns < 0 || p.MaxIdleConns < 0 || p.ConnMaxLifetime.Duration < 0 || p.ConnectTimeout.Duration < 0 {
+		problems = append(problems, "postgres pool limits and timeouts can't be negative")
+	}
+	if p.MaxOpenConns > 0 && p.MaxIdleConns > p.MaxOpenConns {
+		problems = append(problems, "postgres.max_idle_conns can't exceed postgres.max_open_conns")
+	}
+	return problems
+}
+
+func (r Redis) validate() []string {
+	var problems []string
+	switch r.Mode {
+	case RedisStandalone:
+		if strings.TrimSpace(r.Addr) == "" {
+			problems = append(problems, "redis.addr is required")
+		}
+	case RedisSentinel:
+		if len(r.Addrs) == 0 || r.MasterName == "" {
+			problems = append(problems, "redis.addrs and redis.master_name are required in sentinel mode")
+		}
+	case RedisCluster:
+		if len(r.Addrs) == 0 {
+			problems = append(problems, "redis.addrs are required in cluster mode")
+		}
+		if r.DB != 0 {
+			problems = append(problems, "redis.db must be 0 in cluster mode")
+		}
+	default:
+		problems = append(problems, "redis.mode must be one of standalone, sentinel, cluster")
+	}
+
+	if r.DB < 0 {
+		problems = append(problems, "redis.db can't be negative")
+	}
+
+	if r.PoolSize < 0 || r.MinIdleConns < 0 {
+		problems = append(problems, "redis pool limits can't be negative")
+	}
+
+	for _, d := range []Duration{r.DialTimeout, r.ReadTimeout, r.WriteTimeout, r.PoolTimeout, r.IdleTimeout} {
+		if d.Duration < 0 {
+			problems = append(problems, "redis timeouts can't be negative")
+			break
+		}
+	}
+
+	if (r.TLS.CertFile == "") != (r.TLS.KeyFile == "") {
+		problems = append(problems, "redis.tls.cert_file and redis.tls.key_file must be set together")
+	}
+	return problems
+}
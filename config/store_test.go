@@ -0,0 +1,207 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPostgresDSN(t *testing.T) {
+	Convey("Postgres connection string", t, func() {
+		p := Default().Postgres
+
+		Convey("Defaults must keep ssl disabled", func() {
+			So(p.DSN(), ShouldEqual, "connect_timeout='10' dbname='db' host='localhost' port='5432' sslmode='disable' user='postgres'")
+		})
+
+		Convey("Password must be escaped", func() {
+			p.Password = `it's a \secret`
+
+			So(p.DSN(), ShouldContainSubstring, `password='it\'s a \\secret'`)
+		})
+
+		Convey("Certificates must be passed", func() {
+			p.SSLMode, p.SSLRootCert, p.SSLCert, p.SSLKey = "verify-full", "/ca.pem", "/cert.pem", "/key.pem"
+
+			So(p.DSN(), ShouldContainSubstring, "sslcert='/cert.pem' sslkey='/key.pem' sslmode='verify-full' sslrootcert='/ca.pem'")
+		})
+
+		Convey("Short timeout must not turn into infinite one", func() {
+			p.ConnectTimeout = Duration{100 * time.Millisecond}
+
+			So(p.DSN(), ShouldStartWith, "connect_timeout='1' ")
+		})
+	})
+}
+
+func TestStoreOptions(t *testing.T) {
+	Convey("Store options", t, func() {
+		defer clearEnv()()
+
+		dir, err := ioutil.TempDir("", "config")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(dir)
+
+		variants := []map[string]interface{}{
+			{"case": "json", "file": "conf.json", "data": `{"postgres": {"conn_max_lifetime": "1h"}, "redis": {"read_timeout": "250ms", "tls": {"enabled": true}}}`},
+			{"case": "yaml", "file": "conf.yaml", "data": "postgres:\n  conn_max_lifetime: 1h\nredis:\n  read_timeout: 250ms\n  tls:\n    enabled: true\n"},
+			{"case": "toml", "file": "conf.toml", "data": "[postgres]\nconn_max_lifetime = \"1h\"\n[redis]\nread_timeout = \"250ms\"\n[redis.tls]\nenabled = true\n"},
+		}
+
+		for _, v := range variants {
+			Convey("When durations are in "+v["case"].(string), func() {
+				path := filepath.Join(dir, v["file"].(string))
+				So(ioutil.WriteFile(path, []byte(v["data"].(string)), 0600), ShouldEqual, nil)
+
+				c, _, err := Load([]string{"-config", path})
+
+				Convey("Must be parsed", func() {
+					So(err, ShouldEqual, nil)
+					So(c.Postgres.ConnMaxLifetime.Duration, ShouldEqual, time.Hour)
+					So(c.Redis.ReadTimeout.Duration, ShouldEqual, 250*time.Millisecond)
+					So(c.Redis.TLS.Enabled, ShouldBeTrue)
+				})
+			})
+		}
+
+		Convey("When options come from environment", func() {
+			os.Setenv("DBPORT", "6432")
+			os.Setenv("DB_CONN_MAX_LIFETIME", "10m")
+			os.Setenv("REDIS_TLS", "true")
+
+			c, _, err := Load([]string{"-db-sslmode", "require", "-redis-pool-size", "50"})
+
+			Convey("Must be applied", func() {
+				So(err, ShouldEqual, nil)
+				So(c.Postgres.Port, ShouldEqual, 6432)
+				So(c.Postgres.SSLMode, ShouldEqual, "require")
+				So(c.Postgres.ConnMaxLifetime.Duration, ShouldEqual, 10*time.Minute)
+				So(c.Redis.PoolSize, ShouldEqual, 50)
+				So(c.Redis.TLS.Enabled, ShouldBeTrue)
+			})
+		})
+
+		Convey("When options are invalid", func() {
+			_, _, err := Load([]string{"-db-sslmode", "on", "-db-max-open-conns", "2", "-db-sslcert", "/cert.pem", "-redis-pool-size", "-1"})
+
+			Convey("Must report all of them", func() {
+				So(err.Error(), ShouldEqual, "config: postgres.max_idle_conns can't exceed postgres.max_open_conns; "+
+					"postgres.sslcert and postgres.sslkey must be set together; "+
+					"postgres.sslmode must be one of disable, allow, prefer, require, verify-ca, verify-full; "+
+					"redis pool limits can't be negative")
+			})
+		})
+
+		modes := []map[string]interface{}{
+			{"case": "sentinel without master", "args": []string{"-redis-mode", "sentinel", "-redis-addrs", "s1:26379"},
+				"mustbe": "config: redis.addrs and redis.master_name are required in sentinel mode"},
+			{"case": "cluster with db", "args": []string{"-redis-mode", "cluster", "-redis-addrs", "n1:6379", "-redis-db", "1"},
+				"mustbe": "config: redis.db must be 0 in cluster mode"},
+			{"case": "unknown mode", "args": []string{"-redis-mode", "ring"},
+				"mustbe": "config: redis.mode must be one of standalone, sentinel, cluster"},
+		}
+
+		for _, v := range modes {
+			Convey("When redis is "+v["case"].(string), func() {
+				_, _, err := Load(v["args"].([]string))
+
+				Convey("Must be "+v["mustbe"].(string), func() {
+					So(err.Error(), ShouldEqual, v["mustbe"])
+				})
+			})
+		}
+
+		Convey("When redis is sentinel", func() {
+			os.Setenv("REDIS_ADDRS", "s1:26379, s2:26379,")
+
+			c, _, err := Load([]string{"-redis-mode", "sentinel", "-redis-master-name", "sessions"})
+
+			Convey("Must have all sentinels", func() {
+				So(err, ShouldEqual, nil)
+				So(c.Redis.Addrs, ShouldResemble, []string{"s1:26379", "s2:26379"})
+				So(c.Redis.MasterName, ShouldEqual, "sessions")
+			})
+		})
+
+		Convey("When duration is malformed", func() {
+			os.Setenv("REDIS_READ_TIMEOUT", "3")
+
+			_, _, err := Load(nil)
+
+			Convey("Must name the variable", func() {
+				So(err.Error(), ShouldEqual, `config: REDIS_READ_TIMEOUT: "3" is not a duration like 30s or 5m`)
+			})
+		})
+	})
+}
+
+func TestTLSConfig(t *testing.T) {
+	Convey("TLS config", t, func() {
+		dir, err := ioutil.TempDir("", "tls")
+		So(err, ShouldEqual, nil)
+		defer os.RemoveAll(dir)
+
+		Convey("When disabled must be nil", func() {
+			conf, err := TLS{CAFile: "/nowhere.pem"}.Config()
+			So(err, ShouldEqual, nil)
+			So(conf, ShouldBeNil)
+		})
+
+		Convey("When ca is valid", func() {
+			ca := filepath.Join(dir, "ca.pem")
+			So(ioutil.WriteFile(ca, selfSignedPEM(), 0600), ShouldEqual, nil)
+
+			conf, err := TLS{Enabled: true, CAFile: ca, ServerName: "redis.local"}.Config()
+
+			Convey("Must trust it", func() {
+				So(err, ShouldEqual, nil)
+				So(conf.RootCAs, ShouldNotBeNil)
+				So(conf.ServerName, ShouldEqual, "redis.local")
+				So(conf.MinVersion, ShouldEqual, uint16(0x0303))
+			})
+		})
+
+		Convey("When ca has no certificates", func() {
+			ca := filepath.Join(dir, "empty.pem")
+			So(ioutil.WriteFile(ca, []byte("nothing"), 0600), ShouldEqual, nil)
+
+			_, err := TLS{Enabled: true, CAFile: ca}.Config()
+
+			Convey("Must be error", func() {
+				So(err, ShouldNotEqual, nil)
+			})
+		})
+	})
+}
+
+func selfSignedPEM() []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
@@ -0,0 +1,43 @@
+package config
+
+import "strings"
+
+// trace exporters, none keeps tracing api working without recording anything
+const (
+	TraceNone   = "none"
+	TraceStdout = "stdout"
+	TraceOTLP   = "otlp"
+)
+
+type Tracing struct {
+	// Exporter is none, stdout for local use or otlp over http
+	Exporter string `json:"exporter" yaml:"exporter" toml:"exporter"`
+	// Endpoint is host:port of otlp collector, path is default /v1/traces
+	Endpoint string `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+	Insecure bool   `json:"insecure" yaml:"insecure" toml:"insecure"`
+	// SampleRatio is share of traces started here which are recorded,
+	// traces coming with sampled parent are recorded always
+	SampleRatio float64 `json:"sample_ratio" yaml:"sample_ratio" toml:"sample_ratio"`
+	ServiceName string  `json:"service_name" yaml:"service_name" toml:"service_name"`
+}
+
+func (t Tracing) validate() []string {
+	var problems []string
+	switch t.Exporter {
+	case TraceNone, TraceStdout:
+	case TraceOTLP:
+		if strings.TrimSpace(t.Endpoint) == "" {
+			problems = append(problems, "tracing.endpoint is required for otlp exporter")
+		}
+	default:
+		problems = append(problems, "tracing.exporter must be one of none, stdout, otlp")
+	}
+
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		problems = append(problems, "tracing.sample_ratio must be between 0 and 1")
+	}
+	if strings.TrimSpace(t.ServiceName) == "" {
+		problems = append(problems, "tracing.service_name is required")
+	}
+	return problems
+}
@@ -0,0 +1,434 @@
+package federation
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrTokenInvalid = errors.New("invalid id token")
+var ErrProviderUnavailable = errors.New("identity provider is unavailable")
+
+// clockSkew is how much provider's clock may differ from ours
+const clockSkew = time.Minute
+
+// metadataTTL is how long discovery document and keys are cached
+const metadataTTL = time.Hour
+
+// requestTimeout bounds every call to provider, slow one must not hang login requests
+const requestTimeout = 10 * time.Second
+
+var defaultClient = &http.Client{Timeout: requestTimeout}
+
+// Provider is external OpenID Connect identity provider, we are its relying party
+type Provider struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+
+	Client *http.Client `json:"-"`
+
+	mx      sync.Mutex
+	meta    *metadata
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+	pending *fetch
+}
+
+// fetch is discovery in flight, callers coming meanwhile wait for it instead of starting their own
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are ID token claims we use
+type Claims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      audience     `json:"aud"`
+	ExpiresAt     int64        `json:"exp"`
+	IssuedAt      int64        `json:"iat"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+}
+
+// audience is a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// flexibleBool accepts "true" string too, some providers send it this way
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	*b = flexibleBool(s == "true")
+	return nil
+}
+
+// LoadProviders reads json array of providers from file, empty path means no providers
+func LoadProviders(path string) (map[string]*Provider, error) {
+	res := map[string]*Provider{}
+	if path == "" {
+		return res, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Provider
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	for _, p := range list {
+		if p.Name == "" || p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return nil, fmt.Errorf("provider %q: name, issuer, client_id and redirect_url are required", p.Name)
+		}
+		if p.Client == nil {
+			p.Client = defaultClient
+		}
+		res[p.Name] = p
+	}
+	return res, nil
+}
+
+func (p *Provider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return defaultClient
+}
+
+func (p *Provider) scopes() string {
+	scopes := []string{"openid"}
+	for _, s := range p.Scopes {
+		if s != "openid" {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// AuthCodeURL is where user is sent to sign in, PKCE challenge is made from verifier
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", p.scopes())
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems authorization code and returns verified claims of ID token
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return nil, fmt.Errorf("token exchange failed: status %d %s", resp.StatusCode, tok.Error)
+	}
+
+	return p.Verify(ctx, tok.IDToken, nonce)
+}
+
+// Verify checks signature and claims of ID token issued for us
+func (p *Provider) Verify(ctx context.Context, token, nonce string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	// only asymmetric signature, none and HS256 with public key must be rejected
+	if header.Alg != "RS256" {
+		return nil, ErrTokenInvalid
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	var c Claims
+	if err = decodeSegment(parts[1], &c); err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	now := time.Now()
+	switch {
+	case c.Issuer != strings.TrimSuffix(p.Issuer, "/"):
+	case !c.Audience.contains(p.ClientID):
+	case c.Subject == "":
+	case c.Nonce != nonce:
+	case time.Unix(c.ExpiresAt, 0).Add(clockSkew).Before(now):
+	case time.Unix(c.IssuedAt, 0).Add(-clockSkew).After(now):
+	default:
+		return &c, nil
+	}
+	return nil, ErrTokenInvalid
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (p *Provider) metadata(ctx context.Context) (*metadata, error) {
+	p.mx.Lock()
+	meta := p.meta
+	fresh := meta != nil && time.Since(p.fetched) < metadataTTL
+	p.mx.Unlock()
+
+	if fresh {
+		return meta, nil
+	}
+
+	if err := p.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.meta, nil
+}
+
+// key returns signing key by id, keys are refetched when id is unknown, provider could rotate them
+func (p *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mx.Lock()
+	k, ok := p.keys[kid]
+	fresh := time.Since(p.fetched) < metadataTTL
+	// forged kids must not make us hammer provider
+	throttled := !ok && time.Since(p.fetched) < clockSkew
+	p.mx.Unlock()
+
+	switch {
+	case ok && fresh:
+		return k, nil
+	case throttled:
+		return nil, ErrTokenInvalid
+	}
+
+	if err := p.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if k, ok = p.keys[kid]; !ok {
+		return nil, ErrTokenInvalid
+	}
+	return k, nil
+}
+
+// refresh fetches discovery document and keys, lock is not held during requests
+// so cached values stay readable while provider is slow
+func (p *Provider) refresh(ctx context.Context) error {
+	p.mx.Lock()
+	if f := p.pending; f != nil {
+		p.mx.Unlock()
+		select {
+		case <-f.done:
+			return f.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	f := &fetch{done: make(chan struct{})}
+	p.pending = f
+	p.mx.Unlock()
+
+	meta, keys, err := p.discover(ctx)
+
+	p.mx.Lock()
+	if err == nil {
+		p.meta, p.keys, p.fetched = meta, keys, time.Now()
+	}
+	p.pending = nil
+	p.mx.Unlock()
+
+	f.err = err
+	close(f.done)
+	return err
+}
+
+func (p *Provider) discover(ctx context.Context) (*metadata, map[string]*rsa.PublicKey, error) {
+	var meta metadata
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, nil, err
+	}
+
+	if meta.Issuer != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, nil, fmt.Errorf("provider %s: issuer mismatch %q", p.Name, meta.Issuer)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, meta.JWKSURI, &jwks); err != nil {
+		return nil, nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return &meta, keys, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return ErrProviderUnavailable
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ErrProviderUnavailable
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"io"
+	"net/http"
+	"time"
+)
+
+// exportSection is a part of personal data export,
+// it must write single json document into w
+type exportSection struct {
+	Name  string
+	Write func(w io.Writer) error
+}
+
+type exportedUser struct {
+	ID        uuid.UUID  `json:"id"`
+	Email     string     `json:"email"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastLogin *time.Time `json:"last_login"`
+}
+
+func (wa *WebApp) ChangePassword(c iris.Context) {
+	id, ok := wa.authorizeSensitive(c)
+	if !ok {
+		return
+	}
+
+	pw := c.PostValue("new_password")
+
+	old, ok := wa.ownerPassword(c, id, c.PostValue("old_password"))
+	if !ok {
+		return
+	}
+
+	if len(pw) < 8 {
+		ThrowError(c, http.StatusForbidden, "bad password")
+		return
+	}
+
+	err := wa.store(c).User.ChangePassword(wa.context(c), id, sessionID(c), old, pw)
+	if err != nil {
+		switch err {
+		case models.ErrLoginIncorrect:
+			ThrowError(c, http.StatusForbidden, "incorrect password")
+		case models.ErrUserNotFound:
+			ThrowError(c, http.StatusNotFound, "user not found")
+		default:
+			wa.log(c).Error("password change failed", "error", err)
+			ThrowError(c, http.StatusInternalServerError, "server error")
+		}
+		return
+	}
+
+	wa.audit(c, models.EventPasswordChange, id, id, "")
+
+	c.JSON(iris.Map{
+		"success": true,
+	})
+}
+
+func (wa *WebApp) DeleteAccount(c iris.Context) {
+	id, ok := wa.authorizeSensitive(c)
+	if !ok {
+		return
+	}
+
+	pw, ok := wa.ownerPassword(c, id, c.PostValue("password"))
+	if !ok {
+		return
+	}
+
+	err := wa.store(c).User.Delete(wa.context(c), id, pw)
+	if err != nil {
+		switch err {
+		case models.ErrLoginIncorrect:
+			ThrowError(c, http.StatusForbidden, "incorrect password")
+		case models.ErrUserNotFound:
+			ThrowError(c, http.StatusNotFound, "user not found")
+		default:
+			wa.log(c).Error("account deletion failed", "error", err)
+			ThrowError(c, http.StatusInternalServerError, "server error")
+		}
+		return
+	}
+
+	wa.audit(c, models.EventAccountDelete, id, id, "")
+
+	c.JSON(iris.Map{
+		"success": true,
+	})
+}
+
+// ownerPassword returns password confirming sensitive change of the account, it must be given
+// when account has one, user without password must have signed in through identity provider
+// within FreshLoginTTL instead and empty password is returned for him
+func (wa *WebApp) ownerPassword(c iris.Context, id uuid.UUID, password string) (string, bool) {
+	u, err := wa.store(c).User.Get(wa.context(c), id)
+	if err != nil {
+		if err == models.ErrUserNotFound {
+			ThrowError(c, http.StatusNotFound, "user not found")
+			return "", false
+		}
+		wa.log(c).Error("user lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return "", false
+	}
+
+	if u.Password != "" {
+		if password == "" {
+			ThrowError(c, http.StatusForbidden, "incorrect password")
+			return "", false
+		}
+		return password, true
+	}
+
+	if !freshLogin(c) {
+		ThrowError(c, http.StatusForbidden, "sign in through identity provider again")
+		return "", false
+	}
+	return "", true
+}
+
+// ExportAccount streams everything we store about the user,
+// as single json document or as zip with json file per section when format=zip
+func (wa *WebApp) ExportAccount(c iris.Context) {
+	id, ok := wa.authorize(c, models.ScopeAccount)
+	if !ok {
+		return
+	}
+
+	u, err := wa.store(c).User.Get(wa.context(c), id)
+	if err != nil {
+		wa.log(c).Error("user lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	sessions, err := wa.store(c).User.Sessions(wa.context(c), id)
+	if err != nil {
+		wa.log(c).Error("sessions lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	// session ids are secrets, we show only beginning to recognize them
+	for i := range sessions {
+		if len(sessions[i].ID) > 8 {
+			sessions[i].ID = sessions[i].ID[:8] + "..."
+		}
+	}
+
+	sections := []exportSection{{
+		Name: "user",
+		Write: func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(exportedUser{
+				ID:        u.ID,
+				Email:     u.Email,
+				CreatedAt: u.CreatedAt,
+				LastLogin: u.LastLogin,
+			})
+		},
+	}, {
+		Name: "sessions",
+		Write: func(w io.Writer) error {
+			arr := newJSONArray(w)
+			for _, s := range sessions {
+				if err := arr.Add(s); err != nil {
+					return err
+				}
+			}
+			return arr.Close()
+		},
+	}, {
+		Name: "login_history",
+		Write: func(w io.Writer) error {
+			return wa.writeAuditEvents(c, w, models.AuditFilter{
+				Types:  []string{models.EventLoginSuccess, models.EventLoginFailure},
+				Target: &id,
+			})
+		},
+	}, {
+		Name: "audit_events",
+		Write: func(w io.Writer) error {
+			return wa.writeAuditEvents(c, w, models.AuditFilter{
+				Subject: &id,
+			})
+		},
+	}}
+
+	if c.URLParam("format") == "zip" {
+		c.ContentType("application/zip")
+		c.Header("Content-Disposition", `attachment; filename="export.zip"`)
+
+		zw := zip.NewWriter(c.ResponseWriter())
+		for _, s := range sections {
+			f, err := zw.Create(s.Name + ".json")
+			if err != nil {
+				wa.log(c).Error("export archive write failed", "error", err)
+				return
+			}
+
+			if err = s.Write(f); err != nil {
+				wa.log(c).Error("export section write failed", "error", err)
+				return
+			}
+		}
+
+		if err = zw.Close(); err != nil {
+			wa.log(c).Error("export archive close failed", "error", err)
+		}
+		return
+	}
+
+	c.ContentType("application/json")
+	w := c.ResponseWriter()
+
+	// headers are already sent when section fails, so we can only cut the document
+	_, _ = io.WriteString(w, "{")
+	for i, s := range sections {
+		if i > 0 {
+			_, _ = io.WriteString(w, ",")
+		}
+		_, _ = io.WriteString(w, `"`+s.Name+`":`)
+
+		if err = s.Write(w); err != nil {
+			wa.log(c).Error("export section write failed", "error", err)
+			return
+		}
+	}
+	_, _ = io.WriteString(w, "}")
+}
+
+func (wa *WebApp) writeAuditEvents(c iris.Context, w io.Writer, f models.AuditFilter) error {
+	arr := newJSONArray(w)
+	err := wa.Store.Audit.Each(wa.context(c), f, func(e models.AuditEvent) error {
+		return arr.Add(e)
+	})
+	if err != nil {
+		return err
+	}
+	return arr.Close()
+}
+
+// jsonArray encodes elements one by one without building whole array in memory
+type jsonArray struct {
+	w   io.Writer
+	enc *json.Encoder
+	n   int
+}
+
+func newJSONArray(w io.Writer) *jsonArray {
+	return &jsonArray{w: w, enc: json.NewEncoder(w)}
+}
+
+func (a *jsonArray) Add(v interface{}) error {
+	sep := ","
+	if a.n == 0 {
+		sep = "["
+	}
+	a.n++
+
+	if _, err := io.WriteString(a.w, sep); err != nil {
+		return err
+	}
+	return a.enc.Encode(v)
+}
+
+func (a *jsonArray) Close() error {
+	end := "]"
+	if a.n == 0 {
+		end = "[]"
+	}
+
+	_, err := io.WriteString(a.w, end)
+	return err
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"database/sql"
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	Convey("Delete account", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		Convey("When session is empty", func() {
+			answer := ex.POST("/account/delete").WithForm(map[string]interface{}{
+				"sesid":    "",
+				"password": "SuperPassword",
+			}).Expect()
+
+			Convey("Must be auth error", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("When password is empty", func() {
+			answer := ex.POST("/account/delete").WithForm(map[string]interface{}{
+				"sesid":    "6e536fff-baaf-4ca7-a067-352bafeb6ee3",
+				"password": "",
+			}).Expect().JSON().Object()
+
+			Convey("Must be password error", func() {
+				So(answer.Value("error").String().Raw(), ShouldEqual, "incorrect password")
+			})
+		})
+
+		Convey("When password is wrong", func() {
+			ds.User.(*models_mock.MUserStore).DeleteError = models.ErrLoginIncorrect
+
+			answer := ex.POST("/account/delete").WithForm(map[string]interface{}{
+				"sesid":    "6e536fff-baaf-4ca7-a067-352bafeb6ee3",
+				"password": "BadPassword",
+			}).Expect()
+
+			Convey("Must be password error", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+				So(answer.JSON().Object().Value("error").String().Raw(), ShouldEqual, "incorrect password")
+			})
+		})
+
+		Convey("When datastore errors on delete", func() {
+			ds.User.(*models_mock.MUserStore).DeleteError = sql.ErrConnDone
+
+			answer := ex.POST("/account/delete").WithForm(map[string]interface{}{
+				"sesid":    "6e536fff-baaf-4ca7-a067-352bafeb6ee3",
+				"password": "SuperPassword",
+			}).Expect()
+
+			Convey("Must be server error", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusInternalServerError)
+				So(answer.JSON().Object().Value("error").String().Raw(), ShouldEqual, "server error")
+			})
+		})
+
+		Convey("When all valid", func() {
+			answer := ex.POST("/account/delete").WithForm(map[string]interface{}{
+				"sesid":    "6e536fff-baaf-4ca7-a067-352bafeb6ee3",
+				"password": "SuperPassword",
+			}).Expect()
+
+			Convey("Must be OK", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+			})
+		})
+	})
+}
+
+func TestPasswordlessAccount(t *testing.T) {
+	Convey("Account created by federated login", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		users := ds.User.(*models_mock.MUserStore)
+		users.Passwordless = true
+
+		variants := []map[string]interface{}{
+			{"case": "deleted", "path": "/account/delete", "form": map[string]interface{}{}},
+			{"case": "given password", "path": "/account/password", "form": map[string]interface{}{"new_password": "NewSuperPassword"}},
+		}
+
+		for _, v := range variants {
+			Convey("When account is "+v["case"].(string)+" without fresh sign in", func() {
+				old := time.Now().Add(-models.FreshLoginTTL - time.Minute)
+				users.AuthTime = &old
+
+				answer := ex.POST(v["path"].(string)).WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithForm(v["form"]).Expect()
+
+				Convey("Must ask to sign in again", func() {
+					So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+					So(answer.JSON().Object().Value("error").String().Raw(), ShouldEqual, "sign in through identity provider again")
+				})
+			})
+
+			Convey("When account is "+v["case"].(string)+" right after sign in", func() {
+				now := time.Now()
+				users.AuthTime = &now
+
+				answer := ex.POST(v["path"].(string)).WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithForm(v["form"]).Expect()
+
+				Convey("Must be OK", func() {
+					So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+				})
+			})
+		}
+	})
+}
+
+func TestExportAccount(t *testing.T) {
+	Convey("Export account", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		Convey("When session is empty", func() {
+			answer := ex.GET("/account/export").Expect()
+
+			Convey("Must be auth error", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("When json requested", func() {
+			answer := ex.GET("/account/export").
+				WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				Expect().JSON().Object()
+
+			Convey("Must contain user without secrets", func() {
+				user := answer.Value("user").Object()
+				So(user.Value("email").String().Raw(), ShouldEqual, "tester@exter.com")
+				So(user.Raw()["password"], ShouldBeNil)
+			})
+
+			Convey("Must contain masked sessions", func() {
+				sessions := answer.Value("sessions").Array()
+				So(sessions.Length().Raw(), ShouldEqual, 1)
+				So(sessions.First().Object().Value("id").String().Raw(), ShouldEqual, "6e536fff...")
+			})
+
+			Convey("Must contain login history", func() {
+				So(answer.Value("login_history").Array().Length().Raw(), ShouldEqual, 0)
+				So(answer.Value("audit_events").Array().Length().Raw(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When zip requested", func() {
+			answer := ex.GET("/account/export").
+				WithQuery("format", "zip").
+				WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				Expect()
+
+			Convey("Must be zip archive", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+				So(answer.Raw().Header.Get("Content-Type"), ShouldStartWith, "application/zip")
+				So(answer.Body().Raw(), ShouldStartWith, "PK")
+			})
+		})
+	})
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CreateAPIKey creates key limited to requested scopes, they can't be wider than scopes
+// of the caller, by default key gets all of them
+func (wa *WebApp) CreateAPIKey(c iris.Context) {
+	id, granted, ok := wa.credentials(c)
+	if !ok {
+		return
+	}
+
+	if !models.HasScopes(granted, models.ScopeAccount) {
+		ThrowError(c, http.StatusForbidden, "insufficient scope")
+		return
+	}
+
+	if denyImpersonation(c) {
+		return
+	}
+
+	scopes := strings.Fields(c.PostValue("scopes"))
+	if len(scopes) == 0 {
+		scopes = granted
+	}
+
+	if !models.HasScopes(models.KnownScopes, scopes...) || !models.HasScopes(granted, scopes...) {
+		ThrowError(c, http.StatusBadRequest, "bad scopes")
+		return
+	}
+
+	name := strings.TrimSpace(c.PostValue("name"))
+	if name == "" || len(name) > 100 {
+		ThrowError(c, http.StatusBadRequest, "bad name")
+		return
+	}
+
+	var expiresAt *time.Time
+	if v := c.PostValue("expires_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil || !t.After(time.Now()) {
+			ThrowError(c, http.StatusBadRequest, "bad expires_at")
+			return
+		}
+		expiresAt = &t
+	}
+
+	k, key, err := wa.store(c).APIKey.Create(wa.context(c), id, name, scopes, expiresAt)
+	if err != nil {
+		wa.log(c).Error("api key creation failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	wa.audit(c, models.EventAPIKeyCreate, id, id, "key="+k.ID.String())
+
+	c.JSON(iris.Map{
+		"key":     key,
+		"api_key": k,
+	})
+}
+
+func (wa *WebApp) ListAPIKeys(c iris.Context) {
+	id, ok := wa.authorize(c, models.ScopeAccount)
+	if !ok {
+		return
+	}
+
+	list, err := wa.store(c).APIKey.List(wa.context(c), id)
+	if err != nil {
+		wa.log(c).Error("api keys lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if list == nil {
+		list = []models.APIKey{}
+	}
+	c.JSON(list)
+}
+
+func (wa *WebApp) RevokeAPIKey(c iris.Context) {
+	id, ok := wa.authorize(c, models.ScopeAccount)
+	if !ok {
+		return
+	}
+
+	kid := uuid.FromStringOrNil(c.Params().Get("id"))
+	if kid == uuid.Nil {
+		ThrowError(c, http.StatusNotFound, "api key not found")
+		return
+	}
+
+	err := wa.store(c).APIKey.Revoke(wa.context(c), id, kid)
+	if err != nil {
+		if err == models.ErrAPIKeyNotFound {
+			ThrowError(c, http.StatusNotFound, "api key not found")
+			return
+		}
+		wa.log(c).Error("api key revocation failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	wa.audit(c, models.EventAPIKeyRevoke, id, id, "key="+kid.String())
+
+	c.JSON(iris.Map{
+		"success": true,
+	})
+}
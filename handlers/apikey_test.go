@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"github.com/iris-contrib/httpexpect"
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	Convey("User api keys", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		create := func(form map[string]interface{}) *httpexpect.Response {
+			return ex.POST("/account/keys").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				WithForm(form).Expect()
+		}
+
+		Convey("When not authorized", func() {
+			ds.User.(*models_mock.MUserStore).FakeError = models.ErrAuthIncorrect
+			answer := ex.POST("/account/keys").WithFormField("name", "crawler").Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+
+		forms := []map[string]interface{}{{
+			"name":   "",
+			"case":   "empty name",
+			"mustbe": "bad name",
+		}, {
+			"name":       "crawler",
+			"expires_at": "tomorrow",
+			"case":       "unparsable expiry",
+			"mustbe":     "bad expires_at",
+		}, {
+			"name":       "crawler",
+			"expires_at": time.Now().Add(-time.Hour).Format(time.RFC3339),
+			"case":       "past expiry",
+			"mustbe":     "bad expires_at",
+		}}
+
+		for _, variant := range forms {
+			Convey("Test when invalid: "+variant["case"].(string), func() {
+				answer := create(variant).JSON().Object()
+
+				So(answer.Value("error").String().Raw(), ShouldEqual, variant["mustbe"].(string))
+			})
+		}
+
+		Convey("When key is created", func() {
+			answer := create(map[string]interface{}{"name": "crawler", "scopes": "crawl:read crawl:write"}).JSON().Object()
+			key := answer.Value("key").String().Raw()
+			id := answer.Value("api_key").Object().Value("id").String().Raw()
+
+			So(key, ShouldStartWith, "crk_")
+			So(answer.Value("api_key").Object().Value("scopes").Array().Length().Raw(), ShouldEqual, 2)
+			So(answer.Value("api_key").Object().Raw()["secret_hash"], ShouldBeNil)
+
+			Convey("Auth must resolve it to owner", func() {
+				answer := ex.POST("/user/auth").WithHeader("Authorization", "Bearer "+key).Expect().JSON().Object()
+
+				So(answer.Value("uuid").String().Raw(), ShouldEqual, models_mock.TestUUID.String())
+			})
+
+			Convey("It must be listed", func() {
+				answer := ex.GET("/account/keys").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					Expect().JSON().Array()
+
+				So(answer.Length().Raw(), ShouldEqual, 1)
+				So(answer.First().Object().Value("last_used_at").Raw(), ShouldBeNil)
+			})
+
+			Convey("When revoked", func() {
+				answer := ex.DELETE("/account/keys/"+id).WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					Expect().JSON().Object()
+				So(answer.Value("success").Boolean().Raw(), ShouldBeTrue)
+
+				auth := ex.POST("/user/auth").WithHeader("Authorization", "Bearer "+key).Expect()
+				So(auth.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+				So(ds.Audit.(*models_mock.MAuditStore).Types(), ShouldResemble, []string{models.EventAPIKeyCreate, models.EventAPIKeyRevoke})
+			})
+		})
+
+		Convey("When key is unknown", func() {
+			answer := ex.POST("/user/auth").WithHeader("Authorization", "Bearer crk_nope_nope").Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
@@ -2,30 +2,100 @@ package handlers
 
 import (
 	"github.com/kataras/iris"
+	"github.com/kataras/iris/middleware/recover"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/federation"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"github.com/xssnick/crawlyzer-auth/metrics"
 	"github.com/xssnick/crawlyzer-auth/models"
-	"log"
-	"os"
 )
 
 type WebApp struct {
-	Store  *models.DataStore
-	Logger *log.Logger
+	Store     *models.DataStore
+	Audit     models.AuditSink
+	Config    *config.Config
+	Providers map[string]*federation.Provider
+	Logger    *logging.Logger
 }
 
 var app *iris.Application
 
-func InitApp(store *models.DataStore) *iris.Application {
-	app = iris.Default()
+func InitApp(store *models.DataStore, conf *config.Config, providers map[string]*federation.Provider) *iris.Application {
+	// iris request logger is replaced by logRequest writing json with request id
+	app = iris.New()
+	app.Use(recover.New())
 
 	wa := &WebApp{
-		Store:  store,
-		Logger: log.New(os.Stdout, "[handler]", log.LstdFlags|log.Lshortfile),
+		Store:     store,
+		Audit:     store.Audit,
+		Config:    conf,
+		Providers: providers,
+		Logger:    logging.Default().With("component", "handler"),
+	}
+
+	app.UseGlobal(wa.logRequest, wa.measure, wa.trace, wa.limit)
+
+	// probes and metrics are registered before tenant middleware, they don't belong to any tenant
+	app.Get("/healthz", wa.Healthz)
+	app.Get("/readyz", wa.Readyz)
+	app.Get("/metrics", iris.FromStd(metrics.Handler()))
+
+	app.Use(wa.resolveTenant)
+
+	user := app.Party("/user")
+	user.Post("/login", wa.Login)
+	user.Post("/auth", wa.Auth)
+	user.Post("/logout", wa.Logout)
+	user.Post("/register", wa.RegisterNewUser)
+	user.Get("/list", wa.List)
+	user.Post("/impersonate", wa.Impersonate)
+	user.Get("/identities", wa.ListIdentities)
+	user.Get("/federated", wa.ListProviders)
+	user.Get("/federated/{provider:string}/login", wa.FederatedLogin)
+	user.Get("/federated/{provider:string}/callback", wa.FederatedCallback)
+
+	account := app.Party("/account")
+	account.Post("/password", wa.ChangePassword)
+	account.Post("/delete", wa.DeleteAccount)
+	account.Get("/export", wa.ExportAccount)
+	account.Post("/keys", wa.CreateAPIKey)
+	account.Get("/keys", wa.ListAPIKeys)
+	account.Delete("/keys/{id:string}", wa.RevokeAPIKey)
+
+	orgs := app.Party("/orgs")
+	orgs.Post("/", wa.CreateOrg)
+	orgs.Get("/", wa.ListOrgs)
+	orgs.Post("/invitations/accept", wa.AcceptInvitation)
+	orgs.Get("/{id:string}/members", wa.ListMembers)
+	orgs.Delete("/{id:string}/members/{user:string}", wa.RemoveMember)
+	orgs.Post("/{id:string}/invitations", wa.InviteMember)
+
+	audit := app.Party("/audit")
+	audit.Get("/", wa.ListAudit)
+	audit.Get("/verify", wa.VerifyAudit)
+
+	webhooks := app.Party("/webhooks")
+	webhooks.Post("/", wa.CreateWebhook)
+	webhooks.Get("/", wa.ListWebhooks)
+	webhooks.Delete("/{id:string}", wa.DeleteWebhook)
+	webhooks.Get("/{id:string}/deliveries", wa.WebhookDeliveries)
+
+	oauth := app.Party("/oauth")
+	oauth.Get("/authorize", wa.OAuthAuthorize)
+	oauth.Post("/authorize", wa.OAuthAuthorize)
+	oauth.Post("/token", wa.OAuthToken)
+	oauth.Post("/introspect", wa.OAuthIntrospect)
+	oauth.Post("/revoke", wa.OAuthRevoke)
+	oauth.Post("/clients", wa.CreateOAuthClient)
+	oauth.Get("/clients", wa.ListOAuthClients)
+
+	if conf.OIDCEnabled {
+		app.Get("/.well-known/openid-configuration", wa.OIDCDiscovery)
+		app.Get("/.well-known/jwks.json", wa.JWKS)
+		app.Get("/userinfo", wa.UserInfo)
+		app.Post("/userinfo", wa.UserInfo)
 	}
 
-	app.Post("/login", wa.Login)
-	app.Post("/auth", wa.Auth)
-	app.Post("/register", wa.RegisterNewUser)
-	app.Get("/list", wa.List)
 	app.Get("/node", wa.Node)
 	app.OnErrorCode(404,func(c iris.Context) {
 		c.JSON(c.Request().URL.String())
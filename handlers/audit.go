@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ListAudit returns audit events newest first, filtered by
+// type (comma separated), actor, target, since, until (RFC3339), before_id and limit
+func (wa *WebApp) ListAudit(c iris.Context) {
+	admin, ok := wa.authorizeGlobalAdmin(c)
+	if !ok {
+		return
+	}
+
+	f := models.AuditFilter{
+		Limit: 100,
+	}
+
+	if t := c.URLParam("type"); t != "" {
+		f.Types = strings.Split(t, ",")
+	}
+
+	for name, dst := range map[string]**uuid.UUID{"actor": &f.Actor, "target": &f.Target} {
+		if v := c.URLParam(name); v != "" {
+			id, err := uuid.FromString(v)
+			if err != nil {
+				ThrowError(c, http.StatusBadRequest, "bad "+name)
+				return
+			}
+			*dst = &id
+		}
+	}
+
+	for name, dst := range map[string]**time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := c.URLParam(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				ThrowError(c, http.StatusBadRequest, "bad "+name)
+				return
+			}
+			*dst = &t
+		}
+	}
+
+	if c.URLParamExists("before_id") {
+		id, err := c.URLParamInt64("before_id")
+		if err != nil {
+			ThrowError(c, http.StatusBadRequest, "bad before_id")
+			return
+		}
+		f.BeforeID = id
+	}
+
+	if c.URLParamExists("limit") {
+		limit, err := c.URLParamInt("limit")
+		if err != nil || limit <= 0 || limit > 1000 {
+			ThrowError(c, http.StatusBadRequest, "bad limit")
+			return
+		}
+		f.Limit = limit
+	}
+
+	list, err := wa.Store.Audit.Find(wa.context(c), f)
+	if err != nil {
+		wa.log(c).Error("audit lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	wa.audit(c, models.EventAdminAuditRead, admin, uuid.Nil, c.Request().URL.RawQuery)
+
+	if list == nil {
+		list = []models.AuditEvent{}
+	}
+	c.JSON(list)
+}
+
+// VerifyAudit walks audit hash chain and reports first broken event if any
+func (wa *WebApp) VerifyAudit(c iris.Context) {
+	admin, ok := wa.authorizeGlobalAdmin(c)
+	if !ok {
+		return
+	}
+
+	rep, err := wa.Store.Audit.Verify(wa.context(c))
+	if err != nil {
+		wa.log(c).Error("audit verification failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	wa.audit(c, models.EventAdminAuditVerify, admin, uuid.Nil, "")
+
+	c.JSON(iris.Map{
+		"ok":     rep.OK(),
+		"report": rep,
+	})
+}
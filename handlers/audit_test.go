@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"testing"
+)
+
+func TestAuditRecording(t *testing.T) {
+	Convey("Audit events recording", t, func() {
+		ds := models_mock.InitMockStore()
+		conf := config.Default()
+		conf.AuditKey = "audit-key"
+		ex := httptest.New(t, InitApp(ds, conf, nil))
+		audit := ds.Audit.(*models_mock.MAuditStore)
+
+		Convey("When registered and logged in", func() {
+			ex.POST("/user/register").WithForm(map[string]interface{}{
+				"email":    "gop@sup.com",
+				"password": "SuperPassword",
+			}).Expect()
+			ex.POST("/user/login").WithHeader("User-Agent", "tester").WithForm(map[string]interface{}{
+				"email":    "gop@sup.com",
+				"password": "SuperPassword",
+			}).Expect()
+
+			Convey("Must be recorded with user agent", func() {
+				So(audit.Types(), ShouldResemble, []string{models.EventRegister, models.EventLoginSuccess})
+				So(audit.Events[1].UserAgent, ShouldEqual, "tester")
+				So(*audit.Events[1].Target, ShouldEqual, models_mock.TestUUID)
+			})
+		})
+
+		Convey("When login failed", func() {
+			ds.User.(*models_mock.MUserStore).FakeError = models.ErrLoginIncorrect
+
+			ex.POST("/user/login").WithForm(map[string]interface{}{
+				"email":    "gop@sup.com",
+				"password": "BadPassword",
+			}).Expect()
+
+			Convey("Must be recorded as failure with email hash", func() {
+				So(audit.Types(), ShouldResemble, []string{models.EventLoginFailure})
+				So(audit.Events[0].Details, ShouldEqual, "email_hash="+models.EmailDigest("audit-key", "gop@sup.com"))
+				So(audit.Events[0].Details, ShouldNotContainSubstring, "gop@sup.com")
+			})
+
+			Convey("Email hash must not depend on case", func() {
+				So(models.EmailDigest("audit-key", "Gop@Sup.com"), ShouldEqual, models.EmailDigest("audit-key", "gop@sup.com"))
+				So(models.EmailDigest("other-key", "gop@sup.com"), ShouldNotEqual, models.EmailDigest("audit-key", "gop@sup.com"))
+			})
+		})
+
+		Convey("When login failed without audit key", func() {
+			conf.AuditKey = ""
+			ds.User.(*models_mock.MUserStore).FakeError = models.ErrLoginIncorrect
+
+			ex.POST("/user/login").WithForm(map[string]interface{}{
+				"email":    "gop@sup.com",
+				"password": "BadPassword",
+			}).Expect()
+
+			Convey("Email must not be recorded", func() {
+				So(audit.Types(), ShouldResemble, []string{models.EventLoginFailure})
+				So(audit.Events[0].Details, ShouldEqual, "")
+			})
+		})
+
+		Convey("When changed password and logged out", func() {
+			ex.POST("/account/password").WithForm(map[string]interface{}{
+				"sesid":        "6e536fff-baaf-4ca7-a067-352bafeb6ee3",
+				"old_password": "SuperPassword",
+				"new_password": "NewSuperPassword",
+			}).Expect()
+			ex.POST("/user/logout").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+			Convey("Must be recorded", func() {
+				So(audit.Types(), ShouldResemble, []string{models.EventPasswordChange, models.EventLogout})
+			})
+		})
+	})
+}
+
+func TestListAudit(t *testing.T) {
+	Convey("List audit events", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		ds.Audit.Record(context.Background(), models.AuditEvent{Type: models.EventRegister})
+
+		Convey("When not admin", func() {
+			answer := ex.GET("/audit").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+			Convey("Must be forbidden", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("When admin", func() {
+			ds.User.(*models_mock.MUserStore).Admin = true
+
+			Convey("With bad filter", func() {
+				answer := ex.GET("/audit").WithQuery("since", "yesterday").
+					WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("With type filter", func() {
+				answer := ex.GET("/audit").WithQuery("type", models.EventRegister).
+					WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+				So(answer.JSON().Array().Length().Raw(), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestVerifyAudit(t *testing.T) {
+	Convey("Verify audit chain", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		Convey("When not admin", func() {
+			answer := ex.GET("/audit/verify").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+			Convey("Must be forbidden", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("When admin", func() {
+			ds.User.(*models_mock.MUserStore).Admin = true
+
+			answer := ex.GET("/audit/verify").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				Expect().JSON().Object()
+
+			Convey("Must be OK and recorded", func() {
+				So(answer.Value("ok").Boolean().Raw(), ShouldBeTrue)
+				So(ds.Audit.(*models_mock.MAuditStore).Types(), ShouldResemble, []string{models.EventAdminAuditVerify})
+			})
+		})
+	})
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"context"
+	"github.com/kataras/iris"
+)
+
+// contextKey is request value with context holding logger, span and deadline of the request
+const contextKey = "request_context"
+
+// limit puts deadline from config on the request, store calls made with its context
+// give up when it passes or when client goes away
+func (wa *WebApp) limit(c iris.Context) {
+	ctx, cancel := context.WithTimeout(wa.context(c), wa.Config.RequestTimeout.Duration)
+	defer cancel()
+
+	c.Values().Set(contextKey, ctx)
+	c.Next()
+}
+
+// context returns context of the request, it is passed to store calls
+func (wa *WebApp) context(c iris.Context) context.Context {
+	if ctx, ok := c.Values().Get(contextKey).(context.Context); ok {
+		return ctx
+	}
+	return c.Request().Context()
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"testing"
+	"time"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	Convey("Request deadline", t, func() {
+		conf := config.Default()
+		conf.RequestTimeout = config.Duration{Duration: 3 * time.Second}
+
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, conf, nil))
+
+		start := time.Now()
+		ex.POST("/user/login").WithFormField("email", "tester@exter.com").WithFormField("password", "SuperPassword").
+			Expect().Status(httptest.StatusOK)
+		end := time.Now()
+
+		Convey("Store must get context limited by config", func() {
+			ctx := ds.User.(*models_mock.MUserStore).LastContext
+			deadline, ok := ctx.Deadline()
+			So(ok, ShouldBeTrue)
+			So(deadline, ShouldHappenOnOrBetween, start.Add(3*time.Second), end.Add(3*time.Second))
+		})
+
+		Convey("Context must be done with request", func() {
+			So(ds.User.(*models_mock.MUserStore).LastContext.Err(), ShouldNotEqual, nil)
+		})
+	})
+}
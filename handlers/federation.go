@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const federationCookie = "crawlyzer_federation"
+
+func (wa *WebApp) ListProviders(c iris.Context) {
+	res := []string{}
+	for name := range wa.Providers {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+
+	c.JSON(iris.Map{
+		"providers": res,
+	})
+}
+
+// FederatedLogin redirects user to identity provider
+func (wa *WebApp) FederatedLogin(c iris.Context) {
+	name := c.Params().Get("provider")
+	p, ok := wa.Providers[name]
+	if !ok {
+		ThrowError(c, http.StatusNotFound, "unknown provider")
+		return
+	}
+
+	st, err := wa.store(c).Identity.CreateState(wa.context(c), name)
+	if err != nil {
+		wa.log(c).Error("federation state creation failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	to, err := p.AuthCodeURL(wa.context(c), st.State, st.Nonce, st.Verifier)
+	if err != nil {
+		wa.log(c).Error("federation redirect failed", "error", err)
+		ThrowError(c, http.StatusBadGateway, "provider unavailable")
+		return
+	}
+
+	// state is bound to the browser, so login started by someone else can't be finished here
+	setFederationCookie(c, st.State, models.FederationStateTTL)
+	c.Redirect(to, http.StatusFound)
+}
+
+// FederatedCallback finishes login when provider sends user back with code
+func (wa *WebApp) FederatedCallback(c iris.Context) {
+	name := c.Params().Get("provider")
+	p, ok := wa.Providers[name]
+	if !ok {
+		ThrowError(c, http.StatusNotFound, "unknown provider")
+		return
+	}
+
+	state := c.URLParam("state")
+	cookie := c.GetCookie(federationCookie)
+	setFederationCookie(c, "", -1)
+
+	if state == "" || state != cookie {
+		ThrowError(c, http.StatusForbidden, "incorrect state")
+		return
+	}
+
+	st, err := wa.store(c).Identity.TakeState(wa.context(c), state)
+	if err != nil {
+		if err == models.ErrGrantIncorrect {
+			ThrowError(c, http.StatusForbidden, "incorrect state")
+			return
+		}
+		wa.log(c).Error("federation state lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if st.Provider != name {
+		ThrowError(c, http.StatusForbidden, "incorrect state")
+		return
+	}
+
+	if e := c.URLParam("error"); e != "" {
+		ThrowError(c, http.StatusForbidden, "provider error: "+e)
+		return
+	}
+
+	claims, err := p.Exchange(wa.context(c), c.URLParam("code"), st.Verifier, st.Nonce)
+	if err != nil {
+		wa.log(c).Error("federated code exchange failed", "provider", name, "error", err)
+		wa.audit(c, models.EventLoginFailure, uuid.Nil, uuid.Nil, "provider="+name)
+		ThrowError(c, http.StatusForbidden, "federated login failed")
+		return
+	}
+
+	ses, created, err := wa.store(c).Identity.Login(wa.context(c), models.ExternalIdentity{
+		Provider:      name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+	})
+	if err != nil {
+		switch err {
+		case models.ErrIdentityConflict:
+			ThrowError(c, http.StatusConflict, "account with this email already exists, sign in with password")
+		case models.ErrIdentityNoEmail:
+			ThrowError(c, http.StatusForbidden, "provider didn't share email")
+		case models.ErrUserNotFound:
+			ThrowError(c, http.StatusForbidden, "account is deleted")
+		default:
+			wa.log(c).Error("federated login failed", "error", err)
+			ThrowError(c, http.StatusInternalServerError, "server error")
+		}
+		return
+	}
+
+	if created {
+		wa.audit(c, models.EventRegister, ses.UserID, ses.UserID, "provider="+name)
+	}
+	wa.audit(c, models.EventLoginSuccess, ses.UserID, ses.UserID, "provider="+name)
+
+	c.JSON(iris.Map{
+		"session": ses.ID,
+	})
+}
+
+func (wa *WebApp) ListIdentities(c iris.Context) {
+	id, ok := wa.authorize(c, models.ScopeAccount)
+	if !ok {
+		return
+	}
+
+	list, err := wa.store(c).Identity.List(wa.context(c), id)
+	if err != nil {
+		wa.log(c).Error("identities lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if list == nil {
+		list = []models.Identity{}
+	}
+	c.JSON(list)
+}
+
+func setFederationCookie(c iris.Context, state string, ttl time.Duration) {
+	c.SetCookie(&http.Cookie{
+		Name:     federationCookie,
+		Value:    state,
+		Path:     "/user/federated",
+		MaxAge:   int(ttl / time.Second),
+		HttpOnly: true,
+		Secure:   c.Request().TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/iris-contrib/httpexpect"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/federation"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeIdP is a minimal OpenID provider, it issues token for the last authorize request
+type fakeIdP struct {
+	*httptest.Server
+	key *models.SigningKey
+
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newFakeIdP() *fakeIdP {
+	key, _ := models.NewSigningKey()
+	idp := &fakeIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []models.JWK{idp.key.JWK()},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+
+		if id != "crawlyzer" || secret != "s3cret" || r.PostFormValue("code") != "good-code" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":            idp.URL,
+			"sub":            "idp-user-1",
+			"aud":            "crawlyzer",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          idp.nonce,
+			"email":          "gop@sup.com",
+			"email_verified": true,
+		}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+
+		tok, _ := idp.key.Sign(claims)
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "idp-access",
+			"token_type":   "Bearer",
+			"id_token":     tok,
+		})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func TestFederatedLogin(t *testing.T) {
+	Convey("Login through external identity provider", t, func() {
+		idp := newFakeIdP()
+		defer idp.Close()
+
+		ds := models_mock.InitMockStore()
+		ex := newNoRedirectExpect(t, InitApp(ds, config.Default(), map[string]*federation.Provider{
+			"corp": {
+				Name:         "corp",
+				Issuer:       idp.URL,
+				ClientID:     "crawlyzer",
+				ClientSecret: "s3cret",
+				RedirectURL:  "http://auth.local/user/federated/corp/callback",
+				Scopes:       []string{"email"},
+				Client:       idp.Client(),
+			},
+		}))
+
+		// login goes to provider, it remembers what we sent there
+		login := func() string {
+			answer := ex.GET("/user/federated/corp/login").Expect()
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusFound)
+
+			loc, _ := url.Parse(answer.Header("Location").Raw())
+			idp.challenge = loc.Query().Get("code_challenge")
+			idp.nonce = loc.Query().Get("nonce")
+			return loc.Query().Get("state")
+		}
+
+		callback := func(state string) *httpexpect.Response {
+			return ex.GET("/user/federated/corp/callback").
+				WithQuery("code", "good-code").WithQuery("state", state).Expect()
+		}
+
+		Convey("When provider is unknown", func() {
+			answer := ex.GET("/user/federated/nope/login").Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Must redirect with PKCE and nonce", func() {
+			answer := ex.GET("/user/federated/corp/login").Expect()
+			loc, _ := url.Parse(answer.Header("Location").Raw())
+
+			So(loc.Host, ShouldEqual, idp.Listener.Addr().String())
+			So(loc.Query().Get("scope"), ShouldEqual, "openid email")
+			So(loc.Query().Get("code_challenge_method"), ShouldEqual, "S256")
+			So(loc.Query().Get("nonce"), ShouldNotBeBlank)
+		})
+
+		Convey("When signed in first time", func() {
+			answer := callback(login())
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+			So(answer.JSON().Object().Value("session").String().Raw(), ShouldNotBeBlank)
+			So(ds.Audit.(*models_mock.MAuditStore).Types(), ShouldResemble, []string{models.EventRegister, models.EventLoginSuccess})
+			So(ds.Webhook.(*models_mock.MWebhookStore).Enqueued, ShouldHaveLength, 1)
+
+			Convey("Next time user must be found", func() {
+				answer := callback(login())
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+				So(ds.Webhook.(*models_mock.MWebhookStore).Enqueued, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("When state is not from this browser", func() {
+			login()
+			answer := callback("state-forged")
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("When state is replayed", func() {
+			state := login()
+			callback(state)
+
+			ex.GET("/user/federated/corp/login").Expect()
+			answer := callback(state)
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+
+		invalid := []map[string]interface{}{
+			{"nonce": "other-nonce", "mustbe": "nonce mismatch"},
+			{"aud": "other-client", "mustbe": "issued for other client"},
+			{"iss": "https://evil.local", "mustbe": "issued by other provider"},
+			{"exp": time.Now().Add(-time.Hour).Unix(), "mustbe": "expired"},
+		}
+
+		for _, variant := range invalid {
+			variant := variant
+			Convey("Test when id token is "+variant["mustbe"].(string), func() {
+				idp.claims = variant
+				answer := callback(login())
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+				So(answer.JSON().Object().Value("error").String().Raw(), ShouldEqual, "federated login failed")
+			})
+		}
+
+		Convey("When unverified email belongs to local account", func() {
+			idp.claims = map[string]interface{}{"email": "tester@exter.com", "email_verified": false}
+			answer := callback(login())
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusConflict)
+		})
+	})
+}
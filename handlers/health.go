@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"github.com/kataras/iris"
+	"net/http"
+	"time"
+)
+
+// readyTimeout limits every dependency probe of readiness check
+const readyTimeout = 2 * time.Second
+
+// Healthz tells that process is alive and serves requests, dependencies are not checked,
+// so orchestrator doesn't restart node that lost redis
+func (wa *WebApp) Healthz(c iris.Context) {
+	c.JSON(iris.Map{"status": "ok"})
+}
+
+// Readyz tells whether node can serve logins, it fails with 503 when any dependency is unusable
+func (wa *WebApp) Readyz(c iris.Context) {
+	status := "ok"
+	checks := iris.Map{}
+	for _, check := range wa.Store.Health.Check(wa.context(c), readyTimeout) {
+		res := iris.Map{
+			"status":     "ok",
+			"latency_ms": check.Latency.Nanoseconds() / int64(time.Millisecond),
+		}
+		// reason goes only to log, it may contain addresses of infrastructure
+		if check.Err != nil {
+			wa.log(c).Warn("dependency is not ready", "dependency", check.Name, "error", check.Err)
+			res["status"], status = "fail", "fail"
+		}
+		checks[check.Name] = res
+	}
+
+	if status != "ok" {
+		c.StatusCode(http.StatusServiceUnavailable)
+	}
+	c.JSON(iris.Map{"status": status, "checks": checks})
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	Convey("Health probes", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+		health := ds.Health.(*models_mock.MHealthStore)
+
+		Convey("Liveness must not depend on anything", func() {
+			health.Down = map[string]error{models.DependencyPostgres: errors.New("connection refused")}
+
+			answer := ex.GET("/healthz").Expect()
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+			So(answer.JSON().Object().Value("status").String().Raw(), ShouldEqual, "ok")
+		})
+
+		Convey("Liveness must ignore bad tenant", func() {
+			answer := ex.GET("/healthz").WithHeader("X-Tenant-ID", "Bad Tenant").Expect()
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("When all dependencies are up", func() {
+			answer := ex.GET("/readyz").Expect()
+
+			Convey("Must be ready", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+
+				obj := answer.JSON().Object()
+				So(obj.Value("status").String().Raw(), ShouldEqual, "ok")
+				for _, name := range []string{models.DependencyPostgres, models.DependencyRedis, models.DependencyMigrations} {
+					So(obj.Value("checks").Object().Value(name).Object().Value("status").String().Raw(), ShouldEqual, "ok")
+				}
+			})
+		})
+
+		Convey("When redis is lost", func() {
+			health.Down = map[string]error{models.DependencyRedis: models.ErrCheckTimeout}
+			answer := ex.GET("/readyz").Expect()
+
+			Convey("Must be unavailable with failed redis only", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+
+				obj := answer.JSON().Object()
+				So(obj.Value("status").String().Raw(), ShouldEqual, "fail")
+				So(obj.Value("checks").Object().Value(models.DependencyRedis).Object().Value("status").String().Raw(), ShouldEqual, "fail")
+				So(obj.Value("checks").Object().Value(models.DependencyPostgres).Object().Value("status").String().Raw(), ShouldEqual, "ok")
+			})
+		})
+	})
+}
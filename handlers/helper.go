@@ -1,7 +1,17 @@
 package handlers
 
 import (
+	uuid "github.com/iris-contrib/go.uuid"
 	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"net/http"
+	"time"
+)
+
+// keys of request values set by credentials
+const (
+	impersonatorKey = "impersonated_by"
+	authTimeKey     = "auth_time"
 )
 
 func ThrowError(c iris.Context, code int, text string) {
@@ -10,3 +20,173 @@ func ThrowError(c iris.Context, code int, text string) {
 		"error": text,
 	})
 }
+
+// authorize resolves session passed in sesid form value or in X-Session-ID header
+// or api key passed as bearer token, throws forbidden error when it is not valid
+// or doesn't have all required scopes
+func (wa *WebApp) authorize(c iris.Context, scopes ...string) (uuid.UUID, bool) {
+	id, granted, ok := wa.credentials(c)
+	if !ok {
+		return uuid.Nil, false
+	}
+
+	if !models.HasScopes(granted, scopes...) {
+		ThrowError(c, http.StatusForbidden, "insufficient scope")
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// credentials returns user and scopes of session or api key
+func (wa *WebApp) credentials(c iris.Context) (uuid.UUID, []string, bool) {
+	if key := bearerToken(c); models.IsAPIKey(key) {
+		k, err := wa.store(c).APIKey.Authenticate(wa.context(c), key)
+		if err != nil {
+			if err == models.ErrAPIKeyIncorrect {
+				ThrowError(c, http.StatusForbidden, "incorrect api key")
+				return uuid.Nil, nil, false
+			}
+			wa.log(c).Error("api key authentication failed", "error", err)
+			ThrowError(c, http.StatusInternalServerError, "server error")
+			return uuid.Nil, nil, false
+		}
+		return k.UserID, k.Scopes, true
+	}
+
+	sesid := sessionID(c)
+	if sesid == "" {
+		ThrowError(c, http.StatusForbidden, "incorrect session")
+		return uuid.Nil, nil, false
+	}
+
+	ses, err := wa.store(c).User.AuthSession(wa.context(c), sesid)
+	if err != nil {
+		ThrowError(c, http.StatusForbidden, "incorrect session")
+		return uuid.Nil, nil, false
+	}
+
+	rememberSession(c, ses)
+	return ses.UserID, ses.Scopes, true
+}
+
+// rememberSession keeps facts of the session authorizing request for checks of handlers
+func rememberSession(c iris.Context, ses *models.Session) {
+	if ses.ImpersonatedBy != nil {
+		c.Values().Set(impersonatorKey, ses.ImpersonatedBy)
+	}
+	if ses.AuthTime != nil {
+		c.Values().Set(authTimeKey, *ses.AuthTime)
+	}
+}
+
+// freshLogin tells if session authorized by credentials was signed in within FreshLoginTTL,
+// api keys and sessions issued to oauth clients are never fresh
+func freshLogin(c iris.Context) bool {
+	at, ok := c.Values().Get(authTimeKey).(time.Time)
+	return ok && time.Since(at) < models.FreshLoginTTL
+}
+
+// impersonator returns admin working in the session authorized by credentials, nil for user himself
+func impersonator(c iris.Context) *uuid.UUID {
+	admin, _ := c.Values().Get(impersonatorKey).(*uuid.UUID)
+	return admin
+}
+
+// denyImpersonation answers forbidden when admin impersonates the user, impersonation must not
+// do what outlives it or speaks for the user: credentials, api keys, oauth grants, memberships
+func denyImpersonation(c iris.Context) bool {
+	if impersonator(c) == nil {
+		return false
+	}
+
+	ThrowError(c, http.StatusForbidden, "not allowed during impersonation")
+	return true
+}
+
+// authorizeSensitive is authorize for account management which can't be done
+// by admin impersonating the user
+func (wa *WebApp) authorizeSensitive(c iris.Context) (uuid.UUID, bool) {
+	id, ok := wa.authorize(c, models.ScopeAccount)
+	if !ok || denyImpersonation(c) {
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// authorizeAdmin is authorize which also requires user to be an admin
+// and credentials to allow account management
+func (wa *WebApp) authorizeAdmin(c iris.Context) (uuid.UUID, bool) {
+	id, ok := wa.authorize(c, models.ScopeAccount)
+	if !ok {
+		return uuid.Nil, false
+	}
+
+	u, err := wa.store(c).User.Get(wa.context(c), id)
+	if err != nil {
+		if err == models.ErrUserNotFound {
+			ThrowError(c, http.StatusForbidden, "incorrect session")
+			return uuid.Nil, false
+		}
+		wa.log(c).Error("user lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return uuid.Nil, false
+	}
+
+	if !u.IsAdmin {
+		ThrowError(c, http.StatusForbidden, "admin only")
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// authorizeGlobalAdmin is authorizeAdmin for data shared by all tenants, like audit log, webhooks
+// and oauth clients, only admins of default tenant can manage it
+func (wa *WebApp) authorizeGlobalAdmin(c iris.Context) (uuid.UUID, bool) {
+	if c.Values().GetString(tenantNameKey) != models.DefaultTenant {
+		ThrowError(c, http.StatusForbidden, "global admin only")
+		return uuid.Nil, false
+	}
+	return wa.authorizeAdmin(c)
+}
+
+func sessionID(c iris.Context) string {
+	if sesid := c.GetHeader("X-Session-ID"); sesid != "" {
+		return sesid
+	}
+	return c.PostValue("sesid")
+}
+
+// audit records event with request's ip and user agent,
+// failures are only logged to not break the flow for the user
+func (wa *WebApp) audit(c iris.Context, typ string, actor, target uuid.UUID, details string) {
+	e := models.AuditEvent{
+		Type:      typ,
+		IP:        c.RemoteAddr(),
+		UserAgent: c.GetHeader("User-Agent"),
+		Details:   details,
+		CreatedAt: time.Now(),
+	}
+
+	if actor != uuid.Nil {
+		e.Actor = &actor
+	}
+	if target != uuid.Nil {
+		e.Target = &target
+	}
+
+	if err := wa.Audit.Record(wa.context(c), e); err != nil {
+		wa.log(c).Error("audit record failed", "type", typ, "error", err)
+	}
+}
+
+// auditEmail returns details part identifying email by its keyed hash,
+// without audit key email is not recorded at all
+func (wa *WebApp) auditEmail(email string) string {
+	if wa.Config.AuditKey == "" {
+		return ""
+	}
+	return "email_hash=" + models.EmailDigest(wa.Config.AuditKey, email)
+}
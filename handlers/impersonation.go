@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"net/http"
+	"strings"
+)
+
+// Impersonate gives admin short session of the user to reproduce his issue,
+// reason is required and goes to audit log, logout of the session ends impersonation
+func (wa *WebApp) Impersonate(c iris.Context) {
+	admin, ok := wa.authorizeAdmin(c)
+	if !ok {
+		return
+	}
+
+	target := uuid.FromStringOrNil(c.PostValue("user_id"))
+	if target == uuid.Nil {
+		ThrowError(c, http.StatusBadRequest, "bad user id")
+		return
+	}
+
+	reason := strings.TrimSpace(c.PostValue("reason"))
+	if reason == "" {
+		ThrowError(c, http.StatusBadRequest, "no reason")
+		return
+	}
+
+	if target == admin {
+		ThrowError(c, http.StatusBadRequest, "can't impersonate yourself")
+		return
+	}
+
+	u, err := wa.store(c).User.Get(wa.context(c), target)
+	if err != nil {
+		if err == models.ErrUserNotFound {
+			ThrowError(c, http.StatusNotFound, "user not found")
+			return
+		}
+		wa.log(c).Error("impersonation target lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	// admin session can do more than support should
+	if u.IsAdmin {
+		ThrowError(c, http.StatusForbidden, "can't impersonate admin")
+		return
+	}
+
+	ses, err := wa.store(c).User.Impersonate(wa.context(c), admin, target)
+	if err != nil {
+		if err == models.ErrUserNotFound {
+			ThrowError(c, http.StatusNotFound, "user not found")
+			return
+		}
+		wa.log(c).Error("impersonation failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	wa.audit(c, models.EventAdminImpersonateStart, admin, target, "reason="+reason)
+
+	c.JSON(iris.Map{
+		"session": ses,
+	})
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"testing"
+)
+
+func TestImpersonate(t *testing.T) {
+	Convey("Admin impersonation", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+		audit := ds.Audit.(*models_mock.MAuditStore)
+		target := "d96bee74-07c5-40ca-b0cc-c0e04d4a7589"
+
+		Convey("When user is not admin", func() {
+			answer := ex.POST("/user/impersonate").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				WithForm(map[string]interface{}{"user_id": target, "reason": "ticket 42"}).Expect()
+
+			Convey("Must be forbidden", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("When user is admin", func() {
+			ds.User.(*models_mock.MUserStore).Admin = true
+
+			variants := []map[string]interface{}{
+				{"case": "bad user", "user_id": "nope", "reason": "ticket 42", "mustbe": "bad user id"},
+				{"case": "no reason", "user_id": target, "reason": " ", "mustbe": "no reason"},
+				{"case": "himself", "user_id": models_mock.TestUUID.String(), "reason": "ticket 42", "mustbe": "can't impersonate yourself"},
+			}
+
+			for _, v := range variants {
+				Convey("When "+v["case"].(string), func() {
+					answer := ex.POST("/user/impersonate").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+						WithForm(map[string]interface{}{"user_id": v["user_id"], "reason": v["reason"]}).Expect().JSON().Object()
+
+					Convey("Must be "+v["mustbe"].(string), func() {
+						So(answer.Value("error").String().Raw(), ShouldEqual, v["mustbe"])
+					})
+				})
+			}
+
+			Convey("When all valid", func() {
+				answer := ex.POST("/user/impersonate").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithForm(map[string]interface{}{"user_id": target, "reason": "ticket 42"}).Expect()
+
+				Convey("Must return session marked with admin", func() {
+					So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+
+					ses := answer.JSON().Object().Value("session").Object()
+					So(ses.Value("impersonated_by").String().Raw(), ShouldEqual, models_mock.TestUUID.String())
+
+					So(audit.Types(), ShouldResemble, []string{models.EventAdminImpersonateStart})
+					So(audit.Events[0].Target.String(), ShouldEqual, target)
+					So(audit.Events[0].Details, ShouldEqual, "reason=ticket 42")
+				})
+			})
+		})
+	})
+
+	Convey("Impersonated session", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+		audit := ds.Audit.(*models_mock.MAuditStore)
+
+		admin := uuid.FromStringOrNil("6e536fff-bcaf-4ca9-a067-352bafeb6ed2")
+		ds.User.(*models_mock.MUserStore).ImpersonatedBy = &admin
+
+		Convey("Auth must show impersonator", func() {
+			answer := ex.POST("/user/auth").WithFormField("sesid", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				Expect().JSON().Object()
+
+			So(answer.Value("impersonated_by").String().Raw(), ShouldEqual, admin.String())
+		})
+
+		variants := []map[string]interface{}{
+			{"case": "password change", "path": "/account/password", "form": map[string]interface{}{"old_password": "SuperPassword", "new_password": "NewPassword"}},
+			{"case": "account deletion", "path": "/account/delete", "form": map[string]interface{}{"password": "SuperPassword"}},
+			{"case": "api key creation", "path": "/account/keys", "form": map[string]interface{}{"name": "crawler"}},
+			{"case": "invitation acceptance", "path": "/orgs/invitations/accept", "form": map[string]interface{}{"token": "invitation-1"}},
+		}
+		ds.Org.Invite(context.Background(), models_mock.TestUUID, "tester@exter.com", models.RoleMember, admin)
+
+		for _, v := range variants {
+			Convey(v["case"].(string)+" must be forbidden", func() {
+				answer := ex.POST(v["path"].(string)).WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithForm(v["form"]).Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+				So(answer.JSON().Object().Value("error").String().Raw(), ShouldEqual, "not allowed during impersonation")
+			})
+		}
+
+		Convey("Logout must stop impersonation", func() {
+			ex.POST("/user/logout").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+			So(audit.Types(), ShouldResemble, []string{models.EventAdminImpersonateStop})
+			So(*audit.Events[0].Actor, ShouldEqual, admin)
+			So(*audit.Events[0].Target, ShouldEqual, models_mock.TestUUID)
+		})
+	})
+
+	Convey("Own session", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		Convey("Auth must not show impersonator", func() {
+			answer := ex.POST("/user/auth").WithFormField("sesid", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				Expect().JSON().Object()
+
+			answer.Value("impersonated_by").Null()
+		})
+	})
+}
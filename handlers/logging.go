@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"time"
+)
+
+// requestIDHeader carries id of the request from caller or proxy, it is echoed back
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen limits id taken from caller, longer ones are replaced
+const maxRequestIDLen = 128
+
+// logRequest gives request an id and logger with it, then logs request when it is done,
+// route is registered path, not url, so neither ids nor tokens get into log
+func (wa *WebApp) logRequest(c iris.Context) {
+	start := time.Now()
+
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.Must(uuid.NewV4()).String()
+	}
+	c.Header(requestIDHeader, id)
+
+	logger := wa.Logger.With("request_id", id)
+	c.Values().Set(contextKey, logging.NewContext(c.Request().Context(), logger))
+
+	c.Next()
+
+	route := ""
+	if r := c.GetCurrentRoute(); r != nil {
+		route = r.Path()
+	}
+	wa.log(c).Info("request", "method", c.Method(), "route", route, "status", c.GetStatusCode(),
+		"duration_ms", time.Since(start).Seconds()*1000)
+}
+
+// validRequestID accepts printable ascii without spaces and quotes,
+// anything else from caller could forge log lines or headers downstream
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' || id[i] == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// log returns logger of the request, records carry its id and trace
+func (wa *WebApp) log(c iris.Context) *logging.Logger {
+	return logging.FromContext(wa.context(c))
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogging(t *testing.T) {
+	Convey("Request logging", t, func() {
+		var buf bytes.Buffer
+		std := logging.Default()
+		logging.SetDefault(logging.New(&buf, logging.LevelInfo))
+		defer logging.SetDefault(std)
+
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		Convey("When caller sends request id", func() {
+			r := ex.GET("/healthz").WithHeader("X-Request-ID", "edge-42").Expect()
+
+			Convey("It must be echoed and logged", func() {
+				r.Header("X-Request-ID").Equal("edge-42")
+				So(buf.String(), ShouldContainSubstring, `"request_id":"edge-42"`)
+				So(buf.String(), ShouldContainSubstring, `"route":"/healthz"`)
+			})
+		})
+
+		variants := []map[string]interface{}{
+			{"case": "missing", "id": ""},
+			{"case": "too long", "id": strings.Repeat("a", maxRequestIDLen+1)},
+			{"case": "with quote", "id": `a"b`},
+		}
+
+		for _, v := range variants {
+			Convey("When request id is "+v["case"].(string), func() {
+				req := ex.GET("/healthz")
+				if id := v["id"].(string); id != "" {
+					req = req.WithHeader("X-Request-ID", id)
+				}
+				r := req.Expect()
+
+				Convey("New one must be generated", func() {
+					id := r.Raw().Header.Get("X-Request-ID")
+					So(len(id), ShouldEqual, 36)
+					So(id, ShouldNotEqual, v["id"])
+				})
+			})
+		}
+
+		Convey("When store fails on login", func() {
+			ds.User.(*models_mock.MUserStore).FakeError = sql.ErrConnDone
+
+			ex.POST("/user/login").WithHeader("X-Request-ID", "edge-43").
+				WithFormField("email", "tester@exter.com").WithFormField("password", "SuperPassword").Expect()
+
+			Convey("Error must be logged with request id and no password", func() {
+				So(buf.String(), ShouldContainSubstring, `"level":"ERROR","msg":"login failed","component":"handler","request_id":"edge-43"`)
+				So(buf.String(), ShouldNotContainSubstring, "SuperPassword")
+			})
+		})
+	})
+}
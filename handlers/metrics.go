@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/metrics"
+	"strconv"
+	"time"
+)
+
+// measure counts request and its latency by registered route path,
+// requests without route are not measured, they are 404 of any url
+func (wa *WebApp) measure(c iris.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.GetCurrentRoute()
+	if route == nil {
+		return
+	}
+
+	metrics.Requests.WithLabelValues(route.Path(), c.Method(), strconv.Itoa(c.GetStatusCode())).Inc()
+	metrics.RequestDuration.WithLabelValues(route.Path(), c.Method()).Observe(time.Since(start).Seconds())
+}
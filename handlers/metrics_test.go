@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	Convey("Metrics", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		ex.GET("/orgs/0d1a2f7e-3b4c-4d5e-8f60-718293a4b5c6/members").Expect()
+		ex.GET("/nowhere").Expect()
+
+		answer := ex.GET("/metrics").Expect()
+
+		Convey("Must be served in text format", func() {
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+			So(answer.Raw().Header.Get("Content-Type"), ShouldStartWith, "text/plain")
+		})
+
+		Convey("Requests must be counted by route, not by url", func() {
+			body := answer.Body().Raw()
+			So(body, ShouldContainSubstring, `crawlyzer_auth_http_requests_total{method="GET",route="/orgs/{id:string}/members",status="403"}`)
+			So(body, ShouldContainSubstring, `crawlyzer_auth_http_request_duration_seconds_count{method="GET",route="/orgs/{id:string}/members"}`)
+			So(body, ShouldNotContainSubstring, "0d1a2f7e")
+			So(body, ShouldNotContainSubstring, "/nowhere")
+		})
+	})
+}
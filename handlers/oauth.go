@@ -0,0 +1,712 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sessionCookie keeps browser session for authorize page only
+const sessionCookie = "crawlyzer_session"
+
+// loginCookie keeps random value login form token is made from, there is no session yet to bind it to
+const loginCookie = "crawlyzer_login"
+
+var oauthPage = template.Must(template.New("oauth").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Crawlyzer</title></head>
+<body>
+{{if .Fatal}}
+<p>{{.Error}}</p>
+{{else}}
+<form method="post">
+{{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{$v}}">
+{{end}}
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+{{if .Login}}
+<p>Sign in to continue to {{.Client}}</p>
+<input type="email" name="email" placeholder="Email">
+<input type="password" name="password" placeholder="Password">
+<button type="submit">Sign in</button>
+{{else}}
+<p>{{.Client}} wants to access your account{{if .Scopes}} with scopes:{{end}}</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+<button type="submit" name="consent" value="approve">Allow</button>
+<button type="submit" name="consent" value="deny">Deny</button>
+{{end}}
+</form>
+{{end}}
+</body>
+</html>`))
+
+type oauthPageData struct {
+	Fatal  bool
+	Error  string
+	Login  bool
+	Client string
+	Scopes []string
+	Params map[string]string
+	CSRF   string
+}
+
+type authorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+}
+
+func parseAuthorizeRequest(c iris.Context) authorizeRequest {
+	return authorizeRequest{
+		ResponseType:        c.FormValue("response_type"),
+		ClientID:            c.FormValue("client_id"),
+		RedirectURI:         c.FormValue("redirect_uri"),
+		Scope:               c.FormValue("scope"),
+		State:               c.FormValue("state"),
+		CodeChallenge:       c.FormValue("code_challenge"),
+		CodeChallengeMethod: c.FormValue("code_challenge_method"),
+		Nonce:               c.FormValue("nonce"),
+	}
+}
+
+func (r authorizeRequest) params() map[string]string {
+	return map[string]string{
+		"response_type":         r.ResponseType,
+		"client_id":             r.ClientID,
+		"redirect_uri":          r.RedirectURI,
+		"scope":                 r.Scope,
+		"state":                 r.State,
+		"code_challenge":        r.CodeChallenge,
+		"code_challenge_method": r.CodeChallengeMethod,
+		"nonce":                 r.Nonce,
+	}
+}
+
+// OAuthAuthorize handles authorization code flow page, user signs in with his password
+// if he has no browser session and then approves client's access once per scope set
+func (wa *WebApp) OAuthAuthorize(c iris.Context) {
+	r := parseAuthorizeRequest(c)
+
+	client, err := wa.store(c).OAuth.GetClient(wa.context(c), r.ClientID)
+	if err != nil {
+		if err == models.ErrClientNotFound {
+			wa.renderOAuthPage(c, http.StatusBadRequest, oauthPageData{Fatal: true, Error: "unknown client"})
+			return
+		}
+		wa.log(c).Error("oauth client lookup failed", "error", err)
+		wa.renderOAuthPage(c, http.StatusInternalServerError, oauthPageData{Fatal: true, Error: "server error"})
+		return
+	}
+
+	// we must not redirect to unregistered uri, so user sees the error
+	if !client.AllowsRedirect(r.RedirectURI) {
+		wa.renderOAuthPage(c, http.StatusBadRequest, oauthPageData{Fatal: true, Error: "invalid redirect_uri"})
+		return
+	}
+
+	switch {
+	case r.ResponseType != "code":
+		redirectOAuthError(c, r, "unsupported_response_type", "only code is supported")
+		return
+	case !client.AllowsGrant(models.GrantAuthorizationCode):
+		redirectOAuthError(c, r, "unauthorized_client", "authorization_code grant is not allowed")
+		return
+	case r.CodeChallenge == "" || r.CodeChallengeMethod != "S256":
+		redirectOAuthError(c, r, "invalid_request", "PKCE with S256 is required")
+		return
+	case !client.AllowsScope(r.Scope):
+		redirectOAuthError(c, r, "invalid_scope", "scope is not allowed")
+		return
+	}
+
+	page := oauthPageData{
+		Client: client.Name,
+		Scopes: strings.Fields(r.Scope),
+		Params: r.params(),
+	}
+
+	var authTime time.Time
+
+	uid, sesid := wa.browserSession(c)
+	if denyImpersonation(c) {
+		return
+	}
+
+	if uid == uuid.Nil {
+		nonce, err := loginNonce(c)
+		if err != nil {
+			wa.log(c).Error("login cookie creation failed", "error", err)
+			wa.renderOAuthPage(c, http.StatusInternalServerError, oauthPageData{Fatal: true, Error: "server error"})
+			return
+		}
+		page.Login, page.CSRF = true, loginCSRF(nonce, client.ID)
+
+		email := c.PostValue("email")
+		if c.Method() != http.MethodPost || email == "" {
+			wa.renderOAuthPage(c, http.StatusOK, page)
+			return
+		}
+
+		// otherwise any site could sign the browser in to attacker's account and collect consents there
+		if subtle.ConstantTimeCompare([]byte(c.PostValue("csrf")), []byte(page.CSRF)) != 1 {
+			wa.renderOAuthPage(c, http.StatusForbidden, oauthPageData{Fatal: true, Error: "request expired, try again"})
+			return
+		}
+
+		ses, err := wa.store(c).User.Login(wa.context(c), email, c.PostValue("password"))
+		if err != nil {
+			if err == models.ErrLoginIncorrect {
+				wa.audit(c, models.EventLoginFailure, uuid.Nil, uuid.Nil, wa.auditEmail(email))
+				page.Error = "incorrect email or password"
+				wa.renderOAuthPage(c, http.StatusForbidden, page)
+				return
+			}
+			wa.log(c).Error("login failed", "error", err)
+			wa.renderOAuthPage(c, http.StatusInternalServerError, oauthPageData{Fatal: true, Error: "server error"})
+			return
+		}
+
+		wa.audit(c, models.EventLoginSuccess, ses.UserID, ses.UserID, "client="+client.ID)
+		setSessionCookie(c, ses)
+		uid, sesid, authTime = ses.UserID, ses.ID, ses.CreatedAt
+		page.Login = false
+	}
+
+	consent, err := wa.store(c).OAuth.HasConsent(wa.context(c), uid, client.ID, r.Scope)
+	if err != nil {
+		wa.log(c).Error("oauth consent lookup failed", "error", err)
+		wa.renderOAuthPage(c, http.StatusInternalServerError, oauthPageData{Fatal: true, Error: "server error"})
+		return
+	}
+
+	if !consent {
+		page.CSRF = consentCSRF(sesid, client.ID)
+
+		answer := c.PostValue("consent")
+		if c.Method() != http.MethodPost || answer == "" {
+			wa.renderOAuthPage(c, http.StatusOK, page)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(c.PostValue("csrf")), []byte(page.CSRF)) != 1 {
+			wa.renderOAuthPage(c, http.StatusForbidden, oauthPageData{Fatal: true, Error: "request expired, try again"})
+			return
+		}
+
+		if answer != "approve" {
+			redirectOAuthError(c, r, "access_denied", "user denied access")
+			return
+		}
+
+		if err = wa.store(c).OAuth.SaveConsent(wa.context(c), uid, client.ID, r.Scope); err != nil {
+			wa.log(c).Error("oauth consent save failed", "error", err)
+			wa.renderOAuthPage(c, http.StatusInternalServerError, oauthPageData{Fatal: true, Error: "server error"})
+			return
+		}
+		wa.audit(c, models.EventOAuthConsent, uid, uid, "client="+client.ID+" scope="+r.Scope)
+	}
+
+	code, err := wa.store(c).OAuth.CreateCode(wa.context(c), models.AuthCode{
+		ClientID:      client.ID,
+		UserID:        uid,
+		RedirectURI:   r.RedirectURI,
+		Scope:         r.Scope,
+		CodeChallenge: r.CodeChallenge,
+		Nonce:         r.Nonce,
+		AuthTime:      authTime,
+	})
+	if err != nil {
+		wa.log(c).Error("oauth code issue failed", "error", err)
+		wa.renderOAuthPage(c, http.StatusInternalServerError, oauthPageData{Fatal: true, Error: "server error"})
+		return
+	}
+
+	redirectOAuth(c, r, url.Values{"code": {code}})
+}
+
+// OAuthToken exchanges grants for tokens, clients authenticate with basic auth or form fields
+func (wa *WebApp) OAuthToken(c iris.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, ok := wa.oauthClient(c)
+	if !ok {
+		return
+	}
+
+	grant := c.PostValue("grant_type")
+	switch grant {
+	case models.GrantAuthorizationCode, models.GrantRefreshToken, models.GrantClientCredentials:
+	default:
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	if !client.AllowsGrant(grant) {
+		oauthError(c, http.StatusBadRequest, "unauthorized_client", "grant type is not allowed")
+		return
+	}
+
+	var g models.OAuthGrant
+	var nonce string
+	var authTime time.Time
+
+	switch grant {
+	case models.GrantAuthorizationCode:
+		code, err := wa.store(c).OAuth.TakeCode(wa.context(c), c.PostValue("code"))
+		if err != nil {
+			if err == models.ErrGrantIncorrect {
+				oauthError(c, http.StatusBadRequest, "invalid_grant", "code is invalid or expired")
+				return
+			}
+			wa.log(c).Error("oauth code exchange failed", "error", err)
+			oauthError(c, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+
+		if code.ClientID != client.ID || code.RedirectURI != c.PostValue("redirect_uri") {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "code was issued to another client or redirect_uri")
+			return
+		}
+
+		if !verifyPKCE(c.PostValue("code_verifier"), code.CodeChallenge) {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "code_verifier does not match")
+			return
+		}
+
+		g = models.OAuthGrant{ClientID: client.ID, UserID: code.UserID, Scope: code.Scope}
+		nonce, authTime = code.Nonce, code.AuthTime
+	case models.GrantRefreshToken:
+		prev, err := wa.store(c).OAuth.TakeRefreshToken(wa.context(c), c.PostValue("refresh_token"))
+		if err != nil {
+			if err == models.ErrGrantIncorrect {
+				oauthError(c, http.StatusBadRequest, "invalid_grant", "refresh_token is invalid or expired")
+				return
+			}
+			wa.log(c).Error("refresh token exchange failed", "error", err)
+			oauthError(c, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+
+		if prev.ClientID != client.ID {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "refresh_token was issued to another client")
+			return
+		}
+
+		g = *prev
+		if scope := c.PostValue("scope"); scope != "" {
+			if !scopeSubset(scope, prev.Scope) {
+				oauthError(c, http.StatusBadRequest, "invalid_scope", "scope exceeds granted one")
+				return
+			}
+			g.Scope = scope
+		}
+	case models.GrantClientCredentials:
+		if !client.Confidential() {
+			oauthError(c, http.StatusBadRequest, "unauthorized_client", "public clients can not use client_credentials")
+			return
+		}
+
+		g = models.OAuthGrant{ClientID: client.ID, Scope: c.PostValue("scope")}
+		if g.Scope == "" {
+			g.Scope = strings.Join(client.Scopes, " ")
+		}
+
+		if !client.AllowsScope(g.Scope) {
+			oauthError(c, http.StatusBadRequest, "invalid_scope", "scope is not allowed")
+			return
+		}
+	}
+
+	var access string
+	var u *models.User
+	if g.UserID != uuid.Nil {
+		var err error
+		u, err = wa.store(c).User.Get(wa.context(c), g.UserID)
+		if err != nil || u.DeletedAt != nil {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "user is not active")
+			return
+		}
+
+		ses, err := wa.store(c).User.CreateSession(wa.context(c), g.UserID, strings.Fields(g.Scope))
+		if err != nil {
+			wa.log(c).Error("session creation failed", "error", err)
+			oauthError(c, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		access = ses.ID
+	}
+
+	refresh := g.UserID != uuid.Nil && client.AllowsGrant(models.GrantRefreshToken)
+
+	tok, err := wa.store(c).OAuth.IssueToken(wa.context(c), g, access, refresh)
+	if err != nil {
+		wa.log(c).Error("oauth token issue failed", "error", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	// without oidc openid scope is kept for clients but no id token is issued
+	if wa.Config.OIDCEnabled && u != nil && hasScope(g.Scope, ScopeOpenID) {
+		if tok.IDToken, err = wa.idToken(wa.context(c), client.ID, u, g.Scope, nonce, authTime); err != nil {
+			wa.log(c).Error("id token signing failed", "error", err)
+			oauthError(c, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+	}
+
+	wa.audit(c, models.EventOAuthToken, g.UserID, g.UserID, "client="+client.ID+" grant="+grant+" scope="+g.Scope)
+
+	c.JSON(tok)
+}
+
+// OAuthIntrospect tells resource servers if token or session is active (RFC 7662),
+// only confidential clients may ask
+func (wa *WebApp) OAuthIntrospect(c iris.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	client, ok := wa.oauthClient(c)
+	if !ok {
+		return
+	}
+
+	if !client.Confidential() {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "introspection requires confidential client")
+		return
+	}
+
+	info, err := wa.store(c).OAuth.Introspect(wa.context(c), c.PostValue("token"))
+	if err != nil {
+		if err == models.ErrGrantIncorrect {
+			c.JSON(iris.Map{
+				"active": false,
+			})
+			return
+		}
+		wa.log(c).Error("token introspection failed", "error", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	res := iris.Map{
+		"active":     true,
+		"token_type": "Bearer",
+		"exp":        info.ExpiresAt.Unix(),
+	}
+	if info.Type == models.TokenTypeRefresh {
+		res["token_type"] = models.TokenTypeRefresh
+	}
+	if info.Grant.UserID != uuid.Nil {
+		res["sub"] = info.Grant.UserID.String()
+	}
+	if info.Grant.ClientID != "" {
+		res["client_id"] = info.Grant.ClientID
+	}
+	if info.Grant.Scope != "" {
+		res["scope"] = info.Grant.Scope
+	}
+	c.JSON(res)
+}
+
+// OAuthRevoke revokes access or refresh token of the client (RFC 7009),
+// answer is always ok so unknown and foreign tokens can't be told apart
+func (wa *WebApp) OAuthRevoke(c iris.Context) {
+	client, ok := wa.oauthClient(c)
+	if !ok {
+		return
+	}
+
+	token := c.PostValue("token")
+	info, err := wa.store(c).OAuth.Introspect(wa.context(c), token)
+	if err != nil {
+		if err == models.ErrGrantIncorrect {
+			c.StatusCode(http.StatusOK)
+			return
+		}
+		wa.log(c).Error("token introspection failed", "error", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	if info.Grant.ClientID != client.ID {
+		c.StatusCode(http.StatusOK)
+		return
+	}
+
+	if err = wa.store(c).OAuth.Revoke(wa.context(c), token); err != nil {
+		wa.log(c).Error("token revocation failed", "error", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	// user access token is his session
+	if info.Type == models.TokenTypeAccess && info.Grant.UserID != uuid.Nil {
+		if err = wa.store(c).User.Logout(wa.context(c), token); err != nil {
+			wa.log(c).Error("logout failed", "error", err)
+			oauthError(c, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+	}
+
+	wa.audit(c, models.EventOAuthRevoke, info.Grant.UserID, info.Grant.UserID, "client="+client.ID+" type="+info.Type)
+	c.StatusCode(http.StatusOK)
+}
+
+// CreateOAuthClient registers client, lists are space separated,
+// secret is generated and shown only once when confidential=true
+func (wa *WebApp) CreateOAuthClient(c iris.Context) {
+	admin, ok := wa.authorizeGlobalAdmin(c)
+	if !ok {
+		return
+	}
+
+	client := &models.OAuthClient{
+		Name:         strings.TrimSpace(c.PostValue("name")),
+		RedirectURIs: strings.Fields(c.PostValue("redirect_uris")),
+		GrantTypes:   strings.Fields(c.PostValue("grant_types")),
+		Scopes:       strings.Fields(c.PostValue("scopes")),
+	}
+	confidential := c.PostValue("confidential") == "true"
+
+	if client.Name == "" {
+		ThrowError(c, http.StatusBadRequest, "bad name")
+		return
+	}
+
+	if len(client.GrantTypes) == 0 {
+		ThrowError(c, http.StatusBadRequest, "no grant types")
+		return
+	}
+
+	for _, g := range client.GrantTypes {
+		switch g {
+		case models.GrantAuthorizationCode, models.GrantRefreshToken:
+		case models.GrantClientCredentials:
+			if !confidential {
+				ThrowError(c, http.StatusBadRequest, "client_credentials requires confidential client")
+				return
+			}
+		default:
+			ThrowError(c, http.StatusBadRequest, "unknown grant type "+g)
+			return
+		}
+	}
+
+	if client.AllowsGrant(models.GrantAuthorizationCode) && len(client.RedirectURIs) == 0 {
+		ThrowError(c, http.StatusBadRequest, "no redirect uris")
+		return
+	}
+
+	for _, uri := range client.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Fragment != "" {
+			ThrowError(c, http.StatusBadRequest, "bad redirect uri "+uri)
+			return
+		}
+	}
+
+	secret, err := wa.store(c).OAuth.CreateClient(wa.context(c), client, confidential)
+	if err != nil {
+		wa.log(c).Error("oauth client creation failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	wa.audit(c, models.EventAdminOAuthClientCreate, admin, uuid.Nil, "client="+client.ID)
+
+	c.JSON(iris.Map{
+		"client":        client,
+		"client_secret": secret,
+	})
+}
+
+func (wa *WebApp) ListOAuthClients(c iris.Context) {
+	if _, ok := wa.authorizeGlobalAdmin(c); !ok {
+		return
+	}
+
+	list, err := wa.store(c).OAuth.ListClients(wa.context(c))
+	if err != nil {
+		wa.log(c).Error("oauth clients lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if list == nil {
+		list = []models.OAuthClient{}
+	}
+	c.JSON(list)
+}
+
+// oauthClient authenticates client of token endpoint, writes invalid_client error on failure
+func (wa *WebApp) oauthClient(c iris.Context) (*models.OAuthClient, bool) {
+	id, secret, basic := c.Request().BasicAuth()
+	if basic {
+		// credentials in basic auth are form encoded by RFC 6749
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = c.PostValue("client_id"), c.PostValue("client_secret")
+	}
+
+	client, err := wa.store(c).OAuth.AuthenticateClient(wa.context(c), id, secret)
+	if err != nil {
+		if err == models.ErrClientIncorrect {
+			c.Header("WWW-Authenticate", `Basic realm="crawlyzer"`)
+			oauthError(c, http.StatusUnauthorized, "invalid_client", "")
+			return nil, false
+		}
+		wa.log(c).Error("oauth client authentication failed", "error", err)
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return nil, false
+	}
+	return client, true
+}
+
+// browserSession returns user of the authorize page cookie if it is still valid
+func (wa *WebApp) browserSession(c iris.Context) (uuid.UUID, string) {
+	sesid := c.GetCookie(sessionCookie)
+	if sesid == "" {
+		return uuid.Nil, ""
+	}
+
+	ses, err := wa.store(c).User.AuthSession(wa.context(c), sesid)
+	if err != nil {
+		return uuid.Nil, ""
+	}
+
+	rememberSession(c, ses)
+	return ses.UserID, sesid
+}
+
+func setSessionCookie(c iris.Context, ses *models.Session) {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookie,
+		Value:    ses.ID,
+		Path:     "/oauth",
+		Expires:  ses.ExpiresAt,
+		MaxAge:   int(time.Until(ses.ExpiresAt) / time.Second),
+		HttpOnly: true,
+		Secure:   c.Request().TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// consentCSRF binds consent form to the browser session, other sites don't know its id
+func consentCSRF(sesid, clientID string) string {
+	sum := sha256.Sum256([]byte("consent:" + sesid + ":" + clientID))
+	return hex.EncodeToString(sum[:])
+}
+
+// loginCSRF binds login form to random cookie set on first visit, other sites can't read or set it
+func loginCSRF(nonce, clientID string) string {
+	sum := sha256.Sum256([]byte("login:" + nonce + ":" + clientID))
+	return hex.EncodeToString(sum[:])
+}
+
+// loginNonce returns value of login cookie, setting it when browser has none
+func loginNonce(c iris.Context) (string, error) {
+	nonce := c.GetCookie(loginCookie)
+	if nonce == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		nonce = hex.EncodeToString(b)
+
+		c.SetCookie(&http.Cookie{
+			Name:     loginCookie,
+			Value:    nonce,
+			Path:     "/oauth/authorize",
+			HttpOnly: true,
+			Secure:   c.Request().TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return nonce, nil
+}
+
+func verifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// scopeSubset checks that every scope of requested is in granted
+func scopeSubset(requested, granted string) bool {
+	have := strings.Fields(granted)
+	for _, s := range strings.Fields(requested) {
+		found := false
+		for _, h := range have {
+			found = found || h == s
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// renderOAuthPage shows authorize page, it must not be framed, or clicks on it could be hijacked
+func (wa *WebApp) renderOAuthPage(c iris.Context, code int, data oauthPageData) {
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.StatusCode(code)
+	c.ContentType("text/html")
+	if err := oauthPage.Execute(c, data); err != nil {
+		wa.log(c).Error("oauth page render failed", "error", err)
+	}
+}
+
+func redirectOAuth(c iris.Context, r authorizeRequest, params url.Values) {
+	u, _ := url.Parse(r.RedirectURI)
+
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if r.State != "" {
+		q.Set("state", r.State)
+	}
+	u.RawQuery = q.Encode()
+
+	c.Redirect(u.String(), http.StatusFound)
+}
+
+func redirectOAuthError(c iris.Context, r authorizeRequest, code, description string) {
+	redirectOAuth(c, r, url.Values{
+		"error":             {code},
+		"error_description": {description},
+	})
+}
+
+func oauthError(c iris.Context, status int, code, description string) {
+	c.StatusCode(status)
+
+	res := iris.Map{
+		"error": code,
+	}
+	if description != "" {
+		res["error_description"] = description
+	}
+	c.JSON(res)
+}
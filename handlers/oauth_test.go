@@ -0,0 +1,469 @@
+package handlers
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/iris-contrib/httpexpect"
+	"github.com/kataras/iris"
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// RFC 7636 example pair
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+const testChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+// newNoRedirectExpect is httptest.New which does not follow redirects,
+// authorize endpoint redirects to client's site which we must inspect
+func newNoRedirectExpect(t *testing.T, app *iris.Application) *httpexpect.Expect {
+	_ = app.Build()
+
+	return httpexpect.WithConfig(httpexpect.Config{
+		// cookie jar ignores requests without host
+		BaseURL: "http://auth.local",
+		Client: &http.Client{
+			Transport: httpexpect.NewBinder(app),
+			Jar:       httpexpect.NewJar(),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		Reporter: httpexpect.NewAssertReporter(t),
+	})
+}
+
+func TestOAuthAuthorize(t *testing.T) {
+	Convey("OAuth authorization code flow", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := newNoRedirectExpect(t, InitApp(ds, config.Default(), nil))
+
+		client := &models.OAuthClient{
+			Name:         "Crawlyzer UI",
+			RedirectURIs: []string{"https://app.local/cb"},
+			GrantTypes:   []string{models.GrantAuthorizationCode, models.GrantRefreshToken},
+			Scopes:       []string{"crawl:read", "crawl:write"},
+		}
+		ds.OAuth.CreateClient(context.Background(), client, false)
+
+		params := map[string]interface{}{
+			"response_type":         "code",
+			"client_id":             client.ID,
+			"redirect_uri":          "https://app.local/cb",
+			"scope":                 "crawl:read",
+			"state":                 "xyz",
+			"code_challenge":        testChallenge,
+			"code_challenge_method": "S256",
+		}
+
+		authorize := func(extra map[string]interface{}) *httpexpect.Response {
+			form := map[string]interface{}{}
+			for k, v := range params {
+				form[k] = v
+			}
+			// login form is posted with token of our login cookie unless test passes its own
+			if _, ok := extra["email"]; ok {
+				form["csrf"] = loginCSRF("nonce", client.ID)
+			}
+			for k, v := range extra {
+				form[k] = v
+			}
+			return ex.POST("/oauth/authorize").WithCookie(loginCookie, "nonce").WithForm(form).Expect()
+		}
+
+		Convey("When client is unknown", func() {
+			answer := ex.GET("/oauth/authorize").WithQuery("client_id", "nope").Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("When redirect uri is not registered", func() {
+			answer := authorize(map[string]interface{}{"redirect_uri": "https://evil.local/cb"})
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(answer.Header("Location").Raw(), ShouldBeBlank)
+		})
+
+		Convey("When PKCE is missing", func() {
+			answer := authorize(map[string]interface{}{"code_challenge_method": "plain"})
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusFound)
+			loc, _ := url.Parse(answer.Header("Location").Raw())
+			So(loc.Query().Get("error"), ShouldEqual, "invalid_request")
+			So(loc.Query().Get("state"), ShouldEqual, "xyz")
+		})
+
+		Convey("When scope is not allowed", func() {
+			answer := authorize(map[string]interface{}{"scope": "billing"})
+
+			loc, _ := url.Parse(answer.Header("Location").Raw())
+			So(loc.Query().Get("error"), ShouldEqual, "invalid_scope")
+		})
+
+		Convey("When not signed in", func() {
+			answer := ex.GET("/oauth/authorize").WithQueryObject(params).Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+			So(answer.Body().Raw(), ShouldContainSubstring, `name="password"`)
+
+			Convey("Page must not be framed", func() {
+				So(answer.Header("X-Frame-Options").Raw(), ShouldEqual, "DENY")
+				So(answer.Header("Content-Security-Policy").Raw(), ShouldEqual, "frame-ancestors 'none'")
+			})
+
+			Convey("Login form must carry token of login cookie", func() {
+				nonce := answer.Cookie(loginCookie).Value().Raw()
+				So(nonce, ShouldNotBeBlank)
+				So(answer.Body().Raw(), ShouldContainSubstring, loginCSRF(nonce, client.ID))
+			})
+		})
+
+		Convey("When login form is posted from other site", func() {
+			answer := authorize(map[string]interface{}{"email": "gop@sup.com", "password": "SuperPassword", "csrf": "forged"})
+
+			Convey("User must not be signed in", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+				So(answer.Raw().Header.Get("Set-Cookie"), ShouldNotContainSubstring, sessionCookie)
+				So(ds.Audit.(*models_mock.MAuditStore).Types(), ShouldNotContain, models.EventLoginSuccess)
+			})
+		})
+
+		Convey("When password is incorrect", func() {
+			ds.User.(*models_mock.MUserStore).FakeError = models.ErrLoginIncorrect
+			answer := authorize(map[string]interface{}{"email": "gop@sup.com", "password": "BadPassword"})
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			So(answer.Body().Raw(), ShouldContainSubstring, "incorrect email or password")
+		})
+
+		Convey("When browser session is impersonated", func() {
+			authorize(map[string]interface{}{"email": "gop@sup.com", "password": "SuperPassword"})
+			admin := uuid.FromStringOrNil("6e536fff-bcaf-4ca9-a067-352bafeb6ed2")
+			ds.User.(*models_mock.MUserStore).ImpersonatedBy = &admin
+
+			answer := authorize(map[string]interface{}{
+				"consent": "approve",
+				"csrf":    consentCSRF("6e536fff-baaf-4ca7-a067-352bafeb6ee3", client.ID),
+			})
+
+			Convey("Consent must not be granted", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+				So(answer.Raw().Header.Get("Location"), ShouldBeBlank)
+				So(ds.Audit.(*models_mock.MAuditStore).Types(), ShouldNotContain, models.EventOAuthConsent)
+			})
+		})
+
+		Convey("When signed in", func() {
+			answer := authorize(map[string]interface{}{"email": "gop@sup.com", "password": "SuperPassword"})
+			csrf := consentCSRF("6e536fff-baaf-4ca7-a067-352bafeb6ee3", client.ID)
+
+			Convey("Must ask for consent", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+				So(answer.Cookie(sessionCookie).Value().Raw(), ShouldEqual, "6e536fff-baaf-4ca7-a067-352bafeb6ee3")
+				So(answer.Body().Raw(), ShouldContainSubstring, csrf)
+			})
+
+			Convey("When consent is forged", func() {
+				answer := authorize(map[string]interface{}{"consent": "approve", "csrf": "forged"})
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			})
+
+			Convey("When denied", func() {
+				answer := authorize(map[string]interface{}{"consent": "deny", "csrf": csrf})
+
+				loc, _ := url.Parse(answer.Header("Location").Raw())
+				So(loc.Query().Get("error"), ShouldEqual, "access_denied")
+			})
+
+			Convey("When approved", func() {
+				answer := authorize(map[string]interface{}{"consent": "approve", "csrf": csrf})
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusFound)
+				loc, _ := url.Parse(answer.Header("Location").Raw())
+				So(loc.Host, ShouldEqual, "app.local")
+				So(loc.Query().Get("code"), ShouldNotBeBlank)
+				So(loc.Query().Get("state"), ShouldEqual, "xyz")
+
+				Convey("Next time consent must be skipped", func() {
+					answer := ex.GET("/oauth/authorize").WithQueryObject(params).Expect()
+
+					So(answer.Raw().StatusCode, ShouldEqual, http.StatusFound)
+				})
+			})
+		})
+	})
+}
+
+func TestOAuthToken(t *testing.T) {
+	Convey("OAuth token endpoint", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		public := &models.OAuthClient{
+			Name:         "Crawlyzer UI",
+			RedirectURIs: []string{"https://app.local/cb"},
+			GrantTypes:   []string{models.GrantAuthorizationCode, models.GrantRefreshToken},
+			Scopes:       []string{"crawl:read", "crawl:write"},
+		}
+		ds.OAuth.CreateClient(context.Background(), public, false)
+
+		service := &models.OAuthClient{
+			Name:       "Crawler",
+			GrantTypes: []string{models.GrantClientCredentials},
+			Scopes:     []string{"crawl:read"},
+		}
+		secret, _ := ds.OAuth.CreateClient(context.Background(), service, true)
+
+		code, _ := ds.OAuth.CreateCode(context.Background(), models.AuthCode{
+			ClientID:      public.ID,
+			UserID:        models_mock.TestUUID,
+			RedirectURI:   "https://app.local/cb",
+			Scope:         "crawl:read crawl:write",
+			CodeChallenge: testChallenge,
+		})
+
+		exchange := map[string]interface{}{
+			"grant_type":    models.GrantAuthorizationCode,
+			"client_id":     public.ID,
+			"code":          code,
+			"redirect_uri":  "https://app.local/cb",
+			"code_verifier": testVerifier,
+		}
+
+		Convey("When grant type is unknown", func() {
+			answer := ex.POST("/oauth/token").WithForm(map[string]interface{}{
+				"grant_type": "password",
+				"client_id":  public.ID,
+			}).Expect().JSON().Object()
+
+			So(answer.Value("error").String().Raw(), ShouldEqual, "unsupported_grant_type")
+		})
+
+		Convey("When verifier is wrong", func() {
+			exchange["code_verifier"] = "wrong-verifier-wrong-verifier-wrong-verifier"
+			answer := ex.POST("/oauth/token").WithForm(exchange).Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(answer.JSON().Object().Value("error").String().Raw(), ShouldEqual, "invalid_grant")
+		})
+
+		Convey("When code is exchanged", func() {
+			answer := ex.POST("/oauth/token").WithForm(exchange).Expect()
+			tok := answer.JSON().Object()
+
+			Convey("Must return tokens", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+				So(answer.Header("Cache-Control").Raw(), ShouldEqual, "no-store")
+				So(tok.Value("access_token").String().Raw(), ShouldNotEqual, models_mock.TestSession)
+				So(ex.POST("/user/auth").WithFormField("sesid", tok.Value("access_token").String().Raw()).
+					Expect().Raw().StatusCode, ShouldEqual, http.StatusOK)
+				So(tok.Value("token_type").String().Raw(), ShouldEqual, "Bearer")
+				So(tok.Value("scope").String().Raw(), ShouldEqual, "crawl:read crawl:write")
+			})
+
+			Convey("Code must not be reused", func() {
+				answer := ex.POST("/oauth/token").WithForm(exchange).Expect().JSON().Object()
+
+				So(answer.Value("error").String().Raw(), ShouldEqual, "invalid_grant")
+			})
+
+			Convey("When refreshed with narrower scope", func() {
+				refresh := tok.Value("refresh_token").String().Raw()
+				answer := ex.POST("/oauth/token").WithForm(map[string]interface{}{
+					"grant_type":    models.GrantRefreshToken,
+					"client_id":     public.ID,
+					"refresh_token": refresh,
+					"scope":         "crawl:read",
+				}).Expect().JSON().Object()
+
+				So(answer.Value("scope").String().Raw(), ShouldEqual, "crawl:read")
+				So(answer.Value("refresh_token").String().Raw(), ShouldNotEqual, refresh)
+
+				Convey("Old refresh token must be revoked", func() {
+					answer := ex.POST("/oauth/token").WithForm(map[string]interface{}{
+						"grant_type":    models.GrantRefreshToken,
+						"client_id":     public.ID,
+						"refresh_token": refresh,
+					}).Expect().JSON().Object()
+
+					So(answer.Value("error").String().Raw(), ShouldEqual, "invalid_grant")
+				})
+			})
+
+			Convey("When refreshed with wider scope", func() {
+				answer := ex.POST("/oauth/token").WithForm(map[string]interface{}{
+					"grant_type":    models.GrantRefreshToken,
+					"client_id":     public.ID,
+					"refresh_token": tok.Value("refresh_token").String().Raw(),
+					"scope":         "crawl:read billing",
+				}).Expect().JSON().Object()
+
+				So(answer.Value("error").String().Raw(), ShouldEqual, "invalid_scope")
+			})
+		})
+
+		Convey("When client credentials are used", func() {
+			answer := ex.POST("/oauth/token").WithBasicAuth(service.ID, secret).WithForm(map[string]interface{}{
+				"grant_type": models.GrantClientCredentials,
+			}).Expect().JSON().Object()
+
+			So(answer.Value("access_token").String().Raw(), ShouldNotBeBlank)
+			So(answer.Value("scope").String().Raw(), ShouldEqual, "crawl:read")
+			So(answer.Raw()["refresh_token"], ShouldBeNil)
+		})
+
+		Convey("When client secret is wrong", func() {
+			answer := ex.POST("/oauth/token").WithBasicAuth(service.ID, "wrong").WithForm(map[string]interface{}{
+				"grant_type": models.GrantClientCredentials,
+			}).Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusUnauthorized)
+			So(answer.JSON().Object().Value("error").String().Raw(), ShouldEqual, "invalid_client")
+		})
+
+		Convey("When public client asks for client credentials", func() {
+			answer := ex.POST("/oauth/token").WithForm(map[string]interface{}{
+				"grant_type": models.GrantClientCredentials,
+				"client_id":  public.ID,
+			}).Expect().JSON().Object()
+
+			So(answer.Value("error").String().Raw(), ShouldEqual, "unauthorized_client")
+		})
+	})
+}
+
+func TestOAuthClients(t *testing.T) {
+	Convey("OAuth clients registration", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+		ds.User.(*models_mock.MUserStore).Admin = true
+
+		forms := []map[string]interface{}{{
+			"name":        "UI",
+			"grant_types": "implicit",
+			"mustbe":      "unknown grant type implicit",
+		}, {
+			"name":        "UI",
+			"grant_types": models.GrantAuthorizationCode,
+			"mustbe":      "no redirect uris",
+		}, {
+			"name":          "UI",
+			"grant_types":   models.GrantAuthorizationCode,
+			"redirect_uris": "/cb",
+			"mustbe":        "bad redirect uri /cb",
+		}, {
+			"name":        "Crawler",
+			"grant_types": models.GrantClientCredentials,
+			"mustbe":      "client_credentials requires confidential client",
+		}}
+
+		for _, variant := range forms {
+			Convey("Test when invalid: "+variant["mustbe"].(string), func() {
+				answer := ex.POST("/oauth/clients").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithForm(variant).Expect().JSON().Object()
+
+				So(answer.Value("error").String().Raw(), ShouldEqual, variant["mustbe"].(string))
+			})
+		}
+
+		Convey("When valid", func() {
+			answer := ex.POST("/oauth/clients").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				WithForm(map[string]interface{}{
+					"name":         "Crawler",
+					"grant_types":  models.GrantClientCredentials,
+					"scopes":       "crawl:read crawl:write",
+					"confidential": "true",
+				}).Expect().JSON().Object()
+
+			So(answer.Value("client_secret").String().Raw(), ShouldNotBeBlank)
+			So(answer.Value("client").Object().Value("scopes").Array().Length().Raw(), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestOAuthIntrospect(t *testing.T) {
+	Convey("OAuth token introspection and revocation", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		gateway := &models.OAuthClient{
+			Name:       "Gateway",
+			GrantTypes: []string{models.GrantClientCredentials},
+			Scopes:     []string{"crawl:read"},
+		}
+		secret, _ := ds.OAuth.CreateClient(context.Background(), gateway, true)
+
+		public := &models.OAuthClient{
+			Name:         "Crawlyzer UI",
+			RedirectURIs: []string{"https://app.local/cb"},
+			GrantTypes:   []string{models.GrantAuthorizationCode, models.GrantRefreshToken},
+			Scopes:       []string{"crawl:read"},
+		}
+		ds.OAuth.CreateClient(context.Background(), public, false)
+
+		tok, _ := ds.OAuth.IssueToken(context.Background(), models.OAuthGrant{ClientID: public.ID, UserID: models_mock.TestUUID, Scope: "crawl:read"},
+			"user-access", true)
+
+		introspect := func(token string) *httpexpect.Object {
+			return ex.POST("/oauth/introspect").WithBasicAuth(gateway.ID, secret).
+				WithFormField("token", token).Expect().JSON().Object()
+		}
+
+		Convey("When client is public", func() {
+			answer := ex.POST("/oauth/introspect").WithFormField("client_id", public.ID).
+				WithFormField("token", tok.AccessToken).Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("When token is unknown", func() {
+			answer := introspect("nope")
+
+			So(answer.Value("active").Boolean().Raw(), ShouldBeFalse)
+			So(answer.Raw()["sub"], ShouldBeNil)
+		})
+
+		Convey("When access token is issued", func() {
+			answer := introspect(tok.AccessToken)
+
+			So(answer.Value("active").Boolean().Raw(), ShouldBeTrue)
+			So(answer.Value("sub").String().Raw(), ShouldEqual, models_mock.TestUUID.String())
+			So(answer.Value("client_id").String().Raw(), ShouldEqual, public.ID)
+			So(answer.Value("scope").String().Raw(), ShouldEqual, "crawl:read")
+			So(answer.Value("exp").Number().Raw(), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("When token is a plain session", func() {
+			answer := introspect("6e536fff-baaf-4ca7-a067-352bafeb6ee3")
+
+			So(answer.Value("active").Boolean().Raw(), ShouldBeTrue)
+			So(answer.Value("sub").String().Raw(), ShouldEqual, models_mock.TestUUID.String())
+			So(answer.Raw()["client_id"], ShouldBeNil)
+		})
+
+		Convey("When other client revokes token", func() {
+			answer := ex.POST("/oauth/revoke").WithBasicAuth(gateway.ID, secret).
+				WithFormField("token", tok.AccessToken).Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+			So(introspect(tok.AccessToken).Value("active").Boolean().Raw(), ShouldBeTrue)
+		})
+
+		Convey("When owner revokes tokens", func() {
+			for _, token := range []string{tok.AccessToken, tok.RefreshToken} {
+				answer := ex.POST("/oauth/revoke").WithFormField("client_id", public.ID).
+					WithFormField("token", token).Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+				So(introspect(token).Value("active").Boolean().Raw(), ShouldBeFalse)
+			}
+			So(ds.Audit.(*models_mock.MAuditStore).Types(), ShouldResemble, []string{models.EventOAuthRevoke, models.EventOAuthRevoke})
+		})
+	})
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeOpenID = "openid"
+	ScopeEmail  = "email"
+)
+
+type idTokenClaims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Audience      string `json:"aud"`
+	ExpiresAt     int64  `json:"exp"`
+	IssuedAt      int64  `json:"iat"`
+	AuthTime      int64  `json:"auth_time,omitempty"`
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// OIDCDiscovery describes our provider for relying parties
+func (wa *WebApp) OIDCDiscovery(c iris.Context) {
+	iss := wa.issuer()
+
+	c.JSON(iris.Map{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/oauth/authorize",
+		"token_endpoint":                        iss + "/oauth/token",
+		"userinfo_endpoint":                     iss + "/userinfo",
+		"jwks_uri":                              iss + "/.well-known/jwks.json",
+		"introspection_endpoint":                iss + "/oauth/introspect",
+		"revocation_endpoint":                   iss + "/oauth/revoke",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{models.GrantAuthorizationCode, models.GrantRefreshToken, models.GrantClientCredentials},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{ScopeOpenID, ScopeEmail},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified"},
+	})
+}
+
+func (wa *WebApp) JWKS(c iris.Context) {
+	// makes sure there is a key to publish before the first token is signed
+	if _, err := wa.Store.Keys.SigningKey(wa.context(c)); err != nil {
+		wa.log(c).Error("signing key lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	keys, err := wa.Store.Keys.PublicKeys(wa.context(c))
+	if err != nil {
+		wa.log(c).Error("jwks lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	res := []models.JWK{}
+	for _, k := range keys {
+		res = append(res, k.JWK())
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(iris.Map{
+		"keys": res,
+	})
+}
+
+// UserInfo returns claims of the user who owns bearer access token with openid scope
+func (wa *WebApp) UserInfo(c iris.Context) {
+	token := bearerToken(c)
+
+	g, err := wa.store(c).OAuth.GetAccessToken(wa.context(c), token)
+	if err != nil {
+		if err == models.ErrGrantIncorrect {
+			bearerError(c, http.StatusUnauthorized, "invalid_token")
+			return
+		}
+		wa.log(c).Error("access token lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if g.UserID == uuid.Nil || !hasScope(g.Scope, ScopeOpenID) {
+		bearerError(c, http.StatusForbidden, "insufficient_scope")
+		return
+	}
+
+	// access token is a session, it could be killed by logout or deletion
+	if _, err = wa.store(c).User.Auth(wa.context(c), token); err != nil {
+		bearerError(c, http.StatusUnauthorized, "invalid_token")
+		return
+	}
+
+	u, err := wa.store(c).User.Get(wa.context(c), g.UserID)
+	if err != nil || u.DeletedAt != nil {
+		bearerError(c, http.StatusUnauthorized, "invalid_token")
+		return
+	}
+
+	res := iris.Map{
+		"sub": u.ID.String(),
+	}
+	if hasScope(g.Scope, ScopeEmail) {
+		res["email"] = u.Email
+		res["email_verified"] = false
+	}
+	c.JSON(res)
+}
+
+// idToken signs ID token for the client, authTime is zero when it is unknown
+func (wa *WebApp) idToken(ctx context.Context, clientID string, u *models.User, scope, nonce string, authTime time.Time) (string, error) {
+	key, err := wa.Store.Keys.SigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := idTokenClaims{
+		Issuer:    wa.issuer(),
+		Subject:   u.ID.String(),
+		Audience:  clientID,
+		ExpiresAt: now.Add(models.SessionTTL).Unix(),
+		IssuedAt:  now.Unix(),
+		Nonce:     nonce,
+	}
+
+	if !authTime.IsZero() {
+		claims.AuthTime = authTime.Unix()
+	}
+
+	if hasScope(scope, ScopeEmail) {
+		// we have no email verification yet
+		verified := false
+		claims.Email, claims.EmailVerified = u.Email, &verified
+	}
+
+	return key.Sign(claims)
+}
+
+// issuer is taken only from config, request headers are controlled by client
+func (wa *WebApp) issuer() string {
+	return strings.TrimSuffix(wa.Config.OIDCIssuer, "/")
+}
+
+func bearerToken(c iris.Context) string {
+	h := c.GetHeader("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return c.PostValue("access_token")
+}
+
+func bearerError(c iris.Context, status int, code string) {
+	c.Header("WWW-Authenticate", `Bearer error="`+code+`"`)
+	ThrowError(c, status, code)
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
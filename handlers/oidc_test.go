@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// verifyJWT checks RS256 signature with JWK and returns claims
+func verifyJWT(token string, key map[string]interface{}) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, rsa.ErrVerification
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(key["n"].(string))
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(key["e"].(string))
+	if err != nil {
+		return nil, err
+	}
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	return claims, json.Unmarshal(payload, &claims)
+}
+
+// oidcConfig is default config with openid provider enabled
+func oidcConfig() *config.Config {
+	conf := config.Default()
+	conf.OIDCEnabled = true
+	conf.OIDCIssuer = "https://auth.crawlyzer.test/"
+	return conf
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	Convey("OpenID provider metadata", t, func() {
+		ex := httptest.New(t, InitApp(models_mock.InitMockStore(), oidcConfig(), nil))
+
+		Convey("Must describe endpoints", func() {
+			answer := ex.GET("/.well-known/openid-configuration").Expect().JSON().Object()
+
+			iss := answer.Value("issuer").String().Raw()
+			So(iss, ShouldEqual, "https://auth.crawlyzer.test")
+			So(answer.Value("jwks_uri").String().Raw(), ShouldEqual, iss+"/.well-known/jwks.json")
+			So(answer.Value("id_token_signing_alg_values_supported").Array().First().String().Raw(), ShouldEqual, "RS256")
+		})
+
+		Convey("When request claims other host", func() {
+			answer := ex.GET("/.well-known/openid-configuration").
+				WithHeader("Host", "evil.test").WithHeader("X-Forwarded-Proto", "http").
+				Expect().JSON().Object()
+
+			Convey("Issuer must stay configured one", func() {
+				So(answer.Value("issuer").String().Raw(), ShouldEqual, "https://auth.crawlyzer.test")
+				So(answer.Value("token_endpoint").String().Raw(), ShouldEqual, "https://auth.crawlyzer.test/oauth/token")
+			})
+		})
+
+		Convey("Must publish signing key", func() {
+			answer := ex.GET("/.well-known/jwks.json").Expect().JSON().Object()
+			key := answer.Value("keys").Array().First().Object()
+
+			So(key.Value("kty").String().Raw(), ShouldEqual, "RSA")
+			So(key.Value("alg").String().Raw(), ShouldEqual, "RS256")
+			So(key.Value("kid").String().Raw(), ShouldNotBeBlank)
+		})
+	})
+}
+
+func TestOIDCIDToken(t *testing.T) {
+	Convey("OpenID Connect tokens", t, func() {
+		ds := models_mock.InitMockStore()
+		conf := oidcConfig()
+		ex := httptest.New(t, InitApp(ds, conf, nil))
+
+		client := &models.OAuthClient{
+			Name:         "Crawlyzer UI",
+			RedirectURIs: []string{"https://app.local/cb"},
+			GrantTypes:   []string{models.GrantAuthorizationCode},
+			Scopes:       []string{"openid", "email", "crawl:read"},
+		}
+		ds.OAuth.CreateClient(context.Background(), client, false)
+
+		exchange := func(scope string) map[string]interface{} {
+			code, _ := ds.OAuth.CreateCode(context.Background(), models.AuthCode{
+				ClientID:      client.ID,
+				UserID:        models_mock.TestUUID,
+				RedirectURI:   "https://app.local/cb",
+				Scope:         scope,
+				CodeChallenge: testChallenge,
+				Nonce:         "n-0S6_WzA2Mj",
+			})
+
+			return ex.POST("/oauth/token").WithForm(map[string]interface{}{
+				"grant_type":    models.GrantAuthorizationCode,
+				"client_id":     client.ID,
+				"code":          code,
+				"redirect_uri":  "https://app.local/cb",
+				"code_verifier": testVerifier,
+			}).Expect().JSON().Object().Raw()
+		}
+
+		Convey("When openid is not requested", func() {
+			tok := exchange("crawl:read")
+
+			So(tok["id_token"], ShouldBeNil)
+		})
+
+		Convey("When openid is requested", func() {
+			tok := exchange("openid email")
+			iss := ex.GET("/.well-known/openid-configuration").Expect().JSON().Object().Value("issuer").String().Raw()
+			key := ex.GET("/.well-known/jwks.json").Expect().JSON().Object().Value("keys").Array().First().Object().Raw()
+
+			claims, err := verifyJWT(tok["id_token"].(string), key)
+
+			Convey("Must be signed with published key", func() {
+				So(err, ShouldBeNil)
+				So(claims["iss"], ShouldEqual, iss)
+				So(claims["sub"], ShouldEqual, models_mock.TestUUID.String())
+				So(claims["aud"], ShouldEqual, client.ID)
+				So(claims["nonce"], ShouldEqual, "n-0S6_WzA2Mj")
+				So(claims["email"], ShouldEqual, "tester@exter.com")
+			})
+
+			Convey("Userinfo must return claims", func() {
+				answer := ex.GET("/userinfo").WithHeader("Authorization", "Bearer "+tok["access_token"].(string)).
+					Expect().JSON().Object()
+
+				So(answer.Value("sub").String().Raw(), ShouldEqual, models_mock.TestUUID.String())
+				So(answer.Value("email").String().Raw(), ShouldEqual, "tester@exter.com")
+			})
+		})
+
+		Convey("When oidc is disabled", func() {
+			conf.OIDCEnabled = false
+			ex := httptest.New(t, InitApp(ds, conf, nil))
+
+			Convey("Provider must not be served", func() {
+				ex.GET("/.well-known/openid-configuration").Expect().Status(http.StatusNotFound)
+				ex.GET("/.well-known/jwks.json").Expect().Status(http.StatusNotFound)
+			})
+
+			Convey("ID token must not be issued", func() {
+				code, _ := ds.OAuth.CreateCode(context.Background(), models.AuthCode{
+					ClientID:      client.ID,
+					UserID:        models_mock.TestUUID,
+					RedirectURI:   "https://app.local/cb",
+					Scope:         "openid",
+					CodeChallenge: testChallenge,
+				})
+
+				tok := ex.POST("/oauth/token").WithForm(map[string]interface{}{
+					"grant_type":    models.GrantAuthorizationCode,
+					"client_id":     client.ID,
+					"code":          code,
+					"redirect_uri":  "https://app.local/cb",
+					"code_verifier": testVerifier,
+				}).Expect().JSON().Object().Raw()
+
+				So(tok["access_token"], ShouldNotBeNil)
+				So(tok["id_token"], ShouldBeNil)
+			})
+		})
+
+		Convey("When userinfo token is unknown", func() {
+			answer := ex.GET("/userinfo").WithHeader("Authorization", "Bearer nope").Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusUnauthorized)
+			So(answer.Header("WWW-Authenticate").Raw(), ShouldContainSubstring, "invalid_token")
+		})
+
+		Convey("When userinfo token has no openid scope", func() {
+			tok := exchange("crawl:read")
+			answer := ex.GET("/userinfo").WithHeader("Authorization", "Bearer "+tok["access_token"].(string)).Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func (wa *WebApp) CreateOrg(c iris.Context) {
+	id, ok := wa.authorize(c, models.ScopeAccount)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(c.PostValue("name"))
+	if name == "" || len(name) > 100 {
+		ThrowError(c, http.StatusBadRequest, "bad name")
+		return
+	}
+
+	o, err := wa.store(c).Org.Create(wa.context(c), name, id)
+	if err != nil {
+		wa.log(c).Error("organization creation failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	wa.audit(c, models.EventOrgCreate, id, id, "org="+o.ID.String())
+
+	c.JSON(iris.Map{
+		"organization": o,
+	})
+}
+
+func (wa *WebApp) ListOrgs(c iris.Context) {
+	id, ok := wa.authorize(c)
+	if !ok {
+		return
+	}
+
+	list, err := wa.memberships(c, id)
+	if err != nil {
+		wa.log(c).Error("organizations lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+	c.JSON(list)
+}
+
+func (wa *WebApp) ListMembers(c iris.Context) {
+	id, ok := wa.authorize(c)
+	if !ok {
+		return
+	}
+
+	org, _, ok := wa.orgRole(c, id)
+	if !ok {
+		return
+	}
+
+	list, err := wa.store(c).Org.Members(wa.context(c), org)
+	if err != nil {
+		wa.log(c).Error("members lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if list == nil {
+		list = []models.Member{}
+	}
+	c.JSON(list)
+}
+
+// InviteMember creates invitation and mails its token to the invited email,
+// the inviter never sees the token
+func (wa *WebApp) InviteMember(c iris.Context) {
+	id, ok := wa.authorize(c, models.ScopeAccount)
+	if !ok {
+		return
+	}
+
+	org, role, ok := wa.orgRole(c, id)
+	if !ok {
+		return
+	}
+
+	if role != models.RoleOwner && role != models.RoleAdmin {
+		ThrowError(c, http.StatusForbidden, "owner or admin only")
+		return
+	}
+
+	if !wa.Config.Mail.Enabled() {
+		ThrowError(c, http.StatusServiceUnavailable, "email delivery is not configured")
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(c.PostValue("email")))
+	if !emailRegex.MatchString(email) {
+		ThrowError(c, http.StatusBadRequest, "bad email")
+		return
+	}
+
+	invRole := c.PostValue("role")
+	if invRole == "" {
+		invRole = models.RoleMember
+	}
+
+	if !models.ValidRole(invRole) {
+		ThrowError(c, http.StatusBadRequest, "bad role")
+		return
+	}
+
+	if invRole == models.RoleOwner && role != models.RoleOwner {
+		ThrowError(c, http.StatusForbidden, "only owner can invite owners")
+		return
+	}
+
+	o, err := wa.store(c).Org.Get(wa.context(c), org)
+	if err != nil {
+		wa.log(c).Error("organization lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	inv, token, err := wa.store(c).Org.Invite(wa.context(c), org, email, invRole, id)
+	if err != nil {
+		wa.log(c).Error("invitation failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	// invitation without mail is harmless, its token is known to nobody
+	m, err := wa.invitationMail(o.Name, inv, token)
+	if err == nil {
+		err = wa.Store.Mail.Enqueue(wa.context(c), m)
+	}
+	if err != nil {
+		wa.log(c).Error("invitation mail failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	details := "org=" + org.String() + " role=" + invRole
+	if e := wa.auditEmail(email); e != "" {
+		details += " " + e
+	}
+	wa.audit(c, models.EventOrgInvite, id, uuid.Nil, details)
+
+	c.JSON(iris.Map{
+		"invitation": inv,
+	})
+}
+
+// AcceptInvitation joins user to organization, token is mailed only to invited email,
+// so holding it proves the address: signed in user must have that email,
+// without session account for it is created with given password
+func (wa *WebApp) AcceptInvitation(c iris.Context) {
+	token := c.PostValue("token")
+
+	inv, err := wa.store(c).Org.Invitation(wa.context(c), token)
+	if err != nil {
+		if err == models.ErrInvitationIncorrect {
+			ThrowError(c, http.StatusForbidden, "incorrect invitation")
+			return
+		}
+		wa.log(c).Error("invitation lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	var m *models.Membership
+	var ses *models.Session
+	if sessionID(c) != "" || models.IsAPIKey(bearerToken(c)) {
+		id, ok := wa.authorizeSensitive(c)
+		if !ok {
+			return
+		}
+
+		u, err := wa.store(c).User.Get(wa.context(c), id)
+		if err != nil {
+			wa.log(c).Error("user lookup failed", "error", err)
+			ThrowError(c, http.StatusInternalServerError, "server error")
+			return
+		}
+
+		if !strings.EqualFold(u.Email, inv.Email) {
+			ThrowError(c, http.StatusForbidden, "invitation is for another email")
+			return
+		}
+
+		if m, err = wa.store(c).Org.Accept(wa.context(c), token, id); err != nil {
+			wa.acceptFailed(c, err)
+			return
+		}
+	} else {
+		pw := c.PostValue("password")
+		if len(pw) < 8 {
+			ThrowError(c, http.StatusBadRequest, "bad password")
+			return
+		}
+
+		// account is created in one transaction with membership, failed acceptance leaves no account
+		if m, err = wa.store(c).Org.AcceptAsNew(wa.context(c), token, pw); err != nil {
+			wa.acceptFailed(c, err)
+			return
+		}
+
+		wa.audit(c, models.EventRegister, m.UserID, m.UserID, "invitation="+inv.ID.String())
+
+		if ses, err = wa.store(c).User.Login(wa.context(c), inv.Email, pw); err != nil {
+			wa.log(c).Error("login failed", "error", err)
+			ThrowError(c, http.StatusInternalServerError, "server error")
+			return
+		}
+	}
+
+	wa.audit(c, models.EventOrgJoin, m.UserID, m.UserID, "org="+m.OrgID.String()+" role="+m.Role)
+
+	res := iris.Map{
+		"membership": m,
+	}
+	if ses != nil {
+		res["session"] = ses.ID
+	}
+	c.JSON(res)
+}
+
+// acceptFailed answers with the reason invitation was not accepted
+func (wa *WebApp) acceptFailed(c iris.Context, err error) {
+	switch err {
+	case models.ErrInvitationIncorrect:
+		ThrowError(c, http.StatusForbidden, "incorrect invitation")
+	case models.ErrAlreadyMember:
+		ThrowError(c, http.StatusConflict, "already a member")
+	case models.ErrAlreadyCreated:
+		ThrowError(c, http.StatusConflict, "account already exists, sign in to accept")
+	default:
+		wa.log(c).Error("invitation acceptance failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+	}
+}
+
+// RemoveMember removes member, owners and admins can remove others, anyone can leave,
+// admins can't remove owners
+func (wa *WebApp) RemoveMember(c iris.Context) {
+	id, ok := wa.authorize(c, models.ScopeAccount)
+	if !ok {
+		return
+	}
+
+	org, role, ok := wa.orgRole(c, id)
+	if !ok {
+		return
+	}
+
+	target := uuid.FromStringOrNil(c.Params().Get("user"))
+	if target == uuid.Nil {
+		ThrowError(c, http.StatusNotFound, "member not found")
+		return
+	}
+
+	if target != id {
+		targetRole, err := wa.store(c).Org.Role(wa.context(c), org, target)
+		if err != nil {
+			if err == models.ErrNotMember {
+				ThrowError(c, http.StatusNotFound, "member not found")
+				return
+			}
+			wa.log(c).Error("member role lookup failed", "error", err)
+			ThrowError(c, http.StatusInternalServerError, "server error")
+			return
+		}
+
+		if role != models.RoleOwner && (role != models.RoleAdmin || targetRole == models.RoleOwner) {
+			ThrowError(c, http.StatusForbidden, "not enough rights")
+			return
+		}
+	}
+
+	err := wa.store(c).Org.RemoveMember(wa.context(c), org, target)
+	if err != nil {
+		switch err {
+		case models.ErrNotMember:
+			ThrowError(c, http.StatusNotFound, "member not found")
+		case models.ErrLastOwner:
+			ThrowError(c, http.StatusConflict, "organization must have an owner")
+		default:
+			wa.log(c).Error("member removal failed", "error", err)
+			ThrowError(c, http.StatusInternalServerError, "server error")
+		}
+		return
+	}
+
+	wa.audit(c, models.EventOrgMemberRemove, id, target, "org="+org.String())
+
+	c.JSON(iris.Map{
+		"success": true,
+	})
+}
+
+// orgRole returns organization from path and role of the user in it,
+// organization is not found for non members
+func (wa *WebApp) orgRole(c iris.Context, userID uuid.UUID) (uuid.UUID, string, bool) {
+	org := uuid.FromStringOrNil(c.Params().Get("id"))
+	if org == uuid.Nil {
+		ThrowError(c, http.StatusNotFound, "organization not found")
+		return uuid.Nil, "", false
+	}
+
+	role, err := wa.store(c).Org.Role(wa.context(c), org, userID)
+	if err != nil {
+		if err == models.ErrNotMember {
+			ThrowError(c, http.StatusNotFound, "organization not found")
+			return uuid.Nil, "", false
+		}
+		wa.log(c).Error("role lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return uuid.Nil, "", false
+	}
+	return org, role, true
+}
+
+func (wa *WebApp) memberships(c iris.Context, userID uuid.UUID) ([]models.Membership, error) {
+	list, err := wa.store(c).Org.Memberships(wa.context(c), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if list == nil {
+		list = []models.Membership{}
+	}
+	return list, nil
+}
+
+// invitationMail makes email with link to invite page carrying the token
+func (wa *WebApp) invitationMail(orgName string, inv *models.Invitation, token string) (models.Mail, error) {
+	link, err := url.Parse(wa.Config.Mail.InviteURL)
+	if err != nil {
+		return models.Mail{}, err
+	}
+
+	q := link.Query()
+	q.Set("token", token)
+	link.RawQuery = q.Encode()
+
+	return models.Mail{
+		To:      inv.Email,
+		Subject: "Invitation to " + orgName,
+		Body: "You are invited to join " + orgName + " as " + inv.Role + ".\n\n" +
+			"Accept the invitation: " + link.String() + "\n\n" +
+			"The link expires on " + inv.ExpiresAt.UTC().Format("2 Jan 2006 15:04 MST") + ", " +
+			"ignore this email if you don't expect it.\n",
+	}, nil
+}
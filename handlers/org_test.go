@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"testing"
+)
+
+func TestOrgs(t *testing.T) {
+	Convey("Organizations", t, func() {
+		ds := models_mock.InitMockStore()
+		conf := config.Default()
+		conf.Mail = config.Mail{SMTPAddr: "smtp.local:587", From: "auth@crawlyzer.io", InviteURL: "https://app.crawlyzer.io/invite"}
+		ex := httptest.New(t, InitApp(ds, conf, nil))
+		orgs := ds.Org.(*models_mock.MOrgStore)
+		mails := ds.Mail.(*models_mock.MMailStore)
+		other := uuid.FromStringOrNil("0b5e0b0e-7d8b-4ac2-93f8-37c5e7f0f6aa")
+
+		Convey("When org is created", func() {
+			answer := ex.POST("/orgs").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				WithFormField("name", "Crawl Team").Expect().JSON().Object()
+			id := answer.Value("organization").Object().Value("id").String().Raw()
+
+			Convey("Creator must be its owner", func() {
+				auth := ex.POST("/user/auth").WithFormField("sesid", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					Expect().JSON().Object()
+				org := auth.Value("orgs").Array().First().Object()
+
+				So(org.Value("org_id").String().Raw(), ShouldEqual, id)
+				So(org.Value("name").String().Raw(), ShouldEqual, "Crawl Team")
+				So(org.Value("role").String().Raw(), ShouldEqual, models.RoleOwner)
+			})
+
+			forms := []map[string]interface{}{{
+				"email":  "bad",
+				"role":   models.RoleMember,
+				"mustbe": "bad email",
+			}, {
+				"email":  "gop@sup.com",
+				"role":   "root",
+				"mustbe": "bad role",
+			}}
+
+			for _, variant := range forms {
+				Convey("Test when invitation is invalid: "+variant["mustbe"].(string), func() {
+					answer := ex.POST("/orgs/"+id+"/invitations").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+						WithForm(variant).Expect().JSON().Object()
+
+					So(answer.Value("error").String().Raw(), ShouldEqual, variant["mustbe"].(string))
+				})
+			}
+
+			Convey("When member is invited", func() {
+				answer := ex.POST("/orgs/"+id+"/invitations").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithForm(map[string]interface{}{"email": "gop@sup.com", "role": models.RoleAdmin}).Expect().JSON().Object()
+
+				So(answer.Raw()["token"], ShouldBeNil)
+				So(answer.Value("invitation").Object().Value("role").String().Raw(), ShouldEqual, models.RoleAdmin)
+
+				Convey("Token must be mailed to invited email only", func() {
+					So(len(mails.Enqueued), ShouldEqual, 1)
+					So(mails.Enqueued[0].To, ShouldEqual, "gop@sup.com")
+					So(mails.Enqueued[0].Subject, ShouldEqual, "Invitation to Crawl Team")
+					So(mails.Enqueued[0].Body, ShouldContainSubstring, "https://app.crawlyzer.io/invite?token=invitation-1")
+				})
+			})
+
+			Convey("When email delivery is not configured", func() {
+				conf.Mail = config.Mail{}
+
+				answer := ex.POST("/orgs/"+id+"/invitations").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithFormField("email", "gop@sup.com").Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+				So(mails.Enqueued, ShouldBeEmpty)
+			})
+
+			Convey("Last owner must not leave", func() {
+				answer := ex.DELETE("/orgs/"+id+"/members/"+models_mock.TestUUID.String()).
+					WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusConflict)
+			})
+
+			Convey("Owner must remove member", func() {
+				orgs.AddMember(uuid.FromStringOrNil(id), other, models.RoleMember)
+
+				answer := ex.DELETE("/orgs/"+id+"/members/"+other.String()).
+					WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect().JSON().Object()
+				So(answer.Value("success").Boolean().Raw(), ShouldBeTrue)
+
+				members := ex.GET("/orgs/"+id+"/members").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					Expect().JSON().Array()
+				So(members.Length().Raw(), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When user is not a member", func() {
+			o, _ := ds.Org.Create(context.Background(), "Foreign", other)
+			answer := ex.GET("/orgs/"+o.ID.String()+"/members").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("When admin removes owner", func() {
+			o, _ := ds.Org.Create(context.Background(), "Foreign", other)
+			orgs.AddMember(o.ID, models_mock.TestUUID, models.RoleAdmin)
+
+			answer := ex.DELETE("/orgs/"+o.ID.String()+"/members/"+other.String()).
+				WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("When member invites", func() {
+			o, _ := ds.Org.Create(context.Background(), "Foreign", other)
+			orgs.AddMember(o.ID, models_mock.TestUUID, models.RoleMember)
+
+			answer := ex.POST("/orgs/"+o.ID.String()+"/invitations").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				WithFormField("email", "gop@sup.com").Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("When invitation is accepted", func() {
+			o, _ := ds.Org.Create(context.Background(), "Foreign", other)
+			_, token, _ := ds.Org.Invite(context.Background(), o.ID, "tester@exter.com", models.RoleMember, other)
+
+			Convey("Without account it must be created", func() {
+				answer := ex.POST("/orgs/invitations/accept").WithForm(map[string]interface{}{
+					"token":    token,
+					"password": "SuperPassword",
+				}).Expect().JSON().Object()
+
+				So(answer.Value("session").String().Raw(), ShouldNotBeBlank)
+				So(answer.Value("membership").Object().Value("role").String().Raw(), ShouldEqual, models.RoleMember)
+				So(ds.Audit.(*models_mock.MAuditStore).Types(), ShouldResemble, []string{models.EventRegister, models.EventOrgJoin})
+			})
+
+			Convey("With session user must join", func() {
+				answer := ex.POST("/orgs/invitations/accept").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithFormField("token", token).Expect().JSON().Object()
+
+				So(answer.Raw()["session"], ShouldBeNil)
+				So(answer.Value("membership").Object().Value("org_id").String().Raw(), ShouldEqual, o.ID.String())
+
+				Convey("Invitation must not be reused", func() {
+					answer := ex.POST("/orgs/invitations/accept").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+						WithFormField("token", token).Expect()
+
+					So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+				})
+
+				Convey("Used invitation must not create account", func() {
+					answer := ex.POST("/orgs/invitations/accept").WithForm(map[string]interface{}{
+						"token":    token,
+						"password": "SuperPassword",
+					}).Expect()
+
+					So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+					So(ds.Webhook.(*models_mock.MWebhookStore).Enqueued, ShouldBeEmpty)
+				})
+			})
+
+			Convey("With session of another email user must not join", func() {
+				_, foreign, _ := ds.Org.Invite(context.Background(), o.ID, "gop@sup.com", models.RoleMember, other)
+
+				answer := ex.POST("/orgs/invitations/accept").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithFormField("token", foreign).Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+				_, err := ds.Org.Role(context.Background(), o.ID, models_mock.TestUUID)
+				So(err, ShouldEqual, models.ErrNotMember)
+			})
+
+			Convey("When account exists", func() {
+				ds.User.(*models_mock.MUserStore).FakeError = models.ErrAlreadyCreated
+				answer := ex.POST("/orgs/invitations/accept").WithForm(map[string]interface{}{
+					"token":    token,
+					"password": "SuperPassword",
+				}).Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusConflict)
+			})
+		})
+	})
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// keys of request values set by resolveTenant
+const (
+	tenantNameKey  = "tenant"
+	tenantStoreKey = "tenant_store"
+)
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// resolveTenant scopes store of the request to its tenant and span, host mapped in config wins,
+// then X-Tenant-ID header and tenant form value, default tenant otherwise,
+// tenants mapped to hosts are served only on them and can't be picked by header or form
+func (wa *WebApp) resolveTenant(c iris.Context) {
+	tenant, ok := wa.Config.TenantHosts[hostname(c.Host())]
+	if !ok {
+		tenant = c.GetHeader("X-Tenant-ID")
+		if tenant == "" {
+			tenant = c.FormValue("tenant")
+		}
+		if tenant == "" {
+			tenant = models.DefaultTenant
+		}
+
+		if wa.hostBound(tenant) {
+			ThrowError(c, http.StatusForbidden, "tenant is served on its own host")
+			return
+		}
+	}
+
+	if !tenantPattern.MatchString(tenant) {
+		ThrowError(c, http.StatusBadRequest, "bad tenant")
+		return
+	}
+
+	c.Values().Set(tenantNameKey, tenant)
+	c.Values().Set(tenantStoreKey, wa.Store.ForTenant(tenant))
+	c.Next()
+}
+
+// store returns data store of request's tenant
+func (wa *WebApp) store(c iris.Context) *models.DataStore {
+	if ds, ok := c.Values().Get(tenantStoreKey).(*models.DataStore); ok {
+		return ds
+	}
+	return wa.Store
+}
+
+// hostBound tells if tenant is mapped to some host
+func (wa *WebApp) hostBound(tenant string) bool {
+	for _, t := range wa.Config.TenantHosts {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
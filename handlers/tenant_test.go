@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	Convey("Tenant resolution", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		variants := []map[string]interface{}{
+			{"case": "nothing", "header": "", "form": "", "mustbe": models.DefaultTenant},
+			{"case": "header", "header": "acme", "form": "", "mustbe": "acme"},
+			{"case": "form", "header": "", "form": "globex", "mustbe": "globex"},
+			{"case": "header and form", "header": "acme", "form": "globex", "mustbe": "acme"},
+		}
+
+		for _, v := range variants {
+			Convey("When tenant is passed by "+v["case"].(string), func() {
+				req := ex.POST("/user/auth").WithFormField("sesid", "6e536fff-baaf-4ca7-a067-352bafeb6ee3")
+				if v["header"] != "" {
+					req = req.WithHeader("X-Tenant-ID", v["header"].(string))
+				}
+				if v["form"] != "" {
+					req = req.WithFormField("tenant", v["form"])
+				}
+				answer := req.Expect().JSON().Object()
+
+				Convey("Must be "+v["mustbe"].(string), func() {
+					So(answer.Value("tenant").String().Raw(), ShouldEqual, v["mustbe"])
+					So(ds.User.(*models_mock.MUserStore).LastTenant, ShouldEqual, v["mustbe"])
+				})
+			})
+		}
+
+		Convey("When tenant is malformed", func() {
+			answer := ex.POST("/user/login").WithHeader("X-Tenant-ID", "Bad_Tenant").
+				WithForm(map[string]interface{}{"email": "tester@tester.com", "password": "SuperPassword"}).Expect()
+
+			Convey("Must be bad request", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusBadRequest)
+				So(answer.JSON().Object().Value("error").String().Raw(), ShouldEqual, "bad tenant")
+			})
+		})
+	})
+
+	Convey("Data shared by tenants", t, func() {
+		ds := models_mock.InitMockStore()
+		ds.User.(*models_mock.MUserStore).Admin = true
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		for _, path := range []string{"/audit", "/audit/verify", "/webhooks", "/oauth/clients"} {
+			Convey("When admin of other tenant reads "+path, func() {
+				answer := ex.GET(path).WithHeader("X-Tenant-ID", "acme").
+					WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+				Convey("Must be forbidden", func() {
+					So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+					So(answer.JSON().Object().Value("error").String().Raw(), ShouldEqual, "global admin only")
+				})
+			})
+
+			Convey("When admin of default tenant reads "+path, func() {
+				answer := ex.GET(path).WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+				Convey("Must be allowed", func() {
+					So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+				})
+			})
+		}
+	})
+
+	Convey("Tenant mapped to host", t, func() {
+		conf := config.Default()
+		conf.TenantHosts = map[string]string{"auth.acme.com": "acme", "auth.initech.com": "initech"}
+
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, conf, nil), httptest.URL("http://auth.initech.com"))
+
+		Convey("Host must win over header", func() {
+			answer := ex.POST("/user/auth").WithHeader("X-Tenant-ID", "acme").
+				WithFormField("sesid", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect().JSON().Object()
+
+			So(answer.Value("tenant").String().Raw(), ShouldEqual, "initech")
+		})
+
+		Convey("Tenant of host must not be picked on other host", func() {
+			other := httptest.New(t, InitApp(ds, conf, nil), httptest.URL("http://auth.crawlyzer.io"))
+			answer := other.POST("/user/auth").WithHeader("X-Tenant-ID", "acme").
+				WithFormField("sesid", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			So(ds.User.(*models_mock.MUserStore).LastTenant, ShouldEqual, "")
+		})
+
+		Convey("Host must ignore port and case", func() {
+			So(conf.TenantHosts[hostname("Auth.Acme.com:8080")], ShouldEqual, "acme")
+		})
+	})
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+)
+
+// trace runs request in server span, which continues trace of the caller when
+// it sends traceparent header, requests without route are not traced
+func (wa *WebApp) trace(c iris.Context) {
+	route := c.GetCurrentRoute()
+	if route == nil {
+		c.Next()
+		return
+	}
+
+	ctx := tracing.Extract(wa.context(c), c.Request().Header)
+	ctx, span := tracing.StartServer(ctx, c.Method(), route.Path())
+	if sc := span.SpanContext(); sc.IsValid() {
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("trace_id", sc.TraceID().String()))
+	}
+	c.Values().Set(contextKey, ctx)
+
+	c.Next()
+	tracing.EndServer(span, c.GetStatusCode())
+}
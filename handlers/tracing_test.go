@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"database/sql"
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	Convey("Request tracing", t, func() {
+		recorder := tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		Convey("When caller sends trace context", func() {
+			ex.POST("/user/login").WithHeader("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01").
+				WithFormField("email", "tester@exter.com").WithFormField("password", "SuperPassword").Expect()
+
+			spans := recorder.Ended()
+
+			Convey("Server span must continue it", func() {
+				So(len(spans), ShouldEqual, 1)
+				So(spans[0].Name(), ShouldEqual, "POST /user/login")
+				So(spans[0].SpanContext().TraceID().String(), ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+				So(spans[0].Parent().SpanID().String(), ShouldEqual, "00f067aa0ba902b7")
+				So(spans[0].Attributes(), ShouldContain, attribute.Int("http.status_code", 200))
+			})
+		})
+
+		Convey("When route has parameters", func() {
+			ex.GET("/orgs/0d1a2f7e-3b4c-4d5e-8f60-718293a4b5c6/members").Expect()
+
+			Convey("Span must be named by route", func() {
+				So(recorder.Ended()[0].Name(), ShouldEqual, "GET /orgs/{id:string}/members")
+			})
+		})
+
+		Convey("When store fails", func() {
+			ds.User.(*models_mock.MUserStore).FakeError = sql.ErrConnDone
+
+			ex.POST("/user/register").WithFormField("email", "gop@sup.com").WithFormField("password", "SuperPassword").Expect()
+
+			Convey("Span must be marked failed", func() {
+				So(recorder.Ended()[0].Status().Code, ShouldEqual, codes.Error)
+			})
+		})
+
+		Convey("When client is rejected", func() {
+			ex.GET("/user/list").Expect()
+
+			Convey("Span must not be marked failed", func() {
+				So(recorder.Ended()[0].Status().Code, ShouldNotEqual, codes.Error)
+			})
+		})
+	})
+}
@@ -1,11 +1,12 @@
 package handlers
 
 import (
+	uuid "github.com/iris-contrib/go.uuid"
 	"github.com/kataras/iris"
 	"github.com/xssnick/crawlyzer-auth/models"
 	"net/http"
-	"os"
 	"regexp"
+	"strings"
 )
 
 var emailRegex = regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
@@ -24,37 +25,79 @@ func (wa *WebApp) Login(c iris.Context) {
 		return
 	}
 
-	ses, err := wa.Store.User.Login(email, pw)
+	ses, err := wa.store(c).User.Login(wa.context(c), email, pw)
 	if err != nil {
 		if err == models.ErrLoginIncorrect {
+			wa.audit(c, models.EventLoginFailure, uuid.Nil, uuid.Nil, wa.auditEmail(email))
 			ThrowError(c, http.StatusForbidden, "invalid email")
 		} else {
-			wa.Logger.Println(err)
+			wa.log(c).Error("login failed", "error", err)
 			ThrowError(c, http.StatusInternalServerError, "server error")
 		}
 		return
 	}
 
+	wa.audit(c, models.EventLoginSuccess, ses.UserID, ses.UserID, "")
+
 	c.JSON(iris.Map{
-		"session": ses,
+		"session": ses.ID,
 	})
 }
 
+// Auth resolves session or api key from Authorization header to user uuid and scopes,
+// when scope is passed credentials must have all of its space separated scopes
 func (wa *WebApp) Auth(c iris.Context) {
-	sesid := c.PostValue("sesid")
-	if sesid == "" {
-		ThrowError(c, http.StatusForbidden, "incorrect session")
+	id, scopes, ok := wa.credentials(c)
+	if !ok {
+		return
+	}
+
+	if !models.HasScopes(scopes, strings.Fields(c.PostValue("scope"))...) {
+		ThrowError(c, http.StatusForbidden, "insufficient scope")
 		return
 	}
 
-	id, err := wa.Store.User.Auth(sesid)
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	orgs, err := wa.memberships(c, id)
 	if err != nil {
-		ThrowError(c, http.StatusForbidden, "incorrect session")
+		wa.log(c).Error("session check failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
 		return
 	}
 
 	c.JSON(iris.Map{
-		"uuid": id,
+		"uuid":            id,
+		"tenant":          c.Values().GetString(tenantNameKey),
+		"scopes":          scopes,
+		"orgs":            orgs,
+		"impersonated_by": impersonator(c),
+	})
+}
+
+func (wa *WebApp) Logout(c iris.Context) {
+	id, ok := wa.authorize(c)
+	if !ok {
+		return
+	}
+
+	err := wa.store(c).User.Logout(wa.context(c), sessionID(c))
+	if err != nil {
+		wa.log(c).Error("logout failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if admin := impersonator(c); admin != nil {
+		wa.audit(c, models.EventAdminImpersonateStop, *admin, id, "")
+	} else {
+		wa.audit(c, models.EventLogout, id, id, "")
+	}
+
+	c.JSON(iris.Map{
+		"success": true,
 	})
 }
 
@@ -73,22 +116,24 @@ func (wa *WebApp) RegisterNewUser(c iris.Context) {
 	}
 
 	//TODO: check for already registered
-	_, err := wa.Store.User.Create(email, pw)
+	id, err := wa.store(c).User.Create(wa.context(c), email, pw)
 	if err != nil {
-		wa.Logger.Println(err)
+		wa.log(c).Error("registration failed", "error", err)
 		ThrowError(c, http.StatusInternalServerError, "server error")
 		return
 	}
 
+	wa.audit(c, models.EventRegister, id, id, "")
+
 	c.JSON(iris.Map{
 		"success": true,
 	})
 }
 
 func (wa *WebApp) List(c iris.Context) {
-	list, err := wa.Store.User.GetAll()
+	list, err := wa.store(c).User.GetAll(wa.context(c))
 	if err != nil {
-		wa.Logger.Println(err)
+		wa.log(c).Error("users lookup failed", "error", err)
 		ThrowError(c, http.StatusInternalServerError, "server error")
 		return
 	}
@@ -97,5 +142,5 @@ func (wa *WebApp) List(c iris.Context) {
 }
 
 func (wa *WebApp) Node(c iris.Context) {
-	c.JSON(os.Getenv("NODEID"))
+	c.JSON(wa.Config.NodeID)
 }
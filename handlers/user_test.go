@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"github.com/kataras/iris/httptest"
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
 	"github.com/xssnick/crawlyzer-auth/models"
 	"github.com/xssnick/crawlyzer-auth/models_mock"
 	"net/http"
@@ -14,7 +16,7 @@ import (
 func TestRegister(t *testing.T) {
 	Convey("Register new user", t, func() {
 		ds := models_mock.InitMockStore()
-		ex := httptest.New(t, InitApp(ds))
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
 
 		Convey("When form values are invalid", func() {
 			forms := []map[string]interface{}{{
@@ -108,7 +110,7 @@ func TestRegister(t *testing.T) {
 func TestLogin(t *testing.T) {
 	Convey("Login user", t, func() {
 		ds := models_mock.InitMockStore()
-		ex := httptest.New(t, InitApp(ds))
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
 
 		Convey("When form values are invalid", func() {
 			forms := []map[string]interface{}{{
@@ -204,7 +206,7 @@ func TestLogin(t *testing.T) {
 func TestAuth(t *testing.T) {
 	Convey("Auth user", t, func() {
 		ds := models_mock.InitMockStore()
-		ex := httptest.New(t, InitApp(ds))
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
 
 		Convey("When session is empty", func() {
 			answer := ex.POST("/user/auth").WithForm(map[string]interface{}{
@@ -217,8 +219,6 @@ func TestAuth(t *testing.T) {
 		})
 
 		Convey("When session is not exists", func() {
-			ds.User.(*models_mock.MUserStore).FakeError = models.ErrAuthIncorrect
-
 			answer := ex.POST("/user/auth").WithForm(map[string]interface{}{
 				"sesid": "UnKnOWNsession27772",
 			}).Expect()
@@ -230,12 +230,81 @@ func TestAuth(t *testing.T) {
 
 		Convey("When session is valid", func() {
 			answer := ex.POST("/user/auth").WithForm(map[string]interface{}{
-				"sesid": "UnKnOWNsession27772",
+				"sesid": models_mock.TestSession,
 			}).Expect()
 
 			Convey("Must be auth OK", func() {
 				So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
 			})
 		})
+
+		Convey("When session is logged out", func() {
+			ex.POST("/user/logout").WithHeader("X-Session-ID", models_mock.TestSession).Expect()
+
+			answer := ex.POST("/user/auth").WithForm(map[string]interface{}{
+				"sesid": models_mock.TestSession,
+			}).Expect()
+
+			Convey("Must be auth error", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			})
+		})
+	})
+}
+
+func TestScopes(t *testing.T) {
+	Convey("Scopes of sessions and api keys", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		Convey("Auth must return scopes", func() {
+			answer := ex.POST("/user/auth").WithFormField("sesid", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				Expect().JSON().Object()
+
+			So(answer.Value("scopes").Array().Length().Raw(), ShouldEqual, len(models.DefaultScopes))
+		})
+
+		Convey("When session is limited", func() {
+			ds.User.(*models_mock.MUserStore).Scopes = []string{models.ScopeCrawlRead}
+
+			Convey("Auth must check requested scope", func() {
+				ok := ex.POST("/user/auth").WithForm(map[string]interface{}{
+					"sesid": "6e536fff-baaf-4ca7-a067-352bafeb6ee3",
+					"scope": models.ScopeCrawlRead,
+				}).Expect()
+				So(ok.Raw().StatusCode, ShouldEqual, http.StatusOK)
+
+				denied := ex.POST("/user/auth").WithForm(map[string]interface{}{
+					"sesid": "6e536fff-baaf-4ca7-a067-352bafeb6ee3",
+					"scope": models.ScopeCrawlRead + " " + models.ScopeBilling,
+				}).Expect()
+				So(denied.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+				So(denied.JSON().Object().Value("error").String().Raw(), ShouldEqual, "insufficient scope")
+			})
+
+			Convey("Account must not be managed", func() {
+				answer := ex.POST("/account/password").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithForm(map[string]interface{}{"old_password": "SuperPassword", "new_password": "NewPassword"}).Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("When api key is wider than session", func() {
+			ds.User.(*models_mock.MUserStore).Scopes = []string{models.ScopeAccount, models.ScopeCrawlRead}
+
+			answer := ex.POST("/account/keys").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				WithForm(map[string]interface{}{"name": "crawler", "scopes": models.ScopeCrawlWrite}).Expect().JSON().Object()
+
+			So(answer.Value("error").String().Raw(), ShouldEqual, "bad scopes")
+		})
+
+		Convey("When api key is limited", func() {
+			_, key, _ := ds.APIKey.Create(context.Background(), models_mock.TestUUID, "crawler", []string{models.ScopeCrawlRead}, nil)
+
+			answer := ex.GET("/account/keys").WithHeader("Authorization", "Bearer "+key).Expect()
+
+			So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+		})
 	})
 }
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CreateWebhook subscribes url to comma separated events, secret for signatures is shown only here
+func (wa *WebApp) CreateWebhook(c iris.Context) {
+	admin, ok := wa.authorizeGlobalAdmin(c)
+	if !ok {
+		return
+	}
+
+	u, err := url.Parse(c.PostValue("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		ThrowError(c, http.StatusBadRequest, "bad url")
+		return
+	}
+
+	var events []string
+	for _, e := range strings.Split(c.PostValue("events"), ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+
+		if !isWebhookEvent(e) {
+			ThrowError(c, http.StatusBadRequest, "unknown event "+e)
+			return
+		}
+		events = append(events, e)
+	}
+
+	if len(events) == 0 {
+		ThrowError(c, http.StatusBadRequest, "no events")
+		return
+	}
+
+	w, err := wa.Store.Webhook.Create(wa.context(c), u.String(), events)
+	if err != nil {
+		wa.log(c).Error("webhook creation failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	wa.audit(c, models.EventAdminWebhookCreate, admin, uuid.Nil, "webhook="+w.ID.String()+" url="+w.URL)
+
+	c.JSON(iris.Map{
+		"webhook": w,
+		"secret":  w.Secret,
+	})
+}
+
+func (wa *WebApp) ListWebhooks(c iris.Context) {
+	if _, ok := wa.authorizeGlobalAdmin(c); !ok {
+		return
+	}
+
+	list, err := wa.Store.Webhook.List(wa.context(c))
+	if err != nil {
+		wa.log(c).Error("webhooks lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if list == nil {
+		list = []models.Webhook{}
+	}
+	c.JSON(list)
+}
+
+func (wa *WebApp) DeleteWebhook(c iris.Context) {
+	admin, ok := wa.authorizeGlobalAdmin(c)
+	if !ok {
+		return
+	}
+
+	id, err := uuid.FromString(c.Params().Get("id"))
+	if err != nil {
+		ThrowError(c, http.StatusBadRequest, "bad id")
+		return
+	}
+
+	err = wa.Store.Webhook.Delete(wa.context(c), id)
+	if err != nil {
+		if err == models.ErrWebhookNotFound {
+			ThrowError(c, http.StatusNotFound, "webhook not found")
+			return
+		}
+		wa.log(c).Error("webhook deletion failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	wa.audit(c, models.EventAdminWebhookDelete, admin, uuid.Nil, "webhook="+id.String())
+
+	c.JSON(iris.Map{
+		"success": true,
+	})
+}
+
+func (wa *WebApp) WebhookDeliveries(c iris.Context) {
+	if _, ok := wa.authorizeGlobalAdmin(c); !ok {
+		return
+	}
+
+	id, err := uuid.FromString(c.Params().Get("id"))
+	if err != nil {
+		ThrowError(c, http.StatusBadRequest, "bad id")
+		return
+	}
+
+	limit := c.URLParamIntDefault("limit", 100)
+	if limit <= 0 || limit > 1000 {
+		ThrowError(c, http.StatusBadRequest, "bad limit")
+		return
+	}
+
+	list, err := wa.Store.Webhook.Deliveries(wa.context(c), id, limit)
+	if err != nil {
+		wa.log(c).Error("deliveries lookup failed", "error", err)
+		ThrowError(c, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	if list == nil {
+		list = []models.WebhookDelivery{}
+	}
+	c.JSON(list)
+}
+
+func isWebhookEvent(e string) bool {
+	if e == "*" {
+		return true
+	}
+
+	for _, known := range models.WebhookEvents {
+		if e == known {
+			return true
+		}
+	}
+	return false
+}
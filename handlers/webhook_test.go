@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"github.com/kataras/iris/httptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"net/http"
+	"testing"
+)
+
+func TestWebhooks(t *testing.T) {
+	Convey("Manage webhooks", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+
+		Convey("When not admin", func() {
+			answer := ex.POST("/webhooks").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+				WithForm(map[string]interface{}{
+					"url":    "https://crawler.local/hook",
+					"events": models.WebhookUserRegistered,
+				}).Expect()
+
+			Convey("Must be forbidden", func() {
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusForbidden)
+			})
+		})
+
+		Convey("When admin", func() {
+			ds.User.(*models_mock.MUserStore).Admin = true
+
+			forms := []map[string]interface{}{{
+				"url":    "ftp://crawler.local/hook",
+				"events": models.WebhookUserRegistered,
+				"mustbe": "bad url",
+			}, {
+				"url":    "https://crawler.local/hook",
+				"events": "user.exploded",
+				"mustbe": "unknown event user.exploded",
+			}, {
+				"url":    "https://crawler.local/hook",
+				"events": " ,",
+				"mustbe": "no events",
+			}}
+
+			for _, variant := range forms {
+				Convey("Test when invalid: "+variant["mustbe"].(string), func() {
+					answer := ex.POST("/webhooks").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+						WithForm(variant).Expect().JSON().Object()
+
+					So(answer.Value("error").String().Raw(), ShouldEqual, variant["mustbe"].(string))
+				})
+			}
+
+			Convey("When valid", func() {
+				answer := ex.POST("/webhooks").WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").
+					WithForm(map[string]interface{}{
+						"url":    "https://crawler.local/hook",
+						"events": models.WebhookUserRegistered + "," + models.WebhookUserDeleted,
+					}).Expect().JSON().Object()
+
+				Convey("Must return secret once", func() {
+					So(answer.Value("secret").String().Raw(), ShouldEqual, "secret")
+					So(answer.Value("webhook").Object().Raw()["secret"], ShouldBeNil)
+					So(answer.Value("webhook").Object().Value("events").Array().Length().Raw(), ShouldEqual, 2)
+				})
+			})
+
+			Convey("When deleting unknown", func() {
+				answer := ex.DELETE("/webhooks/d96bee74-07c5-40ca-b0cc-c0e04d4a7589").
+					WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusNotFound)
+			})
+
+			Convey("When deleting existing", func() {
+				answer := ex.DELETE("/webhooks/"+models_mock.TestUUID.String()).
+					WithHeader("X-Session-ID", "6e536fff-baaf-4ca7-a067-352bafeb6ee3").Expect()
+
+				So(answer.Raw().StatusCode, ShouldEqual, http.StatusOK)
+			})
+		})
+	})
+}
+
+func TestWebhookNotifications(t *testing.T) {
+	Convey("Lifecycle events notifications", t, func() {
+		ds := models_mock.InitMockStore()
+		ex := httptest.New(t, InitApp(ds, config.Default(), nil))
+		hooks := ds.Webhook.(*models_mock.MWebhookStore)
+
+		ex.POST("/user/register").WithForm(map[string]interface{}{
+			"email":    "gop@sup.com",
+			"password": "SuperPassword",
+		}).Expect()
+		ex.POST("/account/password").WithForm(map[string]interface{}{
+			"sesid":        "6e536fff-baaf-4ca7-a067-352bafeb6ee3",
+			"old_password": "SuperPassword",
+			"new_password": "NewSuperPassword",
+		}).Expect()
+		ex.POST("/account/delete").WithForm(map[string]interface{}{
+			"sesid":    "6e536fff-baaf-4ca7-a067-352bafeb6ee3",
+			"password": "NewSuperPassword",
+		}).Expect()
+
+		Convey("Must be enqueued", func() {
+			So(hooks.Enqueued, ShouldResemble, []string{
+				models.WebhookUserRegistered,
+				models.WebhookUserPasswordChanged,
+				models.WebhookUserDeleted,
+			})
+		})
+	})
+}
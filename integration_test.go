@@ -3,15 +3,30 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/go-redis/redis"
 	uuid "github.com/iris-contrib/go.uuid"
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/logging"
 	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/workers"
 	"testing"
+	"time"
 )
 
 func bootstrap(name string, f func(ds *models.DataStore), t *testing.T) {
 	Convey(name, t, func() {
-		ds, err := models.BuildStore()
+		conf, _, err := config.Load(nil)
+		if err != nil {
+			t.Fatal(err)
+			return
+		}
+
+		ds, err := models.BuildStore(conf, logging.Default())
 		if err != nil {
 			t.Fatal("failed to init datastore")
 			return
@@ -19,26 +34,28 @@ func bootstrap(name string, f func(ds *models.DataStore), t *testing.T) {
 
 		f(ds)
 
-		models.MigrateDown(ds.Postgres.DB)
+		models.MigrateDown(ds.Postgres.DB, logging.Default())
 	})
 }
 
 func TestCreate(t *testing.T) {
 	bootstrap("User creation", func(ds *models.DataStore) {
+		ctx := context.Background()
+
 		Convey("When OK", func() {
-			uid, err := ds.User.Create("kis@pips.com", "231vre423")
+			uid, err := ds.User.Create(ctx, "kis@pips.com", "231vre423")
 
 			So(err, ShouldEqual, nil)
 			So(uid, ShouldNotEqual, uuid.Nil)
 		})
 
 		Convey("When duplicate", func() {
-			uid, err := ds.User.Create("kis@pips.com", "231vre423")
+			uid, err := ds.User.Create(ctx, "kis@pips.com", "231vre423")
 
 			So(err, ShouldEqual, nil)
 			So(uid, ShouldNotEqual, uuid.Nil)
 
-			_, err = ds.User.Create("kis@pips.com", "3423423")
+			_, err = ds.User.Create(ctx, "kis@pips.com", "3423423")
 			So(err, ShouldEqual, models.ErrAlreadyCreated)
 		})
 	}, t)
@@ -46,41 +63,55 @@ func TestCreate(t *testing.T) {
 
 func TestLogin(t *testing.T) {
 	bootstrap("User login", func(ds *models.DataStore) {
+		ctx := context.Background()
+
 		Convey("When user not exists", func() {
-			_, err := ds.User.Login("kis@pips.com", "123456789")
+			_, err := ds.User.Login(ctx, "kis@pips.com", "123456789")
 			So(err, ShouldEqual, models.ErrLoginIncorrect)
 		})
 
 		Convey("When password incorrect", func() {
-			ds.User.Create("kis@pips.com", "123456789")
+			ds.User.Create(ctx, "kis@pips.com", "123456789")
 
-			_, err := ds.User.Login("kis@pips.com", "BadPassword")
+			_, err := ds.User.Login(ctx, "kis@pips.com", "BadPassword")
 			So(err, ShouldEqual, models.ErrLoginIncorrect)
 		})
 
 		Convey("When all correct", func() {
-			ds.User.Create("kis@pips.com", "123456789")
+			ds.User.Create(ctx, "kis@pips.com", "123456789")
 
-			ses, err := ds.User.Login("kis@pips.com", "123456789")
+			ses, err := ds.User.Login(ctx, "kis@pips.com", "123456789")
 			So(err, ShouldEqual, nil)
-			So(ses, ShouldNotBeBlank)
+			So(ses.ID, ShouldNotBeBlank)
+		})
+
+		Convey("When caller is gone", func() {
+			ds.User.Create(ctx, "kis@pips.com", "123456789")
+
+			gone, cancel := context.WithCancel(ctx)
+			cancel()
+
+			_, err := ds.User.Login(gone, "kis@pips.com", "123456789")
+			So(err, ShouldEqual, context.Canceled)
 		})
 	}, t)
 }
 
 func TestGetAll(t *testing.T) {
 	bootstrap("Users list", func(ds *models.DataStore) {
+		ctx := context.Background()
+
 		Convey("When 2 users", func() {
-			ds.User.Create("kis@pips.com", "7564756fg")
-			ds.User.Create("poo@six.biz", "12346453FFF")
+			ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+			ds.User.Create(ctx, "poo@six.biz", "12346453FFF")
 
-			all, err := ds.User.GetAll()
+			all, err := ds.User.GetAll(ctx)
 			So(err, ShouldEqual, nil)
 			So(len(all), ShouldEqual, 2)
 		})
 
 		Convey("When empty", func() {
-			all, err := ds.User.GetAll()
+			all, err := ds.User.GetAll(ctx)
 			So(err, ShouldEqual, nil)
 			So(len(all), ShouldEqual, 0)
 		})
@@ -89,18 +120,1190 @@ func TestGetAll(t *testing.T) {
 
 func TestAuth(t *testing.T) {
 	bootstrap("User auth", func(ds *models.DataStore) {
+		ctx := context.Background()
+
 		Convey("When session not exists", func() {
-			_, err := ds.User.Auth("unknown-ses-id")
+			_, err := ds.User.Auth(ctx, "unknown-ses-id")
 			So(err, ShouldEqual, models.ErrAuthIncorrect)
 		})
 
 		Convey("When session exists", func() {
-			cuid, _ := ds.User.Create("kis@pips.com", "7564756fg")
-			sesid, _ := ds.User.Login("kis@pips.com", "7564756fg")
+			cuid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+			ses, _ := ds.User.Login(ctx, "kis@pips.com", "7564756fg")
 
-			uid, err := ds.User.Auth(sesid)
+			uid, err := ds.User.Auth(ctx, ses.ID)
 			So(err, ShouldEqual, nil)
 			So(uid, ShouldEqual, cuid)
 		})
+
+		Convey("When logged out", func() {
+			cuid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+			ses, _ := ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+			ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+
+			sessions, err := ds.User.Sessions(ctx, cuid)
+			So(err, ShouldEqual, nil)
+			So(len(sessions), ShouldEqual, 2)
+
+			err = ds.User.Logout(ctx, ses.ID)
+			So(err, ShouldEqual, nil)
+
+			_, err = ds.User.Auth(ctx, ses.ID)
+			So(err, ShouldEqual, models.ErrAuthIncorrect)
+
+			sessions, err = ds.User.Sessions(ctx, cuid)
+			So(err, ShouldEqual, nil)
+			So(len(sessions), ShouldEqual, 1)
+		})
+	}, t)
+}
+
+func TestDelete(t *testing.T) {
+	bootstrap("User deletion", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		Convey("When password incorrect", func() {
+			cuid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+
+			err := ds.User.Delete(ctx, cuid, "BadPassword")
+			So(err, ShouldEqual, models.ErrLoginIncorrect)
+		})
+
+		Convey("When all correct", func() {
+			cuid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+			ses, _ := ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+
+			err := ds.User.Delete(ctx, cuid, "7564756fg")
+			So(err, ShouldEqual, nil)
+
+			_, err = ds.User.Auth(ctx, ses.ID)
+			So(err, ShouldEqual, models.ErrAuthIncorrect)
+
+			_, err = ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+			So(err, ShouldEqual, models.ErrLoginIncorrect)
+
+			all, _ := ds.User.GetAll(ctx)
+			So(len(all), ShouldEqual, 0)
+		})
+
+		Convey("When retention passed", func() {
+			cuid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+			ds.User.Delete(ctx, cuid, "7564756fg")
+
+			n, err := ds.User.Anonymize(ctx, time.Now().Add(-time.Hour))
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+
+			n, err = ds.User.Anonymize(ctx, time.Now())
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+
+			// replayed events must not bring email back
+			var payloads []string
+			err = ds.Event.Replay(ctx, 0, func(e models.DomainEvent) error {
+				if e.AggregateID == cuid {
+					payloads = append(payloads, e.Payload)
+				}
+				return nil
+			})
+			So(err, ShouldEqual, nil)
+			So(payloads, ShouldNotBeEmpty)
+			for _, p := range payloads {
+				So(p, ShouldNotContainSubstring, "kis@pips.com")
+			}
+
+			_, err = ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+			So(err, ShouldEqual, nil)
+		})
+	}, t)
+}
+
+func TestChangePassword(t *testing.T) {
+	bootstrap("Password change", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		Convey("When old password incorrect", func() {
+			cuid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+
+			err := ds.User.ChangePassword(ctx, cuid, "", "BadPassword", "NewPassword")
+			So(err, ShouldEqual, models.ErrLoginIncorrect)
+		})
+
+		Convey("When all correct", func() {
+			cuid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+
+			err := ds.User.ChangePassword(ctx, cuid, "", "7564756fg", "NewPassword")
+			So(err, ShouldEqual, nil)
+
+			_, err = ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+			So(err, ShouldEqual, models.ErrLoginIncorrect)
+
+			_, err = ds.User.Login(ctx, "kis@pips.com", "NewPassword")
+			So(err, ShouldEqual, nil)
+		})
+
+		Convey("When signed in on several devices", func() {
+			cuid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+			current, _ := ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+			other, _ := ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+
+			err := ds.User.ChangePassword(ctx, cuid, current.ID, "7564756fg", "NewPassword")
+			So(err, ShouldEqual, nil)
+
+			Convey("Only session of the change must stay", func() {
+				_, err = ds.User.Auth(ctx, current.ID)
+				So(err, ShouldEqual, nil)
+
+				_, err = ds.User.Auth(ctx, other.ID)
+				So(err, ShouldEqual, models.ErrAuthIncorrect)
+			})
+		})
+	}, t)
+}
+
+func TestAudit(t *testing.T) {
+	bootstrap("Audit events", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		uid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+		other, _ := ds.User.Create(ctx, "poo@six.biz", "12346453FFF")
+
+		ds.Audit.Record(ctx, models.AuditEvent{Type: models.EventRegister, Actor: &uid, Target: &uid})
+		ds.Audit.Record(ctx, models.AuditEvent{Type: models.EventRegister, Actor: &other, Target: &other})
+		ds.Audit.Record(ctx, models.AuditEvent{Type: models.EventLoginSuccess, Actor: &uid, Target: &uid, IP: "127.0.0.1"})
+
+		Convey("When filtered by target", func() {
+			list, err := ds.Audit.Find(ctx, models.AuditFilter{Target: &uid})
+			So(err, ShouldEqual, nil)
+			So(len(list), ShouldEqual, 2)
+			So(list[0].Type, ShouldEqual, models.EventLoginSuccess)
+			So(list[0].IP, ShouldEqual, "127.0.0.1")
+		})
+
+		Convey("When filtered by type and limited", func() {
+			list, err := ds.Audit.Find(ctx, models.AuditFilter{Types: []string{models.EventRegister}, Limit: 1})
+			So(err, ShouldEqual, nil)
+			So(len(list), ShouldEqual, 1)
+			So(*list[0].Target, ShouldEqual, other)
+		})
+
+		Convey("When trying to edit", func() {
+			_, err := ds.Postgres.Exec("UPDATE audit_events SET type='edited'")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("When chain is intact", func() {
+			rep, err := ds.Audit.Verify(ctx)
+			So(err, ShouldEqual, nil)
+			So(rep.OK(), ShouldBeTrue)
+			So(rep.Checked, ShouldEqual, 3)
+		})
+
+		Convey("When event edited bypassing trigger", func() {
+			list, _ := ds.Audit.Find(ctx, models.AuditFilter{Types: []string{models.EventLoginSuccess}})
+
+			ds.Postgres.MustExec("ALTER TABLE audit_events DISABLE TRIGGER audit_events_append_only")
+			ds.Postgres.MustExec("UPDATE audit_events SET ip='10.0.0.1' WHERE id=$1", list[0].ID)
+
+			rep, err := ds.Audit.Verify(ctx)
+			So(err, ShouldEqual, nil)
+			So(rep.OK(), ShouldBeFalse)
+			So(rep.BrokenID, ShouldEqual, list[0].ID)
+		})
+
+		Convey("When hashes are stripped from all events", func() {
+			ds.Postgres.MustExec("ALTER TABLE audit_events DISABLE TRIGGER audit_events_append_only")
+			ds.Postgres.MustExec("UPDATE audit_events SET hash='', prev_hash=''")
+
+			rep, err := ds.Audit.Verify(ctx)
+			So(err, ShouldEqual, nil)
+			So(rep.OK(), ShouldBeFalse)
+			So(rep.Reason, ShouldEqual, "missing hash")
+		})
+
+		Convey("When newest event is deleted", func() {
+			ds.Postgres.MustExec("ALTER TABLE audit_events DISABLE TRIGGER audit_events_append_only")
+			ds.Postgres.MustExec("DELETE FROM audit_events WHERE id=(SELECT max(id) FROM audit_events)")
+
+			rep, err := ds.Audit.Verify(ctx)
+			So(err, ShouldEqual, nil)
+			So(rep.OK(), ShouldBeFalse)
+			So(rep.Reason, ShouldEqual, "newest events are missing")
+		})
+
+		Convey("When chain is keyed", func() {
+			keyed := models.NewAuditStore(ds.Postgres, "chain-key")
+			err := keyed.Record(ctx, models.AuditEvent{Type: models.EventLogout, Actor: &uid, Target: &uid})
+			So(err, ShouldEqual, nil)
+
+			rep, err := keyed.Verify(ctx)
+			So(err, ShouldEqual, nil)
+			So(rep.OK(), ShouldBeTrue)
+			So(rep.Checked, ShouldEqual, 4)
+
+			Convey("Verification must need the key", func() {
+				rep, err := models.NewAuditStore(ds.Postgres, "").Verify(ctx)
+				So(err, ShouldEqual, nil)
+				So(rep.OK(), ShouldBeFalse)
+
+				rep, err = models.NewAuditStore(ds.Postgres, "other-key").Verify(ctx)
+				So(err, ShouldEqual, nil)
+				So(rep.OK(), ShouldBeFalse)
+			})
+
+			Convey("Keyed event must not be rehashed without the key", func() {
+				list, _ := ds.Audit.Find(ctx, models.AuditFilter{Types: []string{models.EventLogout}})
+				e := list[0]
+				e.IP = "10.0.0.1"
+				e.Hash = e.ComputeHash("")
+
+				ds.Postgres.MustExec("ALTER TABLE audit_events DISABLE TRIGGER audit_events_append_only")
+				ds.Postgres.MustExec("UPDATE audit_events SET ip=$2, hash=$3 WHERE id=$1", e.ID, e.IP, e.Hash)
+				ds.Postgres.MustExec("UPDATE audit_chain SET head_hash=$1", e.Hash)
+
+				rep, err := keyed.Verify(ctx)
+				So(err, ShouldEqual, nil)
+				So(rep.BrokenID, ShouldEqual, e.ID)
+				So(rep.Reason, ShouldEqual, "event must be keyed")
+			})
+		})
+	}, t)
+}
+
+func TestWebhookOutbox(t *testing.T) {
+	bootstrap("Webhook outbox", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		// registered before webhooks exist, so its event goes nowhere
+		uid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+
+		hook, err := ds.Webhook.Create(ctx, "https://crawler.local/hook", []string{models.WebhookUserRegistered})
+		So(err, ShouldEqual, nil)
+		ds.Webhook.Create(ctx, "https://other.local/hook", []string{"*"})
+
+		Convey("When user changes go through store", func() {
+			gid, err := ds.User.Create(ctx, "gop@pips.com", "7564756fg")
+			So(err, ShouldEqual, nil)
+
+			_, err = ds.User.Create(ctx, "gop@pips.com", "7564756fg")
+			So(err, ShouldEqual, models.ErrAlreadyCreated)
+
+			err = ds.User.ChangePassword(ctx, gid, "", "BadPassword", "NewPassword")
+			So(err, ShouldEqual, models.ErrLoginIncorrect)
+
+			err = ds.User.Delete(ctx, gid, "7564756fg")
+			So(err, ShouldEqual, nil)
+
+			items, err := ds.Webhook.Claim(ctx, 10, time.Minute)
+			So(err, ShouldEqual, nil)
+
+			Convey("Events must be enqueued only for committed ones", func() {
+				var events []string
+				for _, it := range items {
+					events = append(events, it.URL+" "+it.Event)
+				}
+				So(events, ShouldHaveLength, 3)
+				So(events, ShouldContain, "https://crawler.local/hook "+models.WebhookUserRegistered)
+				So(events, ShouldContain, "https://other.local/hook "+models.WebhookUserRegistered)
+				So(events, ShouldContain, "https://other.local/hook "+models.WebhookUserDeleted)
+			})
+		})
+
+		Convey("When event is not subscribed", func() {
+			ds.Webhook.Enqueue(ctx, models.DefaultTenant, models.WebhookUserDeleted, uid)
+
+			items, err := ds.Webhook.Claim(ctx, 10, time.Minute)
+			So(err, ShouldEqual, nil)
+			So(len(items), ShouldEqual, 1)
+			So(items[0].URL, ShouldEqual, "https://other.local/hook")
+			So(items[0].Payload, ShouldContainSubstring, `"tenant":"default"`)
+		})
+
+		Convey("When delivery fails and retried", func() {
+			ds.Webhook.Enqueue(ctx, models.DefaultTenant, models.WebhookUserRegistered, uid)
+
+			items, _ := ds.Webhook.Claim(ctx, 10, time.Minute)
+			So(len(items), ShouldEqual, 2)
+
+			// claimed items are leased
+			again, _ := ds.Webhook.Claim(ctx, 10, time.Minute)
+			So(len(again), ShouldEqual, 0)
+
+			for _, item := range items {
+				retry := time.Now().Add(-time.Second)
+				err := ds.Webhook.Complete(ctx, models.WebhookDelivery{
+					OutboxID:   item.ID,
+					WebhookID:  item.WebhookID,
+					Event:      item.Event,
+					Attempt:    1,
+					StatusCode: 500,
+				}, &retry)
+				So(err, ShouldEqual, nil)
+			}
+
+			items, _ = ds.Webhook.Claim(ctx, 10, time.Minute)
+			So(len(items), ShouldEqual, 2)
+			So(items[0].Attempts, ShouldEqual, 1)
+
+			for _, item := range items {
+				ds.Webhook.Complete(ctx, models.WebhookDelivery{
+					OutboxID:   item.ID,
+					WebhookID:  item.WebhookID,
+					Event:      item.Event,
+					Attempt:    2,
+					Success:    true,
+					StatusCode: 200,
+				}, nil)
+			}
+
+			log, err := ds.Webhook.Deliveries(ctx, hook.ID, 10)
+			So(err, ShouldEqual, nil)
+			So(len(log), ShouldEqual, 2)
+			So(log[0].Success, ShouldBeTrue)
+
+			items, _ = ds.Webhook.Claim(ctx, 10, time.Minute)
+			So(len(items), ShouldEqual, 0)
+		})
+	}, t)
+}
+
+func TestMailOutbox(t *testing.T) {
+	bootstrap("Mail outbox", func(ds *models.DataStore) {
+		ctx := context.Background()
+		err := ds.Mail.Enqueue(ctx, models.Mail{To: "kis@pips.com", Subject: "Invitation", Body: "token=secret"})
+		So(err, ShouldEqual, nil)
+
+		mails, err := ds.Mail.Claim(ctx, 10, time.Minute)
+		So(err, ShouldEqual, nil)
+		So(len(mails), ShouldEqual, 1)
+		So(mails[0].Body, ShouldEqual, "token=secret")
+
+		// claimed mails are leased
+		again, _ := ds.Mail.Claim(ctx, 10, time.Minute)
+		So(len(again), ShouldEqual, 0)
+
+		Convey("When sending fails and retried", func() {
+			retry := time.Now().Add(-time.Second)
+			So(ds.Mail.Complete(ctx, mails[0].ID, 1, "421 try later", &retry), ShouldEqual, nil)
+
+			mails, _ = ds.Mail.Claim(ctx, 10, time.Minute)
+			So(len(mails), ShouldEqual, 1)
+			So(mails[0].Attempts, ShouldEqual, 1)
+		})
+
+		Convey("When sent", func() {
+			So(ds.Mail.Complete(ctx, mails[0].ID, 1, "", nil), ShouldEqual, nil)
+
+			Convey("Body must be erased", func() {
+				var body string
+				So(ds.Postgres.Get(&body, "SELECT body FROM mail_outbox WHERE id=$1", mails[0].ID), ShouldEqual, nil)
+				So(body, ShouldEqual, "")
+			})
+		})
+
+		Convey("When mail is unknown", func() {
+			So(ds.Mail.Complete(ctx, -1, 1, "", nil), ShouldEqual, models.ErrMailNotFound)
+		})
+	}, t)
+}
+
+func TestEventsOutbox(t *testing.T) {
+	bootstrap("Domain events publishing", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		publisher := &workers.EventPublisher{
+			Store:  ds.Event,
+			Redis:  ds.Redis,
+			Stream: "test:auth:events",
+			Batch:  10,
+		}
+		defer ds.Redis.Del(publisher.Stream)
+
+		ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+		ses, _ := ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+		ds.User.Logout(ctx, ses.ID)
+
+		Convey("When published", func() {
+			n, err := ds.Event.Publish(ctx, 10, func(e models.DomainEvent) (string, error) {
+				return publisher.Redis.XAdd(&redis.XAddArgs{
+					Stream: publisher.Stream,
+					Values: map[string]interface{}{"event_id": e.ID, "type": e.Type},
+				}).Result()
+			})
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 3)
+
+			list, _ := ds.Redis.XRange(publisher.Stream, "-", "+").Result()
+			So(len(list), ShouldEqual, 3)
+			So(list[0].Values["type"], ShouldEqual, models.DomainUserCreated)
+			So(list[1].Values["type"], ShouldEqual, models.DomainUserLoggedIn)
+			So(list[2].Values["type"], ShouldEqual, models.DomainSessionRevoked)
+
+			n, _ = ds.Event.Publish(ctx, 10, func(e models.DomainEvent) (string, error) {
+				return "", nil
+			})
+			So(n, ShouldEqual, 0)
+		})
+
+		Convey("When failed to publish", func() {
+			n, err := ds.Event.Publish(ctx, 10, func(e models.DomainEvent) (string, error) {
+				if e.Type == models.DomainSessionRevoked {
+					return "", errors.New("redis is down")
+				}
+				return "1-1", nil
+			})
+			So(err, ShouldNotEqual, nil)
+			So(n, ShouldEqual, 2)
+
+			var left []models.DomainEvent
+			ds.Event.Publish(ctx, 10, func(e models.DomainEvent) (string, error) {
+				left = append(left, e)
+				return "1-2", nil
+			})
+			So(len(left), ShouldEqual, 1)
+			So(left[0].Type, ShouldEqual, models.DomainSessionRevoked)
+		})
+
+		Convey("When replayed", func() {
+			n, err := publisher.Replay(0)
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 3)
+
+			list, _ := ds.Redis.XRange(publisher.Stream, "-", "+").Result()
+			So(len(list), ShouldEqual, 3)
+			So(list[0].Values["aggregate_id"], ShouldNotBeBlank)
+		})
+	}, t)
+}
+
+// brokenSessions fails deletes after break is set
+type brokenSessions struct {
+	models.ISessionStore
+	broken bool
+}
+
+func (ss *brokenSessions) Delete(ctx context.Context, sesid string) error {
+	if ss.broken {
+		return errors.New("session backend is down")
+	}
+	return ss.ISessionStore.Delete(ctx, sesid)
+}
+
+func TestEventsBeforeSessions(t *testing.T) {
+	bootstrap("Domain events of sessions", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		sessions := &brokenSessions{ISessionStore: models.NewMemorySessionStore()}
+		users := models.NewUserStore(ds.Postgres, sessions)
+
+		users.Create(ctx, "kis@pips.com", "7564756fg")
+		ses, err := users.Login(ctx, "kis@pips.com", "7564756fg")
+		So(err, ShouldEqual, nil)
+
+		types := func() []string {
+			var res []string
+			ds.Event.Replay(ctx, 0, func(e models.DomainEvent) error {
+				res = append(res, e.Type)
+				return nil
+			})
+			return res
+		}
+
+		Convey("Login must be recorded with live session", func() {
+			So(types(), ShouldResemble, []string{models.DomainUserCreated, models.DomainUserLoggedIn})
+		})
+
+		Convey("When session can't be deleted on logout", func() {
+			sessions.broken = true
+			So(users.Logout(ctx, ses.ID), ShouldNotEqual, nil)
+
+			Convey("Revoke must be recorded and retry must kill session", func() {
+				So(types(), ShouldResemble, []string{models.DomainUserCreated, models.DomainUserLoggedIn, models.DomainSessionRevoked})
+
+				sessions.broken = false
+				So(users.Logout(ctx, ses.ID), ShouldEqual, nil)
+				_, err := users.Auth(ctx, ses.ID)
+				So(err, ShouldEqual, models.ErrAuthIncorrect)
+			})
+		})
+	}, t)
+}
+
+func TestOAuthStore(t *testing.T) {
+	bootstrap("OAuth store", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		client := &models.OAuthClient{
+			Name:         "Crawler",
+			RedirectURIs: []string{"https://app.local/cb"},
+			GrantTypes:   []string{models.GrantAuthorizationCode, models.GrantClientCredentials},
+			Scopes:       []string{"crawl:read", "crawl:write"},
+		}
+		secret, err := ds.OAuth.CreateClient(ctx, client, true)
+		So(err, ShouldEqual, nil)
+		So(secret, ShouldNotBeBlank)
+
+		uid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+
+		Convey("When client authenticates", func() {
+			c, err := ds.OAuth.AuthenticateClient(ctx, client.ID, secret)
+			So(err, ShouldEqual, nil)
+			So(c.AllowsScope("crawl:read crawl:write"), ShouldBeTrue)
+
+			_, err = ds.OAuth.AuthenticateClient(ctx, client.ID, "wrong")
+			So(err, ShouldEqual, models.ErrClientIncorrect)
+		})
+
+		Convey("When consent is extended", func() {
+			ds.OAuth.SaveConsent(ctx, uid, client.ID, "crawl:read")
+
+			ok, _ := ds.OAuth.HasConsent(ctx, uid, client.ID, "crawl:read crawl:write")
+			So(ok, ShouldBeFalse)
+
+			ds.OAuth.SaveConsent(ctx, uid, client.ID, "crawl:write")
+
+			ok, err := ds.OAuth.HasConsent(ctx, uid, client.ID, "crawl:read crawl:write")
+			So(err, ShouldEqual, nil)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("When code is taken twice", func() {
+			code, err := ds.OAuth.CreateCode(ctx, models.AuthCode{ClientID: client.ID, UserID: uid, Scope: "crawl:read"})
+			So(err, ShouldEqual, nil)
+
+			c, err := ds.OAuth.TakeCode(ctx, code)
+			So(err, ShouldEqual, nil)
+			So(c.UserID, ShouldEqual, uid)
+
+			_, err = ds.OAuth.TakeCode(ctx, code)
+			So(err, ShouldEqual, models.ErrGrantIncorrect)
+		})
+
+		Convey("When token is issued for user", func() {
+			ses, _ := ds.User.CreateSession(ctx, uid, []string{"crawl:read"})
+
+			tok, err := ds.OAuth.IssueToken(ctx, models.OAuthGrant{ClientID: client.ID, UserID: uid, Scope: "crawl:read"}, ses.ID, true)
+			So(err, ShouldEqual, nil)
+			So(tok.AccessToken, ShouldEqual, ses.ID)
+
+			auid, err := ds.User.Auth(ctx, tok.AccessToken)
+			So(err, ShouldEqual, nil)
+			So(auid, ShouldEqual, uid)
+
+			g, err := ds.OAuth.TakeRefreshToken(ctx, tok.RefreshToken)
+			So(err, ShouldEqual, nil)
+			So(g.Scope, ShouldEqual, "crawl:read")
+
+			_, err = ds.OAuth.TakeRefreshToken(ctx, tok.RefreshToken)
+			So(err, ShouldEqual, models.ErrGrantIncorrect)
+		})
+	}, t)
+}
+
+func TestKeyStore(t *testing.T) {
+	bootstrap("OIDC signing keys", func(ds *models.DataStore) {
+		ctx := context.Background()
+		key := []byte("0123456789abcdef0123456789abcdef")
+
+		k, err := models.NewKeyStore(ds.Postgres, key).SigningKey(ctx)
+		So(err, ShouldEqual, nil)
+		So(k.ID, ShouldNotBeBlank)
+
+		Convey("Key must be stored once and encrypted", func() {
+			keys := models.NewKeyStore(ds.Postgres, key)
+			again, err := keys.SigningKey(ctx)
+			So(err, ShouldEqual, nil)
+			So(again.ID, ShouldEqual, k.ID)
+
+			list, err := keys.PublicKeys(ctx)
+			So(err, ShouldEqual, nil)
+			So(len(list), ShouldEqual, 1)
+
+			var stored string
+			ds.Postgres.Get(&stored, "SELECT private_key FROM oidc_keys WHERE id=$1", k.ID)
+			So(stored, ShouldNotContainSubstring, "PRIVATE KEY")
+		})
+
+		Convey("Key must not be read with other key", func() {
+			_, err := models.NewKeyStore(ds.Postgres, []byte("fedcba9876543210fedcba9876543210")).PublicKeys(ctx)
+			So(err, ShouldEqual, models.ErrKeySealed)
+		})
+
+		Convey("Key stored before encryption must be encrypted on load", func() {
+			old, _ := models.NewSigningKey()
+			data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(old.Key)})
+			ds.Postgres.Exec("INSERT INTO oidc_keys (id, private_key, created_at) VALUES ($1,$2,$3)", old.ID, string(data), old.CreatedAt)
+
+			list, err := models.NewKeyStore(ds.Postgres, key).PublicKeys(ctx)
+			So(err, ShouldEqual, nil)
+			So(len(list), ShouldEqual, 2)
+			So(list[0].ID, ShouldEqual, old.ID)
+
+			var stored string
+			ds.Postgres.Get(&stored, "SELECT private_key FROM oidc_keys WHERE id=$1", old.ID)
+			So(stored, ShouldNotContainSubstring, "PRIVATE KEY")
+		})
+	}, t)
+}
+
+func TestIdentities(t *testing.T) {
+	bootstrap("External identities", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		ext := models.ExternalIdentity{Provider: "corp", Subject: "idp-1", Email: "fed@pips.com", EmailVerified: true}
+
+		ses, created, err := ds.Identity.Login(ctx, ext)
+		So(err, ShouldEqual, nil)
+		So(created, ShouldBeTrue)
+
+		uid, err := ds.User.Auth(ctx, ses.ID)
+		So(err, ShouldEqual, nil)
+		So(uid, ShouldEqual, ses.UserID)
+
+		Convey("Second login must find the same user", func() {
+			again, created, err := ds.Identity.Login(ctx, ext)
+			So(err, ShouldEqual, nil)
+			So(created, ShouldBeFalse)
+			So(again.UserID, ShouldEqual, ses.UserID)
+		})
+
+		Convey("Password login must not work for him", func() {
+			_, err := ds.User.Login(ctx, "fed@pips.com", "")
+			So(err, ShouldEqual, models.ErrLoginIncorrect)
+		})
+
+		Convey("Session must remember sign in time", func() {
+			got, err := ds.User.AuthSession(ctx, ses.ID)
+			So(err, ShouldEqual, nil)
+			So(got.AuthTime, ShouldNotBeNil)
+			So(*got.AuthTime, ShouldHappenWithin, time.Second, ses.CreatedAt)
+		})
+
+		Convey("He must be able to set first password", func() {
+			So(ds.User.ChangePassword(ctx, ses.UserID, ses.ID, "", "7564756fg"), ShouldEqual, nil)
+
+			_, err := ds.User.Login(ctx, "fed@pips.com", "7564756fg")
+			So(err, ShouldEqual, nil)
+
+			So(ds.User.ChangePassword(ctx, ses.UserID, ses.ID, "", "other-password"), ShouldEqual, models.ErrLoginIncorrect)
+		})
+
+		Convey("He must be able to delete account", func() {
+			So(ds.User.Delete(ctx, ses.UserID, "any"), ShouldEqual, models.ErrLoginIncorrect)
+			So(ds.User.Delete(ctx, ses.UserID, ""), ShouldEqual, nil)
+
+			_, err := ds.User.Auth(ctx, ses.ID)
+			So(err, ShouldEqual, models.ErrAuthIncorrect)
+		})
+
+		Convey("When local account has the email", func() {
+			local, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+
+			_, _, err := ds.Identity.Login(ctx, models.ExternalIdentity{Provider: "corp", Subject: "idp-2", Email: "kis@pips.com"})
+			So(err, ShouldEqual, models.ErrIdentityConflict)
+
+			linked, created, err := ds.Identity.Login(ctx, models.ExternalIdentity{Provider: "corp", Subject: "idp-2", Email: "kis@pips.com", EmailVerified: true})
+			So(err, ShouldEqual, nil)
+			So(created, ShouldBeFalse)
+			So(linked.UserID, ShouldEqual, local)
+
+			list, err := ds.Identity.List(ctx, local)
+			So(err, ShouldEqual, nil)
+			So(len(list), ShouldEqual, 1)
+		})
+
+		Convey("State must be taken once", func() {
+			st, err := ds.Identity.CreateState(ctx, "corp")
+			So(err, ShouldEqual, nil)
+
+			taken, err := ds.Identity.TakeState(ctx, st.State)
+			So(err, ShouldEqual, nil)
+			So(taken.Nonce, ShouldEqual, st.Nonce)
+
+			_, err = ds.Identity.TakeState(ctx, st.State)
+			So(err, ShouldEqual, models.ErrGrantIncorrect)
+		})
+	}, t)
+}
+
+func TestOAuthIntrospect(t *testing.T) {
+	bootstrap("OAuth introspection", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		uid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+		ses, _ := ds.User.CreateSession(ctx, uid, []string{"crawl:read"})
+
+		tok, err := ds.OAuth.IssueToken(ctx, models.OAuthGrant{ClientID: "client", UserID: uid, Scope: "crawl:read"}, ses.ID, true)
+		So(err, ShouldEqual, nil)
+
+		Convey("Access token must be found", func() {
+			info, err := ds.OAuth.Introspect(ctx, tok.AccessToken)
+			So(err, ShouldEqual, nil)
+			So(info.Type, ShouldEqual, models.TokenTypeAccess)
+			So(info.Grant.UserID, ShouldEqual, uid)
+			So(info.ExpiresAt, ShouldHappenAfter, time.Now())
+		})
+
+		Convey("Refresh token must be found", func() {
+			info, err := ds.OAuth.Introspect(ctx, tok.RefreshToken)
+			So(err, ShouldEqual, nil)
+			So(info.Type, ShouldEqual, models.TokenTypeRefresh)
+		})
+
+		Convey("Plain session must be found", func() {
+			other, _ := ds.User.CreateSession(ctx, uid, models.DefaultScopes)
+
+			info, err := ds.OAuth.Introspect(ctx, other.ID)
+			So(err, ShouldEqual, nil)
+			So(info.Type, ShouldEqual, models.TokenTypeSession)
+			So(info.Grant.UserID, ShouldEqual, uid)
+		})
+
+		Convey("Access token must die with session", func() {
+			ds.User.Logout(ctx, ses.ID)
+
+			_, err := ds.OAuth.Introspect(ctx, tok.AccessToken)
+			So(err, ShouldEqual, models.ErrGrantIncorrect)
+		})
+
+		Convey("Revoked token must be inactive", func() {
+			So(ds.OAuth.Revoke(ctx, tok.RefreshToken), ShouldEqual, nil)
+
+			_, err := ds.OAuth.Introspect(ctx, tok.RefreshToken)
+			So(err, ShouldEqual, models.ErrGrantIncorrect)
+		})
+	}, t)
+}
+
+func TestAPIKeys(t *testing.T) {
+	bootstrap("API keys", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		uid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+
+		k, key, err := ds.APIKey.Create(ctx, uid, "crawler", []string{"crawl:read"}, nil)
+		So(err, ShouldEqual, nil)
+		So(models.IsAPIKey(key), ShouldBeTrue)
+
+		Convey("Key must authenticate and be touched", func() {
+			ak, err := ds.APIKey.Authenticate(ctx, key)
+			So(err, ShouldEqual, nil)
+			So(ak.UserID, ShouldEqual, uid)
+			So(ak.LastUsedAt, ShouldNotBeNil)
+
+			list, _ := ds.APIKey.List(ctx, uid)
+			So(list[0].LastUsedAt, ShouldNotBeNil)
+		})
+
+		Convey("Wrong secret must not authenticate", func() {
+			_, err := ds.APIKey.Authenticate(ctx, key+"x")
+			So(err, ShouldEqual, models.ErrAPIKeyIncorrect)
+		})
+
+		Convey("Revoked key must not authenticate", func() {
+			So(ds.APIKey.Revoke(ctx, uid, k.ID), ShouldEqual, nil)
+			So(ds.APIKey.Revoke(ctx, uid, k.ID), ShouldEqual, models.ErrAPIKeyNotFound)
+
+			_, err := ds.APIKey.Authenticate(ctx, key)
+			So(err, ShouldEqual, models.ErrAPIKeyIncorrect)
+		})
+
+		Convey("Expired key must not authenticate", func() {
+			past := time.Now().Add(-time.Minute)
+			_, expired, _ := ds.APIKey.Create(ctx, uid, "old", nil, &past)
+
+			_, err := ds.APIKey.Authenticate(ctx, expired)
+			So(err, ShouldEqual, models.ErrAPIKeyIncorrect)
+		})
+
+		Convey("Keys of deleted user must not authenticate", func() {
+			ds.User.Delete(ctx, uid, "7564756fg")
+
+			_, err := ds.APIKey.Authenticate(ctx, key)
+			So(err, ShouldEqual, models.ErrAPIKeyIncorrect)
+		})
+	}, t)
+}
+
+func TestSessionScopes(t *testing.T) {
+	bootstrap("Session scopes", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		uid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+
+		Convey("Password login must get default scopes", func() {
+			ses, _ := ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+
+			auth, err := ds.User.AuthSession(ctx, ses.ID)
+			So(err, ShouldEqual, nil)
+			So(auth.UserID, ShouldEqual, uid)
+			So(auth.Scopes, ShouldResemble, models.DefaultScopes)
+		})
+
+		Convey("Limited session must keep its scopes", func() {
+			ses, _ := ds.User.CreateSession(ctx, uid, []string{models.ScopeCrawlRead})
+
+			auth, err := ds.User.AuthSession(ctx, ses.ID)
+			So(err, ShouldEqual, nil)
+			So(auth.Scopes, ShouldResemble, []string{models.ScopeCrawlRead})
+			So(auth.ExpiresAt, ShouldHappenAfter, time.Now())
+		})
+
+		Convey("Session without scopes must get default ones", func() {
+			ds.Redis.Set("user:session:legacy", uid.String(), time.Minute)
+
+			auth, err := ds.User.AuthSession(ctx, "legacy")
+			So(err, ShouldEqual, nil)
+			So(auth.UserID, ShouldEqual, uid)
+			So(auth.Scopes, ShouldResemble, models.DefaultScopes)
+		})
+	}, t)
+}
+
+func TestOrgs(t *testing.T) {
+	bootstrap("Organizations", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		owner, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+		member, _ := ds.User.Create(ctx, "gop@pips.com", "7564756fg")
+
+		o, err := ds.Org.Create(ctx, "Crawl Team", owner)
+		So(err, ShouldEqual, nil)
+
+		role, err := ds.Org.Role(ctx, o.ID, owner)
+		So(err, ShouldEqual, nil)
+		So(role, ShouldEqual, models.RoleOwner)
+
+		Convey("Invitation must be accepted once", func() {
+			_, token, err := ds.Org.Invite(ctx, o.ID, "gop@pips.com", models.RoleAdmin, owner)
+			So(err, ShouldEqual, nil)
+
+			inv, err := ds.Org.Invitation(ctx, token)
+			So(err, ShouldEqual, nil)
+			So(inv.Email, ShouldEqual, "gop@pips.com")
+
+			m, err := ds.Org.Accept(ctx, token, member)
+			So(err, ShouldEqual, nil)
+			So(m.Role, ShouldEqual, models.RoleAdmin)
+			So(m.OrgName, ShouldEqual, "Crawl Team")
+
+			_, err = ds.Org.Accept(ctx, token, member)
+			So(err, ShouldEqual, models.ErrInvitationIncorrect)
+
+			list, _ := ds.Org.Memberships(ctx, member)
+			So(len(list), ShouldEqual, 1)
+
+			members, _ := ds.Org.Members(ctx, o.ID)
+			So(len(members), ShouldEqual, 2)
+		})
+
+		Convey("Invited account must be created with membership", func() {
+			_, token, err := ds.Org.Invite(ctx, o.ID, "new@pips.com", models.RoleMember, owner)
+			So(err, ShouldEqual, nil)
+
+			m, err := ds.Org.AcceptAsNew(ctx, token, "7564756fg")
+			So(err, ShouldEqual, nil)
+			So(m.Role, ShouldEqual, models.RoleMember)
+
+			ses, err := ds.User.Login(ctx, "new@pips.com", "7564756fg")
+			So(err, ShouldEqual, nil)
+			So(ses.UserID, ShouldEqual, m.UserID)
+
+			Convey("When account exists invitation must stay usable", func() {
+				_, token, _ := ds.Org.Invite(ctx, o.ID, "gop@pips.com", models.RoleMember, owner)
+
+				_, err = ds.Org.AcceptAsNew(ctx, token, "7564756fg")
+				So(err, ShouldEqual, models.ErrAlreadyCreated)
+
+				_, err = ds.Org.Accept(ctx, token, member)
+				So(err, ShouldEqual, nil)
+			})
+		})
+
+		Convey("Last owner must not be removed", func() {
+			So(ds.Org.RemoveMember(ctx, o.ID, owner), ShouldEqual, models.ErrLastOwner)
+			So(ds.Org.RemoveMember(ctx, o.ID, member), ShouldEqual, models.ErrNotMember)
+		})
+	}, t)
+}
+
+func TestTenants(t *testing.T) {
+	bootstrap("Tenant isolation", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		acme, globex := ds.ForTenant("acme"), ds.ForTenant("globex")
+
+		acmeID, err := acme.User.Create(ctx, "kis@pips.com", "7564756fg")
+		So(err, ShouldEqual, nil)
+
+		Convey("Same email must be free in other tenant", func() {
+			globexID, err := globex.User.Create(ctx, "kis@pips.com", "other-password")
+			So(err, ShouldEqual, nil)
+			So(globexID, ShouldNotEqual, acmeID)
+
+			_, err = acme.User.Create(ctx, "kis@pips.com", "7564756fg")
+			So(err, ShouldEqual, models.ErrAlreadyCreated)
+		})
+
+		Convey("Login must not cross tenants", func() {
+			_, err := globex.User.Login(ctx, "kis@pips.com", "7564756fg")
+			So(err, ShouldEqual, models.ErrLoginIncorrect)
+
+			_, err = ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+			So(err, ShouldEqual, models.ErrLoginIncorrect)
+		})
+
+		Convey("Session must be valid only in its tenant", func() {
+			ses, err := acme.User.Login(ctx, "kis@pips.com", "7564756fg")
+			So(err, ShouldEqual, nil)
+
+			id, err := acme.User.Auth(ctx, ses.ID)
+			So(err, ShouldEqual, nil)
+			So(id, ShouldEqual, acmeID)
+
+			_, err = globex.User.Auth(ctx, ses.ID)
+			So(err, ShouldNotEqual, nil)
+
+			_, err = ds.User.Auth(ctx, ses.ID)
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Users list must contain only users of tenant", func() {
+			list, err := globex.User.GetAll(ctx)
+			So(err, ShouldEqual, nil)
+			So(len(list), ShouldEqual, 0)
+
+			_, err = globex.User.Get(ctx, acmeID)
+			So(err, ShouldEqual, models.ErrUserNotFound)
+		})
+
+		Convey("Organization must be seen only in its tenant", func() {
+			o, err := acme.Org.Create(ctx, "Crawl Team", acmeID)
+			So(err, ShouldEqual, nil)
+
+			_, token, err := acme.Org.Invite(ctx, o.ID, "gop@pips.com", models.RoleMember, acmeID)
+			So(err, ShouldEqual, nil)
+
+			_, err = globex.Org.Get(ctx, o.ID)
+			So(err, ShouldEqual, models.ErrOrgNotFound)
+
+			members, _ := globex.Org.Members(ctx, o.ID)
+			So(len(members), ShouldEqual, 0)
+
+			_, err = globex.Org.Invitation(ctx, token)
+			So(err, ShouldEqual, models.ErrInvitationIncorrect)
+
+			globexID, _ := globex.User.Create(ctx, "gop@pips.com", "7564756fg")
+			_, err = globex.Org.Accept(ctx, token, globexID)
+			So(err, ShouldEqual, models.ErrInvitationIncorrect)
+		})
+
+		Convey("OAuth grants and federation states must stay in their tenant", func() {
+			code, err := acme.OAuth.CreateCode(ctx, models.AuthCode{ClientID: "client", UserID: acmeID, Scope: "crawl:read"})
+			So(err, ShouldEqual, nil)
+
+			_, err = globex.OAuth.TakeCode(ctx, code)
+			So(err, ShouldEqual, models.ErrGrantIncorrect)
+
+			tok, err := acme.OAuth.IssueToken(ctx, models.OAuthGrant{ClientID: "client", Scope: "crawl:read"}, "", true)
+			So(err, ShouldEqual, nil)
+
+			_, err = globex.OAuth.Introspect(ctx, tok.AccessToken)
+			So(err, ShouldEqual, models.ErrGrantIncorrect)
+
+			_, err = globex.OAuth.TakeRefreshToken(ctx, tok.RefreshToken)
+			So(err, ShouldEqual, models.ErrGrantIncorrect)
+
+			info, err := acme.OAuth.Introspect(ctx, tok.RefreshToken)
+			So(err, ShouldEqual, nil)
+			So(info.Type, ShouldEqual, models.TokenTypeRefresh)
+
+			st, err := acme.Identity.CreateState(ctx, "corp")
+			So(err, ShouldEqual, nil)
+
+			_, err = globex.Identity.TakeState(ctx, st.State)
+			So(err, ShouldEqual, models.ErrGrantIncorrect)
+		})
+	}, t)
+}
+
+func TestImpersonation(t *testing.T) {
+	bootstrap("Impersonation", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		admin, _ := ds.User.Create(ctx, "admin@pips.com", "7564756fg")
+		uid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+
+		Convey("Session must be marked and short", func() {
+			ses, err := ds.User.Impersonate(ctx, admin, uid)
+			So(err, ShouldEqual, nil)
+
+			auth, err := ds.User.AuthSession(ctx, ses.ID)
+			So(err, ShouldEqual, nil)
+			So(auth.UserID, ShouldEqual, uid)
+			So(*auth.ImpersonatedBy, ShouldEqual, admin)
+			So(auth.ExpiresAt, ShouldHappenBefore, time.Now().Add(models.ImpersonationTTL+time.Second))
+		})
+
+		Convey("Own session must not be marked", func() {
+			ses, _ := ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+
+			auth, err := ds.User.AuthSession(ctx, ses.ID)
+			So(err, ShouldEqual, nil)
+			So(auth.ImpersonatedBy, ShouldBeNil)
+		})
+
+		Convey("Deleted user must not be impersonated", func() {
+			So(ds.User.Delete(ctx, uid, "7564756fg"), ShouldEqual, nil)
+
+			_, err := ds.User.Impersonate(ctx, admin, uid)
+			So(err, ShouldEqual, models.ErrUserNotFound)
+		})
+	}, t)
+}
+
+func TestSessionIndex(t *testing.T) {
+	bootstrap("Session index", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		uid, _ := ds.User.Create(ctx, "kis@pips.com", "7564756fg")
+		ses, _ := ds.User.Login(ctx, "kis@pips.com", "7564756fg")
+
+		Convey("Session must be counted until logout", func() {
+			n, err := ds.Session.Count(ctx)
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+
+			ds.User.Logout(ctx, ses.ID)
+
+			n, _ = ds.Session.Count(ctx)
+			So(n, ShouldEqual, 0)
+		})
+
+		Convey("Index must be hash tagged by user", func() {
+			n, err := ds.Redis.ZCard("user:sessions:{" + uid.String() + "}").Result()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+		})
+
+		Convey("Sessions of old index must be listed and killed", func() {
+			ds.Redis.Set("user:session:legacy", uid.String(), time.Minute)
+			ds.Redis.ZAdd("user:sessions:"+uid.String(), redis.Z{Score: float64(time.Now().Unix()), Member: "legacy"})
+
+			list, err := ds.User.Sessions(ctx, uid)
+			So(err, ShouldEqual, nil)
+			So(len(list), ShouldEqual, 2)
+
+			So(ds.User.Delete(ctx, uid, "7564756fg"), ShouldEqual, nil)
+
+			_, err = ds.User.Auth(ctx, "legacy")
+			So(err, ShouldNotEqual, nil)
+			_, err = ds.User.Auth(ctx, ses.ID)
+			So(err, ShouldNotEqual, nil)
+		})
+	}, t)
+}
+
+func TestSQLSessions(t *testing.T) {
+	bootstrap("Sessions in postgres", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		sessions := models.NewSQLSessionStore(ds.Postgres)
+		users := models.NewUserStore(ds.Postgres, sessions)
+
+		uid, _ := users.Create(ctx, "kis@pips.com", "7564756fg")
+		ses, err := users.Login(ctx, "kis@pips.com", "7564756fg")
+		So(err, ShouldEqual, nil)
+
+		Convey("Session must be found", func() {
+			got, err := users.AuthSession(ctx, ses.ID)
+			So(err, ShouldEqual, nil)
+			So(got.UserID, ShouldEqual, uid)
+			So(got.Scopes, ShouldResemble, models.DefaultScopes)
+		})
+
+		Convey("Session must not be visible to other tenant", func() {
+			_, err := users.Tenant("initech").AuthSession(ctx, ses.ID)
+			So(err, ShouldEqual, models.ErrAuthIncorrect)
+		})
+
+		Convey("Touched session must live longer", func() {
+			So(sessions.Touch(ctx, ses.ID, 10*time.Hour), ShouldEqual, nil)
+
+			got, _ := sessions.Get(ctx, ses.ID)
+			So(got.ExpiresAt, ShouldHappenAfter, ses.ExpiresAt)
+		})
+
+		Convey("Used session must slide", func() {
+			So(sessions.Touch(ctx, ses.ID, time.Hour), ShouldEqual, nil)
+
+			_, err := users.AuthSession(ctx, ses.ID)
+			So(err, ShouldEqual, nil)
+
+			got, _ := sessions.Get(ctx, ses.ID)
+			So(got.ExpiresAt, ShouldHappenAfter, time.Now().Add(models.SessionTTL-time.Minute))
+		})
+
+		Convey("Expired session must be gone", func() {
+			So(sessions.Touch(ctx, ses.ID, -time.Second), ShouldEqual, nil)
+
+			_, err := users.Auth(ctx, ses.ID)
+			So(err, ShouldEqual, models.ErrAuthIncorrect)
+			So(sessions.Touch(ctx, ses.ID, time.Hour), ShouldEqual, models.ErrAuthIncorrect)
+
+			list, err := users.Sessions(ctx, uid)
+			So(err, ShouldEqual, nil)
+			So(len(list), ShouldEqual, 0)
+		})
+
+		Convey("Logout must kill session", func() {
+			n, _ := sessions.Count(ctx)
+			So(n, ShouldEqual, 1)
+
+			So(users.Logout(ctx, ses.ID), ShouldEqual, nil)
+
+			n, _ = sessions.Count(ctx)
+			So(n, ShouldEqual, 0)
+
+			_, err := users.Auth(ctx, ses.ID)
+			So(err, ShouldEqual, models.ErrAuthIncorrect)
+		})
+
+		Convey("Account delete must kill all sessions", func() {
+			users.Login(ctx, "kis@pips.com", "7564756fg")
+
+			list, _ := users.Sessions(ctx, uid)
+			So(len(list), ShouldEqual, 2)
+
+			So(users.Delete(ctx, uid, "7564756fg"), ShouldEqual, nil)
+
+			list, _ = users.Sessions(ctx, uid)
+			So(len(list), ShouldEqual, 0)
+		})
+	}, t)
+}
+
+func TestHealthStore(t *testing.T) {
+	bootstrap("Health checks", func(ds *models.DataStore) {
+		ctx := context.Background()
+
+		Convey("All dependencies must be up", func() {
+			checks := ds.Health.Check(ctx, time.Second)
+			So(len(checks), ShouldEqual, 3)
+			for _, check := range checks {
+				So(check.Err, ShouldEqual, nil)
+			}
+		})
+
+		Convey("Migrations behind must be reported", func() {
+			ds.Postgres.Exec("UPDATE schema_migrations SET version=version-1")
+			defer ds.Postgres.Exec("UPDATE schema_migrations SET version=version+1")
+
+			for _, check := range ds.Health.Check(ctx, time.Second) {
+				if check.Name == models.DependencyMigrations {
+					So(check.Err, ShouldNotEqual, nil)
+				}
+			}
+		})
 	}, t)
 }
@@ -0,0 +1,96 @@
+// Package logging sets up log/slog to write leveled json lines where secrets are redacted,
+// both values of secret keys and secrets found inside strings and errors
+package logging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Logger and Level are those of log/slog, aliases keep call sites independent of it
+type (
+	Logger = slog.Logger
+	Level  = slog.Level
+)
+
+const (
+	LevelDebug = slog.LevelDebug
+	LevelInfo  = slog.LevelInfo
+	LevelWarn  = slog.LevelWarn
+	LevelError = slog.LevelError
+)
+
+var ErrUnknownLevel = errors.New("unknown log level")
+
+// ParseLevel reads debug, info, warn or error in any case
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, ErrUnknownLevel
+}
+
+// New returns logger writing records of level and above to w
+func New(w io.Writer, level Level) *Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: replaceAttr,
+	}))
+}
+
+// replaceAttr writes time in utc and durations as text, values are redacted by redactAttr
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 {
+		switch a.Key {
+		case slog.TimeKey:
+			return slog.Time(a.Key, a.Value.Time().UTC())
+		case slog.LevelKey:
+			return a
+		}
+	}
+
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.String(a.Key, a.Value.Duration().String())
+	}
+	return redactAttr(a)
+}
+
+// Default returns logger set by SetDefault, until then it writes info and above to stdout
+func Default() *Logger {
+	return std
+}
+
+var std = New(os.Stdout, LevelInfo)
+
+// SetDefault replaces default logger and the one of log/slog,
+// it must be called on start before logger is used
+func SetDefault(l *Logger) {
+	std = l
+	slog.SetDefault(l)
+}
+
+type contextKey struct{}
+
+// NewContext returns ctx carrying logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns logger put by NewContext or default one
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces values of secret keys
+const Redacted = "[REDACTED]"
+
+// secretKeys are names of values which are never written, compared after
+// lowering case and replacing dashes, so header names match too
+var secretKeys = map[string]bool{
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"session":       true,
+	"session_id":    true,
+	"sesid":         true,
+	"x_session_id":  true,
+	"authorization": true,
+	"cookie":        true,
+	"set_cookie":    true,
+	"api_key":       true,
+	"code":          true,
+	"code_verifier": true,
+}
+
+// secretSuffixes catch names like new_password or webhook_secret
+var secretSuffixes = []string{"_password", "_secret", "_token"}
+
+// IsSecret reports whether value of the key must not get into logs
+func IsSecret(key string) bool {
+	k := strings.Replace(strings.ToLower(key), "-", "_", -1)
+	if secretKeys[k] {
+		return true
+	}
+	for _, s := range secretSuffixes {
+		if strings.HasSuffix(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactAttr hides value of secret key and secrets inside strings and errors,
+// headers and query values are redacted by their own keys
+func redactAttr(a slog.Attr) slog.Attr {
+	if IsSecret(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, RedactText(a.Value.String()))
+	case slog.KindAny:
+		switch x := a.Value.Any().(type) {
+		case error:
+			return slog.String(a.Key, RedactText(x.Error()))
+		case http.Header:
+			return slog.Any(a.Key, redactValues(x))
+		case url.Values:
+			return slog.Any(a.Key, redactValues(x))
+		}
+	}
+	return a
+}
+
+// secretsInText match secrets embedded in free text: key=value and json pairs of secret keys,
+// credentials of authorization schemes, passwords of urls and api keys, which start with crk_
+var secretsInText = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)((?:(?:\b|_)(?:password|secret|token)|\b(?:sesid|session_id|session|api_key|code_verifier|code|cookie))"?\s*[=:]\s*"?)([^\s"&,;]+)`),
+	regexp.MustCompile(`(?i)(\b(?:bearer|basic)\s+)([a-z0-9._~+/=-]+)`),
+	regexp.MustCompile(`(://[^:/@\s]+:)([^@/\s]+)(@)`),
+	regexp.MustCompile(`()\b(crk_[A-Za-z0-9_]+)`),
+}
+
+// RedactText replaces secrets found in s, it is applied to every string and error written
+func RedactText(s string) string {
+	for _, re := range secretsInText {
+		s = re.ReplaceAllString(s, "${1}"+Redacted+"${3}")
+	}
+	return s
+}
+
+func redactValues(values map[string][]string) map[string][]string {
+	res := make(map[string][]string, len(values))
+	for k, v := range values {
+		if IsSecret(k) {
+			v = []string{Redacted}
+		}
+		res[k] = v
+	}
+	return res
+}
@@ -1,21 +1,233 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/kataras/iris"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/federation"
 	"github.com/xssnick/crawlyzer-auth/handlers"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"github.com/xssnick/crawlyzer-auth/metrics"
 	"github.com/xssnick/crawlyzer-auth/models"
-	"log"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"github.com/xssnick/crawlyzer-auth/workers"
+	"net/http"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 )
 
 func main() {
-	ds, err := models.BuildStore()
+	conf, args, err := config.Load(os.Args[1:])
 	if err != nil {
-		log.Println("failed to init datastore!")
-		return
+		logging.Default().Error("failed to load config", "error", err)
+		os.Exit(2)
 	}
 
-	app := handlers.InitApp(ds)
+	// level is validated by config
+	level, _ := logging.ParseLevel(conf.LogLevel)
+	logger := logging.New(os.Stdout, level)
+	if conf.NodeID != "" {
+		logger = logger.With("node_id", conf.NodeID)
+	}
+	logging.SetDefault(logger)
+
+	flushTraces, err := tracing.Init(conf.Tracing, conf.NodeID)
+	if err != nil {
+		logger.Error("failed to init tracing", "error", err)
+		os.Exit(1)
+	}
+
+	ds, err := models.BuildStore(conf, logger.With("component", "datastore"))
+	if err != nil {
+		logger.Error("failed to init datastore", "error", err)
+		os.Exit(1)
+	}
+
+	if err = metrics.RegisterPools(ds.Postgres.DB, ds.Redis); err != nil {
+		logger.Error("failed to register pool metrics", "error", err)
+		ds.Close()
+		os.Exit(1)
+	}
+	err = metrics.RegisterSessions(ds.Session.Count, func(err error) {
+		logger.Error("sessions count failed", "error", err)
+	})
+	if err != nil {
+		logger.Error("failed to register session metrics", "error", err)
+		ds.Close()
+		os.Exit(1)
+	}
+
+	publisher := &workers.EventPublisher{
+		Store:    ds.Event,
+		Redis:    ds.Redis,
+		Stream:   conf.EventsStream,
+		MaxLen:   1000000,
+		Interval: time.Second,
+		Batch:    100,
+		Logger:   logger.With("component", "events"),
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "verify-audit":
+			verifyAudit(ds, logger)
+			return
+		case "replay-events":
+			replayEvents(publisher, args[1:], logger)
+			return
+		}
+	}
+
+	// the last check that can fail at startup, workers started after it have nothing to stop on exit
+	providers, err := federation.LoadProviders(conf.FederationProviders)
+	if err != nil {
+		logger.Error("failed to load identity providers", "error", err)
+		ds.Close()
+		os.Exit(1)
+	}
+
+	retention := &workers.Retention{
+		Store:    ds.User,
+		Period:   time.Duration(conf.RetentionDays) * 24 * time.Hour,
+		Interval: time.Hour,
+		Logger:   logger.With("component", "retention"),
+	}
+
+	dispatcher := &workers.WebhookDispatcher{
+		Store:       ds.Webhook,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Interval:    5 * time.Second,
+		Batch:       50,
+		MaxAttempts: 10,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    6 * time.Hour,
+		Logger:      logger.With("component", "webhooks"),
+	}
+
+	background := []worker{retention, dispatcher, publisher}
+	if conf.Mail.Enabled() {
+		const timeout, batch = 30 * time.Second, 20
+		background = append(background, &workers.MailSender{
+			Store: ds.Mail,
+			Transport: &workers.SMTPTransport{
+				Addr:     conf.Mail.SMTPAddr,
+				Username: conf.Mail.Username,
+				Password: conf.Mail.Password,
+				Timeout:  timeout,
+			},
+			From:        conf.Mail.From,
+			Interval:    5 * time.Second,
+			Batch:       batch,
+			Lease:       batch*timeout + time.Minute,
+			MaxAttempts: 8,
+			BaseDelay:   time.Minute,
+			MaxDelay:    2 * time.Hour,
+			Logger:      logger.With("component", "mail"),
+		})
+	}
+
+	stop := make(chan struct{})
+	var running sync.WaitGroup
+	for _, w := range background {
+		running.Add(1)
+		go func(w worker) {
+			defer running.Done()
+			w.Run(stop)
+		}(w)
+	}
+
+	app := handlers.InitApp(ds, conf, providers)
+
+	// on SIGINT or SIGTERM listener is closed at once and in-flight requests are drained
+	drained := make(chan struct{})
+	iris.RegisterOnInterrupt(func() {
+		defer close(drained)
+
+		ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout.Duration)
+		defer cancel()
 
-	_ = app.Run(iris.Addr(os.Getenv("LISTEN")), iris.WithoutServerError(iris.ErrServerClosed))
+		if err := app.Shutdown(ctx); err != nil {
+			logger.Error("http shutdown failed", "error", err)
+		}
+	})
+
+	err = app.Run(iris.Addr(conf.Listen), iris.WithoutServerError(iris.ErrServerClosed), iris.WithoutInterruptHandler)
+	if err != nil {
+		logger.Error("http server failed", "error", err)
+	} else {
+		<-drained
+	}
+
+	close(stop)
+	shutdown(ds, &running, flushTraces, conf.ShutdownTimeout.Duration, logger)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+type worker interface {
+	Run(stop <-chan struct{})
+}
+
+// shutdown waits for stopped workers to finish their last round, exports remaining spans and closes store,
+// workers which don't make it in time are abandoned, their work is leased or kept in outbox
+func shutdown(ds *models.DataStore, running *sync.WaitGroup, flushTraces func(context.Context) error, timeout time.Duration,
+	logger *logging.Logger) {
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warn("workers are not stopped in time", "timeout", timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := flushTraces(ctx); err != nil {
+		logger.Error("traces flush failed", "error", err)
+	}
+
+	if err := ds.Close(); err != nil {
+		logger.Error("datastore close failed", "error", err)
+	}
+	logger.Info("stopped")
+}
+
+func verifyAudit(ds *models.DataStore, logger *logging.Logger) {
+	rep, err := ds.Audit.Verify(context.Background())
+	if err != nil {
+		logger.Error("audit verification failed", "error", err)
+		os.Exit(1)
+	}
+
+	if !rep.OK() {
+		logger.Error("audit chain is broken", "event", rep.BrokenID, "reason", rep.Reason, "checked", rep.Checked)
+		os.Exit(1)
+	}
+	logger.Info("audit chain is valid", "checked", rep.Checked, "unchained", rep.Unchained)
+}
+
+func replayEvents(publisher *workers.EventPublisher, args []string, logger *logging.Logger) {
+	var from int64
+	if len(args) > 0 {
+		var err error
+		if from, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+			fmt.Fprintln(os.Stderr, "usage: replay-events [from event id]")
+			os.Exit(2)
+		}
+	}
+
+	n, err := publisher.Replay(from)
+	if err != nil {
+		logger.Error("events replay failed", "replayed", n, "error", err)
+		os.Exit(1)
+	}
+	logger.Info("events replayed", "replayed", n, "stream", publisher.Stream)
 }
@@ -0,0 +1,97 @@
+// Package metrics holds prometheus collectors of the service, they are registered
+// in own Registry, so tests and other libraries don't see them in default one
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"math"
+	"net/http"
+	"time"
+)
+
+const namespace = "crawlyzer_auth"
+
+// login results and failure reasons
+const (
+	LoginSuccess = "success"
+	LoginFailure = "failure"
+
+	ReasonBadCredentials = "bad_credentials"
+	ReasonError          = "error"
+)
+
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Requests counts served requests by registered route path, not by raw url,
+	// so path parameters don't blow up number of series
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// Logins counts password logins, reason is empty for success
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Password logins by result and failure reason.",
+	}, []string{"result", "reason"})
+
+	// Bcrypt is split by op, hash is done on registration and password change,
+	// compare on every login
+	Bcrypt = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bcrypt_duration_seconds",
+		Help:      "Time spent in bcrypt by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 10),
+	}, []string{"op"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		Requests,
+		RequestDuration,
+		Logins,
+		Bcrypt,
+	)
+}
+
+// Handler serves all metrics of Registry in prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// countTimeout bounds session counting, so scrape doesn't hang on unavailable backend
+const countTimeout = 5 * time.Second
+
+// RegisterSessions exposes number of live sessions of all tenants, count is called on every scrape,
+// when it fails the gauge is NaN and error goes to onError
+func RegisterSessions(count func(ctx context.Context) (int64, error), onError func(error)) error {
+	return Registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_sessions",
+		Help:      "Live sessions of all tenants.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), countTimeout)
+		defer cancel()
+
+		n, err := count(ctx)
+		if err != nil {
+			onError(err)
+			return math.NaN()
+		}
+		return float64(n)
+	}))
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"database/sql"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// redisPool is implemented by standalone, sentinel and cluster clients, cluster sums its nodes
+type redisPool interface {
+	PoolStats() *redis.PoolStats
+}
+
+func poolDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, nil, nil)
+}
+
+var (
+	pgMaxOpen      = poolDesc("postgres_max_open_connections", "Limit of open postgres connections, 0 is unlimited.")
+	pgOpen         = poolDesc("postgres_open_connections", "Open postgres connections.")
+	pgInUse        = poolDesc("postgres_in_use_connections", "Postgres connections in use.")
+	pgIdle         = poolDesc("postgres_idle_connections", "Idle postgres connections.")
+	pgWaitCount    = poolDesc("postgres_wait_count_total", "Times a query waited for free postgres connection.")
+	pgWaitDuration = poolDesc("postgres_wait_duration_seconds_total", "Time spent waiting for free postgres connection.")
+
+	redisTotal    = poolDesc("redis_pool_connections", "Connections in redis pool.")
+	redisIdle     = poolDesc("redis_pool_idle_connections", "Idle connections in redis pool.")
+	redisHits     = poolDesc("redis_pool_hits_total", "Times free redis connection was found in pool.")
+	redisMisses   = poolDesc("redis_pool_misses_total", "Times free redis connection was not found in pool.")
+	redisTimeouts = poolDesc("redis_pool_timeouts_total", "Times waiting for redis connection timed out.")
+	redisStale    = poolDesc("redis_pool_stale_connections_total", "Stale redis connections removed from pool.")
+)
+
+// poolCollector reads pool stats on scrape, both pools keep their own counters
+type poolCollector struct {
+	db    *sql.DB
+	redis redisPool
+}
+
+func (pc *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{pgMaxOpen, pgOpen, pgInUse, pgIdle, pgWaitCount, pgWaitDuration} {
+		ch <- d
+	}
+	if pc.redis != nil {
+		for _, d := range []*prometheus.Desc{redisTotal, redisIdle, redisHits, redisMisses, redisTimeouts, redisStale} {
+			ch <- d
+		}
+	}
+}
+
+func (pc *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := pc.db.Stats()
+	ch <- prometheus.MustNewConstMetric(pgMaxOpen, prometheus.GaugeValue, float64(s.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(pgOpen, prometheus.GaugeValue, float64(s.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(pgInUse, prometheus.GaugeValue, float64(s.InUse))
+	ch <- prometheus.MustNewConstMetric(pgIdle, prometheus.GaugeValue, float64(s.Idle))
+	ch <- prometheus.MustNewConstMetric(pgWaitCount, prometheus.CounterValue, float64(s.WaitCount))
+	ch <- prometheus.MustNewConstMetric(pgWaitDuration, prometheus.CounterValue, s.WaitDuration.Seconds())
+
+	if pc.redis == nil {
+		return
+	}
+	r := pc.redis.PoolStats()
+	ch <- prometheus.MustNewConstMetric(redisTotal, prometheus.GaugeValue, float64(r.TotalConns))
+	ch <- prometheus.MustNewConstMetric(redisIdle, prometheus.GaugeValue, float64(r.IdleConns))
+	ch <- prometheus.MustNewConstMetric(redisHits, prometheus.CounterValue, float64(r.Hits))
+	ch <- prometheus.MustNewConstMetric(redisMisses, prometheus.CounterValue, float64(r.Misses))
+	ch <- prometheus.MustNewConstMetric(redisTimeouts, prometheus.CounterValue, float64(r.Timeouts))
+	ch <- prometheus.MustNewConstMetric(redisStale, prometheus.CounterValue, float64(r.StaleConns))
+}
+
+// RegisterPools exposes postgres and redis pool stats, redis ones are skipped
+// when client doesn't report them
+func RegisterPools(db *sql.DB, red redis.UniversalClient) error {
+	pc := &poolCollector{db: db}
+	if p, ok := red.(redisPool); ok {
+		pc.redis = p
+	}
+	return Registry.Register(pc)
+}
@@ -0,0 +1,14 @@
+CREATE TABLE api_keys(
+   id UUID PRIMARY KEY,
+   user_id UUID NOT NULL REFERENCES users(id),
+   name TEXT NOT NULL,
+   prefix TEXT NOT NULL UNIQUE,
+   secret_hash TEXT NOT NULL,
+   scopes TEXT[] NOT NULL,
+   created_at TIMESTAMP NOT NULL,
+   expires_at TIMESTAMP,
+   last_used_at TIMESTAMP,
+   revoked_at TIMESTAMP
+);
+
+CREATE INDEX api_keys_user_id ON api_keys(user_id);
@@ -0,0 +1,27 @@
+CREATE TABLE organizations(
+   id UUID PRIMARY KEY,
+   name TEXT NOT NULL,
+   created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE memberships(
+   org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+   user_id UUID NOT NULL REFERENCES users(id),
+   role TEXT NOT NULL,
+   created_at TIMESTAMP NOT NULL,
+   PRIMARY KEY (org_id, user_id)
+);
+
+CREATE INDEX memberships_user_id ON memberships(user_id);
+
+CREATE TABLE invitations(
+   id UUID PRIMARY KEY,
+   org_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+   email TEXT NOT NULL,
+   role TEXT NOT NULL,
+   token_hash TEXT NOT NULL UNIQUE,
+   invited_by UUID NOT NULL REFERENCES users(id),
+   created_at TIMESTAMP NOT NULL,
+   expires_at TIMESTAMP NOT NULL,
+   accepted_at TIMESTAMP
+);
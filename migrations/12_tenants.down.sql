@@ -0,0 +1,7 @@
+ALTER TABLE user_identities DROP CONSTRAINT user_identities_pkey;
+ALTER TABLE user_identities DROP COLUMN tenant;
+ALTER TABLE user_identities ADD PRIMARY KEY (provider, subject);
+
+ALTER TABLE users DROP CONSTRAINT users_tenant_email_key;
+ALTER TABLE users DROP COLUMN tenant;
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
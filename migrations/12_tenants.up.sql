@@ -0,0 +1,7 @@
+ALTER TABLE users ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE users DROP CONSTRAINT users_email_key;
+ALTER TABLE users ADD CONSTRAINT users_tenant_email_key UNIQUE (tenant, email);
+
+ALTER TABLE user_identities ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE user_identities DROP CONSTRAINT user_identities_pkey;
+ALTER TABLE user_identities ADD PRIMARY KEY (tenant, provider, subject);
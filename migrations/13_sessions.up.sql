@@ -0,0 +1,12 @@
+CREATE TABLE sessions(
+   tenant TEXT NOT NULL DEFAULT 'default',
+   id TEXT NOT NULL,
+   user_id UUID NOT NULL REFERENCES users(id),
+   scopes TEXT[] NOT NULL,
+   impersonated_by UUID REFERENCES users(id),
+   created_at TIMESTAMP NOT NULL,
+   expires_at TIMESTAMP NOT NULL,
+   PRIMARY KEY (tenant, id)
+);
+
+CREATE INDEX sessions_user_id ON sessions(user_id);
@@ -0,0 +1,15 @@
+CREATE TABLE mail_outbox(
+   id BIGSERIAL PRIMARY KEY,
+   recipient TEXT NOT NULL,
+   subject TEXT NOT NULL,
+   body TEXT NOT NULL,
+   attempts INT NOT NULL DEFAULT 0,
+   error TEXT NOT NULL DEFAULT '',
+   next_attempt_at TIMESTAMP NOT NULL,
+   sent_at TIMESTAMP,
+   failed_at TIMESTAMP,
+   created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX mail_outbox_pending ON mail_outbox(next_attempt_at)
+   WHERE sent_at IS NULL AND failed_at IS NULL;
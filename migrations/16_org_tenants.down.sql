@@ -0,0 +1,6 @@
+DROP INDEX memberships_tenant_user_id;
+CREATE INDEX memberships_user_id ON memberships(user_id);
+
+ALTER TABLE invitations DROP COLUMN tenant;
+ALTER TABLE memberships DROP COLUMN tenant;
+ALTER TABLE organizations DROP COLUMN tenant;
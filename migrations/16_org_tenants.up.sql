@@ -0,0 +1,6 @@
+ALTER TABLE organizations ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE memberships ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE invitations ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+
+DROP INDEX memberships_user_id;
+CREATE INDEX memberships_tenant_user_id ON memberships(tenant, user_id);
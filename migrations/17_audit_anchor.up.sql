@@ -0,0 +1,11 @@
+CREATE TABLE audit_chain(
+   id INT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+   first_id BIGINT NOT NULL,
+   keyed_from BIGINT,
+   head_hash TEXT NOT NULL DEFAULT ''
+);
+
+INSERT INTO audit_chain (first_id, head_hash)
+   SELECT COALESCE(MIN(id) FILTER (WHERE hash<>''), MAX(id)+1, 1),
+      COALESCE((SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1), '')
+   FROM audit_events;
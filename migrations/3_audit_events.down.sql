@@ -0,0 +1,3 @@
+DROP TABLE audit_events;
+DROP FUNCTION audit_events_append_only();
+ALTER TABLE users DROP COLUMN is_admin;
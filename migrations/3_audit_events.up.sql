@@ -0,0 +1,25 @@
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE audit_events(
+   id BIGSERIAL PRIMARY KEY,
+   type TEXT NOT NULL,
+   actor UUID,
+   target UUID,
+   ip TEXT NOT NULL DEFAULT '',
+   user_agent TEXT NOT NULL DEFAULT '',
+   details TEXT NOT NULL DEFAULT '',
+   created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX audit_events_actor ON audit_events(actor);
+CREATE INDEX audit_events_target ON audit_events(target);
+CREATE INDEX audit_events_type ON audit_events(type);
+
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+   RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+   FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
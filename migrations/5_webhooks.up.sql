@@ -0,0 +1,38 @@
+CREATE TABLE webhooks(
+   id UUID PRIMARY KEY,
+   url TEXT NOT NULL,
+   secret TEXT NOT NULL,
+   events TEXT[] NOT NULL,
+   active BOOLEAN NOT NULL DEFAULT true,
+   created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE webhook_outbox(
+   id BIGSERIAL PRIMARY KEY,
+   webhook_id UUID NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+   event TEXT NOT NULL,
+   payload TEXT NOT NULL,
+   attempts INT NOT NULL DEFAULT 0,
+   next_attempt_at TIMESTAMP NOT NULL,
+   delivered_at TIMESTAMP,
+   failed_at TIMESTAMP,
+   created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX webhook_outbox_pending ON webhook_outbox(next_attempt_at)
+   WHERE delivered_at IS NULL AND failed_at IS NULL;
+
+CREATE TABLE webhook_deliveries(
+   id BIGSERIAL PRIMARY KEY,
+   outbox_id BIGINT NOT NULL REFERENCES webhook_outbox(id) ON DELETE CASCADE,
+   webhook_id UUID NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+   event TEXT NOT NULL,
+   attempt INT NOT NULL,
+   success BOOLEAN NOT NULL,
+   status_code INT NOT NULL DEFAULT 0,
+   error TEXT NOT NULL DEFAULT '',
+   duration_ms BIGINT NOT NULL DEFAULT 0,
+   created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id);
@@ -0,0 +1,11 @@
+CREATE TABLE events_outbox(
+   id BIGSERIAL PRIMARY KEY,
+   type TEXT NOT NULL,
+   aggregate_id UUID NOT NULL,
+   payload TEXT NOT NULL,
+   created_at TIMESTAMP NOT NULL,
+   published_at TIMESTAMP,
+   stream_id TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX events_outbox_unpublished ON events_outbox(id) WHERE published_at IS NULL;
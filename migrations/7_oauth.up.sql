@@ -0,0 +1,17 @@
+CREATE TABLE oauth_clients(
+   id TEXT PRIMARY KEY,
+   secret_hash TEXT NOT NULL DEFAULT '',
+   name TEXT NOT NULL,
+   redirect_uris TEXT[] NOT NULL,
+   grant_types TEXT[] NOT NULL,
+   scopes TEXT[] NOT NULL,
+   created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE oauth_consents(
+   user_id UUID NOT NULL REFERENCES users(id),
+   client_id TEXT NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+   scopes TEXT[] NOT NULL,
+   created_at TIMESTAMP NOT NULL,
+   PRIMARY KEY (user_id, client_id)
+);
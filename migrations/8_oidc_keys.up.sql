@@ -0,0 +1,5 @@
+CREATE TABLE oidc_keys(
+   id TEXT PRIMARY KEY,
+   private_key TEXT NOT NULL,
+   created_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,11 @@
+CREATE TABLE user_identities(
+   provider TEXT NOT NULL,
+   subject TEXT NOT NULL,
+   user_id UUID NOT NULL REFERENCES users(id),
+   email TEXT NOT NULL,
+   created_at TIMESTAMP NOT NULL,
+   last_login TIMESTAMP,
+   PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX user_identities_user_id ON user_identities(user_id);
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every key, so leaked keys are easy to find by secret scanners
+const APIKeyPrefix = "crk"
+
+// apiKeyTouchPeriod limits last_used_at updates of busy keys
+const apiKeyTouchPeriod = time.Minute
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+var ErrAPIKeyIncorrect = errors.New("incorrect, expired or revoked api key")
+
+type IAPIKeyStore interface {
+	// Tenant returns the store accepting only keys of users of the tenant
+	Tenant(tenant string) IAPIKeyStore
+
+	// Create returns new key and its full value, value is shown only once
+	Create(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error)
+	List(ctx context.Context, userID uuid.UUID) ([]APIKey, error)
+	Revoke(ctx context.Context, userID, id uuid.UUID) error
+	// Authenticate checks key value and remembers when it was used
+	Authenticate(ctx context.Context, key string) (*APIKey, error)
+}
+
+type APIKey struct {
+	ID         uuid.UUID      `db:"id" json:"id"`
+	UserID     uuid.UUID      `db:"user_id" json:"-"`
+	Name       string         `db:"name" json:"name"`
+	Prefix     string         `db:"prefix" json:"prefix"`
+	SecretHash string         `db:"secret_hash" json:"-"`
+	Scopes     pq.StringArray `db:"scopes" json:"scopes"`
+	CreatedAt  time.Time      `db:"created_at" json:"created_at"`
+	ExpiresAt  *time.Time     `db:"expires_at" json:"expires_at"`
+	LastUsedAt *time.Time     `db:"last_used_at" json:"last_used_at"`
+	RevokedAt  *time.Time     `db:"revoked_at" json:"revoked_at"`
+}
+
+// Active tells if key is neither revoked nor expired
+func (k *APIKey) Active() bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || k.ExpiresAt.After(time.Now()))
+}
+
+type APIKeyStore struct {
+	db     *sqlx.DB
+	tenant string
+}
+
+// IsAPIKey tells if value looks like api key and not like session
+func IsAPIKey(key string) bool {
+	return strings.HasPrefix(key, APIKeyPrefix+"_")
+}
+
+// splitAPIKey parses crk_<prefix>_<secret>, secret itself could contain underscores
+func splitAPIKey(key string) (string, string, bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != APIKeyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// hashAPIKeySecret is a plain sha256, secret has 256 bits of entropy so slow hash is not needed
+// and it is checked on every request
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ks *APIKeyStore) Create(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt *time.Time) (_ *APIKey, _ string, err error) {
+	ctx, span := tracing.Start(ctx, "APIKeyStore.Create", attribute.String("tenant", ks.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, "", err
+	}
+
+	p := make([]byte, 6)
+	if _, err = rand.Read(p); err != nil {
+		return nil, "", err
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	k := &APIKey{
+		ID:         id,
+		UserID:     userID,
+		Name:       name,
+		Prefix:     hex.EncodeToString(p),
+		SecretHash: hashAPIKeySecret(secret),
+		Scopes:     scopes,
+		CreatedAt:  time.Now(),
+		ExpiresAt:  expiresAt,
+	}
+
+	_, err = ks.db.NamedExecContext(ctx, "INSERT INTO api_keys (id, user_id, name, prefix, secret_hash, scopes, created_at, expires_at) "+
+		"VALUES (:id,:user_id,:name,:prefix,:secret_hash,:scopes,:created_at,:expires_at)", k)
+	if err != nil {
+		return nil, "", err
+	}
+	return k, APIKeyPrefix + "_" + k.Prefix + "_" + secret, nil
+}
+
+func (ks *APIKeyStore) List(ctx context.Context, userID uuid.UUID) (res []APIKey, err error) {
+	ctx, span := tracing.Start(ctx, "APIKeyStore.List", attribute.String("tenant", ks.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	err = ks.db.SelectContext(ctx, &res, "SELECT * FROM api_keys WHERE user_id=$1 ORDER BY created_at", userID)
+	return res, err
+}
+
+// Revoke disables key of the user, revoked keys stay listed
+func (ks *APIKeyStore) Revoke(ctx context.Context, userID, id uuid.UUID) (err error) {
+	ctx, span := tracing.Start(ctx, "APIKeyStore.Revoke", attribute.String("tenant", ks.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	res, err := ks.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at=$3 WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL",
+		id, userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (ks *APIKeyStore) Tenant(tenant string) IAPIKeyStore {
+	return &APIKeyStore{db: ks.db, tenant: tenant}
+}
+
+func (ks *APIKeyStore) Authenticate(ctx context.Context, key string) (_ *APIKey, err error) {
+	ctx, span := tracing.Start(ctx, "APIKeyStore.Authenticate", attribute.String("tenant", ks.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	prefix, secret, ok := splitAPIKey(key)
+	if !ok {
+		return nil, ErrAPIKeyIncorrect
+	}
+
+	// keys of deleted users must stop working with their sessions
+	var k APIKey
+	err = ks.db.GetContext(ctx, &k, "SELECT k.* FROM api_keys k JOIN users u ON u.id=k.user_id "+
+		"WHERE k.prefix=$1 AND u.tenant=$2 AND u.deleted_at IS NULL", prefix, ks.tenant)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAPIKeyIncorrect
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(k.SecretHash), []byte(hashAPIKeySecret(secret))) != 1 || !k.Active() {
+		return nil, ErrAPIKeyIncorrect
+	}
+
+	now := time.Now()
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > apiKeyTouchPeriod {
+		_, err = ks.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at=$2 WHERE id=$1", k.ID, now)
+		if err != nil {
+			return nil, err
+		}
+		k.LastUsedAt = &now
+	}
+	return &k, nil
+}
+
+func NewAPIKeyStore(db *sqlx.DB) *APIKeyStore {
+	return &APIKeyStore{db: db, tenant: DefaultTenant}
+}
@@ -0,0 +1,377 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EventRegister         = "register"
+	EventLoginSuccess     = "login.success"
+	EventLoginFailure     = "login.failure"
+	EventLogout           = "logout"
+	EventPasswordChange   = "password.change"
+	EventAccountDelete    = "account.delete"
+	EventAdminAuditRead   = "admin.audit_read"
+	EventAdminAuditVerify = "admin.audit_verify"
+
+	EventAdminWebhookCreate     = "admin.webhook_create"
+	EventAdminWebhookDelete     = "admin.webhook_delete"
+	EventAdminOAuthClientCreate = "admin.oauth_client_create"
+	EventAdminImpersonateStart  = "admin.impersonate_start"
+	EventAdminImpersonateStop   = "admin.impersonate_stop"
+
+	EventOAuthConsent = "oauth.consent"
+	EventOAuthToken   = "oauth.token"
+	EventOAuthRevoke  = "oauth.revoke"
+
+	EventAPIKeyCreate = "apikey.create"
+	EventAPIKeyRevoke = "apikey.revoke"
+
+	EventOrgCreate       = "org.create"
+	EventOrgInvite       = "org.invite"
+	EventOrgJoin         = "org.join"
+	EventOrgMemberRemove = "org.member_remove"
+)
+
+// AuditSink receives security relevant events, implementations must not lose them silently
+type AuditSink interface {
+	Record(ctx context.Context, e AuditEvent) error
+}
+
+type IAuditStore interface {
+	AuditSink
+	Find(ctx context.Context, f AuditFilter) ([]AuditEvent, error)
+	Each(ctx context.Context, f AuditFilter, fn func(e AuditEvent) error) error
+	Verify(ctx context.Context) (*AuditChainReport, error)
+}
+
+type AuditEvent struct {
+	ID        int64      `db:"id" json:"id"`
+	Type      string     `db:"type" json:"type"`
+	Actor     *uuid.UUID `db:"actor" json:"actor"`
+	Target    *uuid.UUID `db:"target" json:"target"`
+	IP        string     `db:"ip" json:"ip"`
+	UserAgent string     `db:"user_agent" json:"user_agent"`
+	Details   string     `db:"details" json:"details"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+
+	// PrevHash is a Hash of previous event, events written before chaining have both empty
+	PrevHash string `db:"prev_hash" json:"prev_hash"`
+	Hash     string `db:"hash" json:"hash"`
+}
+
+// AuditChainReport is a result of chain verification,
+// BrokenID is an id of first event which hash or link does not match,
+// it is zero when the whole chain is wrong, like when its newest events are gone
+type AuditChainReport struct {
+	Checked   int64  `json:"checked"`
+	Unchained int64  `json:"unchained"`
+	BrokenID  int64  `json:"broken_id,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (r *AuditChainReport) OK() bool {
+	return r.BrokenID == 0 && r.Reason == ""
+}
+
+// keyedHashPrefix marks hashes made with audit key, plain sha256 ones were written before key was configured
+const keyedHashPrefix = "hmac:"
+
+// auditAnchor is a single row telling where chain starts, since which event it is keyed
+// and what its newest hash is, so stripped hashes and dropped tail are noticed
+type auditAnchor struct {
+	ID        int    `db:"id"`
+	FirstID   int64  `db:"first_id"`
+	KeyedFrom *int64 `db:"keyed_from"`
+	HeadHash  string `db:"head_hash"`
+}
+
+// ComputeHash hashes event content together with PrevHash, id is not included
+// because it is known only after insert, order is protected by the links.
+// With key it is HMAC, so whoever can write to the table can't rebuild the chain after editing it
+func (e *AuditEvent) ComputeHash(key string) string {
+	data, _ := json.Marshal(struct {
+		PrevHash  string     `json:"prev_hash"`
+		Type      string     `json:"type"`
+		Actor     *uuid.UUID `json:"actor"`
+		Target    *uuid.UUID `json:"target"`
+		IP        string     `json:"ip"`
+		UserAgent string     `json:"user_agent"`
+		Details   string     `json:"details"`
+		CreatedAt string     `json:"created_at"`
+	}{
+		PrevHash:  e.PrevHash,
+		Type:      e.Type,
+		Actor:     e.Actor,
+		Target:    e.Target,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		Details:   e.Details,
+		CreatedAt: e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+
+	if key == "" {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return keyedHashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// EmailDigest is keyed hash of email written to audit details instead of email itself,
+// so events can be found by email while the log keeps no personal data to anonymize
+func EmailDigest(key, email string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuditFilter narrows events selection, zero fields are ignored
+type AuditFilter struct {
+	Types  []string
+	Actor  *uuid.UUID
+	Target *uuid.UUID
+	// Subject matches events where user is actor or target
+	Subject  *uuid.UUID
+	Since    *time.Time
+	Until    *time.Time
+	BeforeID int64
+	Limit    int
+}
+
+type AuditStore struct {
+	db  *sqlx.DB
+	key string
+}
+
+func (as *AuditStore) Record(ctx context.Context, e AuditEvent) (err error) {
+	ctx, span := tracing.Start(ctx, "AuditStore.Record")
+	defer func() { tracing.End(span, err) }()
+
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	// postgres keeps microseconds without zone, hash must match what we will read back
+	e.CreatedAt = e.CreatedAt.UTC().Truncate(time.Microsecond)
+
+	tx, err := as.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// writers are serialized to keep the chain linear, readers are not blocked
+	_, err = tx.ExecContext(ctx, "LOCK TABLE audit_events IN SHARE ROW EXCLUSIVE MODE")
+	if err != nil {
+		return err
+	}
+
+	err = tx.GetContext(ctx, &e.PrevHash, "SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1")
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	e.Hash = e.ComputeHash(as.key)
+
+	q, args, err := tx.BindNamed("INSERT INTO audit_events (type, actor, target, ip, user_agent, details, created_at, prev_hash, hash) "+
+		"VALUES (:type,:actor,:target,:ip,:user_agent,:details,:created_at,:prev_hash,:hash) RETURNING id", &e)
+	if err != nil {
+		return err
+	}
+	if err = tx.GetContext(ctx, &e.ID, q, args...); err != nil {
+		return err
+	}
+
+	var keyed *int64
+	if as.key != "" {
+		keyed = &e.ID
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE audit_chain SET head_hash=$1, keyed_from=COALESCE(keyed_from, $2)", e.Hash, keyed)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Verify walks whole log from the oldest event and checks hashes and links against the anchor,
+// events before the anchored start may be unchained, keyed events can't be checked without the key
+func (as *AuditStore) Verify(ctx context.Context) (_ *AuditChainReport, err error) {
+	ctx, span := tracing.Start(ctx, "AuditStore.Verify")
+	defer func() { tracing.End(span, err) }()
+
+	// anchor and events must be seen at one moment, events are written meanwhile
+	tx, err := as.db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rep := &AuditChainReport{}
+
+	var a auditAnchor
+	err = tx.GetContext(ctx, &a, "SELECT * FROM audit_chain")
+	if err == sql.ErrNoRows {
+		rep.Reason = "chain anchor is missing"
+		return rep, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryxContext(ctx, "SELECT * FROM audit_events ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prev := ""
+	chained := false
+
+	for rows.Next() {
+		var e AuditEvent
+		if err = rows.StructScan(&e); err != nil {
+			return nil, err
+		}
+
+		keyed := strings.HasPrefix(e.Hash, keyedHashPrefix)
+		key := ""
+		if keyed {
+			key = as.key
+		}
+
+		switch {
+		case e.Hash == "" && !chained && e.ID < a.FirstID:
+			rep.Unchained++
+			continue
+		case e.Hash == "":
+			rep.BrokenID, rep.Reason = e.ID, "missing hash"
+		case e.PrevHash != prev:
+			rep.BrokenID, rep.Reason = e.ID, "link to previous event does not match"
+		case keyed && as.key == "":
+			rep.BrokenID, rep.Reason = e.ID, "event is keyed, audit key is not configured"
+		case !keyed && a.KeyedFrom != nil && e.ID >= *a.KeyedFrom:
+			rep.BrokenID, rep.Reason = e.ID, "event must be keyed"
+		case e.ComputeHash(key) != e.Hash:
+			rep.BrokenID, rep.Reason = e.ID, "content does not match hash"
+		}
+
+		if !rep.OK() {
+			return rep, nil
+		}
+
+		chained = true
+		prev = e.Hash
+		rep.Checked++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if prev != a.HeadHash {
+		rep.Reason = "newest events are missing"
+	}
+	return rep, nil
+}
+
+func (as *AuditStore) Find(ctx context.Context, f AuditFilter) (res []AuditEvent, err error) {
+	ctx, span := tracing.Start(ctx, "AuditStore.Find")
+	defer func() { tracing.End(span, err) }()
+
+	q, args := f.query()
+
+	err = as.db.SelectContext(ctx, &res, q, args...)
+	return res, err
+}
+
+// Each walks matched events one by one without loading all of them
+func (as *AuditStore) Each(ctx context.Context, f AuditFilter, fn func(e AuditEvent) error) (err error) {
+	ctx, span := tracing.Start(ctx, "AuditStore.Each")
+	defer func() { tracing.End(span, err) }()
+
+	q, args := f.query()
+
+	rows, err := as.db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEvent
+		if err = rows.StructScan(&e); err != nil {
+			return err
+		}
+
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (f AuditFilter) query() (string, []interface{}) {
+	var where []string
+	var args []interface{}
+
+	cond := func(c string, v interface{}) {
+		args = append(args, v)
+		where = append(where, strings.Replace(c, "?", "$"+strconv.Itoa(len(args)), -1))
+	}
+
+	if len(f.Types) > 0 {
+		var in []string
+		for _, t := range f.Types {
+			args = append(args, t)
+			in = append(in, "$"+strconv.Itoa(len(args)))
+		}
+		where = append(where, "type IN ("+strings.Join(in, ",")+")")
+	}
+	if f.Actor != nil {
+		cond("actor=?", *f.Actor)
+	}
+	if f.Target != nil {
+		cond("target=?", *f.Target)
+	}
+	if f.Subject != nil {
+		cond("(actor=? OR target=?)", *f.Subject)
+	}
+	if f.Since != nil {
+		cond("created_at>=?", *f.Since)
+	}
+	if f.Until != nil {
+		cond("created_at<?", *f.Until)
+	}
+	if f.BeforeID > 0 {
+		cond("id<?", f.BeforeID)
+	}
+
+	q := "SELECT * FROM audit_events"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY id DESC"
+
+	if f.Limit > 0 {
+		q += " LIMIT " + strconv.Itoa(f.Limit)
+	}
+	return q, args
+}
+
+// NewAuditStore takes key of the hash chain, without it events are chained with plain sha256
+func NewAuditStore(db *sqlx.DB, key string) *AuditStore {
+	return &AuditStore{db: db, key: key}
+}
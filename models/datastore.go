@@ -1,137 +1,227 @@
 package models
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"github.com/go-redis/redis"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
-	"log"
-	"os"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"github.com/xssnick/crawlyzer-auth/logging"
 )
 
 type DataStore struct {
-	User IUserStore
-
-	Redis    *redis.Client
+	User     IUserStore
+	Audit    IAuditStore
+	Webhook  IWebhookStore
+	Mail     IMailStore
+	Event    IEventStore
+	OAuth    IOAuthStore
+	Keys     IKeyStore
+	Identity IIdentityStore
+	APIKey   IAPIKeyStore
+	Org      IOrgStore
+	Session  ISessionStore
+	Health   IHealthStore
+
+	Redis    redis.UniversalClient
 	Postgres *sqlx.DB
 }
 
-type DBConf struct {
-	Host     string
-	DBName   string
-	User     string
-	Password string
+// ForTenant returns copy of the store where users, sessions, identities, api keys
+// and organizations belong to the tenant, oauth clients, audit and webhooks are shared,
+// so handlers let only admins of default tenant manage them
+func (ds *DataStore) ForTenant(tenant string) *DataStore {
+	scoped := *ds
+	scoped.User = ds.User.Tenant(tenant)
+	scoped.OAuth = ds.OAuth.Tenant(tenant)
+	scoped.Identity = ds.Identity.Tenant(tenant)
+	scoped.APIKey = ds.APIKey.Tenant(tenant)
+	scoped.Org = ds.Org.Tenant(tenant)
+	scoped.Session = ds.Session.Tenant(tenant)
+	return &scoped
+}
+
+// Close closes connection pools in reverse order of opening,
+// it must be called after everything using the store is stopped
+func (ds *DataStore) Close() error {
+	var first error
+	if ds.Redis != nil {
+		if err := ds.Redis.Close(); err != nil {
+			first = err
+		}
+	}
+	if ds.Postgres != nil {
+		if err := ds.Postgres.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
 }
 
-func BuildStore() (*DataStore, error) {
-	db, err := InitSQLStore()
+// BuildStore connects to postgres and redis and builds all stores, redis is required
+// whatever session store is picked: oauth codes and tokens, federation states
+// and domain events stream live only there
+func BuildStore(conf *config.Config, logger *logging.Logger) (*DataStore, error) {
+	db, err := InitSQLStore(conf.Postgres, logger)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	red, err := InitRedisStore()
+	red, err := InitRedisStore(conf.Redis, logger)
 	if err != nil {
-		panic(err)
+		db.Close()
+		return nil, err
 	}
 
+	var sessions ISessionStore
+	switch conf.SessionStore {
+	case config.SessionsPostgres:
+		sessions = NewSQLSessionStore(db)
+	case config.SessionsMemory:
+		sessions = NewMemorySessionStore()
+	default:
+		sessions = NewRedisSessionStore(red)
+	}
+
+	users := NewUserStore(db, sessions)
+
+	// key is validated only when oidc is enabled, without it key store calls fail
+	keysKey, _ := conf.OIDCKey()
+
 	return &DataStore{
-		User: NewUserStore(db, red),
+		User:     NewMeteredUserStore(users),
+		Audit:    NewAuditStore(db, conf.AuditKey),
+		Webhook:  NewWebhookStore(db),
+		Mail:     NewMailStore(db),
+		Event:    NewEventStore(db),
+		OAuth:    NewOAuthStore(db, red, sessions),
+		Keys:     NewKeyStore(db, keysKey),
+		Identity: NewIdentityStore(db, red, users),
+		APIKey:   NewAPIKeyStore(db),
+		Org:      NewOrgStore(db),
+		Session:  sessions,
+		Health:   NewHealthStore(db, red, "migrations"),
 
 		Redis:    red,
 		Postgres: db,
 	}, nil
 }
 
-func InitRedisStore() (*redis.Client, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     os.Getenv("REDIS_HOST") + ":6379",
-		Password: os.Getenv("REDIS_PASSWORD"),
-		DB:       0, // use default DB
-	})
+// InitRedisStore connects to standalone redis, to master found by sentinels or to cluster
+func InitRedisStore(conf config.Redis, logger *logging.Logger) (redis.UniversalClient, error) {
+	tlsConf, err := conf.TLS.Config()
+	if err != nil {
+		logger.Error("redis tls config failed", "error", err)
+		return nil, err
+	}
+
+	var client redis.UniversalClient
+	switch conf.Mode {
+	case config.RedisCluster:
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        conf.Addrs,
+			Password:     conf.Password,
+			PoolSize:     conf.PoolSize,
+			MinIdleConns: conf.MinIdleConns,
+			DialTimeout:  conf.DialTimeout.Duration,
+			ReadTimeout:  conf.ReadTimeout.Duration,
+			WriteTimeout: conf.WriteTimeout.Duration,
+			PoolTimeout:  conf.PoolTimeout.Duration,
+			IdleTimeout:  conf.IdleTimeout.Duration,
+			TLSConfig:    tlsConf,
+		})
+	case config.RedisSentinel:
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    conf.MasterName,
+			SentinelAddrs: conf.Addrs,
+			Password:      conf.Password,
+			DB:            conf.DB,
+			PoolSize:      conf.PoolSize,
+			MinIdleConns:  conf.MinIdleConns,
+			DialTimeout:   conf.DialTimeout.Duration,
+			ReadTimeout:   conf.ReadTimeout.Duration,
+			WriteTimeout:  conf.WriteTimeout.Duration,
+			PoolTimeout:   conf.PoolTimeout.Duration,
+			IdleTimeout:   conf.IdleTimeout.Duration,
+			TLSConfig:     tlsConf,
+		})
+	default:
+		client = redis.NewClient(&redis.Options{
+			Addr:         conf.Addr,
+			Password:     conf.Password,
+			DB:           conf.DB,
+			PoolSize:     conf.PoolSize,
+			MinIdleConns: conf.MinIdleConns,
+			DialTimeout:  conf.DialTimeout.Duration,
+			ReadTimeout:  conf.ReadTimeout.Duration,
+			WriteTimeout: conf.WriteTimeout.Duration,
+			PoolTimeout:  conf.PoolTimeout.Duration,
+			IdleTimeout:  conf.IdleTimeout.Duration,
+			TLSConfig:    tlsConf,
+		})
+	}
 
-	_, err := client.Ping().Result()
+	_, err = client.Ping().Result()
 	if err != nil {
+		logger.Error("redis connection failed", "mode", conf.Mode, "error", err)
 		return nil, err
 	}
 	return client, nil
 }
 
-func InitSQLStore() (*sqlx.DB, error) {
-	var conf DBConf
-
-	if os.Getenv("DBNAME") == "" {
-		f, err := os.Open("./dbconf.json")
-		defer f.Close()
-		if err != nil {
-			if err == os.ErrNotExist {
-				err = json.NewEncoder(f).Encode(DBConf{
-					Host:     "localhost",
-					DBName:   "db",
-					User:     "postgres",
-					Password: "",
-				})
-				if err != nil {
-					log.Println("dbconf.json writing error:", err)
-					return nil, err
-				}
-				log.Println("dbconf.json created, fill it now!")
-				defer os.Exit(0)
-				return nil, err
-			}
-			log.Println("dbconf.json open error:", err)
-			return nil, err
-		}
-
-		err = json.NewDecoder(f).Decode(&conf)
-		if err != nil {
-			log.Println("dbconf.json decode error:", err)
-			return nil, err
-		}
-	} else {
-		conf = DBConf{
-			Host:     os.Getenv("DBHOST"),
-			DBName:   os.Getenv("DBNAME"),
-			User:     os.Getenv("DBUSER"),
-			Password: os.Getenv("DBPASS"),
-		}
+// redisWithContext returns client bound to ctx, go-redis v6 keeps it without cancelling
+// commands, so they are still bounded by read and write timeouts from config, not by ctx
+func redisWithContext(ctx context.Context, red redis.UniversalClient) redis.UniversalClient {
+	switch c := red.(type) {
+	case *redis.Client:
+		return c.WithContext(ctx)
+	case *redis.ClusterClient:
+		return c.WithContext(ctx)
 	}
+	return red
+}
 
-	db, err := sqlx.Connect("postgres", "host="+conf.Host+" user="+conf.User+" password="+conf.Password+" dbname="+conf.DBName+" sslmode=disable")
+func InitSQLStore(conf config.Postgres, logger *logging.Logger) (*sqlx.DB, error) {
+	db, err := sqlx.Connect("postgres", conf.DSN())
 	if err != nil {
-		log.Println("postgresql connection error:", err)
+		logger.Error("postgresql connection failed", "host", conf.Host, "db", conf.DBName, "error", err)
 		return nil, err
 	}
 
+	db.SetMaxOpenConns(conf.MaxOpenConns)
+	db.SetMaxIdleConns(conf.MaxIdleConns)
+	db.SetConnMaxLifetime(conf.ConnMaxLifetime.Duration)
+
 	driver, err := postgres.WithInstance(db.DB, &postgres.Config{})
 	m, err := migrate.NewWithDatabaseInstance(
 		"file://migrations",
 		"postgres", driver)
 	if err != nil {
-		log.Println("postgresql migrate init error:", err)
+		logger.Error("postgresql migrate init failed", "error", err)
 	}
 
 	if err = m.Up(); err != nil && err != migrate.ErrNoChange {
-		log.Println("postgresql migrate error:", err)
+		logger.Error("postgresql migrate failed", "error", err)
 		return nil, err
 	}
 	return db, nil
 }
 
-func MigrateDown(db *sql.DB) error {
+func MigrateDown(db *sql.DB, logger *logging.Logger) error {
 	driver, err := postgres.WithInstance(db, &postgres.Config{})
 	m, err := migrate.NewWithDatabaseInstance(
 		"file://migrations",
 		"postgres", driver)
 	if err != nil {
-		log.Println("postgresql migrate init error:", err)
+		logger.Error("postgresql migrate init failed", "error", err)
 	}
 
 	if err = m.Drop(); err != nil {
-		log.Println("postgresql drop error:", err)
+		logger.Error("postgresql drop failed", "error", err)
 		return err
 	}
 
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"time"
+)
+
+const (
+	DomainUserCreated    = "user.created"
+	DomainUserLoggedIn   = "user.logged_in"
+	DomainSessionRevoked = "session.revoked"
+)
+
+type IEventStore interface {
+	Publish(ctx context.Context, limit int, fn func(e DomainEvent) (string, error)) (int, error)
+	Replay(ctx context.Context, fromID int64, fn func(e DomainEvent) error) error
+}
+
+// DomainEvent is written to outbox in the same transaction as the change it describes
+type DomainEvent struct {
+	ID          int64      `db:"id"`
+	Type        string     `db:"type"`
+	AggregateID uuid.UUID  `db:"aggregate_id"`
+	Payload     string     `db:"payload"`
+	CreatedAt   time.Time  `db:"created_at"`
+	PublishedAt *time.Time `db:"published_at"`
+	StreamID    string     `db:"stream_id"`
+}
+
+type UserCreatedPayload struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Tenant    string    `json:"tenant"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type UserLoggedInPayload struct {
+	UserID     uuid.UUID `json:"user_id"`
+	LoggedInAt time.Time `json:"logged_in_at"`
+}
+
+type SessionRevokedPayload struct {
+	UserID uuid.UUID `json:"user_id"`
+	Reason string    `json:"reason"`
+}
+
+type EventStore struct {
+	db *sqlx.DB
+}
+
+// insertEvent puts event into outbox using caller's transaction
+func insertEvent(ctx context.Context, tx sqlx.ExecerContext, typ string, aggregate uuid.UUID, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO events_outbox (type, aggregate_id, payload, created_at) VALUES ($1,$2,$3,$4)",
+		typ, aggregate, string(data), time.Now())
+	return err
+}
+
+// Publish passes unpublished events to fn in order and marks them published with returned stream id.
+// Rows are locked until commit, so other publishers skip them; when we crash after fn
+// events will be passed again, consumers must be ready for duplicates
+func (es *EventStore) Publish(ctx context.Context, limit int, fn func(e DomainEvent) (string, error)) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "EventStore.Publish")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := es.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var list []DomainEvent
+	err = tx.SelectContext(ctx, &list, "SELECT * FROM events_outbox WHERE published_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED", limit)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	var pubErr error
+	for _, e := range list {
+		var sid string
+		sid, pubErr = fn(e)
+		if pubErr != nil {
+			// keep what is already published, rest will be taken next time
+			break
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE events_outbox SET published_at=$2, stream_id=$3 WHERE id=$1", e.ID, time.Now(), sid)
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, pubErr
+}
+
+// Replay walks all events starting from given id regardless of their publish state
+func (es *EventStore) Replay(ctx context.Context, fromID int64, fn func(e DomainEvent) error) (err error) {
+	ctx, span := tracing.Start(ctx, "EventStore.Replay")
+	defer func() { tracing.End(span, err) }()
+
+	rows, err := es.db.QueryxContext(ctx, "SELECT * FROM events_outbox WHERE id>=$1 ORDER BY id", fromID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e DomainEvent
+		if err = rows.StructScan(&e); err != nil {
+			return err
+		}
+
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func NewEventStore(db *sqlx.DB) *EventStore {
+	return &EventStore{db: db}
+}
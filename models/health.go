@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dependencies reported by health checks
+const (
+	DependencyPostgres   = "postgres"
+	DependencyRedis      = "redis"
+	DependencyMigrations = "migrations"
+)
+
+var ErrCheckTimeout = errors.New("check timed out")
+
+type IHealthStore interface {
+	// Check probes all dependencies concurrently, each one within timeout and in its own span
+	Check(ctx context.Context, timeout time.Duration) []HealthCheck
+}
+
+// HealthCheck is result of dependency probe, Err is nil when it is usable
+type HealthCheck struct {
+	Name    string
+	Err     error
+	Latency time.Duration
+}
+
+type HealthStore struct {
+	db    *sqlx.DB
+	redis redis.UniversalClient
+	// migration is the latest version in migrations dir, database must be on it
+	migration    uint
+	migrationErr error
+}
+
+func (hs *HealthStore) Check(ctx context.Context, timeout time.Duration) []HealthCheck {
+	ctx, span := tracing.Start(ctx, "HealthStore.Check")
+	defer span.End()
+
+	probes := []struct {
+		name  string
+		probe func(ctx context.Context) error
+	}{
+		{DependencyPostgres, hs.db.PingContext},
+		{DependencyRedis, hs.pingRedis},
+		{DependencyMigrations, hs.checkMigrations},
+	}
+
+	res := make([]HealthCheck, len(probes))
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func(i int, name string, probe func(ctx context.Context) error) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := step(ctx, "health."+name, probe)
+			if ctx.Err() == context.DeadlineExceeded {
+				err = ErrCheckTimeout
+			}
+			res[i] = HealthCheck{Name: name, Err: err, Latency: time.Since(start)}
+		}(i, p.name, p.probe)
+	}
+	wg.Wait()
+	return res
+}
+
+// pingRedis waits for ping no longer than context allows,
+// client itself is limited only by its read timeout
+func (hs *HealthStore) pingRedis(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- hs.redis.Ping().Err()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (hs *HealthStore) checkMigrations(ctx context.Context) error {
+	if hs.migrationErr != nil {
+		return hs.migrationErr
+	}
+
+	var version uint
+	var dirty bool
+	err := hs.db.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		return fmt.Errorf("migration %d is dirty", version)
+	}
+	if version != hs.migration {
+		return fmt.Errorf("migration %d is applied, %d is expected", version, hs.migration)
+	}
+	return nil
+}
+
+// latestMigration returns the highest version of up migrations in dir
+func latestMigration(dir string) (uint, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var latest uint
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".up.sql") {
+			continue
+		}
+
+		v, err := strconv.ParseUint(strings.SplitN(f.Name(), "_", 2)[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad migration name %s", f.Name())
+		}
+		if uint(v) > latest {
+			latest = uint(v)
+		}
+	}
+	return latest, nil
+}
+
+// NewHealthStore reads expected migration version from dir once,
+// when it can't be read migrations check always fails
+func NewHealthStore(db *sqlx.DB, red redis.UniversalClient, dir string) *HealthStore {
+	v, err := latestMigration(dir)
+	return &HealthStore{db: db, redis: red, migration: v, migrationErr: err}
+}
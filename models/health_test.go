@@ -0,0 +1,30 @@
+package models
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLatestMigration(t *testing.T) {
+	Convey("Latest migration", t, func() {
+		Convey("Must be found in repo migrations", func() {
+			v, err := latestMigration("../migrations")
+			So(err, ShouldEqual, nil)
+			So(v, ShouldEqual, 17)
+		})
+
+		Convey("When name has no version", func() {
+			dir, err := ioutil.TempDir("", "migrations")
+			So(err, ShouldEqual, nil)
+			defer os.RemoveAll(dir)
+
+			So(ioutil.WriteFile(filepath.Join(dir, "init.up.sql"), nil, 0600), ShouldEqual, nil)
+
+			_, err = latestMigration(dir)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
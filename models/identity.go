@@ -0,0 +1,232 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"time"
+)
+
+const FederationStateTTL = 10 * time.Minute
+
+// ErrIdentityConflict means that email is taken by local account and provider didn't verify it,
+// linking it would allow to take over the account
+var ErrIdentityConflict = errors.New("account with this email already exists")
+var ErrIdentityNoEmail = errors.New("identity provider didn't return email")
+
+// IIdentityStore stops waiting for postgres, redis and session backend when ctx is done,
+// its spans are children of span in ctx
+type IIdentityStore interface {
+	// Tenant returns the store linking identities to users of the tenant
+	Tenant(tenant string) IIdentityStore
+
+	// Login finds user linked to external identity, links or creates him on first login
+	// and starts session like UserStore.Login does, created is true for new user
+	Login(ctx context.Context, ext ExternalIdentity) (ses *Session, created bool, err error)
+	List(ctx context.Context, userID uuid.UUID) ([]Identity, error)
+
+	CreateState(ctx context.Context, provider string) (*FederationState, error)
+	TakeState(ctx context.Context, state string) (*FederationState, error)
+}
+
+// ExternalIdentity is what provider told us about the user in ID token
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type Identity struct {
+	Tenant    string     `db:"tenant" json:"-"`
+	Provider  string     `db:"provider" json:"provider"`
+	Subject   string     `db:"subject" json:"subject"`
+	UserID    uuid.UUID  `db:"user_id" json:"-"`
+	Email     string     `db:"email" json:"email"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	LastLogin *time.Time `db:"last_login" json:"last_login"`
+}
+
+// FederationState lives between redirect to provider and callback from it
+type FederationState struct {
+	State    string `json:"state"`
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+type IdentityStore struct {
+	db    *sqlx.DB
+	redis redis.UniversalClient
+	users *UserStore
+}
+
+func federationStateKey(tenant, state string) string {
+	return tenantPrefix(tenant) + "federation:state:" + state
+}
+
+func (is *IdentityStore) Tenant(tenant string) IIdentityStore {
+	return &IdentityStore{db: is.db, redis: is.redis, users: is.users.withTenant(tenant)}
+}
+
+func (is *IdentityStore) Login(ctx context.Context, ext ExternalIdentity) (_ *Session, _ bool, err error) {
+	ctx, span := tracing.Start(ctx, "IdentityStore.Login", attribute.String("tenant", is.users.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	id, created, err := is.resolve(ctx, ext)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ses, err := is.users.startSession(ctx, id, DefaultScopes)
+	if err != nil {
+		return nil, false, err
+	}
+	return ses, created, nil
+}
+
+// resolve returns user of identity, verified email links identity to existing account
+func (is *IdentityStore) resolve(ctx context.Context, ext ExternalIdentity) (uuid.UUID, bool, error) {
+	tx, err := is.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+	defer tx.Rollback()
+
+	var u User
+	err = tx.GetContext(ctx, &u, "SELECT u.* FROM users u JOIN user_identities ui ON ui.user_id=u.id "+
+		"WHERE ui.tenant=$1 AND ui.provider=$2 AND ui.subject=$3", is.users.tenant, ext.Provider, ext.Subject)
+	if err == nil {
+		if u.DeletedAt != nil {
+			return uuid.Nil, false, ErrUserNotFound
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE user_identities SET last_login=$4 WHERE tenant=$1 AND provider=$2 AND subject=$3",
+			is.users.tenant, ext.Provider, ext.Subject, time.Now())
+		if err != nil {
+			return uuid.Nil, false, err
+		}
+		return u.ID, false, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return uuid.Nil, false, err
+	}
+
+	if ext.Email == "" {
+		return uuid.Nil, false, ErrIdentityNoEmail
+	}
+
+	created := false
+	err = tx.GetContext(ctx, &u, "SELECT * FROM users WHERE email=$1 AND tenant=$2 AND deleted_at IS NULL", ext.Email, is.users.tenant)
+	if err == sql.ErrNoRows {
+		if u.ID, err = is.createUser(ctx, tx, ext.Email); err != nil {
+			return uuid.Nil, false, err
+		}
+		created = true
+	} else if err != nil {
+		return uuid.Nil, false, err
+	} else if !ext.EmailVerified {
+		return uuid.Nil, false, ErrIdentityConflict
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO user_identities (tenant, provider, subject, user_id, email, created_at, last_login) "+
+		"VALUES ($1,$2,$3,$4,$5,$6,$6)", is.users.tenant, ext.Provider, ext.Subject, u.ID, ext.Email, time.Now())
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+	return u.ID, created, tx.Commit()
+}
+
+// createUser creates user without password, he can sign in only through provider
+func (is *IdentityStore) createUser(ctx context.Context, tx *sqlx.Tx, email string) (uuid.UUID, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, "INSERT INTO users (id, tenant, email, password, created_at) VALUES ($1,$2,$3,'',$4)",
+		id, is.users.tenant, email, now)
+
+	//23505 is postgres' error code that means - item exists, it could be deleted account
+	if pgerr, ok := err.(*pq.Error); ok {
+		if pgerr.Code == "23505" {
+			return uuid.Nil, ErrIdentityConflict
+		}
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	err = insertEvent(ctx, tx, DomainUserCreated, id, UserCreatedPayload{
+		UserID:    id,
+		Tenant:    is.users.tenant,
+		Email:     email,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err = enqueueWebhook(ctx, tx, is.users.tenant, WebhookUserRegistered, id); err != nil {
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+func (is *IdentityStore) List(ctx context.Context, userID uuid.UUID) (res []Identity, err error) {
+	ctx, span := tracing.Start(ctx, "IdentityStore.List", attribute.String("tenant", is.users.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	err = is.db.SelectContext(ctx, &res, "SELECT * FROM user_identities WHERE user_id=$1 ORDER BY created_at", userID)
+	return res, err
+}
+
+// CreateState generates state, nonce and PKCE verifier for new login attempt
+func (is *IdentityStore) CreateState(ctx context.Context, provider string) (_ *FederationState, err error) {
+	ctx, span := tracing.Start(ctx, "IdentityStore.CreateState", attribute.String("tenant", is.users.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	st := &FederationState{Provider: provider}
+
+	for _, v := range []*string{&st.State, &st.Nonce, &st.Verifier} {
+		var err error
+		if *v, err = randomToken(); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+
+	err = redisWithContext(ctx, is.redis).Set(federationStateKey(is.users.tenant, st.State), data, FederationStateTTL).Err()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// TakeState returns state and removes it, so callback can't be replayed
+func (is *IdentityStore) TakeState(ctx context.Context, state string) (_ *FederationState, err error) {
+	ctx, span := tracing.Start(ctx, "IdentityStore.TakeState", attribute.String("tenant", is.users.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	var st FederationState
+	if err := take(redisWithContext(ctx, is.redis), federationStateKey(is.users.tenant, state), &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func NewIdentityStore(db *sqlx.DB, red redis.UniversalClient, users *UserStore) *IdentityStore {
+	return &IdentityStore{db: db, redis: red, users: users}
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"time"
+)
+
+var ErrMailNotFound = errors.New("mail not found")
+
+// IMailStore is outbox of emails, they are sent by mail worker,
+// bodies may carry secrets, so they are erased once message leaves outbox
+type IMailStore interface {
+	Enqueue(ctx context.Context, m Mail) error
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]Mail, error)
+	// Complete marks mail sent when errText is empty, otherwise it is retried at retryAt
+	// or given up when it is nil
+	Complete(ctx context.Context, id int64, attempt int, errText string, retryAt *time.Time) error
+}
+
+type Mail struct {
+	ID       int64  `db:"id"`
+	To       string `db:"recipient"`
+	Subject  string `db:"subject"`
+	Body     string `db:"body"`
+	Attempts int    `db:"attempts"`
+}
+
+type MailStore struct {
+	db *sqlx.DB
+}
+
+func (ms *MailStore) Enqueue(ctx context.Context, m Mail) (err error) {
+	ctx, span := tracing.Start(ctx, "MailStore.Enqueue")
+	defer func() { tracing.End(span, err) }()
+
+	_, err = ms.db.ExecContext(ctx, "INSERT INTO mail_outbox (recipient, subject, body, next_attempt_at, created_at) "+
+		"VALUES ($1, $2, $3, $4, $4)", m.To, m.Subject, m.Body, time.Now())
+	return err
+}
+
+// Claim takes due mails and hides them from other workers for lease duration
+func (ms *MailStore) Claim(ctx context.Context, limit int, lease time.Duration) (res []Mail, err error) {
+	ctx, span := tracing.Start(ctx, "MailStore.Claim")
+	defer func() { tracing.End(span, err) }()
+
+	now := time.Now()
+
+	err = ms.db.SelectContext(ctx, &res, "UPDATE mail_outbox SET next_attempt_at=$2 WHERE id IN ("+
+		"SELECT id FROM mail_outbox WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at<=$1 "+
+		"ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED) "+
+		"RETURNING id, recipient, subject, body, attempts", now, now.Add(lease), limit)
+	return res, err
+}
+
+func (ms *MailStore) Complete(ctx context.Context, id int64, attempt int, errText string, retryAt *time.Time) (err error) {
+	ctx, span := tracing.Start(ctx, "MailStore.Complete")
+	defer func() { tracing.End(span, err) }()
+
+	now := time.Now()
+
+	var res sql.Result
+	switch {
+	case errText == "":
+		res, err = ms.db.ExecContext(ctx, "UPDATE mail_outbox SET attempts=$2, error='', body='', sent_at=$3 WHERE id=$1", id, attempt, now)
+	case retryAt != nil:
+		res, err = ms.db.ExecContext(ctx, "UPDATE mail_outbox SET attempts=$2, error=$3, next_attempt_at=$4 WHERE id=$1", id, attempt, errText, *retryAt)
+	default:
+		res, err = ms.db.ExecContext(ctx, "UPDATE mail_outbox SET attempts=$2, error=$3, body='', failed_at=$4 WHERE id=$1", id, attempt, errText, now)
+	}
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrMailNotFound
+	}
+	return nil
+}
+
+func NewMailStore(db *sqlx.DB) *MailStore {
+	return &MailStore{db: db}
+}
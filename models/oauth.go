@@ -0,0 +1,497 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+	"time"
+)
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// token types reported by introspection, session is a plain login session not issued to any client
+const (
+	TokenTypeAccess  = "access_token"
+	TokenTypeRefresh = "refresh_token"
+	TokenTypeSession = "session"
+)
+
+const (
+	AuthCodeTTL     = 10 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var ErrClientNotFound = errors.New("oauth client not found")
+var ErrClientIncorrect = errors.New("incorrect client credentials")
+var ErrGrantIncorrect = errors.New("incorrect or expired grant")
+
+type IOAuthStore interface {
+	// Tenant returns the store where codes, tokens and sessions belong to the tenant, clients are shared
+	Tenant(tenant string) IOAuthStore
+
+	// methods stop waiting for postgres, redis and session backend when ctx is done,
+	// their spans are children of span in ctx
+	CreateClient(ctx context.Context, c *OAuthClient, confidential bool) (string, error)
+	ListClients(ctx context.Context) ([]OAuthClient, error)
+	GetClient(ctx context.Context, id string) (*OAuthClient, error)
+	AuthenticateClient(ctx context.Context, id, secret string) (*OAuthClient, error)
+
+	HasConsent(ctx context.Context, userID uuid.UUID, clientID string, scope string) (bool, error)
+	SaveConsent(ctx context.Context, userID uuid.UUID, clientID string, scope string) error
+
+	CreateCode(ctx context.Context, c AuthCode) (string, error)
+	TakeCode(ctx context.Context, code string) (*AuthCode, error)
+
+	IssueToken(ctx context.Context, g OAuthGrant, accessToken string, refresh bool) (*TokenResponse, error)
+	GetAccessToken(ctx context.Context, token string) (*OAuthGrant, error)
+	TakeRefreshToken(ctx context.Context, token string) (*OAuthGrant, error)
+
+	Introspect(ctx context.Context, token string) (*TokenInfo, error)
+	Revoke(ctx context.Context, token string) error
+}
+
+type OAuthClient struct {
+	ID           string         `db:"id" json:"client_id"`
+	SecretHash   string         `db:"secret_hash" json:"-"`
+	Name         string         `db:"name" json:"name"`
+	RedirectURIs pq.StringArray `db:"redirect_uris" json:"redirect_uris"`
+	GrantTypes   pq.StringArray `db:"grant_types" json:"grant_types"`
+	Scopes       pq.StringArray `db:"scopes" json:"scopes"`
+	CreatedAt    time.Time      `db:"created_at" json:"created_at"`
+}
+
+// Confidential clients have a secret, public ones (browser, mobile) rely only on PKCE
+func (c *OAuthClient) Confidential() bool {
+	return c.SecretHash != ""
+}
+
+func (c *OAuthClient) AllowsGrant(grant string) bool {
+	return contains(c.GrantTypes, grant)
+}
+
+func (c *OAuthClient) AllowsRedirect(uri string) bool {
+	return contains(c.RedirectURIs, uri)
+}
+
+// AllowsScope checks that every space separated scope is registered for the client
+func (c *OAuthClient) AllowsScope(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if !contains(c.Scopes, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// AuthCode is a short living authorization code with PKCE challenge (S256 only)
+type AuthCode struct {
+	ClientID      string    `json:"client_id"`
+	UserID        uuid.UUID `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scope         string    `json:"scope"`
+	CodeChallenge string    `json:"code_challenge"`
+	Nonce         string    `json:"nonce,omitempty"`
+	AuthTime      time.Time `json:"auth_time"`
+}
+
+// OAuthGrant is what access or refresh token gives, UserID is nil for client credentials
+type OAuthGrant struct {
+	ClientID string    `json:"client_id"`
+	UserID   uuid.UUID `json:"user_id"`
+	Scope    string    `json:"scope"`
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// TokenInfo describes active token, Grant.ClientID is empty for sessions
+type TokenInfo struct {
+	Type      string
+	Grant     OAuthGrant
+	ExpiresAt time.Time
+}
+
+type OAuthStore struct {
+	db       *sqlx.DB
+	redis    redis.UniversalClient
+	sessions ISessionStore
+	tenant   string
+}
+
+// codes and tokens are keyed within tenant, so one issued on a host of the tenant
+// is neither exchanged nor introspected on a host of another one
+func accessTokenKey(tenant, token string) string {
+	return tenantPrefix(tenant) + "oauth:access:" + token
+}
+
+func refreshTokenKey(tenant, token string) string {
+	return tenantPrefix(tenant) + "oauth:refresh:" + token
+}
+
+func authCodeKey(tenant, code string) string {
+	return tenantPrefix(tenant) + "oauth:code:" + code
+}
+
+// randomToken returns url safe random string with 256 bits of entropy
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (oas *OAuthStore) Tenant(tenant string) IOAuthStore {
+	return &OAuthStore{db: oas.db, redis: oas.redis, sessions: oas.sessions.Tenant(tenant), tenant: tenant}
+}
+
+// CreateClient registers client with new id, returns secret for confidential one,
+// only its hash is stored
+func (oas *OAuthStore) CreateClient(ctx context.Context, c *OAuthClient, confidential bool) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.CreateClient", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+
+	c.ID = id.String()
+	c.CreatedAt = time.Now()
+
+	var secret string
+	if confidential {
+		if secret, err = randomToken(); err != nil {
+			return "", err
+		}
+
+		if c.SecretHash, err = hashSecret(secret); err != nil {
+			return "", err
+		}
+	}
+
+	_, err = oas.db.NamedExecContext(ctx, "INSERT INTO oauth_clients (id, secret_hash, name, redirect_uris, grant_types, scopes, created_at) "+
+		"VALUES (:id,:secret_hash,:name,:redirect_uris,:grant_types,:scopes,:created_at)", c)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (oas *OAuthStore) ListClients(ctx context.Context) (res []OAuthClient, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.ListClients", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	err = oas.db.SelectContext(ctx, &res, "SELECT * FROM oauth_clients ORDER BY created_at")
+	return res, err
+}
+
+func (oas *OAuthStore) GetClient(ctx context.Context, id string) (_ *OAuthClient, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.GetClient", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	var c OAuthClient
+	err = oas.db.GetContext(ctx, &c, "SELECT * FROM oauth_clients WHERE id=$1", id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrClientNotFound
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// AuthenticateClient checks secret of confidential client, public client must pass empty secret
+func (oas *OAuthStore) AuthenticateClient(ctx context.Context, id, secret string) (_ *OAuthClient, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.AuthenticateClient", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	c, err := oas.GetClient(ctx, id)
+	if err != nil {
+		if err == ErrClientNotFound {
+			return nil, ErrClientIncorrect
+		}
+		return nil, err
+	}
+
+	if !c.Confidential() {
+		if secret != "" {
+			return nil, ErrClientIncorrect
+		}
+		return c, nil
+	}
+
+	if compareSecret(c.SecretHash, secret) != nil {
+		return nil, ErrClientIncorrect
+	}
+	return c, nil
+}
+
+// HasConsent tells if user already allowed all requested scopes to the client
+func (oas *OAuthStore) HasConsent(ctx context.Context, userID uuid.UUID, clientID string, scope string) (_ bool, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.HasConsent", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	var scopes pq.StringArray
+	err = oas.db.GetContext(ctx, &scopes, "SELECT scopes FROM oauth_consents WHERE user_id=$1 AND client_id=$2", userID, clientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, s := range strings.Fields(scope) {
+		if !contains(scopes, s) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// SaveConsent remembers allowed scopes, they are added to previously allowed ones
+func (oas *OAuthStore) SaveConsent(ctx context.Context, userID uuid.UUID, clientID string, scope string) (err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.SaveConsent", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	_, err = oas.db.ExecContext(ctx, "INSERT INTO oauth_consents (user_id, client_id, scopes, created_at) VALUES ($1,$2,$3,$4) "+
+		"ON CONFLICT (user_id, client_id) DO UPDATE SET "+
+		"scopes=ARRAY(SELECT DISTINCT unnest(oauth_consents.scopes || EXCLUDED.scopes)), created_at=EXCLUDED.created_at",
+		userID, clientID, pq.StringArray(strings.Fields(scope)), time.Now())
+	return err
+}
+
+func (oas *OAuthStore) CreateCode(ctx context.Context, c AuthCode) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.CreateCode", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	err = redisWithContext(ctx, oas.redis).Set(authCodeKey(oas.tenant, code), data, AuthCodeTTL).Err()
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// TakeCode returns code data and removes it, so code can be exchanged only once
+func (oas *OAuthStore) TakeCode(ctx context.Context, code string) (_ *AuthCode, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.TakeCode", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	var c AuthCode
+	if err := take(redisWithContext(ctx, oas.redis), authCodeKey(oas.tenant, code), &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// IssueToken stores grant of access token and creates refresh token when asked.
+// For user grants accessToken is his session id, so it works everywhere session works,
+// for client credentials it must be empty and new one will be generated
+func (oas *OAuthStore) IssueToken(ctx context.Context, g OAuthGrant, accessToken string, refresh bool) (_ *TokenResponse, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.IssueToken", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	if accessToken == "" {
+		if accessToken, err = randomToken(); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(g)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(SessionTTL / time.Second),
+		Scope:       g.Scope,
+	}
+
+	if refresh {
+		if res.RefreshToken, err = randomToken(); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = redisWithContext(ctx, oas.redis).TxPipelined(func(p redis.Pipeliner) error {
+		p.Set(accessTokenKey(oas.tenant, res.AccessToken), data, SessionTTL)
+		if refresh {
+			p.Set(refreshTokenKey(oas.tenant, res.RefreshToken), data, RefreshTokenTTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetAccessToken returns grant of access token issued by IssueToken
+func (oas *OAuthStore) GetAccessToken(ctx context.Context, token string) (_ *OAuthGrant, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.GetAccessToken", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	data, err := redisWithContext(ctx, oas.redis).Get(accessTokenKey(oas.tenant, token)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrGrantIncorrect
+		}
+		return nil, err
+	}
+
+	var g OAuthGrant
+	if err = json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// TakeRefreshToken returns grant of refresh token and removes it, new one must be issued (rotation)
+func (oas *OAuthStore) TakeRefreshToken(ctx context.Context, token string) (_ *OAuthGrant, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.TakeRefreshToken", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	var g OAuthGrant
+	if err := take(redisWithContext(ctx, oas.redis), refreshTokenKey(oas.tenant, token), &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// Introspect finds token among access tokens, refresh tokens and sessions
+func (oas *OAuthStore) Introspect(ctx context.Context, token string) (_ *TokenInfo, err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.Introspect", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	if token == "" {
+		return nil, ErrGrantIncorrect
+	}
+
+	var access, refresh *redis.StringCmd
+	var accessTTL, refreshTTL *redis.DurationCmd
+	_, err = redisWithContext(ctx, oas.redis).Pipelined(func(p redis.Pipeliner) error {
+		access, accessTTL = p.Get(accessTokenKey(oas.tenant, token)), p.TTL(accessTokenKey(oas.tenant, token))
+		refresh, refreshTTL = p.Get(refreshTokenKey(oas.tenant, token)), p.TTL(refreshTokenKey(oas.tenant, token))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	info := &TokenInfo{}
+	switch {
+	case access.Err() == nil:
+		info.Type = TokenTypeAccess
+		info.ExpiresAt = time.Now().Add(accessTTL.Val())
+		if err = json.Unmarshal([]byte(access.Val()), &info.Grant); err != nil {
+			return nil, err
+		}
+
+		// access token of user is his session, logout kills it
+		if info.Grant.UserID != uuid.Nil {
+			if _, err = oas.sessions.Get(ctx, token); err != nil {
+				if err == ErrAuthIncorrect {
+					return nil, ErrGrantIncorrect
+				}
+				return nil, err
+			}
+		}
+	case refresh.Err() == nil:
+		info.Type = TokenTypeRefresh
+		info.ExpiresAt = time.Now().Add(refreshTTL.Val())
+		if err = json.Unmarshal([]byte(refresh.Val()), &info.Grant); err != nil {
+			return nil, err
+		}
+	default:
+		ses, err := oas.sessions.Get(ctx, token)
+		if err != nil {
+			if err == ErrAuthIncorrect {
+				return nil, ErrGrantIncorrect
+			}
+			return nil, err
+		}
+
+		info.Type = TokenTypeSession
+		info.ExpiresAt = ses.ExpiresAt
+		info.Grant.UserID, info.Grant.Scope = ses.UserID, strings.Join(ses.Scopes, " ")
+	}
+	return info, nil
+}
+
+// Revoke removes access or refresh token, session behind user access token
+// must be killed by UserStore.Logout
+func (oas *OAuthStore) Revoke(ctx context.Context, token string) (err error) {
+	ctx, span := tracing.Start(ctx, "OAuthStore.Revoke", attribute.String("tenant", oas.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	// separate commands, in cluster keys are in different slots
+	_, err = redisWithContext(ctx, oas.redis).Pipelined(func(p redis.Pipeliner) error {
+		p.Del(accessTokenKey(oas.tenant, token))
+		p.Del(refreshTokenKey(oas.tenant, token))
+		return nil
+	})
+	return err
+}
+
+// take atomically reads and deletes json value
+func take(red redis.UniversalClient, key string, v interface{}) error {
+	var get *redis.StringCmd
+	_, err := red.TxPipelined(func(p redis.Pipeliner) error {
+		get = p.Get(key)
+		p.Del(key)
+		return nil
+	})
+	if err != nil {
+		if err == redis.Nil {
+			return ErrGrantIncorrect
+		}
+		return err
+	}
+
+	return json.Unmarshal([]byte(get.Val()), v)
+}
+
+func NewOAuthStore(db *sqlx.DB, red redis.UniversalClient, sessions ISessionStore) *OAuthStore {
+	return &OAuthStore{db: db, redis: red, sessions: sessions, tenant: DefaultTenant}
+}
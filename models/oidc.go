@@ -0,0 +1,295 @@
+package models
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcKeysLock is an advisory lock id, only one node must generate first key
+const oidcKeysLock = 73310001
+
+// sealedKeyPrefix marks encrypted private key, keys stored before encryption are plain pem
+const sealedKeyPrefix = "aes-gcm:"
+
+var ErrKeySealed = errors.New("signing key can't be decrypted")
+var ErrKeysKey = errors.New("key encrypting signing keys must be 32 bytes")
+
+type IKeyStore interface {
+	// SigningKey returns the newest key, it is generated when there are no keys yet
+	SigningKey(ctx context.Context) (*SigningKey, error)
+	// PublicKeys returns all keys which tokens can still be signed with
+	PublicKeys(ctx context.Context) ([]SigningKey, error)
+}
+
+type SigningKey struct {
+	ID        string
+	Key       *rsa.PrivateKey
+	CreatedAt time.Time
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func NewSigningKey() (*SigningKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	return &SigningKey{
+		ID:        hex.EncodeToString(sum[:8]),
+		Key:       key,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func (k *SigningKey) JWK() JWK {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: k.ID,
+		N:   base64.RawURLEncoding.EncodeToString(k.Key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.Key.E)).Bytes()),
+	}
+}
+
+// Sign makes RS256 JWT from claims
+func (k *SigningKey) Sign(claims interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": k.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.Key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+type keyRow struct {
+	ID         string    `db:"id"`
+	PrivateKey string    `db:"private_key"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// KeyStore keeps signing keys in postgres so all nodes sign with the same keys,
+// rotation is done by inserting new key, old ones stay published until deleted.
+// Private keys are encrypted with key from config, id of the key is authenticated with it
+// so rows can't be swapped
+type KeyStore struct {
+	db   *sqlx.DB
+	aead cipher.AEAD
+	// aeadErr is returned by every call when key from config is unusable
+	aeadErr error
+
+	mx     sync.Mutex
+	keys   []SigningKey
+	loaded time.Time
+}
+
+// keysCacheTTL is how fast nodes notice rotated keys
+const keysCacheTTL = 5 * time.Minute
+
+func (ks *KeyStore) SigningKey(ctx context.Context) (_ *SigningKey, err error) {
+	ctx, span := tracing.Start(ctx, "KeyStore.SigningKey")
+	defer func() { tracing.End(span, err) }()
+
+	keys, err := ks.PublicKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		if err = ks.generate(ctx); err != nil {
+			return nil, err
+		}
+
+		if keys, err = ks.PublicKeys(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return &keys[0], nil
+}
+
+// PublicKeys also encrypts keys stored before encryption was introduced
+func (ks *KeyStore) PublicKeys(ctx context.Context) (_ []SigningKey, err error) {
+	ctx, span := tracing.Start(ctx, "KeyStore.PublicKeys")
+	defer func() { tracing.End(span, err) }()
+
+	if ks.aeadErr != nil {
+		return nil, ks.aeadErr
+	}
+
+	ks.mx.Lock()
+	defer ks.mx.Unlock()
+
+	if len(ks.keys) > 0 && time.Since(ks.loaded) < keysCacheTTL {
+		return ks.keys, nil
+	}
+
+	var rows []keyRow
+	err = ks.db.SelectContext(ctx, &rows, "SELECT * FROM oidc_keys ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []SigningKey
+	for _, r := range rows {
+		data, sealed, err := ks.open(r.ID, r.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			continue
+		}
+
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if !sealed {
+			_, err = ks.db.ExecContext(ctx, "UPDATE oidc_keys SET private_key=$3 WHERE id=$1 AND private_key=$2",
+				r.ID, r.PrivateKey, ks.seal(r.ID, data))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		keys = append(keys, SigningKey{
+			ID:        r.ID,
+			Key:       key,
+			CreatedAt: r.CreatedAt,
+		})
+	}
+
+	ks.keys, ks.loaded = keys, time.Now()
+	return keys, nil
+}
+
+func (ks *KeyStore) generate(ctx context.Context) error {
+	tx, err := ks.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", oidcKeysLock)
+	if err != nil {
+		return err
+	}
+
+	var n int
+	if err = tx.GetContext(ctx, &n, "SELECT count(*) FROM oidc_keys"); err != nil {
+		return err
+	}
+
+	// other node was first
+	if n > 0 {
+		return tx.Commit()
+	}
+
+	k, err := NewSigningKey()
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(k.Key),
+	})
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO oidc_keys (id, private_key, created_at) VALUES ($1,$2,$3)", k.ID, ks.seal(k.ID, data), k.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// seal encrypts pem of the key with random nonce put before ciphertext
+func (ks *KeyStore) seal(id string, data []byte) string {
+	nonce := make([]byte, ks.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return sealedKeyPrefix + base64.StdEncoding.EncodeToString(ks.aead.Seal(nonce, nonce, data, []byte(id)))
+}
+
+// open decrypts stored key, plain pem is returned as is with sealed false
+func (ks *KeyStore) open(id, stored string) ([]byte, bool, error) {
+	if !strings.HasPrefix(stored, sealedKeyPrefix) {
+		return []byte(stored), false, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedKeyPrefix))
+	if err != nil || len(data) < ks.aead.NonceSize() {
+		return nil, true, ErrKeySealed
+	}
+
+	n := ks.aead.NonceSize()
+	data, err = ks.aead.Open(nil, data[:n], data[n:], []byte(id))
+	if err != nil {
+		return nil, true, ErrKeySealed
+	}
+	return data, true, nil
+}
+
+// NewKeyStore takes 32 bytes key encrypting private keys, with other key every call fails
+func NewKeyStore(db *sqlx.DB, key []byte) *KeyStore {
+	ks := &KeyStore{db: db, aeadErr: ErrKeysKey}
+	if len(key) != 32 {
+		return ks
+	}
+
+	block, err := aes.NewCipher(key)
+	if err == nil {
+		ks.aead, err = cipher.NewGCM(block)
+	}
+	ks.aeadErr = err
+	return ks
+}
@@ -0,0 +1,378 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"time"
+)
+
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+const InvitationTTL = 7 * 24 * time.Hour
+
+var ErrOrgNotFound = errors.New("organization not found")
+var ErrNotMember = errors.New("user is not a member")
+var ErrAlreadyMember = errors.New("user is already a member")
+var ErrLastOwner = errors.New("organization must have an owner")
+var ErrInvitationIncorrect = errors.New("incorrect, expired or used invitation")
+
+type IOrgStore interface {
+	// Tenant returns the store limited to organizations of the tenant
+	Tenant(tenant string) IOrgStore
+
+	// Create makes organization with the user as its owner
+	Create(ctx context.Context, name string, owner uuid.UUID) (*Organization, error)
+	Get(ctx context.Context, id uuid.UUID) (*Organization, error)
+	// Memberships returns organizations of the user
+	Memberships(ctx context.Context, userID uuid.UUID) ([]Membership, error)
+	Members(ctx context.Context, orgID uuid.UUID) ([]Member, error)
+	// Role returns role of the user in organization or ErrNotMember
+	Role(ctx context.Context, orgID, userID uuid.UUID) (string, error)
+	RemoveMember(ctx context.Context, orgID, userID uuid.UUID) error
+
+	// Invite returns invitation and its token, only token's hash is stored
+	Invite(ctx context.Context, orgID uuid.UUID, email, role string, invitedBy uuid.UUID) (*Invitation, string, error)
+	// Invitation returns pending invitation by token
+	Invitation(ctx context.Context, token string) (*Invitation, error)
+	// Accept makes the user a member with invitation's role, invitation can be used once
+	Accept(ctx context.Context, token string, userID uuid.UUID) (*Membership, error)
+	// AcceptAsNew creates account for invited email together with membership,
+	// neither is left when the other fails
+	AcceptAsNew(ctx context.Context, token, password string) (*Membership, error)
+}
+
+type Organization struct {
+	ID        uuid.UUID `db:"id" json:"id"`
+	Tenant    string    `db:"tenant" json:"-"`
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+type Membership struct {
+	OrgID     uuid.UUID `db:"org_id" json:"org_id"`
+	OrgName   string    `db:"org_name" json:"name"`
+	UserID    uuid.UUID `db:"user_id" json:"-"`
+	Role      string    `db:"role" json:"role"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+type Member struct {
+	UserID    uuid.UUID `db:"user_id" json:"user_id"`
+	Email     string    `db:"email" json:"email"`
+	Role      string    `db:"role" json:"role"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+type Invitation struct {
+	ID         uuid.UUID  `db:"id" json:"id"`
+	OrgID      uuid.UUID  `db:"org_id" json:"org_id"`
+	Tenant     string     `db:"tenant" json:"-"`
+	Email      string     `db:"email" json:"email"`
+	Role       string     `db:"role" json:"role"`
+	TokenHash  string     `db:"token_hash" json:"-"`
+	InvitedBy  uuid.UUID  `db:"invited_by" json:"invited_by"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	ExpiresAt  time.Time  `db:"expires_at" json:"expires_at"`
+	AcceptedAt *time.Time `db:"accepted_at" json:"accepted_at"`
+}
+
+// ValidRole tells if role is known
+func ValidRole(role string) bool {
+	return role == RoleOwner || role == RoleAdmin || role == RoleMember
+}
+
+type OrgStore struct {
+	db     *sqlx.DB
+	tenant string
+}
+
+func (ors *OrgStore) Tenant(tenant string) IOrgStore {
+	return &OrgStore{db: ors.db, tenant: tenant}
+}
+
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ors *OrgStore) Create(ctx context.Context, name string, owner uuid.UUID) (_ *Organization, err error) {
+	ctx, span := tracing.Start(ctx, "OrgStore.Create", attribute.String("tenant", ors.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Organization{
+		ID:        id,
+		Tenant:    ors.tenant,
+		Name:      name,
+		CreatedAt: time.Now(),
+	}
+
+	tx, err := ors.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.NamedExecContext(ctx, "INSERT INTO organizations (id, tenant, name, created_at) VALUES (:id,:tenant,:name,:created_at)", o)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO memberships (org_id, tenant, user_id, role, created_at) VALUES ($1,$2,$3,$4,$5)",
+		o.ID, ors.tenant, owner, RoleOwner, o.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return o, tx.Commit()
+}
+
+func (ors *OrgStore) Get(ctx context.Context, id uuid.UUID) (_ *Organization, err error) {
+	ctx, span := tracing.Start(ctx, "OrgStore.Get", attribute.String("tenant", ors.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	var o Organization
+	err = ors.db.GetContext(ctx, &o, "SELECT * FROM organizations WHERE id=$1 AND tenant=$2", id, ors.tenant)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrOrgNotFound
+		}
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (ors *OrgStore) Memberships(ctx context.Context, userID uuid.UUID) (res []Membership, err error) {
+	ctx, span := tracing.Start(ctx, "OrgStore.Memberships", attribute.String("tenant", ors.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	err = ors.db.SelectContext(ctx, &res, "SELECT m.org_id, o.name AS org_name, m.user_id, m.role, m.created_at "+
+		"FROM memberships m JOIN organizations o ON o.id=m.org_id WHERE m.user_id=$1 AND m.tenant=$2 ORDER BY m.created_at", userID, ors.tenant)
+	return res, err
+}
+
+func (ors *OrgStore) Members(ctx context.Context, orgID uuid.UUID) (res []Member, err error) {
+	ctx, span := tracing.Start(ctx, "OrgStore.Members", attribute.String("tenant", ors.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	err = ors.db.SelectContext(ctx, &res, "SELECT m.user_id, u.email, m.role, m.created_at "+
+		"FROM memberships m JOIN users u ON u.id=m.user_id WHERE m.org_id=$1 AND m.tenant=$2 AND u.tenant=$2 ORDER BY m.created_at",
+		orgID, ors.tenant)
+	return res, err
+}
+
+func (ors *OrgStore) Role(ctx context.Context, orgID, userID uuid.UUID) (role string, err error) {
+	ctx, span := tracing.Start(ctx, "OrgStore.Role", attribute.String("tenant", ors.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	err = ors.db.GetContext(ctx, &role, "SELECT role FROM memberships WHERE org_id=$1 AND user_id=$2 AND tenant=$3", orgID, userID, ors.tenant)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrNotMember
+		}
+		return "", err
+	}
+	return role, nil
+}
+
+// RemoveMember removes the user from organization, last owner can't be removed
+func (ors *OrgStore) RemoveMember(ctx context.Context, orgID, userID uuid.UUID) (err error) {
+	ctx, span := tracing.Start(ctx, "OrgStore.RemoveMember", attribute.String("tenant", ors.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := ors.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// memberships of the org are locked so two owners can't remove each other at once
+	var roles []struct {
+		UserID uuid.UUID `db:"user_id"`
+		Role   string    `db:"role"`
+	}
+	err = tx.SelectContext(ctx, &roles, "SELECT user_id, role FROM memberships WHERE org_id=$1 AND tenant=$2 FOR UPDATE", orgID, ors.tenant)
+	if err != nil {
+		return err
+	}
+
+	owners, found := 0, false
+	for _, r := range roles {
+		if r.Role == RoleOwner && r.UserID != userID {
+			owners++
+		}
+		if r.UserID == userID {
+			found = true
+		}
+	}
+
+	if !found {
+		return ErrNotMember
+	}
+	if owners == 0 {
+		return ErrLastOwner
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM memberships WHERE org_id=$1 AND user_id=$2 AND tenant=$3", orgID, userID, ors.tenant)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ors *OrgStore) Invite(ctx context.Context, orgID uuid.UUID, email, role string, invitedBy uuid.UUID) (_ *Invitation, _ string, err error) {
+	ctx, span := tracing.Start(ctx, "OrgStore.Invite", attribute.String("tenant", ors.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	inv := &Invitation{
+		ID:        id,
+		OrgID:     orgID,
+		Tenant:    ors.tenant,
+		Email:     email,
+		Role:      role,
+		TokenHash: hashInvitationToken(token),
+		InvitedBy: invitedBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(InvitationTTL),
+	}
+
+	_, err = ors.db.NamedExecContext(ctx, "INSERT INTO invitations (id, org_id, tenant, email, role, token_hash, invited_by, created_at, expires_at) "+
+		"VALUES (:id,:org_id,:tenant,:email,:role,:token_hash,:invited_by,:created_at,:expires_at)", inv)
+	if err != nil {
+		return nil, "", err
+	}
+	return inv, token, nil
+}
+
+func (ors *OrgStore) Invitation(ctx context.Context, token string) (_ *Invitation, err error) {
+	ctx, span := tracing.Start(ctx, "OrgStore.Invitation", attribute.String("tenant", ors.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	var inv Invitation
+	err = ors.db.GetContext(ctx, &inv, "SELECT * FROM invitations WHERE token_hash=$1 AND tenant=$2 AND accepted_at IS NULL AND expires_at > $3",
+		hashInvitationToken(token), ors.tenant, time.Now())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvitationIncorrect
+		}
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (ors *OrgStore) Accept(ctx context.Context, token string, userID uuid.UUID) (_ *Membership, err error) {
+	ctx, span := tracing.Start(ctx, "OrgStore.Accept", attribute.String("tenant", ors.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := ors.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m, err := ors.accept(ctx, tx, token, userID)
+	if err != nil {
+		return nil, err
+	}
+	return m, tx.Commit()
+}
+
+func (ors *OrgStore) AcceptAsNew(ctx context.Context, token, password string) (_ *Membership, err error) {
+	ctx, span := tracing.Start(ctx, "OrgStore.AcceptAsNew", attribute.String("tenant", ors.tenant))
+	defer func() { tracing.End(span, err) }()
+
+	inv, err := ors.Invitation(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := newUser(ctx, ors.tenant, inv.Email, password)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := ors.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err = insertUser(ctx, tx, u); err != nil {
+		return nil, err
+	}
+
+	// invitation is checked again under lock, it could be used while password was hashed
+	m, err := ors.accept(ctx, tx, token, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	return m, tx.Commit()
+}
+
+// accept joins user by invitation using caller's transaction
+func (ors *OrgStore) accept(ctx context.Context, tx *sqlx.Tx, token string, userID uuid.UUID) (*Membership, error) {
+	var inv Invitation
+	err := tx.GetContext(ctx, &inv, "SELECT * FROM invitations WHERE token_hash=$1 AND tenant=$2 AND accepted_at IS NULL AND expires_at > $3 FOR UPDATE",
+		hashInvitationToken(token), ors.tenant, time.Now())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvitationIncorrect
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	res, err := tx.ExecContext(ctx, "INSERT INTO memberships (org_id, tenant, user_id, role, created_at) VALUES ($1,$2,$3,$4,$5) "+
+		"ON CONFLICT (org_id, user_id) DO NOTHING", inv.OrgID, ors.tenant, userID, inv.Role, now)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrAlreadyMember
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE invitations SET accepted_at=$2 WHERE id=$1", inv.ID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Membership{
+		OrgID:     inv.OrgID,
+		UserID:    userID,
+		Role:      inv.Role,
+		CreatedAt: now,
+	}
+	if err = tx.GetContext(ctx, &m.OrgName, "SELECT name FROM organizations WHERE id=$1", inv.OrgID); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func NewOrgStore(db *sqlx.DB) *OrgStore {
+	return &OrgStore{db: db, tenant: DefaultTenant}
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"github.com/xssnick/crawlyzer-auth/metrics"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+// hashSecret and compareSecret are the only places bcrypt is called,
+// so its cost is visible in metrics
+func hashSecret(secret string) (string, error) {
+	defer observeBcrypt("hash", time.Now())
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func compareSecret(hash, secret string) error {
+	defer observeBcrypt("compare", time.Now())
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret))
+}
+
+func observeBcrypt(op string, start time.Time) {
+	metrics.Bcrypt.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
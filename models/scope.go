@@ -0,0 +1,25 @@
+package models
+
+const (
+	// ScopeAccount allows to manage the account itself: password, api keys, deletion and admin actions
+	ScopeAccount    = "account"
+	ScopeCrawlRead  = "crawl:read"
+	ScopeCrawlWrite = "crawl:write"
+	ScopeBilling    = "billing"
+)
+
+// KnownScopes are scopes sessions and api keys could be limited to
+var KnownScopes = []string{ScopeAccount, ScopeCrawlRead, ScopeCrawlWrite, ScopeBilling}
+
+// DefaultScopes are given to sessions started by password or external provider login
+var DefaultScopes = KnownScopes
+
+// HasScopes tells if all required scopes are granted
+func HasScopes(granted []string, required ...string) bool {
+	for _, r := range required {
+		if !contains(granted, r) {
+			return false
+		}
+	}
+	return true
+}
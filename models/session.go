@@ -0,0 +1,281 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis"
+	uuid "github.com/iris-contrib/go.uuid"
+	"strconv"
+	"time"
+)
+
+// ISessionStore keeps sessions of users, implementations are picked by config
+type ISessionStore interface {
+	// Tenant returns the store limited to sessions of the tenant
+	Tenant(tenant string) ISessionStore
+
+	// Create saves session until its ExpiresAt
+	Create(ctx context.Context, ses *Session) error
+	// Get returns live session, ErrAuthIncorrect when it is gone or expired
+	Get(ctx context.Context, sesid string) (*Session, error)
+	// Touch moves expiration of live session to ttl from now
+	Touch(ctx context.Context, sesid string, ttl time.Duration) error
+	// Delete removes session, missing one is not an error
+	Delete(ctx context.Context, sesid string) error
+	// List returns live sessions of the user, oldest first
+	List(ctx context.Context, id uuid.UUID) ([]Session, error)
+	// Count returns number of live sessions of all tenants
+	Count(ctx context.Context) (int64, error)
+}
+
+var ErrSessionExists = errors.New("session already exists")
+
+// sessionValue is what is stored under session key
+type sessionValue struct {
+	UserID         uuid.UUID  `json:"user_id"`
+	Scopes         []string   `json:"scopes"`
+	ImpersonatedBy *uuid.UUID `json:"impersonated_by,omitempty"`
+	AuthTime       *time.Time `json:"auth_time,omitempty"`
+}
+
+// decodeSession parses session key value, sessions created before scopes
+// were introduced hold only user id and get default scopes
+func decodeSession(val string) (*sessionValue, error) {
+	if id := uuid.FromStringOrNil(val); id != uuid.Nil {
+		return &sessionValue{UserID: id, Scopes: DefaultScopes}, nil
+	}
+
+	var v sessionValue
+	if err := json.Unmarshal([]byte(val), &v); err != nil || v.UserID == uuid.Nil {
+		return nil, ErrAuthIncorrect
+	}
+	return &v, nil
+}
+
+// tenantPrefix namespaces redis keys of the tenant, default tenant keeps
+// keys without prefix so sessions made before tenants were introduced stay valid
+func tenantPrefix(tenant string) string {
+	if tenant == "" || tenant == DefaultTenant {
+		return ""
+	}
+	return "tenant:" + tenant + ":"
+}
+
+// sessionKey is not hash tagged, session is found by its id alone, so the key can't carry
+// user id and its slot is taken by the whole key
+func sessionKey(tenant, sesid string) string {
+	return tenantPrefix(tenant) + "user:session:" + sesid
+}
+
+// sessionsKey is a sorted set of all session ids of the user scored by creation time,
+// used to list sessions and to kill all of them at once, user id is a hash tag,
+// so in cluster index of the user stays on one slot whatever prefix it gets
+func sessionsKey(tenant string, id uuid.UUID) string {
+	return tenantPrefix(tenant) + "user:sessions:{" + id.String() + "}"
+}
+
+// sessionsExpiryKey is a sorted set of session keys of all tenants scored by expiration time,
+// it is used only for counting, sessions created before it was introduced are not counted
+const sessionsExpiryKey = "user:sessions:expiry"
+
+// RedisSessionStore keeps session as json under its key with redis ttl.
+// In cluster session key, user indexes and expiry index are in different slots, so no command
+// and no MULTI spans two of them, pipelines are plain and cluster client splits them by node.
+// Session key is the source of truth and is written before indexes and deleted before them:
+// a dead id left in index is dropped by List and Count, an index write failing in Create
+// removes the session, so every live session can be listed and killed
+type RedisSessionStore struct {
+	redis  redis.UniversalClient
+	tenant string
+}
+
+func (ss *RedisSessionStore) Tenant(tenant string) ISessionStore {
+	return &RedisSessionStore{redis: ss.redis, tenant: tenant}
+}
+
+// sessionsKeys are indexes of the user sessions, default tenant also has index
+// written before keys were hash tagged, it is only read and cleaned by single key commands,
+// so its slot doesn't matter, and sessions in it are gone in SessionTTL after upgrade
+func (ss *RedisSessionStore) sessionsKeys(id uuid.UUID) []string {
+	keys := []string{sessionsKey(ss.tenant, id)}
+	if tenantPrefix(ss.tenant) == "" {
+		keys = append(keys, "user:sessions:"+id.String())
+	}
+	return keys
+}
+
+// sessionIndex returns ids of user's sessions scored by creation time, some of them may be expired
+func (ss *RedisSessionStore) sessionIndex(red redis.UniversalClient, id uuid.UUID) ([]redis.Z, error) {
+	var res []redis.Z
+	for _, key := range ss.sessionsKeys(id) {
+		list, err := red.ZRangeWithScores(key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, list...)
+	}
+	return res, nil
+}
+
+func (ss *RedisSessionStore) Create(ctx context.Context, ses *Session) error {
+	red := redisWithContext(ctx, ss.redis)
+
+	val, err := json.Marshal(sessionValue{UserID: ses.UserID, Scopes: ses.Scopes, ImpersonatedBy: ses.ImpersonatedBy, AuthTime: ses.AuthTime})
+	if err != nil {
+		return err
+	}
+
+	wset, err := red.SetNX(sessionKey(ss.tenant, ses.ID), val, time.Until(ses.ExpiresAt)).Result()
+	if err != nil {
+		return err
+	}
+	if !wset {
+		return ErrSessionExists
+	}
+
+	// indexes never expire by themselves, dead ids are cleaned on listing and counting
+	_, err = red.Pipelined(func(p redis.Pipeliner) error {
+		p.ZAdd(sessionsKey(ss.tenant, ses.UserID), redis.Z{
+			Score:  float64(ses.CreatedAt.Unix()),
+			Member: ses.ID,
+		})
+		p.ZAdd(sessionsExpiryKey, redis.Z{
+			Score:  float64(ses.ExpiresAt.Unix()),
+			Member: sessionKey(ss.tenant, ses.ID),
+		})
+		return nil
+	})
+	if err != nil {
+		// session missing in index couldn't be killed with the rest of user's sessions
+		red.Del(sessionKey(ss.tenant, ses.ID))
+		return err
+	}
+	return nil
+}
+
+func (ss *RedisSessionStore) Get(ctx context.Context, sesid string) (*Session, error) {
+	var get *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := redisWithContext(ctx, ss.redis).Pipelined(func(p redis.Pipeliner) error {
+		get, ttl = p.Get(sessionKey(ss.tenant, sesid)), p.TTL(sessionKey(ss.tenant, sesid))
+		return nil
+	})
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrAuthIncorrect
+		}
+		return nil, err
+	}
+
+	v, err := decodeSession(get.Val())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		ID:             sesid,
+		UserID:         v.UserID,
+		Scopes:         v.Scopes,
+		ExpiresAt:      time.Now().Add(ttl.Val()),
+		ImpersonatedBy: v.ImpersonatedBy,
+		AuthTime:       v.AuthTime,
+	}, nil
+}
+
+func (ss *RedisSessionStore) Touch(ctx context.Context, sesid string, ttl time.Duration) error {
+	red := redisWithContext(ctx, ss.redis)
+
+	ok, err := red.Expire(sessionKey(ss.tenant, sesid), ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrAuthIncorrect
+	}
+
+	return red.ZAddXX(sessionsExpiryKey, redis.Z{
+		Score:  float64(time.Now().Add(ttl).Unix()),
+		Member: sessionKey(ss.tenant, sesid),
+	}).Err()
+}
+
+func (ss *RedisSessionStore) Delete(ctx context.Context, sesid string) error {
+	red := redisWithContext(ctx, ss.redis)
+
+	val, err := red.Get(sessionKey(ss.tenant, sesid)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	}
+
+	var id uuid.UUID
+	if v, err := decodeSession(val); err == nil {
+		id = v.UserID
+	}
+
+	// session key goes first, it ends the session
+	if err = red.Del(sessionKey(ss.tenant, sesid)).Err(); err != nil {
+		return err
+	}
+
+	_, err = red.Pipelined(func(p redis.Pipeliner) error {
+		for _, key := range ss.sessionsKeys(id) {
+			p.ZRem(key, sesid)
+		}
+		p.ZRem(sessionsExpiryKey, sessionKey(ss.tenant, sesid))
+		return nil
+	})
+	return err
+}
+
+func (ss *RedisSessionStore) List(ctx context.Context, id uuid.UUID) ([]Session, error) {
+	red := redisWithContext(ctx, ss.redis)
+
+	list, err := ss.sessionIndex(red, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Session
+	for _, z := range list {
+		sesid := z.Member.(string)
+
+		ttl, err := red.TTL(sessionKey(ss.tenant, sesid)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		// negative ttl means that session key is already gone
+		if ttl < 0 {
+			for _, key := range ss.sessionsKeys(id) {
+				red.ZRem(key, sesid)
+			}
+			continue
+		}
+
+		res = append(res, Session{
+			ID:        sesid,
+			UserID:    id,
+			CreatedAt: time.Unix(int64(z.Score), 0),
+			ExpiresAt: time.Now().Add(ttl),
+		})
+	}
+	return res, nil
+}
+
+func (ss *RedisSessionStore) Count(ctx context.Context) (int64, error) {
+	red := redisWithContext(ctx, ss.redis)
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := red.ZRemRangeByScore(sessionsExpiryKey, "-inf", "("+now).Err(); err != nil {
+		return 0, err
+	}
+	return red.ZCount(sessionsExpiryKey, now, "+inf").Result()
+}
+
+func NewRedisSessionStore(red redis.UniversalClient) *RedisSessionStore {
+	return &RedisSessionStore{redis: red, tenant: DefaultTenant}
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often Create drops all expired sessions,
+// between sweeps expired ones are only hidden
+const memorySweepInterval = time.Minute
+
+// MemorySessionStore keeps sessions in the process, they are lost on restart
+// and not visible to other instances, it is for single instance and tests
+type MemorySessionStore struct {
+	data   *memorySessions
+	tenant string
+}
+
+// memorySessions is shared by all tenant scoped copies of the store
+type memorySessions struct {
+	mx        sync.Mutex
+	sessions  map[string]Session
+	lastSweep time.Time
+	// now is replaced in tests to move time forward
+	now func() time.Time
+}
+
+// key joins tenant and session id, tenant can't contain colon
+func (ss *MemorySessionStore) key(sesid string) string {
+	return ss.tenant + ":" + sesid
+}
+
+func (ss *MemorySessionStore) Tenant(tenant string) ISessionStore {
+	return &MemorySessionStore{data: ss.data, tenant: tenant}
+}
+
+func (ss *MemorySessionStore) Create(_ context.Context, ses *Session) error {
+	ss.data.mx.Lock()
+	defer ss.data.mx.Unlock()
+
+	now := ss.data.now()
+	if now.Sub(ss.data.lastSweep) >= memorySweepInterval {
+		for k, s := range ss.data.sessions {
+			if !now.Before(s.ExpiresAt) {
+				delete(ss.data.sessions, k)
+			}
+		}
+		ss.data.lastSweep = now
+	}
+
+	if s, ok := ss.data.sessions[ss.key(ses.ID)]; ok && now.Before(s.ExpiresAt) {
+		return ErrSessionExists
+	}
+
+	s := *ses
+	s.Scopes = append([]string(nil), ses.Scopes...)
+	ss.data.sessions[ss.key(ses.ID)] = s
+	return nil
+}
+
+// live returns session if it is not expired, caller must hold the lock
+func (ss *MemorySessionStore) live(sesid string) (Session, bool) {
+	s, ok := ss.data.sessions[ss.key(sesid)]
+	if !ok {
+		return Session{}, false
+	}
+	if !ss.data.now().Before(s.ExpiresAt) {
+		delete(ss.data.sessions, ss.key(sesid))
+		return Session{}, false
+	}
+	return s, true
+}
+
+func (ss *MemorySessionStore) Get(_ context.Context, sesid string) (*Session, error) {
+	ss.data.mx.Lock()
+	defer ss.data.mx.Unlock()
+
+	s, ok := ss.live(sesid)
+	if !ok {
+		return nil, ErrAuthIncorrect
+	}
+	s.Scopes = append([]string(nil), s.Scopes...)
+	return &s, nil
+}
+
+func (ss *MemorySessionStore) Touch(_ context.Context, sesid string, ttl time.Duration) error {
+	ss.data.mx.Lock()
+	defer ss.data.mx.Unlock()
+
+	s, ok := ss.live(sesid)
+	if !ok {
+		return ErrAuthIncorrect
+	}
+	s.ExpiresAt = ss.data.now().Add(ttl)
+	ss.data.sessions[ss.key(sesid)] = s
+	return nil
+}
+
+func (ss *MemorySessionStore) Delete(_ context.Context, sesid string) error {
+	ss.data.mx.Lock()
+	defer ss.data.mx.Unlock()
+
+	delete(ss.data.sessions, ss.key(sesid))
+	return nil
+}
+
+func (ss *MemorySessionStore) List(_ context.Context, id uuid.UUID) ([]Session, error) {
+	ss.data.mx.Lock()
+	defer ss.data.mx.Unlock()
+
+	var res []Session
+	for k, s := range ss.data.sessions {
+		if s.UserID != id || k != ss.key(s.ID) {
+			continue
+		}
+		if s, ok := ss.live(s.ID); ok {
+			s.Scopes = append([]string(nil), s.Scopes...)
+			res = append(res, s)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+	return res, nil
+}
+
+func (ss *MemorySessionStore) Count(_ context.Context) (int64, error) {
+	ss.data.mx.Lock()
+	defer ss.data.mx.Unlock()
+
+	var n int64
+	now := ss.data.now()
+	for _, s := range ss.data.sessions {
+		if now.Before(s.ExpiresAt) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		data: &memorySessions{
+			sessions: map[string]Session{},
+			now:      time.Now,
+		},
+		tenant: DefaultTenant,
+	}
+}
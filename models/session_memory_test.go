@@ -0,0 +1,94 @@
+package models
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	Convey("Sessions in memory", t, func() {
+		ctx := context.Background()
+		ss := NewMemorySessionStore()
+		now := time.Now()
+		ss.data.now = func() time.Time { return now }
+
+		uid := uuid.FromStringOrNil("4f477db2-17b7-432d-ad0e-c2a098cbd2b0")
+		newSession := func(id string, ttl time.Duration) *Session {
+			return &Session{ID: id, UserID: uid, Scopes: DefaultScopes, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+		}
+
+		So(ss.Create(ctx, newSession("first", time.Hour)), ShouldEqual, nil)
+
+		Convey("Session must be found", func() {
+			ses, err := ss.Get(ctx, "first")
+			So(err, ShouldEqual, nil)
+			So(ses.UserID, ShouldEqual, uid)
+			So(ses.Scopes, ShouldResemble, DefaultScopes)
+		})
+
+		Convey("Same id must not be reused", func() {
+			So(ss.Create(ctx, newSession("first", time.Hour)), ShouldEqual, ErrSessionExists)
+		})
+
+		Convey("Session must not be visible to other tenant", func() {
+			_, err := ss.Tenant("initech").Get(ctx, "first")
+			So(err, ShouldEqual, ErrAuthIncorrect)
+
+			list, _ := ss.Tenant("initech").List(ctx, uid)
+			So(len(list), ShouldEqual, 0)
+		})
+
+		Convey("When time passes ttl", func() {
+			now = now.Add(time.Hour)
+
+			Convey("Session must be gone", func() {
+				_, err := ss.Get(ctx, "first")
+				So(err, ShouldEqual, ErrAuthIncorrect)
+				So(ss.Touch(ctx, "first", time.Hour), ShouldEqual, ErrAuthIncorrect)
+
+				n, _ := ss.Count(ctx)
+				So(n, ShouldEqual, 0)
+			})
+
+			Convey("Sweep must free memory", func() {
+				So(ss.Create(ctx, newSession("second", time.Hour)), ShouldEqual, nil)
+				So(len(ss.data.sessions), ShouldEqual, 1)
+			})
+		})
+
+		Convey("Touched session must outlive ttl", func() {
+			now = now.Add(30 * time.Minute)
+			So(ss.Touch(ctx, "first", time.Hour), ShouldEqual, nil)
+
+			now = now.Add(45 * time.Minute)
+			_, err := ss.Get(ctx, "first")
+			So(err, ShouldEqual, nil)
+		})
+
+		Convey("Sessions must be listed oldest first", func() {
+			now = now.Add(time.Minute)
+			So(ss.Create(ctx, newSession("second", time.Hour)), ShouldEqual, nil)
+
+			list, err := ss.List(ctx, uid)
+			So(err, ShouldEqual, nil)
+			So(len(list), ShouldEqual, 2)
+			So(list[0].ID, ShouldEqual, "first")
+			So(list[1].ID, ShouldEqual, "second")
+
+			n, err := ss.Tenant("initech").Count(ctx)
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 2)
+		})
+
+		Convey("Deleted session must be gone", func() {
+			So(ss.Delete(ctx, "first"), ShouldEqual, nil)
+			So(ss.Delete(ctx, "first"), ShouldEqual, nil)
+
+			_, err := ss.Get(ctx, "first")
+			So(err, ShouldEqual, ErrAuthIncorrect)
+		})
+	})
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"time"
+)
+
+// SQLSessionStore keeps sessions in postgres table, so deployment can run without redis for them,
+// expired rows are skipped by queries and removed when user starts new session
+type SQLSessionStore struct {
+	db     *sqlx.DB
+	tenant string
+}
+
+type sessionRow struct {
+	ID             string         `db:"id"`
+	UserID         uuid.UUID      `db:"user_id"`
+	Scopes         pq.StringArray `db:"scopes"`
+	ImpersonatedBy *uuid.UUID     `db:"impersonated_by"`
+	AuthTime       *time.Time     `db:"auth_time"`
+	CreatedAt      time.Time      `db:"created_at"`
+	ExpiresAt      time.Time      `db:"expires_at"`
+}
+
+func (r *sessionRow) session() Session {
+	return Session{
+		ID:             r.ID,
+		UserID:         r.UserID,
+		Scopes:         r.Scopes,
+		CreatedAt:      r.CreatedAt,
+		ExpiresAt:      r.ExpiresAt,
+		ImpersonatedBy: r.ImpersonatedBy,
+		AuthTime:       r.AuthTime,
+	}
+}
+
+func (ss *SQLSessionStore) Tenant(tenant string) ISessionStore {
+	return &SQLSessionStore{db: ss.db, tenant: tenant}
+}
+
+func (ss *SQLSessionStore) Create(ctx context.Context, ses *Session) error {
+	tx, err := ss.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM sessions WHERE tenant=$1 AND user_id=$2 AND expires_at <= $3", ss.tenant, ses.UserID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO sessions (tenant, id, user_id, scopes, impersonated_by, auth_time, created_at, expires_at) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)",
+		ss.tenant, ses.ID, ses.UserID, pq.StringArray(ses.Scopes), ses.ImpersonatedBy, ses.AuthTime, ses.CreatedAt, ses.ExpiresAt)
+
+	//23505 is postgres' error code that means - item exists
+	if pgerr, ok := err.(*pq.Error); ok {
+		if pgerr.Code == "23505" {
+			return ErrSessionExists
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ss *SQLSessionStore) Get(ctx context.Context, sesid string) (*Session, error) {
+	var r sessionRow
+	err := ss.db.GetContext(ctx, &r, "SELECT id,user_id,scopes,impersonated_by,auth_time,created_at,expires_at FROM sessions "+
+		"WHERE tenant=$1 AND id=$2 AND expires_at > $3", ss.tenant, sesid, time.Now())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAuthIncorrect
+		}
+		return nil, err
+	}
+
+	ses := r.session()
+	return &ses, nil
+}
+
+func (ss *SQLSessionStore) Touch(ctx context.Context, sesid string, ttl time.Duration) error {
+	now := time.Now()
+	res, err := ss.db.ExecContext(ctx, "UPDATE sessions SET expires_at=$4 WHERE tenant=$1 AND id=$2 AND expires_at > $3",
+		ss.tenant, sesid, now, now.Add(ttl))
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAuthIncorrect
+	}
+	return nil
+}
+
+func (ss *SQLSessionStore) Delete(ctx context.Context, sesid string) error {
+	_, err := ss.db.ExecContext(ctx, "DELETE FROM sessions WHERE tenant=$1 AND id=$2", ss.tenant, sesid)
+	return err
+}
+
+func (ss *SQLSessionStore) List(ctx context.Context, id uuid.UUID) ([]Session, error) {
+	var rows []sessionRow
+	err := ss.db.SelectContext(ctx, &rows, "SELECT id,user_id,scopes,impersonated_by,auth_time,created_at,expires_at FROM sessions "+
+		"WHERE tenant=$1 AND user_id=$2 AND expires_at > $3 ORDER BY created_at", ss.tenant, id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Session
+	for i := range rows {
+		res = append(res, rows[i].session())
+	}
+	return res, nil
+}
+
+func (ss *SQLSessionStore) Count(ctx context.Context) (int64, error) {
+	var n int64
+	err := ss.db.GetContext(ctx, &n, "SELECT count(*) FROM sessions WHERE expires_at > $1", time.Now())
+	return n, err
+}
+
+func NewSQLSessionStore(db *sqlx.DB) *SQLSessionStore {
+	return &SQLSessionStore{db: db, tenant: DefaultTenant}
+}
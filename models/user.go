@@ -1,135 +1,594 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"github.com/go-redis/redis"
 	uuid "github.com/iris-contrib/go.uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
 type IUserStore interface {
-	Create(email, password string) (uuid.UUID, error)
-	Login(email, password string) (string, error)
-	Auth(sesid string) (uuid.UUID, error)
-	Logout(sesid string) error
-	GetAll() ([]User, error)
+	// Tenant returns the store limited to users and sessions of the tenant
+	Tenant(tenant string) IUserStore
+
+	// methods stop waiting for postgres and session backend when ctx is done,
+	// their spans are children of span in ctx
+	Create(ctx context.Context, email, password string) (uuid.UUID, error)
+	Login(ctx context.Context, email, password string) (*Session, error)
+	CreateSession(ctx context.Context, id uuid.UUID, scopes []string) (*Session, error)
+	// Impersonate starts short session of user on behalf of admin, it doesn't count as login
+	Impersonate(ctx context.Context, adminID, id uuid.UUID) (*Session, error)
+	Auth(ctx context.Context, sesid string) (uuid.UUID, error)
+	AuthSession(ctx context.Context, sesid string) (*Session, error)
+	Logout(ctx context.Context, sesid string) error
+	GetAll(ctx context.Context) ([]User, error)
+	Get(ctx context.Context, id uuid.UUID) (*User, error)
+	Sessions(ctx context.Context, id uuid.UUID) ([]Session, error)
+	// ChangePassword ends other sessions of the user, sesid is the one change is made from, empty ends all
+	ChangePassword(ctx context.Context, id uuid.UUID, sesid, oldPassword, newPassword string) error
+	Delete(ctx context.Context, id uuid.UUID, password string) error
+	Anonymize(ctx context.Context, deletedBefore time.Time) (int64, error)
 }
 
 type User struct {
 	ID        uuid.UUID  `db:"id"`
+	Tenant    string     `db:"tenant"`
 	Email     string     `db:"email"`
 	Password  string     `db:"password"`
 	CreatedAt time.Time  `db:"created_at"`
 	LastLogin *time.Time `db:"last_login"`
+	IsAdmin   bool       `db:"is_admin"`
+
+	DeletedAt    *time.Time `db:"deleted_at"`
+	AnonymizedAt *time.Time `db:"anonymized_at"`
+}
+
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    uuid.UUID `json:"-"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// ImpersonatedBy is admin who works in the session instead of user
+	ImpersonatedBy *uuid.UUID `json:"impersonated_by,omitempty"`
+	// AuthTime is when user signed in with password or identity provider,
+	// it is nil for sessions issued to oauth clients and impersonating admins
+	AuthTime *time.Time `json:"auth_time,omitempty"`
 }
 
 type UserStore struct {
-	db    *sqlx.DB
-	redis *redis.Client
+	db       *sqlx.DB
+	sessions ISessionStore
+	tenant   string
 }
 
 var ErrLoginIncorrect = errors.New("incorrect email or password")
 var ErrAuthIncorrect = errors.New("incorrect or old session")
 var ErrAlreadyCreated = errors.New("user already exists")
+var ErrUserNotFound = errors.New("user not found")
 
-func (us *UserStore) Create(email, password string) (uuid.UUID, error) {
-	id, err := uuid.NewV4()
+const SessionTTL = 3 * time.Hour
+
+// SessionMaxAge bounds sliding of session, user signs in again this long after he did
+const SessionMaxAge = 24 * time.Hour
+
+// ImpersonationTTL is shorter than SessionTTL, support shouldn't stay in user's account for long
+const ImpersonationTTL = 30 * time.Minute
+
+// FreshLoginTTL is how long after sign in through identity provider user without password
+// can change password or delete account, he has no password to confirm them with
+const FreshLoginTTL = 10 * time.Minute
+
+// DefaultTenant owns users when no tenant is given
+const DefaultTenant = "default"
+
+func (us *UserStore) Tenant(tenant string) IUserStore {
+	return us.withTenant(tenant)
+}
+
+func (us *UserStore) withTenant(tenant string) *UserStore {
+	return &UserStore{db: us.db, sessions: us.sessions.Tenant(tenant), tenant: tenant}
+}
+
+// span starts span of the call, returned ctx is used for the rest of the call
+// so spans of its steps and nested calls become children
+func (us *UserStore) span(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, name, attribute.String("tenant", us.tenant))
+}
+
+// step runs part of the call in its own span, so slow query, bcrypt and session backend are told apart
+func step(ctx context.Context, name string, f func(ctx context.Context) error) error {
+	ctx, span := tracing.Start(ctx, name)
+	err := f(ctx)
+	tracing.End(span, err)
+	return err
+}
+
+func (us *UserStore) Create(ctx context.Context, email, password string) (_ uuid.UUID, err error) {
+	ctx, span := us.span(ctx, "UserStore.Create")
+	defer func() { tracing.End(span, err) }()
+
+	u, err := newUser(ctx, us.tenant, email, password)
 	if err != nil {
 		return uuid.Nil, err
 	}
 
-	bpw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	tx, err := us.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return uuid.Nil, err
 	}
+	defer tx.Rollback()
 
-	//TODO: pass context to queries
-	_, err = us.db.NamedExec("INSERT INTO users (id, email, password, created_at) VALUES (:id,:email,:password,:created_at)", &User{
+	if err = insertUser(ctx, tx, u); err != nil {
+		return uuid.Nil, err
+	}
+	return u.ID, tx.Commit()
+}
+
+// newUser makes user with hashed password, it is hashed before transaction is opened to not hold it meanwhile
+func newUser(ctx context.Context, tenant, email, password string) (*User, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	var bpw string
+	err = step(ctx, "bcrypt.hash", func(context.Context) (err error) {
+		bpw, err = hashSecret(password)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{
 		ID:        id,
+		Tenant:    tenant,
 		Email:     email,
-		Password:  string(bpw),
+		Password:  bpw,
 		CreatedAt: time.Now(),
+	}, nil
+}
+
+// insertUser saves new user with its event and webhooks using caller's transaction
+func insertUser(ctx context.Context, tx *sqlx.Tx, u *User) error {
+	err := step(ctx, "postgres.insert_user", func(ctx context.Context) error {
+		_, err := tx.NamedExecContext(ctx, "INSERT INTO users (id, tenant, email, password, created_at) VALUES (:id,:tenant,:email,:password,:created_at)", u)
+		return err
 	})
 
 	//23505 is postgres' error code that means - item exists
 	if pgerr, ok := err.(*pq.Error); ok {
 		if pgerr.Code == "23505" {
-			return uuid.Nil, ErrAlreadyCreated
+			return ErrAlreadyCreated
 		}
 	}
+	if err != nil {
+		return err
+	}
 
-	return id, err
+	err = insertEvent(ctx, tx, DomainUserCreated, u.ID, UserCreatedPayload{
+		UserID:    u.ID,
+		Tenant:    u.Tenant,
+		Email:     u.Email,
+		CreatedAt: u.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return enqueueWebhook(ctx, tx, u.Tenant, WebhookUserRegistered, u.ID)
 }
 
-func (us *UserStore) Auth(sesid string) (uuid.UUID, error) {
-	res, err := us.redis.Get("user:session:" + sesid).Result()
+func (us *UserStore) Auth(ctx context.Context, sesid string) (uuid.UUID, error) {
+	ses, err := us.AuthSession(ctx, sesid)
 	if err != nil {
-		if err == redis.Nil {
-			return uuid.Nil, ErrAuthIncorrect
-		}
 		return uuid.Nil, err
 	}
+	return ses.UserID, nil
+}
+
+// AuthSession returns session with its scopes, session user signed in with is prolonged
+// to SessionTTL once half of it has passed, but not beyond SessionMaxAge after sign in
+func (us *UserStore) AuthSession(ctx context.Context, sesid string) (ses *Session, err error) {
+	ctx, span := us.span(ctx, "UserStore.AuthSession")
+	defer func() { tracing.End(span, err) }()
+
+	ses, err = us.sessions.Get(ctx, sesid)
+	if err != nil || ses.AuthTime == nil {
+		return ses, err
+	}
 
-	rid := uuid.FromStringOrNil(res)
-	if rid == uuid.Nil {
-		return uuid.Nil, ErrAuthIncorrect
+	ttl := SessionTTL
+	if left := time.Until(ses.AuthTime.Add(SessionMaxAge)); left < ttl {
+		ttl = left
+	}
+	if time.Until(ses.ExpiresAt) > SessionTTL/2 || ttl <= time.Until(ses.ExpiresAt) {
+		return ses, nil
 	}
 
-	return rid, nil
+	err = step(ctx, "sessions.touch", func(ctx context.Context) error {
+		return us.sessions.Touch(ctx, sesid, ttl)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ses.ExpiresAt = time.Now().Add(ttl)
+	return ses, nil
 }
 
-func (us *UserStore) Logout(sesid string) error {
-	_, err := us.redis.Del("user:session:" + sesid).Result()
+func (us *UserStore) Logout(ctx context.Context, sesid string) (err error) {
+	ctx, span := us.span(ctx, "UserStore.Logout")
+	defer func() { tracing.End(span, err) }()
+
+	var ses *Session
+	err = step(ctx, "sessions.get", func(ctx context.Context) (err error) {
+		ses, err = us.sessions.Get(ctx, sesid)
+		return err
+	})
 	if err != nil {
+		if err == ErrAuthIncorrect {
+			return nil
+		}
 		return err
 	}
 
-	return nil
+	// event is written before session is deleted, when deletion fails
+	// retry writes it again, consumers are ready for duplicates anyway
+	err = insertEvent(ctx, us.db, DomainSessionRevoked, ses.UserID, SessionRevokedPayload{
+		UserID: ses.UserID,
+		Reason: "logout",
+	})
+	if err != nil {
+		return err
+	}
+
+	return step(ctx, "sessions.delete", func(ctx context.Context) error {
+		return us.sessions.Delete(ctx, sesid)
+	})
 }
 
-func (us *UserStore) Login(email, password string) (string, error) {
+// killSessions deletes sessions of the user but the one with except id
+func (us *UserStore) killSessions(ctx context.Context, id uuid.UUID, except string) error {
+	return step(ctx, "sessions.delete_all", func(ctx context.Context) error {
+		sessions, err := us.sessions.List(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		for _, ses := range sessions {
+			if ses.ID == except {
+				continue
+			}
+			if err = us.sessions.Delete(ctx, ses.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (us *UserStore) Login(ctx context.Context, email, password string) (ses *Session, err error) {
+	ctx, span := us.span(ctx, "UserStore.Login")
+	defer func() { tracing.End(span, err) }()
+
 	var u User
-	err := us.db.Get(&u, "SELECT * FROM users WHERE email=$1", email)
+	err = step(ctx, "postgres.select_user", func(ctx context.Context) error {
+		return us.db.GetContext(ctx, &u, "SELECT * FROM users WHERE email=$1 AND tenant=$2 AND deleted_at IS NULL", email, us.tenant)
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return "", ErrLoginIncorrect
+			return nil, ErrLoginIncorrect
+		}
+		return nil, err
+	}
+
+	err = step(ctx, "bcrypt.compare", func(context.Context) error {
+		return compareSecret(u.Password, password)
+	})
+	if err != nil {
+		return nil, ErrLoginIncorrect
+	}
+
+	return us.startSession(ctx, u.ID, DefaultScopes)
+}
+
+// startSession remembers login time and creates session of successfully logged in user,
+// session is saved only after login is committed with its event
+func (us *UserStore) startSession(ctx context.Context, id uuid.UUID, scopes []string) (*Session, error) {
+	ses, err := newSession(sessionValue{UserID: id, Scopes: scopes}, SessionTTL)
+	if err != nil {
+		return nil, err
+	}
+	ses.AuthTime = &ses.CreatedAt
+
+	err = step(ctx, "postgres.update_last_login", func(ctx context.Context) error {
+		tx, err := us.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
 		}
-		return "", err
+		defer tx.Rollback()
+
+		_, err = tx.ExecContext(ctx, "UPDATE users SET last_login=$2 WHERE id=$1", id, ses.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		err = insertEvent(ctx, tx, DomainUserLoggedIn, id, UserLoggedInPayload{
+			UserID:     id,
+			LoggedInAt: ses.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	if err = us.saveSession(ctx, ses); err != nil {
+		return nil, err
+	}
+	return ses, nil
+}
+
+// CreateSession starts new session for the user limited to scopes without any checks
+func (us *UserStore) CreateSession(ctx context.Context, id uuid.UUID, scopes []string) (ses *Session, err error) {
+	ctx, span := us.span(ctx, "UserStore.CreateSession")
+	defer func() { tracing.End(span, err) }()
+
+	return us.createSession(ctx, sessionValue{UserID: id, Scopes: scopes}, SessionTTL)
+}
+
+func (us *UserStore) Impersonate(ctx context.Context, adminID, id uuid.UUID) (ses *Session, err error) {
+	ctx, span := us.span(ctx, "UserStore.Impersonate")
+	defer func() { tracing.End(span, err) }()
+
+	u, err := us.Get(ctx, id)
 	if err != nil {
-		return "", ErrLoginIncorrect
+		return nil, err
+	}
+	if u.DeletedAt != nil {
+		return nil, ErrUserNotFound
 	}
 
+	return us.createSession(ctx, sessionValue{UserID: id, Scopes: DefaultScopes, ImpersonatedBy: &adminID}, ImpersonationTTL)
+}
+
+func (us *UserStore) createSession(ctx context.Context, v sessionValue, ttl time.Duration) (*Session, error) {
+	ses, err := newSession(v, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = us.saveSession(ctx, ses); err != nil {
+		return nil, err
+	}
+	return ses, nil
+}
+
+// newSession generates id of session starting now, it is not saved yet
+func newSession(v sessionValue, ttl time.Duration) (*Session, error) {
 	//TODO: replace to more secure
 	sesid, err := uuid.NewV4()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	now := time.Now()
+	return &Session{
+		ID:             sesid.String(),
+		UserID:         v.UserID,
+		Scopes:         v.Scopes,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(ttl),
+		ImpersonatedBy: v.ImpersonatedBy,
+		AuthTime:       v.AuthTime,
+	}, nil
+}
+
+func (us *UserStore) saveSession(ctx context.Context, ses *Session) error {
+	return step(ctx, "sessions.create", func(ctx context.Context) error {
+		return us.sessions.Create(ctx, ses)
+	})
+}
+
+func (us *UserStore) GetAll(ctx context.Context) (res []User, err error) {
+	ctx, span := us.span(ctx, "UserStore.GetAll")
+	defer func() { tracing.End(span, err) }()
+
+	err = us.db.SelectContext(ctx, &res, "SELECT id,tenant,email,password,created_at,last_login FROM users WHERE tenant=$1 AND deleted_at IS NULL", us.tenant)
+	return res, err
+}
+
+func (us *UserStore) Get(ctx context.Context, id uuid.UUID) (_ *User, err error) {
+	ctx, span := us.span(ctx, "UserStore.Get")
+	defer func() { tracing.End(span, err) }()
+
+	var u User
+	err = us.db.GetContext(ctx, &u, "SELECT * FROM users WHERE id=$1 AND tenant=$2", id, us.tenant)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Sessions returns active sessions of the user, oldest first
+func (us *UserStore) Sessions(ctx context.Context, id uuid.UUID) (list []Session, err error) {
+	ctx, span := us.span(ctx, "UserStore.Sessions")
+	defer func() { tracing.End(span, err) }()
+
+	return us.sessions.List(ctx, id)
+}
+
+func (us *UserStore) ChangePassword(ctx context.Context, id uuid.UUID, sesid, oldPassword, newPassword string) (err error) {
+	ctx, span := us.span(ctx, "UserStore.ChangePassword")
+	defer func() { tracing.End(span, err) }()
+
+	err = us.checkPassword(ctx, id, oldPassword)
+	if err != nil {
+		return err
+	}
+
+	var bpw string
+	err = step(ctx, "bcrypt.hash", func(context.Context) (err error) {
+		bpw, err = hashSecret(newPassword)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	sessions, err := us.sessions.List(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := us.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET password=$2 WHERE id=$1 AND tenant=$3 AND deleted_at IS NULL", id, bpw, us.tenant)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+
+	// whoever knew the old password must not stay signed in
+	for _, ses := range sessions {
+		if ses.ID == sesid {
+			continue
+		}
+
+		err = insertEvent(ctx, tx, DomainSessionRevoked, id, SessionRevokedPayload{
+			UserID: id,
+			Reason: "password_change",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = enqueueWebhook(ctx, tx, us.tenant, WebhookUserPasswordChanged, id); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return us.killSessions(ctx, id, sesid)
+}
+
+// checkPassword compares password with the hash, account created by federated login
+// has no password and matches only empty one, caller must have checked fresh login for it
+func (us *UserStore) checkPassword(ctx context.Context, id uuid.UUID, password string) error {
+	var hash string
+	err := step(ctx, "postgres.select_password", func(ctx context.Context) error {
+		return us.db.GetContext(ctx, &hash, "SELECT password FROM users WHERE id=$1 AND tenant=$2 AND deleted_at IS NULL", id, us.tenant)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		return err
 	}
 
-	wset, err := us.redis.SetNX("user:session:"+sesid.String(), u.ID.String(), 3*time.Hour).Result()
-	if err != nil || !wset {
-		return "", errors.New("session create error")
+	if hash == "" || password == "" {
+		if hash != password {
+			return ErrLoginIncorrect
+		}
+		return nil
 	}
 
-	_, err = us.db.Exec("UPDATE users SET last_login=$2 WHERE id=$1", u.ID, time.Now())
+	err = step(ctx, "bcrypt.compare", func(context.Context) error {
+		return compareSecret(hash, password)
+	})
 	if err != nil {
-		return "", err
+		return ErrLoginIncorrect
 	}
-	return sesid.String(), nil
+	return nil
 }
 
-func (us *UserStore) GetAll() ([]User, error) {
-	var res []User
-	err := us.db.Select(&res, "SELECT id,email,password,created_at,last_login FROM users")
-	return res, err
+// Delete marks user as deleted after password check and kills all his sessions,
+// personal data is kept until Anonymize is called for him.
+// User without password passes empty one, like to ChangePassword to set his first password
+func (us *UserStore) Delete(ctx context.Context, id uuid.UUID, password string) (err error) {
+	ctx, span := us.span(ctx, "UserStore.Delete")
+	defer func() { tracing.End(span, err) }()
+
+	err = us.checkPassword(ctx, id, password)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := us.sessions.List(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := us.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET deleted_at=$2 WHERE id=$1", id, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for range sessions {
+		err = insertEvent(ctx, tx, DomainSessionRevoked, id, SessionRevokedPayload{
+			UserID: id,
+			Reason: "account_delete",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = enqueueWebhook(ctx, tx, us.tenant, WebhookUserDeleted, id); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return us.killSessions(ctx, id, "")
+}
+
+// Anonymize wipes email and password hash of users of all tenants deleted before given time,
+// row itself stays for references. Outbox keeps events for replay, so email is replaced there too,
+// copies already published to the stream are up to its retention
+func (us *UserStore) Anonymize(ctx context.Context, deletedBefore time.Time) (n int64, err error) {
+	ctx, span := us.span(ctx, "UserStore.Anonymize")
+	defer func() { tracing.End(span, err) }()
+
+	// linked external identities hold email too, so they go away with it
+	err = us.db.GetContext(ctx, &n, "WITH anon AS (UPDATE users SET email='deleted-'||id||'@anonymized.invalid', password='', anonymized_at=$2 "+
+		"WHERE deleted_at < $1 AND anonymized_at IS NULL RETURNING id, email), "+
+		"unlinked AS (DELETE FROM user_identities WHERE user_id IN (SELECT id FROM anon)), "+
+		"scrubbed AS (UPDATE events_outbox e SET payload=jsonb_set(e.payload::jsonb, '{email}', to_jsonb(a.email))::text "+
+		"FROM anon a WHERE e.aggregate_id=a.id AND e.type=$3) "+
+		"SELECT count(*) FROM anon", deletedBefore, time.Now(), DomainUserCreated)
+	return n, err
 }
 
-func NewUserStore(db *sqlx.DB, red *redis.Client) *UserStore {
-	return &UserStore{db: db, redis: red}
+func NewUserStore(db *sqlx.DB, sessions ISessionStore) *UserStore {
+	return &UserStore{db: db, sessions: sessions, tenant: DefaultTenant}
 }
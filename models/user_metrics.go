@@ -0,0 +1,33 @@
+package models
+
+import (
+	"context"
+	"github.com/xssnick/crawlyzer-auth/metrics"
+)
+
+// MeteredUserStore counts password logins of the wrapped store by result,
+// other calls go to it as is
+type MeteredUserStore struct {
+	IUserStore
+}
+
+func (ms *MeteredUserStore) Tenant(tenant string) IUserStore {
+	return &MeteredUserStore{ms.IUserStore.Tenant(tenant)}
+}
+
+func (ms *MeteredUserStore) Login(ctx context.Context, email, password string) (*Session, error) {
+	ses, err := ms.IUserStore.Login(ctx, email, password)
+	switch err {
+	case nil:
+		metrics.Logins.WithLabelValues(metrics.LoginSuccess, "").Inc()
+	case ErrLoginIncorrect:
+		metrics.Logins.WithLabelValues(metrics.LoginFailure, metrics.ReasonBadCredentials).Inc()
+	default:
+		metrics.Logins.WithLabelValues(metrics.LoginFailure, metrics.ReasonError).Inc()
+	}
+	return ses, err
+}
+
+func NewMeteredUserStore(users IUserStore) *MeteredUserStore {
+	return &MeteredUserStore{users}
+}
@@ -0,0 +1,43 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/metrics"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"testing"
+)
+
+func TestMeteredUserStore(t *testing.T) {
+	Convey("Metered logins", t, func() {
+		mock := &models_mock.MUserStore{}
+		users := models.NewMeteredUserStore(mock).Tenant("initech")
+
+		count := func(result, reason string) float64 {
+			return testutil.ToFloat64(metrics.Logins.WithLabelValues(result, reason))
+		}
+
+		variants := []map[string]interface{}{
+			{"case": "success", "err": nil, "result": metrics.LoginSuccess, "reason": ""},
+			{"case": "bad credentials", "err": models.ErrLoginIncorrect, "result": metrics.LoginFailure, "reason": metrics.ReasonBadCredentials},
+			{"case": "store failure", "err": errors.New("connection refused"), "result": metrics.LoginFailure, "reason": metrics.ReasonError},
+		}
+
+		for _, v := range variants {
+			Convey("When login is "+v["case"].(string), func() {
+				mock.FakeError, _ = v["err"].(error)
+				before := count(v["result"].(string), v["reason"].(string))
+
+				users.Login(context.Background(), "tester@exter.com", "SuperPassword")
+
+				Convey("Must be counted once", func() {
+					So(count(v["result"].(string), v["reason"].(string)), ShouldEqual, before+1)
+					So(mock.LastTenant, ShouldEqual, "initech")
+				})
+			})
+		}
+	})
+}
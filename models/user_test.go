@@ -0,0 +1,54 @@
+package models
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestSlidingSession(t *testing.T) {
+	Convey("Session expiration sliding", t, func() {
+		ctx := context.Background()
+		ss := NewMemorySessionStore()
+		us := NewUserStore(nil, ss)
+		now := time.Now()
+
+		variants := []map[string]interface{}{
+			{"case": "fresh", "left": SessionTTL - time.Minute, "signed": 10 * time.Minute, "mustbe": SessionTTL - time.Minute},
+			{"case": "half passed", "left": time.Hour, "signed": 2 * time.Hour, "mustbe": SessionTTL},
+			{"case": "close to max age", "left": time.Hour, "signed": SessionMaxAge - 90*time.Minute, "mustbe": 90 * time.Minute},
+			{"case": "at max age", "left": time.Hour, "signed": SessionMaxAge - 30*time.Minute, "mustbe": time.Hour},
+			{"case": "impersonated", "left": time.Hour, "mustbe": time.Hour},
+		}
+
+		for _, v := range variants {
+			Convey("When session is "+v["case"].(string), func() {
+				ses := &Session{
+					ID:        uuid.Must(uuid.NewV4()).String(),
+					UserID:    uuid.Must(uuid.NewV4()),
+					Scopes:    DefaultScopes,
+					CreatedAt: now,
+					ExpiresAt: now.Add(v["left"].(time.Duration)),
+				}
+				if signed, ok := v["signed"].(time.Duration); ok {
+					at := now.Add(-signed)
+					ses.AuthTime = &at
+				}
+				So(ss.Create(ctx, ses), ShouldEqual, nil)
+
+				got, err := us.AuthSession(ctx, ses.ID)
+				So(err, ShouldEqual, nil)
+
+				Convey("It must expire in time", func() {
+					mustbe := now.Add(v["mustbe"].(time.Duration))
+					So(got.ExpiresAt, ShouldHappenWithin, time.Minute, mustbe)
+
+					stored, _ := ss.Get(ctx, ses.ID)
+					So(stored.ExpiresAt, ShouldHappenWithin, time.Minute, mustbe)
+				})
+			})
+		}
+	})
+}
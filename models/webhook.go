@@ -0,0 +1,234 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/xssnick/crawlyzer-auth/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"time"
+)
+
+const (
+	WebhookUserRegistered      = "user.registered"
+	WebhookUserPasswordChanged = "user.password_changed"
+	WebhookUserDeleted         = "user.deleted"
+)
+
+// WebhookEvents are all events which can be subscribed, "*" means all of them
+var WebhookEvents = []string{WebhookUserRegistered, WebhookUserPasswordChanged, WebhookUserDeleted}
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+type IWebhookStore interface {
+	Create(ctx context.Context, url string, events []string) (*Webhook, error)
+	List(ctx context.Context) ([]Webhook, error)
+	Delete(ctx context.Context, id uuid.UUID) error
+	Deliveries(ctx context.Context, id uuid.UUID, limit int) ([]WebhookDelivery, error)
+
+	Enqueue(ctx context.Context, tenant, event string, userID uuid.UUID) error
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]WebhookOutboxItem, error)
+	Complete(ctx context.Context, d WebhookDelivery, retryAt *time.Time) error
+}
+
+type Webhook struct {
+	ID        uuid.UUID      `db:"id" json:"id"`
+	URL       string         `db:"url" json:"url"`
+	Secret    string         `db:"secret" json:"-"`
+	Events    pq.StringArray `db:"events" json:"events"`
+	Active    bool           `db:"active" json:"active"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+}
+
+type WebhookPayload struct {
+	Event      string    `json:"event"`
+	Tenant     string    `json:"tenant"`
+	UserID     uuid.UUID `json:"user_id"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// WebhookOutboxItem is a pending delivery of one event to one webhook
+type WebhookOutboxItem struct {
+	ID        int64     `db:"id"`
+	WebhookID uuid.UUID `db:"webhook_id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	Event     string    `db:"event"`
+	Payload   string    `db:"payload"`
+	Attempts  int       `db:"attempts"`
+}
+
+type WebhookDelivery struct {
+	ID         int64     `db:"id" json:"id"`
+	OutboxID   int64     `db:"outbox_id" json:"outbox_id"`
+	WebhookID  uuid.UUID `db:"webhook_id" json:"webhook_id"`
+	Event      string    `db:"event" json:"event"`
+	Attempt    int       `db:"attempt" json:"attempt"`
+	Success    bool      `db:"success" json:"success"`
+	StatusCode int       `db:"status_code" json:"status_code"`
+	Error      string    `db:"error" json:"error"`
+	DurationMs int64     `db:"duration_ms" json:"duration_ms"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+type WebhookStore struct {
+	db *sqlx.DB
+}
+
+func (ws *WebhookStore) Create(ctx context.Context, url string, events []string) (_ *Webhook, err error) {
+	ctx, span := tracing.Start(ctx, "WebhookStore.Create")
+	defer func() { tracing.End(span, err) }()
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	w := &Webhook{
+		ID:        id,
+		URL:       url,
+		Secret:    hex.EncodeToString(secret),
+		Events:    events,
+		Active:    true,
+		CreatedAt: time.Now(),
+	}
+
+	_, err = ws.db.NamedExecContext(ctx, "INSERT INTO webhooks (id, url, secret, events, active, created_at) "+
+		"VALUES (:id,:url,:secret,:events,:active,:created_at)", w)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (ws *WebhookStore) List(ctx context.Context) (res []Webhook, err error) {
+	ctx, span := tracing.Start(ctx, "WebhookStore.List")
+	defer func() { tracing.End(span, err) }()
+
+	err = ws.db.SelectContext(ctx, &res, "SELECT * FROM webhooks ORDER BY created_at")
+	return res, err
+}
+
+func (ws *WebhookStore) Delete(ctx context.Context, id uuid.UUID) (err error) {
+	ctx, span := tracing.Start(ctx, "WebhookStore.Delete")
+	defer func() { tracing.End(span, err) }()
+
+	res, err := ws.db.ExecContext(ctx, "DELETE FROM webhooks WHERE id=$1", id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Deliveries returns delivery log of the webhook, newest first
+func (ws *WebhookStore) Deliveries(ctx context.Context, id uuid.UUID, limit int) (res []WebhookDelivery, err error) {
+	ctx, span := tracing.Start(ctx, "WebhookStore.Deliveries")
+	defer func() { tracing.End(span, err) }()
+
+	err = ws.db.SelectContext(ctx, &res, "SELECT * FROM webhook_deliveries WHERE webhook_id=$1 ORDER BY id DESC LIMIT $2", id, limit)
+	return res, err
+}
+
+// Enqueue puts event into outbox of every active webhook subscribed to it,
+// webhooks are shared by tenants so payload tells which one the user belongs to
+func (ws *WebhookStore) Enqueue(ctx context.Context, tenant, event string, userID uuid.UUID) (err error) {
+	ctx, span := tracing.Start(ctx, "WebhookStore.Enqueue", attribute.String("tenant", tenant))
+	defer func() { tracing.End(span, err) }()
+
+	return enqueueWebhook(ctx, ws.db, tenant, event, userID)
+}
+
+// enqueueWebhook is Enqueue within caller's transaction, so event is sent only when the change is committed
+func enqueueWebhook(ctx context.Context, tx sqlx.ExecerContext, tenant, event string, userID uuid.UUID) error {
+	now := time.Now()
+
+	payload, err := json.Marshal(WebhookPayload{
+		Event:      event,
+		Tenant:     tenant,
+		UserID:     userID,
+		OccurredAt: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO webhook_outbox (webhook_id, event, payload, next_attempt_at, created_at) "+
+		"SELECT id, $1, $2, $3, $3 FROM webhooks WHERE active AND ($1 = ANY(events) OR '*' = ANY(events))", event, string(payload), now)
+	return err
+}
+
+// Claim takes due outbox items and hides them from other workers for lease duration,
+// so several nodes can deliver in parallel without duplicates
+func (ws *WebhookStore) Claim(ctx context.Context, limit int, lease time.Duration) (res []WebhookOutboxItem, err error) {
+	ctx, span := tracing.Start(ctx, "WebhookStore.Claim")
+	defer func() { tracing.End(span, err) }()
+
+	now := time.Now()
+
+	err = ws.db.SelectContext(ctx, &res, "UPDATE webhook_outbox o SET next_attempt_at=$2 FROM webhooks w "+
+		"WHERE w.id=o.webhook_id AND o.id IN ("+
+		"SELECT id FROM webhook_outbox WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at<=$1 "+
+		"ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED) "+
+		"RETURNING o.id, o.webhook_id, w.url, w.secret, o.event, o.payload, o.attempts", now, now.Add(lease), limit)
+	return res, err
+}
+
+// Complete logs delivery attempt and updates outbox item,
+// failed item is retried at retryAt or given up when it is nil
+func (ws *WebhookStore) Complete(ctx context.Context, d WebhookDelivery, retryAt *time.Time) (err error) {
+	ctx, span := tracing.Start(ctx, "WebhookStore.Complete")
+	defer func() { tracing.End(span, err) }()
+
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+
+	tx, err := ws.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.NamedExecContext(ctx, "INSERT INTO webhook_deliveries (outbox_id, webhook_id, event, attempt, success, status_code, error, duration_ms, created_at) "+
+		"VALUES (:outbox_id,:webhook_id,:event,:attempt,:success,:status_code,:error,:duration_ms,:created_at)", &d)
+	if err != nil {
+		return err
+	}
+
+	var res sql.Result
+	switch {
+	case d.Success:
+		res, err = tx.ExecContext(ctx, "UPDATE webhook_outbox SET attempts=$2, delivered_at=$3 WHERE id=$1", d.OutboxID, d.Attempt, d.CreatedAt)
+	case retryAt != nil:
+		res, err = tx.ExecContext(ctx, "UPDATE webhook_outbox SET attempts=$2, next_attempt_at=$3 WHERE id=$1", d.OutboxID, d.Attempt, *retryAt)
+	default:
+		res, err = tx.ExecContext(ctx, "UPDATE webhook_outbox SET attempts=$2, failed_at=$3 WHERE id=$1", d.OutboxID, d.Attempt, d.CreatedAt)
+	}
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	return tx.Commit()
+}
+
+func NewWebhookStore(db *sqlx.DB) *WebhookStore {
+	return &WebhookStore{db: db}
+}
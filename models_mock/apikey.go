@@ -0,0 +1,99 @@
+package models_mock
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MAPIKeyStore keeps keys in memory, key value is crk_<prefix>_secret
+type MAPIKeyStore struct {
+	FakeError error
+
+	mx   sync.Mutex
+	seq  int
+	keys []*models.APIKey
+}
+
+func (ks *MAPIKeyStore) Tenant(tenant string) models.IAPIKeyStore {
+	return ks
+}
+
+func (ks *MAPIKeyStore) Create(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt *time.Time) (*models.APIKey, string, error) {
+	if ks.FakeError != nil {
+		return nil, "", ks.FakeError
+	}
+
+	ks.mx.Lock()
+	defer ks.mx.Unlock()
+
+	ks.seq++
+	k := &models.APIKey{
+		ID:        uuid.Must(uuid.NewV4()),
+		UserID:    userID,
+		Name:      name,
+		Prefix:    "prefix" + strconv.Itoa(ks.seq),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	ks.keys = append(ks.keys, k)
+	return k, models.APIKeyPrefix + "_" + k.Prefix + "_secret", nil
+}
+
+func (ks *MAPIKeyStore) List(ctx context.Context, userID uuid.UUID) ([]models.APIKey, error) {
+	if ks.FakeError != nil {
+		return nil, ks.FakeError
+	}
+
+	ks.mx.Lock()
+	defer ks.mx.Unlock()
+
+	var res []models.APIKey
+	for _, k := range ks.keys {
+		if k.UserID == userID {
+			res = append(res, *k)
+		}
+	}
+	return res, nil
+}
+
+func (ks *MAPIKeyStore) Revoke(ctx context.Context, userID, id uuid.UUID) error {
+	if ks.FakeError != nil {
+		return ks.FakeError
+	}
+
+	ks.mx.Lock()
+	defer ks.mx.Unlock()
+
+	for _, k := range ks.keys {
+		if k.ID == id && k.UserID == userID && k.RevokedAt == nil {
+			now := time.Now()
+			k.RevokedAt = &now
+			return nil
+		}
+	}
+	return models.ErrAPIKeyNotFound
+}
+
+func (ks *MAPIKeyStore) Authenticate(ctx context.Context, key string) (*models.APIKey, error) {
+	if ks.FakeError != nil {
+		return nil, ks.FakeError
+	}
+
+	ks.mx.Lock()
+	defer ks.mx.Unlock()
+
+	for _, k := range ks.keys {
+		if models.APIKeyPrefix+"_"+k.Prefix+"_secret" == key && k.Active() {
+			now := time.Now()
+			k.LastUsedAt = &now
+			res := *k
+			return &res, nil
+		}
+	}
+	return nil, models.ErrAPIKeyIncorrect
+}
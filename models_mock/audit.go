@@ -0,0 +1,110 @@
+package models_mock
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"sync"
+)
+
+type MAuditStore struct {
+	FakeError error
+
+	mx     sync.Mutex
+	Events []models.AuditEvent
+}
+
+func (as *MAuditStore) Record(ctx context.Context, e models.AuditEvent) error {
+	if as.FakeError != nil {
+		return as.FakeError
+	}
+
+	as.mx.Lock()
+	defer as.mx.Unlock()
+
+	e.ID = int64(len(as.Events) + 1)
+	as.Events = append(as.Events, e)
+	return nil
+}
+
+// Types returns types of recorded events in order
+func (as *MAuditStore) Types() []string {
+	as.mx.Lock()
+	defer as.mx.Unlock()
+
+	var res []string
+	for _, e := range as.Events {
+		res = append(res, e.Type)
+	}
+	return res
+}
+
+func (as *MAuditStore) Find(ctx context.Context, f models.AuditFilter) ([]models.AuditEvent, error) {
+	var res []models.AuditEvent
+	err := as.Each(ctx, f, func(e models.AuditEvent) error {
+		res = append(res, e)
+		return nil
+	})
+	return res, err
+}
+
+func (as *MAuditStore) Each(ctx context.Context, f models.AuditFilter, fn func(e models.AuditEvent) error) error {
+	if as.FakeError != nil {
+		return as.FakeError
+	}
+
+	as.mx.Lock()
+	events := append([]models.AuditEvent{}, as.Events...)
+	as.mx.Unlock()
+
+	for i := len(events) - 1; i >= 0; i-- {
+		if !match(f, events[i]) {
+			continue
+		}
+
+		if err := fn(events[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func match(f models.AuditFilter, e models.AuditEvent) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			found = found || t == e.Type
+		}
+		if !found {
+			return false
+		}
+	}
+
+	is := func(a, b *uuid.UUID) bool {
+		return a != nil && b != nil && *a == *b
+	}
+
+	if f.Actor != nil && !is(f.Actor, e.Actor) {
+		return false
+	}
+	if f.Target != nil && !is(f.Target, e.Target) {
+		return false
+	}
+	if f.Subject != nil && !is(f.Subject, e.Actor) && !is(f.Subject, e.Target) {
+		return false
+	}
+	return true
+}
+
+func (as *MAuditStore) Verify(ctx context.Context) (*models.AuditChainReport, error) {
+	if as.FakeError != nil {
+		return nil, as.FakeError
+	}
+
+	as.mx.Lock()
+	defer as.mx.Unlock()
+
+	return &models.AuditChainReport{
+		Checked: int64(len(as.Events)),
+	}, nil
+}
@@ -0,0 +1,20 @@
+package models_mock
+
+import (
+	"context"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"time"
+)
+
+// MHealthStore reports all dependencies as healthy except ones in Down
+type MHealthStore struct {
+	Down map[string]error
+}
+
+func (hs *MHealthStore) Check(ctx context.Context, timeout time.Duration) []models.HealthCheck {
+	var res []models.HealthCheck
+	for _, name := range []string{models.DependencyPostgres, models.DependencyRedis, models.DependencyMigrations} {
+		res = append(res, models.HealthCheck{Name: name, Err: hs.Down[name], Latency: time.Millisecond})
+	}
+	return res
+}
@@ -0,0 +1,128 @@
+package models_mock
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MIdentityStore links identities in memory, tester@exter.com is treated as existing local account
+type MIdentityStore struct {
+	FakeError error
+	// Webhooks gets registration of new users, nothing is recorded when it is nil
+	Webhooks *MWebhookStore
+
+	mx         sync.Mutex
+	seq        int
+	identities []models.Identity
+	states     map[string]models.FederationState
+}
+
+func (is *MIdentityStore) Tenant(tenant string) models.IIdentityStore {
+	return is
+}
+
+func (is *MIdentityStore) Login(ctx context.Context, ext models.ExternalIdentity) (*models.Session, bool, error) {
+	if is.FakeError != nil {
+		return nil, false, is.FakeError
+	}
+
+	is.mx.Lock()
+	defer is.mx.Unlock()
+
+	uid, created := uuid.Nil, false
+	for _, i := range is.identities {
+		if i.Provider == ext.Provider && i.Subject == ext.Subject {
+			uid = i.UserID
+		}
+	}
+
+	if uid == uuid.Nil {
+		switch {
+		case ext.Email == "":
+			return nil, false, models.ErrIdentityNoEmail
+		case ext.Email == "tester@exter.com" && !ext.EmailVerified:
+			return nil, false, models.ErrIdentityConflict
+		case ext.Email == "tester@exter.com":
+			uid = TestUUID
+		default:
+			uid, created = uuid.Must(uuid.NewV4()), true
+			is.Webhooks.record(models.WebhookUserRegistered)
+		}
+
+		is.identities = append(is.identities, models.Identity{
+			Provider:  ext.Provider,
+			Subject:   ext.Subject,
+			UserID:    uid,
+			Email:     ext.Email,
+			CreatedAt: time.Now(),
+		})
+	}
+
+	return &models.Session{
+		ID:        "6e536fff-baaf-4ca7-a067-352bafeb6ee3",
+		UserID:    uid,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(models.SessionTTL),
+	}, created, nil
+}
+
+func (is *MIdentityStore) List(ctx context.Context, userID uuid.UUID) ([]models.Identity, error) {
+	if is.FakeError != nil {
+		return nil, is.FakeError
+	}
+
+	is.mx.Lock()
+	defer is.mx.Unlock()
+
+	var res []models.Identity
+	for _, i := range is.identities {
+		if i.UserID == userID {
+			res = append(res, i)
+		}
+	}
+	return res, nil
+}
+
+func (is *MIdentityStore) CreateState(ctx context.Context, provider string) (*models.FederationState, error) {
+	if is.FakeError != nil {
+		return nil, is.FakeError
+	}
+
+	is.mx.Lock()
+	defer is.mx.Unlock()
+
+	if is.states == nil {
+		is.states = map[string]models.FederationState{}
+	}
+
+	is.seq++
+	n := strconv.Itoa(is.seq)
+	st := models.FederationState{
+		State:    "state-" + n,
+		Provider: provider,
+		Nonce:    "nonce-" + n,
+		Verifier: "verifier-" + n + "-verifier-verifier-verifier",
+	}
+	is.states[st.State] = st
+	return &st, nil
+}
+
+func (is *MIdentityStore) TakeState(ctx context.Context, state string) (*models.FederationState, error) {
+	if is.FakeError != nil {
+		return nil, is.FakeError
+	}
+
+	is.mx.Lock()
+	defer is.mx.Unlock()
+
+	st, ok := is.states[state]
+	if !ok {
+		return nil, models.ErrGrantIncorrect
+	}
+	delete(is.states, state)
+	return &st, nil
+}
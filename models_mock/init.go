@@ -3,7 +3,20 @@ package models_mock
 import "github.com/xssnick/crawlyzer-auth/models"
 
 func InitMockStore() *models.DataStore {
+	sessions := models.NewMemorySessionStore()
+	hooks := &MWebhookStore{}
+	users := &MUserStore{SessionStore: sessions, Webhooks: hooks}
 	return &models.DataStore{
-		User: &MUserStore{},
+		User:     users,
+		Audit:    &MAuditStore{},
+		Webhook:  hooks,
+		Mail:     &MMailStore{},
+		OAuth:    &MOAuthStore{},
+		Keys:     &MKeyStore{},
+		Identity: &MIdentityStore{Webhooks: hooks},
+		APIKey:   &MAPIKeyStore{},
+		Org:      &MOrgStore{Users: users},
+		Session:  sessions,
+		Health:   &MHealthStore{},
 	}
 }
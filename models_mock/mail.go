@@ -0,0 +1,61 @@
+package models_mock
+
+import (
+	"context"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"sync"
+	"time"
+)
+
+type MMailStore struct {
+	FakeError error
+
+	mx       sync.Mutex
+	Enqueued []models.Mail
+	// Outbox is what is claimed by workers, Enqueue doesn't put mails there
+	Outbox []models.Mail
+	// Errors and RetryAt are passed to Complete, in order of calls
+	Errors  []string
+	RetryAt []*time.Time
+}
+
+func (ms *MMailStore) Enqueue(ctx context.Context, m models.Mail) error {
+	if ms.FakeError != nil {
+		return ms.FakeError
+	}
+
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	ms.Enqueued = append(ms.Enqueued, m)
+	return nil
+}
+
+// Claim hands out all mails of Outbox at once
+func (ms *MMailStore) Claim(ctx context.Context, limit int, lease time.Duration) ([]models.Mail, error) {
+	if ms.FakeError != nil {
+		return nil, ms.FakeError
+	}
+
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+
+	if limit > len(ms.Outbox) {
+		limit = len(ms.Outbox)
+	}
+
+	res := ms.Outbox[:limit]
+	ms.Outbox = ms.Outbox[limit:]
+	return res, nil
+}
+
+func (ms *MMailStore) Complete(ctx context.Context, id int64, attempt int, errText string, retryAt *time.Time) error {
+	if ms.FakeError != nil {
+		return ms.FakeError
+	}
+
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	ms.Errors = append(ms.Errors, errText)
+	ms.RetryAt = append(ms.RetryAt, retryAt)
+	return nil
+}
@@ -0,0 +1,274 @@
+package models_mock
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MOAuthStore keeps everything in memory, client secrets are stored as is
+type MOAuthStore struct {
+	FakeError error
+
+	mx       sync.Mutex
+	seq      int
+	clients  map[string]*models.OAuthClient
+	secrets  map[string]string
+	consents map[string]string
+	codes    map[string]models.AuthCode
+	access   map[string]models.OAuthGrant
+	refresh  map[string]models.OAuthGrant
+}
+
+func (oas *MOAuthStore) Tenant(tenant string) models.IOAuthStore {
+	return oas
+}
+
+func (oas *MOAuthStore) init() {
+	if oas.clients == nil {
+		oas.clients = map[string]*models.OAuthClient{}
+		oas.secrets = map[string]string{}
+		oas.consents = map[string]string{}
+		oas.codes = map[string]models.AuthCode{}
+		oas.access = map[string]models.OAuthGrant{}
+		oas.refresh = map[string]models.OAuthGrant{}
+	}
+}
+
+func (oas *MOAuthStore) next(prefix string) string {
+	oas.seq++
+	return prefix + strconv.Itoa(oas.seq)
+}
+
+func (oas *MOAuthStore) CreateClient(ctx context.Context, c *models.OAuthClient, confidential bool) (string, error) {
+	if oas.FakeError != nil {
+		return "", oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+	oas.init()
+
+	c.ID = oas.next("client-")
+	c.CreatedAt = time.Now()
+
+	var secret string
+	if confidential {
+		secret = oas.next("secret-")
+		c.SecretHash = "hash-" + secret
+	}
+
+	oas.clients[c.ID] = c
+	oas.secrets[c.ID] = secret
+	return secret, nil
+}
+
+func (oas *MOAuthStore) ListClients(ctx context.Context) ([]models.OAuthClient, error) {
+	if oas.FakeError != nil {
+		return nil, oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+
+	var res []models.OAuthClient
+	for _, c := range oas.clients {
+		res = append(res, *c)
+	}
+	return res, nil
+}
+
+func (oas *MOAuthStore) GetClient(ctx context.Context, id string) (*models.OAuthClient, error) {
+	if oas.FakeError != nil {
+		return nil, oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+
+	c, ok := oas.clients[id]
+	if !ok {
+		return nil, models.ErrClientNotFound
+	}
+	return c, nil
+}
+
+func (oas *MOAuthStore) AuthenticateClient(ctx context.Context, id, secret string) (*models.OAuthClient, error) {
+	c, err := oas.GetClient(ctx, id)
+	if err != nil {
+		if err == models.ErrClientNotFound {
+			return nil, models.ErrClientIncorrect
+		}
+		return nil, err
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+
+	if oas.secrets[id] != secret {
+		return nil, models.ErrClientIncorrect
+	}
+	return c, nil
+}
+
+func (oas *MOAuthStore) HasConsent(ctx context.Context, userID uuid.UUID, clientID string, scope string) (bool, error) {
+	if oas.FakeError != nil {
+		return false, oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+
+	granted, ok := oas.consents[userID.String()+clientID]
+	if !ok {
+		return false, nil
+	}
+
+	for _, s := range strings.Fields(scope) {
+		if !strings.Contains(" "+granted+" ", " "+s+" ") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (oas *MOAuthStore) SaveConsent(ctx context.Context, userID uuid.UUID, clientID string, scope string) error {
+	if oas.FakeError != nil {
+		return oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+	oas.init()
+
+	oas.consents[userID.String()+clientID] += " " + scope
+	return nil
+}
+
+func (oas *MOAuthStore) CreateCode(ctx context.Context, c models.AuthCode) (string, error) {
+	if oas.FakeError != nil {
+		return "", oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+	oas.init()
+
+	code := oas.next("code-")
+	oas.codes[code] = c
+	return code, nil
+}
+
+func (oas *MOAuthStore) TakeCode(ctx context.Context, code string) (*models.AuthCode, error) {
+	if oas.FakeError != nil {
+		return nil, oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+
+	c, ok := oas.codes[code]
+	if !ok {
+		return nil, models.ErrGrantIncorrect
+	}
+	delete(oas.codes, code)
+	return &c, nil
+}
+
+func (oas *MOAuthStore) IssueToken(ctx context.Context, g models.OAuthGrant, accessToken string, refresh bool) (*models.TokenResponse, error) {
+	if oas.FakeError != nil {
+		return nil, oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+	oas.init()
+
+	if accessToken == "" {
+		accessToken = oas.next("access-")
+	}
+
+	res := &models.TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(models.SessionTTL / time.Second),
+		Scope:       g.Scope,
+	}
+	oas.access[accessToken] = g
+
+	if refresh {
+		res.RefreshToken = oas.next("refresh-")
+		oas.refresh[res.RefreshToken] = g
+	}
+	return res, nil
+}
+
+func (oas *MOAuthStore) TakeRefreshToken(ctx context.Context, token string) (*models.OAuthGrant, error) {
+	if oas.FakeError != nil {
+		return nil, oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+
+	g, ok := oas.refresh[token]
+	if !ok {
+		return nil, models.ErrGrantIncorrect
+	}
+	delete(oas.refresh, token)
+	return &g, nil
+}
+
+func (oas *MOAuthStore) GetAccessToken(ctx context.Context, token string) (*models.OAuthGrant, error) {
+	if oas.FakeError != nil {
+		return nil, oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+
+	g, ok := oas.access[token]
+	if !ok {
+		return nil, models.ErrGrantIncorrect
+	}
+	return &g, nil
+}
+
+// Introspect knows only issued tokens and the session of MUserStore
+func (oas *MOAuthStore) Introspect(ctx context.Context, token string) (*models.TokenInfo, error) {
+	if oas.FakeError != nil {
+		return nil, oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+
+	exp := time.Now().Add(models.SessionTTL)
+	if g, ok := oas.access[token]; ok {
+		return &models.TokenInfo{Type: models.TokenTypeAccess, Grant: g, ExpiresAt: exp}, nil
+	}
+	if g, ok := oas.refresh[token]; ok {
+		return &models.TokenInfo{Type: models.TokenTypeRefresh, Grant: g, ExpiresAt: time.Now().Add(models.RefreshTokenTTL)}, nil
+	}
+	if token == "6e536fff-baaf-4ca7-a067-352bafeb6ee3" {
+		return &models.TokenInfo{Type: models.TokenTypeSession, Grant: models.OAuthGrant{UserID: TestUUID}, ExpiresAt: exp}, nil
+	}
+	return nil, models.ErrGrantIncorrect
+}
+
+func (oas *MOAuthStore) Revoke(ctx context.Context, token string) error {
+	if oas.FakeError != nil {
+		return oas.FakeError
+	}
+
+	oas.mx.Lock()
+	defer oas.mx.Unlock()
+
+	delete(oas.access, token)
+	delete(oas.refresh, token)
+	return nil
+}
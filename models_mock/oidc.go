@@ -0,0 +1,35 @@
+package models_mock
+
+import (
+	"context"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"sync"
+)
+
+var testKey *models.SigningKey
+var testKeyOnce sync.Once
+
+// MKeyStore always signs with one key generated per process
+type MKeyStore struct {
+	FakeError error
+}
+
+func (ks *MKeyStore) SigningKey(ctx context.Context) (*models.SigningKey, error) {
+	if ks.FakeError != nil {
+		return nil, ks.FakeError
+	}
+
+	var err error
+	testKeyOnce.Do(func() {
+		testKey, err = models.NewSigningKey()
+	})
+	return testKey, err
+}
+
+func (ks *MKeyStore) PublicKeys(ctx context.Context) ([]models.SigningKey, error) {
+	k, err := ks.SigningKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []models.SigningKey{*k}, nil
+}
@@ -0,0 +1,224 @@
+package models_mock
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MOrgStore keeps organizations in memory, invitation tokens are "invitation-N"
+type MOrgStore struct {
+	FakeError error
+	// Users creates accounts for AcceptAsNew, they get TestUUID when it is nil
+	Users models.IUserStore
+
+	mx          sync.Mutex
+	seq         int
+	orgs        []models.Organization
+	members     []models.Membership
+	invitations map[string]*models.Invitation
+}
+
+func (ors *MOrgStore) Tenant(tenant string) models.IOrgStore {
+	return ors
+}
+
+func (ors *MOrgStore) Create(ctx context.Context, name string, owner uuid.UUID) (*models.Organization, error) {
+	if ors.FakeError != nil {
+		return nil, ors.FakeError
+	}
+
+	ors.mx.Lock()
+	defer ors.mx.Unlock()
+
+	o := models.Organization{ID: uuid.Must(uuid.NewV4()), Name: name, CreatedAt: time.Now()}
+	ors.orgs = append(ors.orgs, o)
+	ors.members = append(ors.members, models.Membership{OrgID: o.ID, OrgName: name, UserID: owner, Role: models.RoleOwner, CreatedAt: o.CreatedAt})
+	return &o, nil
+}
+
+// AddMember puts the user into organization bypassing invitations
+func (ors *MOrgStore) AddMember(orgID, userID uuid.UUID, role string) {
+	ors.mx.Lock()
+	defer ors.mx.Unlock()
+
+	ors.members = append(ors.members, models.Membership{OrgID: orgID, UserID: userID, Role: role, CreatedAt: time.Now()})
+}
+
+func (ors *MOrgStore) Get(ctx context.Context, id uuid.UUID) (*models.Organization, error) {
+	if ors.FakeError != nil {
+		return nil, ors.FakeError
+	}
+
+	ors.mx.Lock()
+	defer ors.mx.Unlock()
+
+	for _, o := range ors.orgs {
+		if o.ID == id {
+			return &o, nil
+		}
+	}
+	return nil, models.ErrOrgNotFound
+}
+
+func (ors *MOrgStore) Memberships(ctx context.Context, userID uuid.UUID) ([]models.Membership, error) {
+	if ors.FakeError != nil {
+		return nil, ors.FakeError
+	}
+
+	ors.mx.Lock()
+	defer ors.mx.Unlock()
+
+	var res []models.Membership
+	for _, m := range ors.members {
+		if m.UserID == userID {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func (ors *MOrgStore) Members(ctx context.Context, orgID uuid.UUID) ([]models.Member, error) {
+	if ors.FakeError != nil {
+		return nil, ors.FakeError
+	}
+
+	ors.mx.Lock()
+	defer ors.mx.Unlock()
+
+	var res []models.Member
+	for _, m := range ors.members {
+		if m.OrgID == orgID {
+			res = append(res, models.Member{UserID: m.UserID, Role: m.Role, CreatedAt: m.CreatedAt})
+		}
+	}
+	return res, nil
+}
+
+func (ors *MOrgStore) Role(ctx context.Context, orgID, userID uuid.UUID) (string, error) {
+	if ors.FakeError != nil {
+		return "", ors.FakeError
+	}
+
+	ors.mx.Lock()
+	defer ors.mx.Unlock()
+
+	for _, m := range ors.members {
+		if m.OrgID == orgID && m.UserID == userID {
+			return m.Role, nil
+		}
+	}
+	return "", models.ErrNotMember
+}
+
+func (ors *MOrgStore) RemoveMember(ctx context.Context, orgID, userID uuid.UUID) error {
+	if ors.FakeError != nil {
+		return ors.FakeError
+	}
+
+	ors.mx.Lock()
+	defer ors.mx.Unlock()
+
+	idx, owners := -1, 0
+	for i, m := range ors.members {
+		if m.OrgID != orgID {
+			continue
+		}
+		if m.UserID == userID {
+			idx = i
+		} else if m.Role == models.RoleOwner {
+			owners++
+		}
+	}
+
+	if idx < 0 {
+		return models.ErrNotMember
+	}
+	if owners == 0 {
+		return models.ErrLastOwner
+	}
+
+	ors.members = append(ors.members[:idx], ors.members[idx+1:]...)
+	return nil
+}
+
+func (ors *MOrgStore) Invite(ctx context.Context, orgID uuid.UUID, email, role string, invitedBy uuid.UUID) (*models.Invitation, string, error) {
+	if ors.FakeError != nil {
+		return nil, "", ors.FakeError
+	}
+
+	ors.mx.Lock()
+	defer ors.mx.Unlock()
+
+	if ors.invitations == nil {
+		ors.invitations = map[string]*models.Invitation{}
+	}
+
+	ors.seq++
+	token := "invitation-" + strconv.Itoa(ors.seq)
+	inv := &models.Invitation{
+		ID:        uuid.Must(uuid.NewV4()),
+		OrgID:     orgID,
+		Email:     email,
+		Role:      role,
+		InvitedBy: invitedBy,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(models.InvitationTTL),
+	}
+	ors.invitations[token] = inv
+	return inv, token, nil
+}
+
+func (ors *MOrgStore) Invitation(ctx context.Context, token string) (*models.Invitation, error) {
+	if ors.FakeError != nil {
+		return nil, ors.FakeError
+	}
+
+	ors.mx.Lock()
+	defer ors.mx.Unlock()
+
+	inv, ok := ors.invitations[token]
+	if !ok || inv.AcceptedAt != nil {
+		return nil, models.ErrInvitationIncorrect
+	}
+	return inv, nil
+}
+
+func (ors *MOrgStore) Accept(ctx context.Context, token string, userID uuid.UUID) (*models.Membership, error) {
+	inv, err := ors.Invitation(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = ors.Role(ctx, inv.OrgID, userID); err == nil {
+		return nil, models.ErrAlreadyMember
+	}
+
+	ors.mx.Lock()
+	defer ors.mx.Unlock()
+
+	now := time.Now()
+	inv.AcceptedAt = &now
+
+	m := models.Membership{OrgID: inv.OrgID, UserID: userID, Role: inv.Role, CreatedAt: now}
+	ors.members = append(ors.members, m)
+	return &m, nil
+}
+
+func (ors *MOrgStore) AcceptAsNew(ctx context.Context, token, password string) (*models.Membership, error) {
+	inv, err := ors.Invitation(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	id := TestUUID
+	if ors.Users != nil {
+		if id, err = ors.Users.Create(ctx, inv.Email, password); err != nil {
+			return nil, err
+		}
+	}
+	return ors.Accept(ctx, token, id)
+}
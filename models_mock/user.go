@@ -1,47 +1,182 @@
 package models_mock
 
 import (
+	"context"
 	uuid "github.com/iris-contrib/go.uuid"
 	"github.com/xssnick/crawlyzer-auth/models"
+	"sync"
+	"time"
 )
 
 type MUserStore struct {
 	FakeError error
+	// DeleteError is returned only by Delete, so session check before it passes
+	DeleteError error
+	Admin       bool
+	// Scopes of the test session, default scopes when nil
+	Scopes []string
+	// LastTenant is the tenant store was scoped to by the last request
+	LastTenant string
+	// ImpersonatedBy marks the test session as impersonated by the admin
+	ImpersonatedBy *uuid.UUID
+	// LastContext is the context passed by the last call
+	LastContext context.Context
+	// Passwordless makes users look like created by federated login
+	Passwordless bool
+	// AuthTime is sign in time of the test session
+	AuthTime *time.Time
+	// SessionStore backs session methods, TestSession is put there on first use,
+	// memory store is made when it is nil
+	SessionStore models.ISessionStore
+	// Webhooks gets lifecycle events of successful changes, nothing is recorded when it is nil
+	Webhooks *MWebhookStore
+
+	seed sync.Once
 }
 
 var TestUUID = uuid.FromStringOrNil("4f477db2-17b7-432d-ad0e-c2a098cbd2b0")
 
-func (us *MUserStore) Create(email, password string) (uuid.UUID, error) {
+// TestSession belongs to TestUUID, Scopes, ImpersonatedBy and AuthTime are applied to it when it is read
+const TestSession = "6e536fff-baaf-4ca7-a067-352bafeb6ee3"
+
+func (us *MUserStore) sessions() models.ISessionStore {
+	us.seed.Do(func() {
+		if us.SessionStore == nil {
+			us.SessionStore = models.NewMemorySessionStore()
+		}
+
+		now := time.Now()
+		us.SessionStore.Create(context.Background(), &models.Session{
+			ID:        TestSession,
+			UserID:    TestUUID,
+			Scopes:    models.DefaultScopes,
+			CreatedAt: now,
+			ExpiresAt: now.Add(models.SessionTTL),
+		})
+	})
+	return us.SessionStore
+}
+
+// startSession saves new session of the user
+func (us *MUserStore) startSession(ctx context.Context, ses *models.Session) (*models.Session, error) {
+	ses.CreatedAt = time.Now()
+	if ses.ExpiresAt.IsZero() {
+		ses.ExpiresAt = ses.CreatedAt.Add(models.SessionTTL)
+	}
+
+	if err := us.sessions().Create(ctx, ses); err != nil {
+		return nil, err
+	}
+	return ses, nil
+}
+
+// Tenant remembers the tenant, mock keeps single set of users for all tenants
+func (us *MUserStore) Tenant(tenant string) models.IUserStore {
+	us.LastTenant = tenant
+	return us
+}
+
+func (us *MUserStore) Create(ctx context.Context, email, password string) (uuid.UUID, error) {
+	us.LastContext = ctx
 	if us.FakeError != nil {
 		return uuid.Nil, us.FakeError
 	}
+	us.Webhooks.record(models.WebhookUserRegistered)
 	return TestUUID, nil
 }
 
-func (us *MUserStore) Auth(sesid string) (uuid.UUID, error) {
+func (us *MUserStore) Auth(ctx context.Context, sesid string) (uuid.UUID, error) {
+	ses, err := us.AuthSession(ctx, sesid)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return ses.UserID, nil
+}
+
+func (us *MUserStore) AuthSession(ctx context.Context, sesid string) (*models.Session, error) {
+	us.LastContext = ctx
 	if us.FakeError != nil {
-		return uuid.Nil, us.FakeError
+		return nil, us.FakeError
 	}
 
-	return TestUUID, nil
+	ses, err := us.sessions().Get(ctx, sesid)
+	if err != nil {
+		return nil, err
+	}
+
+	if sesid == TestSession {
+		if us.Scopes != nil {
+			ses.Scopes = us.Scopes
+		}
+		if us.ImpersonatedBy != nil {
+			ses.ImpersonatedBy = us.ImpersonatedBy
+		}
+		if us.AuthTime != nil {
+			ses.AuthTime = us.AuthTime
+		}
+	}
+	return ses, nil
 }
 
-func (us *MUserStore) Logout(sesid string) error {
+func (us *MUserStore) Logout(ctx context.Context, sesid string) error {
+	us.LastContext = ctx
 	if us.FakeError != nil {
 		return us.FakeError
 	}
 
-	return nil
+	return us.sessions().Delete(ctx, sesid)
 }
 
-func (us *MUserStore) Login(email, password string) (string, error) {
+// Login signs TestUUID in with any password, TestSession is started again
+func (us *MUserStore) Login(ctx context.Context, email, password string) (*models.Session, error) {
+	us.LastContext = ctx
 	if us.FakeError != nil {
-		return "", us.FakeError
+		return nil, us.FakeError
 	}
-	return "6e536fff-baaf-4ca7-a067-352bafeb6ee3", nil
+
+	if err := us.sessions().Delete(ctx, TestSession); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return us.startSession(ctx, &models.Session{
+		ID:       TestSession,
+		UserID:   TestUUID,
+		Scopes:   models.DefaultScopes,
+		AuthTime: &now,
+	})
 }
 
-func (us *MUserStore) GetAll() ([]models.User, error) {
+func (us *MUserStore) CreateSession(ctx context.Context, id uuid.UUID, scopes []string) (*models.Session, error) {
+	us.LastContext = ctx
+	if us.FakeError != nil {
+		return nil, us.FakeError
+	}
+
+	return us.startSession(ctx, &models.Session{
+		ID:     uuid.Must(uuid.NewV4()).String(),
+		UserID: id,
+		Scopes: scopes,
+	})
+}
+
+func (us *MUserStore) Impersonate(ctx context.Context, adminID, id uuid.UUID) (*models.Session, error) {
+	us.LastContext = ctx
+	if us.FakeError != nil {
+		return nil, us.FakeError
+	}
+
+	return us.startSession(ctx, &models.Session{
+		ID:             "0d1a2f7e-3b4c-4d5e-8f60-718293a4b5c6",
+		UserID:         id,
+		Scopes:         models.DefaultScopes,
+		ExpiresAt:      time.Now().Add(models.ImpersonationTTL),
+		ImpersonatedBy: &adminID,
+	})
+}
+
+func (us *MUserStore) GetAll(ctx context.Context) ([]models.User, error) {
+	us.LastContext = ctx
 	if us.FakeError != nil {
 		return nil, us.FakeError
 	}
@@ -59,3 +194,61 @@ func (us *MUserStore) GetAll() ([]models.User, error) {
 		},
 	}, nil
 }
+
+func (us *MUserStore) ChangePassword(ctx context.Context, id uuid.UUID, sesid, oldPassword, newPassword string) error {
+	us.LastContext = ctx
+	if us.FakeError != nil {
+		return us.FakeError
+	}
+	us.Webhooks.record(models.WebhookUserPasswordChanged)
+	return nil
+}
+
+func (us *MUserStore) Delete(ctx context.Context, id uuid.UUID, password string) error {
+	us.LastContext = ctx
+	if us.DeleteError != nil {
+		return us.DeleteError
+	}
+	if us.FakeError != nil {
+		return us.FakeError
+	}
+	us.Webhooks.record(models.WebhookUserDeleted)
+	return nil
+}
+
+func (us *MUserStore) Anonymize(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	us.LastContext = ctx
+	if us.FakeError != nil {
+		return 0, us.FakeError
+	}
+	return 1, nil
+}
+
+// Get returns any user, only TestUUID is admin when Admin is set
+func (us *MUserStore) Get(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	us.LastContext = ctx
+	if us.FakeError != nil {
+		return nil, us.FakeError
+	}
+
+	u := &models.User{
+		ID:        id,
+		Email:     "tester@exter.com",
+		Password:  "hash",
+		CreatedAt: time.Now(),
+		IsAdmin:   us.Admin && id == TestUUID,
+	}
+	if us.Passwordless {
+		u.Password = ""
+	}
+	return u, nil
+}
+
+func (us *MUserStore) Sessions(ctx context.Context, id uuid.UUID) ([]models.Session, error) {
+	us.LastContext = ctx
+	if us.FakeError != nil {
+		return nil, us.FakeError
+	}
+
+	return us.sessions().List(ctx, id)
+}
@@ -0,0 +1,113 @@
+package models_mock
+
+import (
+	"context"
+	uuid "github.com/iris-contrib/go.uuid"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"sync"
+	"time"
+)
+
+type MWebhookStore struct {
+	FakeError error
+
+	mx       sync.Mutex
+	Enqueued []string
+	Outbox   []models.WebhookOutboxItem
+	Done     []models.WebhookDelivery
+	// RetryAt is retry time passed for each of Done
+	RetryAt []*time.Time
+}
+
+func (ws *MWebhookStore) Create(ctx context.Context, url string, events []string) (*models.Webhook, error) {
+	if ws.FakeError != nil {
+		return nil, ws.FakeError
+	}
+
+	return &models.Webhook{
+		ID:        TestUUID,
+		URL:       url,
+		Secret:    "secret",
+		Events:    events,
+		Active:    true,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+func (ws *MWebhookStore) List(ctx context.Context) ([]models.Webhook, error) {
+	if ws.FakeError != nil {
+		return nil, ws.FakeError
+	}
+	return []models.Webhook{}, nil
+}
+
+func (ws *MWebhookStore) Delete(ctx context.Context, id uuid.UUID) error {
+	if ws.FakeError != nil {
+		return ws.FakeError
+	}
+
+	if id != TestUUID {
+		return models.ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (ws *MWebhookStore) Deliveries(ctx context.Context, id uuid.UUID, limit int) ([]models.WebhookDelivery, error) {
+	if ws.FakeError != nil {
+		return nil, ws.FakeError
+	}
+
+	ws.mx.Lock()
+	defer ws.mx.Unlock()
+	return append([]models.WebhookDelivery{}, ws.Done...), nil
+}
+
+func (ws *MWebhookStore) Enqueue(ctx context.Context, tenant, event string, userID uuid.UUID) error {
+	if ws.FakeError != nil {
+		return ws.FakeError
+	}
+
+	ws.record(event)
+	return nil
+}
+
+// record keeps event enqueued by user or identity store along with its change
+func (ws *MWebhookStore) record(event string) {
+	if ws == nil {
+		return
+	}
+
+	ws.mx.Lock()
+	defer ws.mx.Unlock()
+	ws.Enqueued = append(ws.Enqueued, event)
+}
+
+// Claim hands out all items of Outbox at once
+func (ws *MWebhookStore) Claim(ctx context.Context, limit int, lease time.Duration) ([]models.WebhookOutboxItem, error) {
+	if ws.FakeError != nil {
+		return nil, ws.FakeError
+	}
+
+	ws.mx.Lock()
+	defer ws.mx.Unlock()
+
+	if limit > len(ws.Outbox) {
+		limit = len(ws.Outbox)
+	}
+
+	res := ws.Outbox[:limit]
+	ws.Outbox = ws.Outbox[limit:]
+	return res, nil
+}
+
+func (ws *MWebhookStore) Complete(ctx context.Context, d models.WebhookDelivery, retryAt *time.Time) error {
+	if ws.FakeError != nil {
+		return ws.FakeError
+	}
+
+	ws.mx.Lock()
+	defer ws.mx.Unlock()
+	ws.Done = append(ws.Done, d)
+	ws.RetryAt = append(ws.RetryAt, retryAt)
+	return nil
+}
@@ -0,0 +1,104 @@
+// Package tracing sets up opentelemetry for the service and starts its spans,
+// until Init is called all spans are no-op
+package tracing
+
+import (
+	"context"
+	"github.com/xssnick/crawlyzer-auth/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// tracerName identifies spans started by the service
+const tracerName = "github.com/xssnick/crawlyzer-auth"
+
+// propagator reads and writes w3c traceparent, tracestate and baggage headers
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Init installs tracer provider exporting spans as configured, returned func
+// flushes spans which are not exported yet and must be called on shutdown
+func Init(conf config.Tracing, nodeID string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case config.TraceStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case config.TraceOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.Endpoint)}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		// exporter connects lazily, unavailable collector doesn't stop the service
+		exp, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []attribute.KeyValue{semconv.ServiceNameKey.String(conf.ServiceName)}
+	if nodeID != "" {
+		attrs = append(attrs, semconv.ServiceInstanceIDKey.String(nodeID))
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Extract returns ctx with remote parent span taken from trace context headers of the request
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Start begins internal span as a child of span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServer begins span of incoming request, route is registered path, not url,
+// so neither ids nor query tokens get into traces
+func StartServer(ctx context.Context, method, route string) (context.Context, trace.Span) {
+	name := method
+	if route != "" {
+		name += " " + route
+	}
+	return otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(method), semconv.HTTPRouteKey.String(route)))
+}
+
+// EndServer records response status and ends span started by StartServer
+func EndServer(span trace.Span, status int) {
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	// client errors are not failures of the server
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// End marks span failed when err is not nil and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
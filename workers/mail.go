@@ -0,0 +1,168 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// MailTransport hands message over to relay
+type MailTransport interface {
+	Send(from, to string, msg []byte) error
+}
+
+// SMTPTransport sends through relay, STARTTLS is used when relay offers it
+// and credentials are never sent without it
+type SMTPTransport struct {
+	Addr     string
+	Username string
+	Password string
+	// Timeout bounds whole conversation with relay
+	Timeout time.Duration
+}
+
+func (st *SMTPTransport) Send(from, to string, msg []byte) error {
+	host, _, err := net.SplitHostPort(st.Addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", st.Addr, st.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(st.Timeout)); err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if st.Username != "" {
+		if _, ok := c.TLSConnectionState(); !ok {
+			return errors.New("smtp relay doesn't offer STARTTLS, credentials are not sent")
+		}
+		if err = c.Auth(smtp.PlainAuth("", st.Username, st.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// MailSender sends mail outbox, failed mails are retried with exponential backoff
+// until MaxAttempts is reached
+type MailSender struct {
+	Store     models.IMailStore
+	Transport MailTransport
+	From      string
+	Interval  time.Duration
+	Batch     int
+	// Lease must outlive sending of the whole batch, otherwise other node can take it
+	Lease       time.Duration
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Logger      *logging.Logger
+}
+
+func (ms *MailSender) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(ms.Interval)
+	defer ticker.Stop()
+
+	for {
+		for ms.Send() == ms.Batch {
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Send sends one batch of due mails and returns number of processed ones
+func (ms *MailSender) Send() int {
+	ctx := context.Background()
+
+	mails, err := ms.Store.Claim(ctx, ms.Batch, ms.Lease)
+	if err != nil {
+		ms.Logger.Error("mail claim failed", "error", err)
+		return 0
+	}
+
+	for _, m := range mails {
+		attempt := m.Attempts + 1
+
+		var errText string
+		var retryAt *time.Time
+		if err = ms.Transport.Send(ms.From, m.To, formatMail(ms.From, m, time.Now())); err != nil {
+			errText = err.Error()
+			if attempt < ms.MaxAttempts {
+				at := time.Now().Add(backoff(ms.BaseDelay, ms.MaxDelay, attempt))
+				retryAt = &at
+			}
+			ms.Logger.Warn("mail sending failed", "mail", m.ID, "attempt", attempt, "error", err)
+		}
+
+		if err = ms.Store.Complete(ctx, m.ID, attempt, errText, retryAt); err != nil {
+			ms.Logger.Error("mail complete failed", "mail", m.ID, "error", err)
+		}
+	}
+	return len(mails)
+}
+
+// formatMail builds plain text message, line breaks are dropped from headers,
+// so recipient or subject can't add headers of their own
+func formatMail(from string, m models.Mail, now time.Time) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", header.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", header.Replace(m.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", header.Replace(m.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.Replace(strings.Replace(m.Body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return b.Bytes()
+}
@@ -0,0 +1,90 @@
+package workers
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+type fakeTransport struct {
+	err  error
+	to   []string
+	msgs []string
+}
+
+func (ft *fakeTransport) Send(from, to string, msg []byte) error {
+	ft.to = append(ft.to, to)
+	ft.msgs = append(ft.msgs, string(msg))
+	return ft.err
+}
+
+func TestMailSender(t *testing.T) {
+	Convey("Mail sending", t, func() {
+		store := &models_mock.MMailStore{}
+		transport := &fakeTransport{}
+		ms := &MailSender{
+			Store:       store,
+			Transport:   transport,
+			From:        "auth@crawlyzer.io",
+			Interval:    time.Second,
+			Batch:       10,
+			Lease:       time.Minute,
+			MaxAttempts: 3,
+			BaseDelay:   time.Minute,
+			MaxDelay:    time.Hour,
+			Logger:      logging.New(ioutil.Discard, logging.LevelError),
+		}
+
+		m := models.Mail{
+			ID:      3,
+			To:      "gop@sup.com",
+			Subject: "Invitation\r\nBcc: evil@sup.com",
+			Body:    "line\nnext line",
+		}
+
+		Convey("When relay accepts", func() {
+			store.Outbox = []models.Mail{m}
+
+			So(ms.Send(), ShouldEqual, 1)
+
+			Convey("Must be sent and marked sent", func() {
+				So(transport.to, ShouldResemble, []string{"gop@sup.com"})
+				So(transport.msgs[0], ShouldContainSubstring, "Subject: InvitationBcc: evil@sup.com\r\n")
+				So(transport.msgs[0], ShouldEndWith, "\r\n\r\nline\r\nnext line")
+				So(store.Errors, ShouldResemble, []string{""})
+				So(store.RetryAt[0], ShouldBeNil)
+			})
+		})
+
+		Convey("When relay fails", func() {
+			transport.err = errors.New("421 try later")
+			store.Outbox = []models.Mail{m}
+
+			ms.Send()
+
+			Convey("Must be retried with backoff", func() {
+				So(store.Errors, ShouldResemble, []string{"421 try later"})
+				So(store.RetryAt[0], ShouldNotBeNil)
+				So(store.RetryAt[0].Sub(time.Now()), ShouldAlmostEqual, time.Minute, time.Second)
+			})
+		})
+
+		Convey("When attempts are exhausted", func() {
+			transport.err = errors.New("550 no such user")
+			m.Attempts = 2
+			store.Outbox = []models.Mail{m}
+
+			ms.Send()
+
+			Convey("Must be given up", func() {
+				So(store.Errors, ShouldResemble, []string{"550 no such user"})
+				So(store.RetryAt[0], ShouldBeNil)
+			})
+		})
+	})
+}
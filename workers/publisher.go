@@ -0,0 +1,84 @@
+package workers
+
+import (
+	"context"
+	"github.com/go-redis/redis"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"strconv"
+	"time"
+)
+
+// EventPublisher relays domain events from postgres outbox to redis stream,
+// every event is delivered at least once, consumers should dedupe by event_id
+type EventPublisher struct {
+	Store  models.IEventStore
+	Redis  redis.UniversalClient
+	Stream string
+	// MaxLen trims the stream approximately, 0 keeps everything
+	MaxLen   int64
+	Interval time.Duration
+	Batch    int
+	Logger   *logging.Logger
+}
+
+func (ep *EventPublisher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(ep.Interval)
+	defer ticker.Stop()
+
+	for {
+		ep.publish()
+
+		select {
+		case <-stop:
+			// events of requests drained on shutdown go out before exit
+			ep.publish()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publish relays outbox until it is empty or error happens
+func (ep *EventPublisher) publish() {
+	for {
+		n, err := ep.Store.Publish(context.Background(), ep.Batch, ep.add)
+		if err != nil {
+			ep.Logger.Error("events publish failed", "stream", ep.Stream, "error", err)
+		}
+
+		if n < ep.Batch || err != nil {
+			return
+		}
+	}
+}
+
+// Replay publishes again all events starting from given outbox id,
+// consumers will see them as new stream entries with the same event_id
+func (ep *EventPublisher) Replay(fromID int64) (int, error) {
+	n := 0
+	err := ep.Store.Replay(context.Background(), fromID, func(e models.DomainEvent) error {
+		if _, err := ep.add(e); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func (ep *EventPublisher) add(e models.DomainEvent) (string, error) {
+	// stream ids are assigned by redis, outbox may commit events out of id order
+	return ep.Redis.XAdd(&redis.XAddArgs{
+		Stream:       ep.Stream,
+		MaxLenApprox: ep.MaxLen,
+		ID:           "*",
+		Values: map[string]interface{}{
+			"event_id":     strconv.FormatInt(e.ID, 10),
+			"type":         e.Type,
+			"aggregate_id": e.AggregateID.String(),
+			"payload":      e.Payload,
+			"occurred_at":  e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		},
+	}).Result()
+}
@@ -0,0 +1,47 @@
+package workers
+
+import (
+	"context"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"time"
+)
+
+// Retention periodically anonymizes users that were deleted more than Period ago
+type Retention struct {
+	Store    models.IUserStore
+	Period   time.Duration
+	Interval time.Duration
+	Logger   *logging.Logger
+}
+
+func (r *Retention) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.purge()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purge is bounded by Interval, so hung postgres doesn't stall later rounds
+func (r *Retention) purge() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Interval)
+	defer cancel()
+
+	n, err := r.Store.Anonymize(ctx, time.Now().Add(-r.Period))
+	if err != nil {
+		r.Logger.Error("anonymization failed", "error", err)
+		return
+	}
+
+	if n > 0 {
+		r.Logger.Info("users anonymized", "count", n)
+	}
+}
@@ -0,0 +1,141 @@
+package workers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebhookDispatcher delivers webhook outbox items, failed deliveries are retried
+// with exponential backoff until MaxAttempts is reached
+type WebhookDispatcher struct {
+	Store       models.IWebhookStore
+	Client      *http.Client
+	Interval    time.Duration
+	Batch       int
+	MaxAttempts int
+	// BaseDelay is a delay before the first retry, each next one is doubled up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Logger    *logging.Logger
+}
+
+// SignWebhook returns signature for X-Crawlyzer-Signature header,
+// receivers must compute it the same way from X-Crawlyzer-Timestamp and raw body
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wd *WebhookDispatcher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(wd.Interval)
+	defer ticker.Stop()
+
+	for {
+		// drain whole backlog before sleeping
+		for wd.Dispatch() == wd.Batch {
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch delivers one batch of due items and returns number of processed ones
+func (wd *WebhookDispatcher) Dispatch() int {
+	// lease must outlive all deliveries of the batch, otherwise other node can take them
+	lease := time.Duration(wd.Batch)*wd.Client.Timeout + time.Minute
+
+	ctx := context.Background()
+	items, err := wd.Store.Claim(ctx, wd.Batch, lease)
+	if err != nil {
+		wd.Logger.Error("webhook claim failed", "error", err)
+		return 0
+	}
+
+	for _, item := range items {
+		d := wd.deliver(item)
+
+		var retryAt *time.Time
+		if !d.Success && d.Attempt < wd.MaxAttempts {
+			at := time.Now().Add(wd.backoff(d.Attempt))
+			retryAt = &at
+		}
+
+		if err = wd.Store.Complete(ctx, d, retryAt); err != nil {
+			wd.Logger.Error("webhook complete failed", "delivery", item.ID, "error", err)
+		}
+	}
+	return len(items)
+}
+
+func (wd *WebhookDispatcher) deliver(item models.WebhookOutboxItem) (d models.WebhookDelivery) {
+	d = models.WebhookDelivery{
+		OutboxID:  item.ID,
+		WebhookID: item.WebhookID,
+		Event:     item.Event,
+		Attempt:   item.Attempts + 1,
+	}
+
+	start := time.Now()
+	defer func() {
+		d.DurationMs = int64(time.Since(start) / time.Millisecond)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, item.URL, strings.NewReader(item.Payload))
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+
+	ts := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "crawlyzer-auth-webhooks")
+	req.Header.Set("X-Crawlyzer-Event", item.Event)
+	req.Header.Set("X-Crawlyzer-Delivery", strconv.FormatInt(item.ID, 10))
+	req.Header.Set("X-Crawlyzer-Timestamp", ts)
+	req.Header.Set("X-Crawlyzer-Signature", SignWebhook(item.Secret, ts, []byte(item.Payload)))
+
+	resp, err := wd.Client.Do(req)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	resp.Body.Close()
+
+	d.StatusCode = resp.StatusCode
+	d.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !d.Success {
+		d.Error = resp.Status
+	}
+	return d
+}
+
+func (wd *WebhookDispatcher) backoff(attempt int) time.Duration {
+	return backoff(wd.BaseDelay, wd.MaxDelay, attempt)
+}
+
+// backoff doubles base delay for each attempt after the first one up to max
+func backoff(base, max time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
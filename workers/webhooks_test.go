@@ -0,0 +1,118 @@
+package workers
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xssnick/crawlyzer-auth/logging"
+	"github.com/xssnick/crawlyzer-auth/models"
+	"github.com/xssnick/crawlyzer-auth/models_mock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookDispatcher(t *testing.T) {
+	Convey("Webhook delivery", t, func() {
+		var received []*http.Request
+		var bodies []string
+		status := http.StatusOK
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received = append(received, r)
+			bodies = append(bodies, string(body))
+			w.WriteHeader(status)
+		}))
+		defer srv.Close()
+
+		store := &models_mock.MWebhookStore{}
+		wd := &WebhookDispatcher{
+			Store:       store,
+			Client:      srv.Client(),
+			Interval:    time.Second,
+			Batch:       10,
+			MaxAttempts: 3,
+			BaseDelay:   time.Minute,
+			MaxDelay:    time.Hour,
+			Logger:      logging.New(ioutil.Discard, logging.LevelError),
+		}
+
+		item := models.WebhookOutboxItem{
+			ID:        7,
+			WebhookID: models_mock.TestUUID,
+			URL:       srv.URL,
+			Secret:    "secret",
+			Event:     models.WebhookUserRegistered,
+			Payload:   `{"event":"user.registered"}`,
+		}
+
+		Convey("When receiver accepts", func() {
+			store.Outbox = []models.WebhookOutboxItem{item}
+
+			So(wd.Dispatch(), ShouldEqual, 1)
+
+			Convey("Must be signed and marked delivered", func() {
+				So(len(received), ShouldEqual, 1)
+				r := received[0]
+				So(bodies[0], ShouldEqual, item.Payload)
+				So(r.Header.Get("X-Crawlyzer-Event"), ShouldEqual, models.WebhookUserRegistered)
+				So(r.Header.Get("X-Crawlyzer-Delivery"), ShouldEqual, "7")
+				So(r.Header.Get("X-Crawlyzer-Signature"), ShouldEqual,
+					SignWebhook("secret", r.Header.Get("X-Crawlyzer-Timestamp"), []byte(bodies[0])))
+
+				So(store.Done[0].Success, ShouldBeTrue)
+				So(store.Done[0].Attempt, ShouldEqual, 1)
+				So(store.RetryAt[0], ShouldBeNil)
+			})
+		})
+
+		Convey("When receiver fails", func() {
+			status = http.StatusBadGateway
+			item.Attempts = 1
+			store.Outbox = []models.WebhookOutboxItem{item}
+
+			wd.Dispatch()
+
+			Convey("Must be retried with backoff", func() {
+				So(store.Done[0].Success, ShouldBeFalse)
+				So(store.Done[0].StatusCode, ShouldEqual, http.StatusBadGateway)
+				So(store.Done[0].Attempt, ShouldEqual, 2)
+				So(store.RetryAt[0], ShouldNotBeNil)
+				So(store.RetryAt[0].Sub(time.Now()), ShouldAlmostEqual, 2*time.Minute, time.Second)
+			})
+		})
+
+		Convey("When attempts are exhausted", func() {
+			status = http.StatusInternalServerError
+			item.Attempts = 2
+			store.Outbox = []models.WebhookOutboxItem{item}
+
+			wd.Dispatch()
+
+			Convey("Must be given up", func() {
+				So(store.Done[0].Success, ShouldBeFalse)
+				So(store.RetryAt[0], ShouldBeNil)
+			})
+		})
+
+		Convey("When receiver is down", func() {
+			item.URL = "http://127.0.0.1:1"
+			store.Outbox = []models.WebhookOutboxItem{item}
+
+			wd.Dispatch()
+
+			Convey("Must be logged with error", func() {
+				So(store.Done[0].Success, ShouldBeFalse)
+				So(store.Done[0].Error, ShouldNotBeBlank)
+				So(store.RetryAt[0], ShouldNotBeNil)
+			})
+		})
+
+		Convey("Backoff must be capped", func() {
+			So(wd.backoff(1), ShouldEqual, time.Minute)
+			So(wd.backoff(3), ShouldEqual, 4*time.Minute)
+			So(wd.backoff(20), ShouldEqual, time.Hour)
+		})
+	})
+}